@@ -0,0 +1,286 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jimididit/nokvault/internal/config"
+	"github.com/jimididit/nokvault/internal/core"
+	"github.com/jimididit/nokvault/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Show and verify the audit log of vault operations",
+	Long: `Every encrypt, decrypt, protect, unprotect, rotate-key, key add, key remove,
+upgrade, secure-delete, backup, restore and prune command, and every file
+encrypted by watch or run by schedule, appends a record to the audit log: its
+time, operation, the command that ran it, a SHA-256 hash of the absolute path
+it worked on, its result and the error code of a failure. The log is audit.log in the config directory, or
+paths.audit_log in the config, and security.audit_log = false turns it off.
+
+Every record holds the hash of the record before it, and a head file beside
+the log holds the hash of the last one, so 'nokvault audit verify' detects
+records that were edited, removed, reordered or cut off the end.`,
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check that the audit log was not edited or truncated",
+	Long: `Check the hash chain of the audit log and that it ends with the record
+named by its head file. The command exits with a non-zero status if any
+record was edited, removed, reordered or cut off.
+
+The hash of the last record is printed, so it can be kept elsewhere and
+compared later: rewriting the whole log and its head file can't be detected
+from the log alone.`,
+	Args: cobra.NoArgs,
+	RunE: runAuditVerify,
+}
+
+var auditShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show the records of the audit log",
+	Long: `Show the records of the audit log, oldest first, selected by the filters.
+
+Paths are matched by their hash, so --path finds the operations on a path
+given as it was then, relative to the current directory or absolute.
+--since and --until take an RFC 3339 time or a date, and a date given to
+--until includes that whole day.
+
+Example:
+  nokvault audit show --operation decrypt --since 2026-01-01
+  nokvault audit show --path ~/vault/report.pdf.nokvault --result failure`,
+	Args: cobra.NoArgs,
+	RunE: runAuditShow,
+}
+
+var (
+	auditVerifyJSON bool
+
+	auditShowOperation string
+	auditShowResult    string
+	auditShowPath      string
+	auditShowSince     string
+	auditShowUntil     string
+	auditShowJSON      bool
+)
+
+func init() {
+	auditVerifyCmd.Flags().BoolVar(&auditVerifyJSON, "json", false, "Print the result as JSON")
+
+	auditShowCmd.Flags().StringVar(&auditShowOperation, "operation", "", "Only show this operation: encrypt, decrypt, rotate-key, add-key, remove-key, upgrade, secure-delete, backup, restore or prune")
+	auditShowCmd.Flags().StringVar(&auditShowResult, "result", "", "Only show operations with this result: success or failure")
+	auditShowCmd.Flags().StringVar(&auditShowPath, "path", "", "Only show operations on this path")
+	auditShowCmd.Flags().StringVar(&auditShowSince, "since", "", "Only show operations at or after this time (RFC 3339 or YYYY-MM-DD)")
+	auditShowCmd.Flags().StringVar(&auditShowUntil, "until", "", "Only show operations before this time, or up to the end of this day (RFC 3339 or YYYY-MM-DD)")
+	auditShowCmd.Flags().BoolVar(&auditShowJSON, "json", false, "Print the records as JSON")
+
+	auditCmd.AddCommand(auditVerifyCmd)
+	auditCmd.AddCommand(auditShowCmd)
+	rootCmd.AddCommand(auditCmd)
+}
+
+// auditLogPath returns the path of the audit log set in cfg, or the default one
+func auditLogPath(cfg *config.Config) string {
+	if cfg.Paths.AuditLog != "" {
+		return cfg.Paths.AuditLog
+	}
+	return config.GetAuditLogPath()
+}
+
+// audited wraps the run function of a command so every run but a dry run is
+// recorded in the audit log as operation on its first argument, or on the
+// repository for commands that take none
+func audited(operation string, run func(cmd *cobra.Command, args []string) error) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		err := run(cmd, args)
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); !dryRun {
+			path := repoDir
+			if len(args) > 0 {
+				path = args[0]
+			}
+			recordAudit(operation, cmd.Name(), path, err)
+		}
+		return err
+	}
+}
+
+// recordAudit appends a record of operation on path, run by command, to the
+// audit log. Failing to record it is only a warning, so the log never keeps
+// an operation from running.
+func recordAudit(operation, command, path string, err error) {
+	cfg := loadConfig()
+	if !cfg.Security.AuditLog {
+		return
+	}
+
+	record := &core.AuditRecord{
+		Operation: operation,
+		Command:   command,
+		PathHash:  core.AuditPathHash(path),
+		Result:    core.AuditSuccess,
+	}
+	if err != nil {
+		record.Result = core.AuditFailure
+		record.ErrorCode = auditErrorCode(err)
+	}
+	if err := core.NewAuditLog(auditLogPath(cfg)).Append(record); err != nil {
+		PrintWarning(fmt.Sprintf("Failed to record the operation in the audit log: %v", err))
+	}
+}
+
+// auditErrorCode returns the code of err, or ERROR if it has none
+func auditErrorCode(err error) string {
+	var nokvaultErr *utils.NokvaultError
+	if errors.As(err, &nokvaultErr) {
+		return nokvaultErr.Code
+	}
+	return "ERROR"
+}
+
+func runAuditVerify(cmd *cobra.Command, args []string) error {
+	// A damaged log is a result, not misuse, so don't follow it with the usage
+	cmd.SilenceUsage = true
+
+	path := auditLogPath(loadConfig())
+	check, err := core.NewAuditLog(path).Verify()
+	if err != nil {
+		return err
+	}
+
+	out := cmd.OutOrStdout()
+	if auditVerifyJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(check); err != nil {
+			return fmt.Errorf("failed to encode result: %w", err)
+		}
+	} else {
+		for _, problem := range check.Problems {
+			fmt.Fprintf(out, "%-11s %s\n", "TAMPERED", problem)
+		}
+	}
+
+	if !check.OK() {
+		return utils.NewErrorWithHint(utils.ErrVerification.Code, fmt.Sprintf("Audit log %s failed verification (problems: %d)", path, len(check.Problems)), nil, "The log was edited, truncated or damaged after it was written. Compare it with a copy kept elsewhere.")
+	}
+	if !auditVerifyJSON {
+		if check.Records == 0 {
+			PrintInfo(fmt.Sprintf("No records in %s", path))
+			return nil
+		}
+		PrintSuccess(fmt.Sprintf("Verified %d records in %s", check.Records, path))
+		PrintInfo(fmt.Sprintf("Last record hash: %s", check.LastHash))
+	}
+	return nil
+}
+
+func runAuditShow(cmd *cobra.Command, args []string) error {
+	filter, err := newAuditFilter()
+	if err != nil {
+		return err
+	}
+
+	path := auditLogPath(loadConfig())
+	records, problems, err := core.NewAuditLog(path).Records()
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		PrintWarning(fmt.Sprintf("%d lines of %s could not be read; check it with 'nokvault audit verify'", len(problems), path))
+	}
+
+	selected := []*core.AuditRecord{}
+	for _, record := range records {
+		if filter.Match(record) {
+			selected = append(selected, record)
+		}
+	}
+
+	out := cmd.OutOrStdout()
+	if auditShowJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(selected); err != nil {
+			return fmt.Errorf("failed to encode records: %w", err)
+		}
+		return nil
+	}
+
+	for _, record := range selected {
+		printAuditRecord(out, record)
+	}
+	if len(selected) == 0 {
+		PrintInfo("No matching records")
+	}
+	return nil
+}
+
+// newAuditFilter builds the filter selected by the flags of 'audit show'
+func newAuditFilter() (*core.AuditFilter, error) {
+	filter := &core.AuditFilter{Operation: auditShowOperation, Result: auditShowResult}
+	switch auditShowOperation {
+	case "", core.AuditEncrypt, core.AuditDecrypt, core.AuditRotateKey, core.AuditAddKey, core.AuditRemoveKey, core.AuditUpgrade,
+		core.AuditSecureDelete, core.AuditBackup, core.AuditRestore, core.AuditPrune:
+	default:
+		return nil, utils.NewErrorWithHint(utils.ErrInvalidArgument.Code, fmt.Sprintf("Unknown operation: %s", auditShowOperation), nil, "Operations are encrypt, decrypt, rotate-key, add-key, remove-key, upgrade, secure-delete, backup, restore and prune.")
+	}
+	switch auditShowResult {
+	case "", core.AuditSuccess, core.AuditFailure:
+	default:
+		return nil, utils.NewErrorWithHint(utils.ErrInvalidArgument.Code, fmt.Sprintf("Unknown result: %s", auditShowResult), nil, "Results are success and failure.")
+	}
+	if auditShowPath != "" {
+		filter.PathHash = core.AuditPathHash(auditShowPath)
+	}
+
+	var err error
+	if filter.Since, err = parseAuditTime(auditShowSince, false); err != nil {
+		return nil, err
+	}
+	if filter.Until, err = parseAuditTime(auditShowUntil, true); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// parseAuditTime parses a --since or --until value: an RFC 3339 time or a
+// local date, which with endOfDay stands for the end of that day
+func parseAuditTime(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	day, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, utils.NewErrorWithHint(utils.ErrInvalidArgument.Code, fmt.Sprintf("Invalid time: %s", value), err, "Use an RFC 3339 time such as 2026-01-02T15:04:05Z or a date such as 2026-01-02.")
+	}
+	if endOfDay {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day, nil
+}
+
+// printAuditRecord prints a record of the audit log on one line
+func printAuditRecord(out io.Writer, record *core.AuditRecord) {
+	result := record.Result
+	if record.ErrorCode != "" {
+		result += " (" + record.ErrorCode + ")"
+	}
+	fmt.Fprintf(out, "%-6d %s  %-13s %-13s %s  %s\n", record.Seq, record.Time.Local().Format(time.RFC3339), record.Operation, record.Command, shortPathHash(record.PathHash), result)
+}
+
+// shortPathHash returns the start of a path hash, enough to tell paths apart
+func shortPathHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
@@ -2,8 +2,12 @@ package cli
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/jimididit/nokvault/internal/config"
+	"github.com/jimididit/nokvault/internal/core"
+	"github.com/jimididit/nokvault/internal/crypto"
+	"github.com/jimididit/nokvault/internal/utils"
 	"github.com/spf13/cobra"
 )
 
@@ -61,6 +65,9 @@ func runConfig(cmd *cobra.Command, args []string) error {
 		fmt.Printf("  Encryption Algorithm: %s\n", cfg.Encryption.Algorithm)
 		fmt.Printf("  Compression: %v\n", cfg.Encryption.Compression)
 		fmt.Printf("  Preserve Metadata: %v\n", cfg.Encryption.PreserveMetadata)
+		fmt.Printf("  Encrypt Names: %v\n", cfg.Encryption.EncryptNames)
+		fmt.Printf("  Padding: %v (%s)\n", cfg.Encryption.Padding, cfg.Encryption.PaddingScheme)
+		fmt.Printf("  Parity: %d%%\n", cfg.Encryption.Parity)
 		fmt.Printf("  Key Derivation: %s\n", cfg.KeyDerivation.Algorithm)
 		fmt.Printf("  Memory Cost: %d KB\n", cfg.KeyDerivation.MemoryCost)
 		fmt.Printf("  Time Cost: %d\n", cfg.KeyDerivation.TimeCost)
@@ -68,6 +75,7 @@ func runConfig(cmd *cobra.Command, args []string) error {
 		fmt.Printf("  Secure Delete: %v\n", cfg.Security.SecureDelete)
 		fmt.Printf("  Delete Passes: %d\n", cfg.Security.DeletePasses)
 		fmt.Printf("  Key Cache Timeout: %d seconds\n", cfg.Security.KeyCacheTimeout)
+		fmt.Printf("  Audit Log: %v (%s)\n", cfg.Security.AuditLog, auditLogPath(cfg))
 		return nil
 	}
 
@@ -80,6 +88,14 @@ func runConfig(cmd *cobra.Command, args []string) error {
 			fmt.Println(cfg.Encryption.Compression)
 		case "preserve_metadata":
 			fmt.Println(cfg.Encryption.PreserveMetadata)
+		case "encrypt_names":
+			fmt.Println(cfg.Encryption.EncryptNames)
+		case "padding":
+			fmt.Println(cfg.Encryption.Padding)
+		case "padding_scheme":
+			fmt.Println(cfg.Encryption.PaddingScheme)
+		case "parity":
+			fmt.Println(cfg.Encryption.Parity)
 		case "memory_cost":
 			fmt.Println(cfg.KeyDerivation.MemoryCost)
 		case "time_cost":
@@ -90,6 +106,10 @@ func runConfig(cmd *cobra.Command, args []string) error {
 			fmt.Println(cfg.Security.SecureDelete)
 		case "delete_passes":
 			fmt.Println(cfg.Security.DeletePasses)
+		case "audit_log":
+			fmt.Println(cfg.Security.AuditLog)
+		case "audit_log_path":
+			fmt.Println(auditLogPath(cfg))
 		default:
 			PrintError(fmt.Sprintf("Unknown configuration key: %s", configGet))
 			return fmt.Errorf("unknown key: %s", configGet)
@@ -114,3 +134,109 @@ func runConfig(cmd *cobra.Command, args []string) error {
 	cmd.Help()
 	return nil
 }
+
+// loadConfig loads the configuration, falling back to defaults when it can't be read
+func loadConfig() *config.Config {
+	cm := config.NewConfigManager()
+	if err := cm.Load(); err != nil {
+		return config.DefaultConfig()
+	}
+	return cm.Get()
+}
+
+// newEncryptionService creates an encryption service that uses the cipher,
+// padding, parity and key derivation settings from cfg for new files. Unset settings
+// keep the defaults.
+func newEncryptionService(cfg *config.Config) (*core.EncryptionService, error) {
+	encryptionService := core.NewEncryptionService()
+
+	if cfg.Encryption.Algorithm != "" {
+		if err := setCipher(encryptionService, cfg.Encryption.Algorithm); err != nil {
+			return nil, utils.NewError(utils.ErrInvalidConfig.Code, "Invalid encryption algorithm in config", err)
+		}
+	}
+	if cfg.Encryption.Padding {
+		if err := setPadding(encryptionService, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if err := encryptionService.SetParity(cfg.Encryption.Parity); err != nil {
+		return nil, utils.NewError(utils.ErrInvalidConfig.Code, fmt.Sprintf("Invalid parity in config: %d", cfg.Encryption.Parity), err)
+	}
+
+	kdf := cfg.KeyDerivation
+	if kdf.Algorithm != "" && kdf.Algorithm != crypto.KDFArgon2id {
+		return nil, utils.NewError(utils.ErrInvalidConfig.Code, fmt.Sprintf("Unsupported key derivation algorithm: %s", kdf.Algorithm), nil)
+	}
+	if kdf.MemoryCost == 0 && kdf.TimeCost == 0 && kdf.Parallelism == 0 {
+		return encryptionService, nil
+	}
+
+	params := crypto.DefaultArgon2Params()
+	if kdf.MemoryCost > 0 {
+		params.Memory = kdf.MemoryCost
+	}
+	if kdf.TimeCost > 0 {
+		params.Time = kdf.TimeCost
+	}
+	if kdf.Parallelism > 0 {
+		params.Parallelism = kdf.Parallelism
+	}
+	if err := params.Validate(); err != nil {
+		return nil, utils.NewError(utils.ErrInvalidConfig.Code, "Invalid key derivation settings in config", err)
+	}
+
+	encryptionService.GetKeyManager().SetParams(params.Memory, params.Time, params.Parallelism, params.KeyLength)
+	return encryptionService, nil
+}
+
+// setCipher selects the cipher for new files from a user-supplied algorithm name
+func setCipher(encryptionService *core.EncryptionService, algorithm string) error {
+	cipherID, err := crypto.ParseCipher(algorithm)
+	if err != nil {
+		return err
+	}
+	return encryptionService.SetCipher(cipherID)
+}
+
+// setPadding makes new files padded with the scheme from cfg, Padmé by default
+func setPadding(encryptionService *core.EncryptionService, cfg *config.Config) error {
+	scheme := cfg.Encryption.PaddingScheme
+	if scheme == "" {
+		scheme = core.PaddingPadme
+	}
+	if err := encryptionService.SetPadding(scheme); err != nil {
+		return utils.NewError(utils.ErrInvalidConfig.Code, fmt.Sprintf("Invalid padding scheme in config: %s", scheme), err)
+	}
+	return nil
+}
+
+// setVolumeSize makes new files split into volumes of the size given by a
+// --volume-size flag
+func setVolumeSize(encryptionService *core.EncryptionService, size string) error {
+	volumeSize, err := utils.ParseSize(size)
+	if err == nil {
+		err = encryptionService.SetVolumeSize(volumeSize)
+	}
+	if err != nil {
+		return utils.NewErrorWithHint(utils.ErrInvalidArgument.Code, fmt.Sprintf("Invalid volume size: %s", size), err, "Give the size in bytes or with a K, M, G or T suffix, such as 700M or 2G, of at least 64K.")
+	}
+	return nil
+}
+
+// keyCacheTTL returns how long derived keys may be cached
+func keyCacheTTL(cfg *config.Config) time.Duration {
+	if cfg.Security.KeyCacheTimeout <= 0 {
+		return 0
+	}
+	return time.Duration(cfg.Security.KeyCacheTimeout) * time.Second
+}
+
+// setParity makes new files written with parity files beside them, taking
+// the percent of their size given by a --parity flag
+func setParity(encryptionService *core.EncryptionService, percent int) error {
+	if err := encryptionService.SetParity(percent); err != nil {
+		return utils.NewErrorWithHint(utils.ErrInvalidArgument.Code, fmt.Sprintf("Invalid parity: %d%%", percent), err, fmt.Sprintf("Give the parity in percent of the file size, from %d to %d, such as 10.", core.MinParity, core.MaxParity))
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -17,18 +18,45 @@ var decryptCmd = &cobra.Command{
 	Long: `Decrypt a nokvault encrypted file or directory.
 
 The decrypted output will be saved to the original location (without .nokvault extension)
-by default, or to the path specified by --output flag.`,
+by default, or to the path specified by --output flag. Archives created by
+'nokvault protect' are restored as directories.
+
+For directories and archives, --include, --exclude and --files-from select
+which entries are decrypted, by their path relative to the directory. The
+layout of the selected entries is preserved and the rest are left alone.
+
+A directory is first checked against its encrypted manifest, and nothing is
+written if files were deleted, added, swapped or replaced by older versions;
+--ignore-manifest decrypts it anyway, listing the differences as warnings.
+
+With --trusted-signers, the signatures written by 'nokvault encrypt
+--sign-key' are checked first against the verifying keys in that file. Nothing
+is decrypted if a signature is missing, from an unknown signer or doesn't
+match its file; --warn-untrusted only warns about missing and unknown
+signatures, but never accepts one that doesn't match.
+
+Example:
+  nokvault decrypt ./vault --include 'configs/**' --exclude '*.log'
+  nokvault decrypt backup.nokvault --files-from restore-list.txt
+  nokvault decrypt report.pdf.nokvault --trusted-signers team-signers.txt`,
 	Args: cobra.ExactArgs(1),
-	RunE: runDecrypt,
+	RunE: audited(core.AuditDecrypt, runDecrypt),
 }
 
 var (
-	decryptOutput   string
-	decryptPassword string
-	decryptKeyfile  string
-	decryptNoPrompt bool
-	decryptDryRun   bool
-	decryptVerbose  bool
+	decryptOutput         string
+	decryptPassword       string
+	decryptKeyfile        string
+	decryptNoPrompt       bool
+	decryptDryRun         bool
+	decryptVerbose        bool
+	decryptIdentities     []string
+	decryptIncludes       []string
+	decryptExcludes       []string
+	decryptFilesFrom      string
+	decryptIgnoreManifest bool
+	decryptTrustedSigners string
+	decryptWarnUntrusted  bool
 )
 
 func init() {
@@ -38,19 +66,28 @@ func init() {
 	decryptCmd.Flags().BoolVar(&decryptNoPrompt, "no-prompt", false, "Don't prompt for password")
 	decryptCmd.Flags().BoolVar(&decryptDryRun, "dry-run", false, "Show what would be decrypted without actually decrypting")
 	decryptCmd.Flags().BoolVarP(&decryptVerbose, "verbose", "v", false, "Verbose output")
+	decryptCmd.Flags().StringArrayVarP(&decryptIdentities, "identity", "i", nil, "Identity file from 'nokvault keygen' (repeatable); no password is asked for unless --password or --keyfile is given")
+
+	decryptCmd.Flags().StringArrayVar(&decryptIncludes, "include", nil, "Only decrypt entries matching this pattern, e.g. 'configs/**' (repeatable)")
+	decryptCmd.Flags().StringArrayVar(&decryptExcludes, "exclude", nil, "Skip entries matching this pattern, e.g. '*.log' (repeatable)")
+	decryptCmd.Flags().StringVar(&decryptFilesFrom, "files-from", "", "Only decrypt the entries listed in this file, one path per line ('-' for stdin)")
+	decryptCmd.Flags().BoolVar(&decryptIgnoreManifest, "ignore-manifest", false, "Decrypt a directory that does not match its manifest, warning about the differences")
+	decryptCmd.Flags().StringVar(&decryptTrustedSigners, "trusted-signers", "", "Only decrypt files signed by a verifying key listed in this file")
+	decryptCmd.Flags().BoolVar(&decryptWarnUntrusted, "warn-untrusted", false, "With --trusted-signers, warn about unsigned files and unknown signers instead of refusing them")
 
 	rootCmd.AddCommand(decryptCmd)
 }
 
 func runDecrypt(cmd *cobra.Command, args []string) error {
-	inputPath := args[0]
-
 	// Validate input path
-	info, err := os.Stat(inputPath)
+	inputPath, info, err := statEncryptedInput(args[0])
 	if os.IsNotExist(err) {
 		PrintError(fmt.Sprintf("Path does not exist: %s", inputPath))
 		return utils.NewError(utils.ErrFileNotFound.Code, fmt.Sprintf("Path does not exist: %s", inputPath), err)
 	}
+	if err != nil {
+		return err
+	}
 
 	// Determine output path
 	outputPath := decryptOutput
@@ -63,102 +100,98 @@ func runDecrypt(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	filter, err := newDecryptFilter()
+	if err != nil {
+		return err
+	}
+
+	if decryptWarnUntrusted && decryptTrustedSigners == "" {
+		return utils.NewErrorWithHint(utils.ErrInvalidArgument.Code, "--warn-untrusted needs --trusted-signers", nil, "Pass the verifying keys to check signatures against with --trusted-signers.")
+	}
+
 	if decryptDryRun {
 		PrintInfo(fmt.Sprintf("Would decrypt: %s -> %s", inputPath, outputPath))
 		return nil
 	}
 
-	// Get password first (needed for both file and directory)
-	password, err := utils.GetPassword(decryptPassword, decryptKeyfile, decryptNoPrompt, false)
+	if decryptTrustedSigners != "" {
+		if err := checkSigners(inputPath, decryptTrustedSigners); err != nil {
+			return err
+		}
+	}
+
+	// Get password and identities first (needed for both file and directory)
+	// Files that need a password and a keyfile record it in their header
+	twoFactor, isArchive := false, false
+	if !info.IsDir() {
+		if header, err := core.NewFileHandler().ReadHeaderFromFile(inputPath); err == nil {
+			twoFactor = core.RequiresKeyfile(header)
+			isArchive = core.IsArchive(header)
+		}
+	}
+	if filter != nil && !info.IsDir() && !isArchive {
+		return utils.NewErrorWithHint(utils.ErrInvalidArgument.Code, "--include, --exclude and --files-from only apply to directories and archives", nil, "Decrypt single files without selection flags.")
+	}
+
+	creds, err := resolveCredentials(decryptPassword, decryptKeyfile, decryptIdentities, decryptNoPrompt, twoFactor)
 	if err != nil {
 		return err
 	}
-	defer utils.ZeroizePassword(password)
+	defer zeroizeCredentials(creds)
 
 	// Create encryption service
 	encryptionService := core.NewEncryptionService()
 
-	// Handle directory vs file
+	// Handle directory vs archive vs file
 	if info.IsDir() {
-		return decryptDirectory(inputPath, outputPath, password, encryptionService)
+		return decryptDirectory(inputPath, outputPath, creds, filter, encryptionService)
+	}
+	if isArchive {
+		return extractArchive(inputPath, outputPath, creds, filter, encryptionService, decryptVerbose)
 	}
 
-	return decryptFile(inputPath, outputPath, password, encryptionService)
+	return decryptFile(inputPath, outputPath, creds, encryptionService)
 }
 
-func decryptFile(inputPath, outputPath string, password []byte, encryptionService *core.EncryptionService) error {
+func decryptFile(inputPath, outputPath string, creds *core.Credentials, encryptionService *core.EncryptionService) error {
 	if decryptVerbose {
 		PrintInfo(fmt.Sprintf("Decrypting file: %s", inputPath))
 	}
 
-	// Open input file
-	inputFile, err := os.Open(inputPath)
-	if err != nil {
-		return fmt.Errorf("failed to open input file: %w", err)
-	}
-	defer inputFile.Close()
-
-	// Read header with metadata
+	// Validate the header before deriving any keys
 	fileHandler := core.NewFileHandler()
-	header, metadata, err := fileHandler.ReadHeaderWithMetadata(inputFile)
-	if err != nil {
+	if _, err := fileHandler.ReadHeaderFromFile(inputPath); err != nil {
 		PrintError("Invalid nokvault file format")
 		return utils.NewError(utils.ErrInvalidFormat.Code, "Invalid nokvault file format", err)
 	}
 
-	// Derive key from password and salt
-	keyManager := encryptionService.GetKeyManager()
-	key, err := keyManager.DeriveKeyFromPasswordAndSalt(password, header.Salt[:])
-	if err != nil {
-		PrintError("Failed to derive decryption key")
-		return err
+	// Ensure output directory exists (only if not root directory)
+	if outputDir := filepath.Dir(outputPath); outputDir != "." && outputDir != "" {
+		if err := os.MkdirAll(outputDir, 0755); err != nil {
+			return fmt.Errorf("failed to create output directory: %w", err)
+		}
 	}
-	defer utils.ZeroizeKey(key)
 
-	// Note: For single file operations, we read everything at once,
-	// so progress bars aren't very useful. We'll skip them for now
-	// to avoid deadlock issues. Progress bars work better for directory operations.
-
-	// Read encrypted data (skip header)
-	inputFile.Seek(int64(header.DataOffset), io.SeekStart)
-	ciphertext, err := io.ReadAll(inputFile)
-	if err != nil {
-		return fmt.Errorf("failed to read encrypted data: %w", err)
+	// Unlock the file key with the key slots recorded in the header and decrypt
+	// the payload chunk by chunk straight into the output file
+	metadata, err := encryptionService.DecryptFileWithCredentials(inputPath, outputPath, creds, nil)
+	if errors.Is(err, core.ErrKeyfileRequired) {
+		return utils.NewErrorWithHint(utils.ErrInvalidPassword.Code, "Decryption failed - this file requires both a password and a keyfile", err, "Pass the keyfile with --keyfile together with the password.")
 	}
-
-	// Decrypt data
-	plaintext, err := encryptionService.DecryptData(ciphertext, key)
 	if err != nil {
-		return utils.NewErrorWithHint(utils.ErrDecryptionFailed.Code, "Decryption failed - incorrect password or corrupted file", err, "Verify your password is correct. If using a keyfile, ensure it hasn't changed.")
+		return utils.NewErrorWithHint(utils.ErrDecryptionFailed.Code, "Decryption failed - incorrect password or corrupted file", err, "Verify your password is correct. If using a keyfile or identity, ensure it hasn't changed.")
 	}
 
-	// Try to decompress if data appears to be compressed
-	compressionService := core.NewCompressionService()
-	if len(plaintext) >= 2 && plaintext[0] == 0x1f && plaintext[1] == 0x8b {
-		// Looks like gzip compressed data
-		decompressed, err := compressionService.Decompress(plaintext)
-		if err == nil {
-			if decryptVerbose {
-				PrintInfo(fmt.Sprintf("Decompressed: %d -> %d bytes", len(plaintext), len(decompressed)))
-			}
-			plaintext = decompressed
-		} else if decryptVerbose {
-			PrintInfo("Data appears compressed but decompression failed, using as-is")
+	// Files of an encrypted directory may record a directory or a link instead
+	if metadata != nil && !metadata.IsRegular() {
+		if metadata.Hardlink != "" {
+			return utils.NewErrorWithHint(utils.ErrInvalidFormat.Code, fmt.Sprintf("%s records a hard link to %s", inputPath, metadata.Hardlink), nil, "Decrypt the whole directory to restore hard links.")
 		}
-	}
-
-	// Ensure output directory exists (only if not root directory)
-	if outputDir := filepath.Dir(outputPath); outputDir != "." && outputDir != "" {
-		if err := os.MkdirAll(outputDir, 0755); err != nil {
-			return fmt.Errorf("failed to create output directory: %w", err)
+		if err := fileHandler.CreateEntry(outputPath, metadata); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", outputPath, err)
 		}
 	}
 
-	// Write decrypted data
-	if err := os.WriteFile(outputPath, plaintext, 0600); err != nil {
-		return fmt.Errorf("failed to write output file: %w", err)
-	}
-
 	// Restore metadata if available
 	if metadata != nil {
 		if err := fileHandler.WriteMetadata(outputPath, metadata); err != nil {
@@ -172,119 +205,210 @@ func decryptFile(inputPath, outputPath string, password []byte, encryptionServic
 	return nil
 }
 
-func decryptDirectory(inputPath, outputPath string, password []byte, encryptionService *core.EncryptionService) error {
-	fileHandler := core.NewFileHandler()
+// statEncryptedInput returns the path an encrypted input is read and named
+// by, and its file info. A volume set, given by one of its volumes or by the
+// name it was split from, is checked to be complete and in order, and is
+// named by the name it was split from.
+func statEncryptedInput(inputPath string) (string, os.FileInfo, error) {
+	basePath, ok := core.VolumeSetBase(inputPath)
+	if !ok {
+		info, err := os.Stat(inputPath)
+		return inputPath, info, err
+	}
 
-	// Count .nokvault files for progress
-	totalFiles := 0
-	err := fileHandler.WalkDirectory(inputPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() && filepath.Ext(path) == ".nokvault" {
-			totalFiles++
-		}
-		return nil
-	})
+	volumes, err := core.ListVolumes(basePath)
 	if err != nil {
-		return fmt.Errorf("failed to count files: %w", err)
+		return inputPath, nil, utils.NewErrorWithHint(utils.ErrInvalidFormat.Code, "Incomplete or mixed volume set", err, "Put every volume of the set in the same directory under its original name.")
 	}
+	info, err := os.Stat(volumes[0])
+	return basePath, info, err
+}
 
-	if totalFiles == 0 {
-		PrintInfo("No .nokvault files found in directory")
-		return nil
+// checkSigners checks the signatures of the input against the trusted signers
+// before anything is decrypted. With --warn-untrusted, missing signatures and
+// unknown signers are only printed as warnings.
+func checkSigners(inputPath, trustedSignersPath string) error {
+	trusted, err := loadTrustedSigners(trustedSignersPath)
+	if err != nil {
+		return err
+	}
+	checks, err := core.CheckSignatures(inputPath, trusted)
+	if err != nil {
+		return err
 	}
 
-	PrintInfo(fmt.Sprintf("Decrypting %d files in directory...", totalFiles))
-
-	// Create progress bar
-	progressBar := utils.NewProgressBar(int64(totalFiles), "Decrypting files")
+	invalid, untrusted := 0, 0
+	for _, check := range checks {
+		switch check.Status {
+		case core.SignatureValid:
+			continue
+		case core.SignatureInvalid:
+			invalid++
+			PrintError(fmt.Sprintf("%s: invalid signature: %s", check.Path, check.Error))
+		case core.SignatureMissing:
+			untrusted++
+			PrintWarning(fmt.Sprintf("%s: not signed", check.Path))
+		default:
+			untrusted++
+			PrintWarning(fmt.Sprintf("%s: signed by an unknown signer %s", check.Path, check.Signer))
+		}
+	}
 
-	// For directory decryption, we need to handle key derivation per file
-	// Each file may have a different salt, so we derive the key per file
-	// This is a simplified version - in practice, we'd want to optimize this
-	var failedFiles []string
-	var successCount int
+	if invalid > 0 {
+		return utils.NewErrorWithHint(utils.ErrVerification.Code, fmt.Sprintf("Signature check failed (invalid signatures: %d)", invalid), nil, "The files or their signatures were changed after they were signed. Restore them from another copy.")
+	}
+	if untrusted > 0 && !decryptWarnUntrusted {
+		return utils.NewErrorWithHint(utils.ErrVerification.Code, fmt.Sprintf("Signature check failed (unsigned or untrusted files: %d)", untrusted), nil, "Add the signer's verifying key to the trusted signers file, or pass --warn-untrusted to decrypt anyway.")
+	}
+	return nil
+}
 
-	err = fileHandler.WalkDirectory(inputPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			// Log error but continue processing
-			PrintError(fmt.Sprintf("Error accessing %s: %v", path, err))
-			return nil // Continue with other files
+// checkManifest checks the encrypted directory inputPath against its manifest
+// before anything is decrypted. With --ignore-manifest the differences are
+// only printed as warnings.
+func checkManifest(inputPath string, creds *core.Credentials, keyCache *core.KeyCache, encryptionService *core.EncryptionService) error {
+	check, err := encryptionService.CheckManifest(inputPath, creds, keyCache)
+	if err != nil {
+		if decryptIgnoreManifest {
+			PrintWarning(fmt.Sprintf("Failed to check the manifest: %v", err))
+			return nil
 		}
+		return utils.NewErrorWithHint(utils.ErrDecryptionFailed.Code, "Failed to decrypt the directory manifest - incorrect password or corrupted manifest", err, "Verify your password is correct, or pass --ignore-manifest to decrypt the files without it.")
+	}
 
-		// Skip directories and non-.nokvault files
-		if info.IsDir() || filepath.Ext(path) != ".nokvault" {
-			return nil
+	for _, problem := range check.Problems {
+		PrintWarning(problem.String())
+	}
+	if !check.OK() && !decryptIgnoreManifest {
+		return utils.NewErrorWithHint(utils.ErrVerification.Code, fmt.Sprintf("Manifest check failed (generation %d, problems: %d)", check.Generation, len(check.Problems)), core.ErrManifestMismatch, "Restore the listed files from another copy, or pass --ignore-manifest to decrypt what is there.")
+	}
+	return nil
+}
+
+// newDecryptFilter builds the filter selected by --include, --exclude and
+// --files-from, or returns nil if none of them is set
+func newDecryptFilter() (*core.PathFilter, error) {
+	if len(decryptIncludes) == 0 && len(decryptExcludes) == 0 && decryptFilesFrom == "" {
+		return nil, nil
+	}
+
+	var files []string
+	if decryptFilesFrom != "" {
+		var reader io.Reader = os.Stdin
+		if decryptFilesFrom != "-" {
+			listFile, err := os.Open(decryptFilesFrom)
+			if err != nil {
+				return nil, utils.NewError(utils.ErrFileNotFound.Code, fmt.Sprintf("Cannot open file list: %s", decryptFilesFrom), err)
+			}
+			defer listFile.Close()
+			reader = listFile
 		}
 
-		// Get relative path
-		relPath, err := fileHandler.GetRelativePath(inputPath, path)
+		var err error
+		files, err = core.ReadFileList(reader)
 		if err != nil {
-			PrintError(fmt.Sprintf("Failed to get relative path for %s: %v", path, err))
-			progressBar.Increment(1)
-			failedFiles = append(failedFiles, relPath)
-			return nil // Continue with other files
+			return nil, err
 		}
+		if len(files) == 0 {
+			return nil, utils.NewError(utils.ErrInvalidArgument.Code, fmt.Sprintf("File list is empty: %s", decryptFilesFrom), nil)
+		}
+	}
+
+	filter, err := core.NewPathFilter(decryptIncludes, decryptExcludes, files)
+	if err != nil {
+		return nil, utils.NewError(utils.ErrInvalidArgument.Code, "Invalid --include or --exclude pattern", err)
+	}
+	return filter, nil
+}
+
+func decryptDirectory(inputPath, outputPath string, creds *core.Credentials, filter *core.PathFilter, encryptionService *core.EncryptionService) error {
+	fileHandler := core.NewFileHandler()
+
+	// Each file records its own salt and key derivation parameters in its key
+	// slots, so slot keys are derived per file and cached for files that share them
+	keyCache := core.NewKeyCache(keyCacheTTL(loadConfig()))
+	defer keyCache.Clear()
 
-		// Remove .nokvault extension
-		outputRelPath := relPath[:len(relPath)-len(".nokvault")]
-		outputFilePath := filepath.Join(outputPath, outputRelPath)
-
-		// Ensure output directory exists
-		outputFileDir := filepath.Dir(outputFilePath)
-		if err := fileHandler.EnsureDirectory(outputFileDir); err != nil {
-			PrintError(fmt.Sprintf("Failed to create output directory for %s: %v", relPath, err))
-			progressBar.Increment(1)
-			failedFiles = append(failedFiles, relPath)
-			return nil // Continue with other files
+	// Directories written before manifests were recorded have none
+	if core.HasManifest(inputPath) {
+		if err := checkManifest(inputPath, creds, keyCache, encryptionService); err != nil {
+			return err
 		}
+	}
 
-		// Read header to get salt
-		inputFile, err := os.Open(path)
-		if err != nil {
-			PrintError(fmt.Sprintf("Failed to open file %s: %v", relPath, err))
-			progressBar.Increment(1)
-			failedFiles = append(failedFiles, relPath)
-			return nil // Continue with other files
+	// Find the .nokvault files with their original paths, which directories
+	// encrypted with hidden names keep in their encrypted name map. All of them
+	// are resolved, since a selected hard link may need the file it links to.
+	files, err := encryptionService.ResolveEncryptedFiles(inputPath, nil, creds, keyCache)
+	if err != nil {
+		if core.HasNameMap(inputPath) {
+			return utils.NewErrorWithHint(utils.ErrDecryptionFailed.Code, "Failed to decrypt the file names - incorrect password or corrupted name map", err, "Verify your password is correct. If using a keyfile or identity, ensure it hasn't changed.")
 		}
-		defer inputFile.Close()
+		return fmt.Errorf("failed to find files: %w", err)
+	}
 
-		header, _, err := fileHandler.ReadHeaderWithMetadata(inputFile)
-		if err != nil {
-			PrintError(fmt.Sprintf("Failed to read header for %s: %v", relPath, err))
-			progressBar.Increment(1)
-			failedFiles = append(failedFiles, relPath)
-			return nil // Continue with other files
+	var selected []core.EncryptedFile
+	totalFiles := 0
+	for _, file := range files {
+		if filter.Match(file.RelativePath) {
+			selected = append(selected, file)
+			if !file.IsDir {
+				totalFiles++
+			}
 		}
+	}
 
-		// Derive key from password and salt
-		keyManager := encryptionService.GetKeyManager()
-		key, err := keyManager.DeriveKeyFromPasswordAndSalt(password, header.Salt[:])
-		if err != nil {
-			PrintError(fmt.Sprintf("Failed to derive key for %s: %v", relPath, err))
-			progressBar.Increment(1)
-			failedFiles = append(failedFiles, relPath)
-			return nil // Continue with other files
+	if len(selected) == 0 {
+		if filter != nil {
+			PrintInfo("No .nokvault files in directory match the selection")
+		} else {
+			PrintInfo("No .nokvault files found in directory")
 		}
-		defer utils.ZeroizeKey(key)
-
-		// Decrypt single file
-		if err := decryptSingleFile(path, outputFilePath, key, encryptionService, fileHandler); err != nil {
-			PrintError(fmt.Sprintf("Failed to decrypt %s: %v", relPath, err))
-			progressBar.Increment(1)
-			failedFiles = append(failedFiles, relPath)
-			return nil // Continue with other files instead of stopping
+		return nil
+	}
+
+	if err := fileHandler.EnsureDirectory(outputPath); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	PrintInfo(fmt.Sprintf("Decrypting %d files in directory...", totalFiles))
+
+	// Create progress bar
+	progressBar := utils.NewProgressBar(int64(totalFiles), "Decrypting files")
+
+	// Links and the modes of directories are restored once every file is written
+	restorer := core.NewTreeRestorer(encryptionService, files, outputPath, creds, keyCache)
+	if decryptVerbose {
+		restorer.SetOnWarning(PrintWarning)
+	}
+
+	var failedFiles []string
+	var successCount int
+
+	for _, file := range selected {
+		if err := restorer.Restore(file); err != nil {
+			PrintError(fmt.Sprintf("Failed to decrypt %s: %v", file.RelativePath, err))
+			failedFiles = append(failedFiles, file.RelativePath)
+			if !file.IsDir {
+				progressBar.Increment(1)
+			}
+			continue // Continue with other files instead of stopping
 		}
 
+		if file.IsDir {
+			continue
+		}
 		successCount++
 		progressBar.Increment(1)
 		if decryptVerbose {
-			PrintInfo(fmt.Sprintf("Decrypted: %s", outputRelPath))
+			PrintInfo(fmt.Sprintf("Decrypted: %s", file.RelativePath))
 		}
+	}
 
-		return nil
-	})
+	finishErr := restorer.Finish()
+	if finishErr != nil {
+		PrintError(fmt.Sprintf("Failed to restore links: %v", finishErr))
+	}
 
 	// Report results
 	if len(failedFiles) > 0 {
@@ -295,7 +419,12 @@ func decryptDirectory(inputPath, outputPath string, password []byte, encryptionS
 		if successCount > 0 {
 			PrintInfo(fmt.Sprintf("Successfully decrypted %d file(s)", successCount))
 		}
-		return fmt.Errorf("directory decryption completed with %d error(s) out of %d file(s)", len(failedFiles), totalFiles)
+		return fmt.Errorf("directory decryption completed with %d error(s) out of %d file(s)", len(failedFiles), len(selected))
+	}
+
+	if finishErr != nil {
+		progressBar.Wait()
+		return fmt.Errorf("failed to restore links: %w", finishErr)
 	}
 
 	if successCount == 0 && totalFiles > 0 {
@@ -309,62 +438,3 @@ func decryptDirectory(inputPath, outputPath string, password []byte, encryptionS
 	PrintSuccess(fmt.Sprintf("Decrypted %d files: %s -> %s", successCount, inputPath, outputPath))
 	return nil
 }
-
-func decryptSingleFile(inputPath, outputPath string, key []byte, encryptionService *core.EncryptionService, fileHandler *core.FileHandler) error {
-	// Open input file
-	inputFile, err := os.Open(inputPath)
-	if err != nil {
-		return fmt.Errorf("failed to open input file: %w", err)
-	}
-	defer inputFile.Close()
-
-	// Read header with metadata
-	header, metadata, err := fileHandler.ReadHeaderWithMetadata(inputFile)
-	if err != nil {
-		return fmt.Errorf("failed to read header: %w", err)
-	}
-
-	// Read encrypted data (skip header)
-	inputFile.Seek(int64(header.DataOffset), io.SeekStart)
-	ciphertext, err := io.ReadAll(inputFile)
-	if err != nil {
-		return fmt.Errorf("failed to read encrypted data: %w", err)
-	}
-
-	// Decrypt data
-	plaintext, err := encryptionService.DecryptData(ciphertext, key)
-	if err != nil {
-		return fmt.Errorf("decryption failed: %w", err)
-	}
-
-	// Try to decompress if data appears to be compressed
-	compressionService := core.NewCompressionService()
-	if len(plaintext) >= 2 && plaintext[0] == 0x1f && plaintext[1] == 0x8b {
-		// Looks like gzip compressed data
-		decompressed, err := compressionService.Decompress(plaintext)
-		if err == nil {
-			plaintext = decompressed
-		}
-	}
-
-	// Ensure output directory exists (only if not root directory)
-	if outputDir := filepath.Dir(outputPath); outputDir != "." && outputDir != "" {
-		if err := os.MkdirAll(outputDir, 0755); err != nil {
-			return fmt.Errorf("failed to create output directory: %w", err)
-		}
-	}
-
-	// Write decrypted data
-	if err := os.WriteFile(outputPath, plaintext, 0600); err != nil {
-		return fmt.Errorf("failed to write output file: %w", err)
-	}
-
-	// Restore metadata if available
-	if metadata != nil {
-		if err := fileHandler.WriteMetadata(outputPath, metadata); err != nil {
-			// Log warning but don't fail
-		}
-	}
-
-	return nil
-}
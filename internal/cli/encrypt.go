@@ -1,6 +1,7 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -13,12 +14,45 @@ import (
 var encryptCmd = &cobra.Command{
 	Use:   "encrypt <path>",
 	Short: "Encrypt a file or directory",
-	Long: `Encrypt a file or directory using AES-256-GCM encryption.
+	Long: `Encrypt a file or directory using AES-256-GCM (default), ChaCha20-Poly1305
+or XChaCha20-Poly1305 authenticated encryption.
 
 The encrypted output will be saved as <path>.nokvault by default.
-You can specify a custom output path using the --output flag.`,
+You can specify a custom output path using the --output flag.
+
+With --encrypt-names (or encryption.encrypt_names in the config), the files of
+a directory are written under random names in a flat layout, and their
+original paths are kept in an encrypted name map that 'nokvault decrypt'
+restores them from.
+
+With --pad (or encryption.padding in the config), the encrypted payload is
+padded with the scheme set by encryption.padding_scheme: "padme" (the default)
+rounds sizes up by at most 12%, "buckets" to a multiple of 64 KB. The padding
+is authenticated and stripped on decryption, so the size of a .nokvault file
+no longer reveals the exact size of the original.
+
+Directories, including empty ones, and symbolic links are encrypted as entries
+of their own, so their modes and times survive a round trip and links are
+restored as links. --preserve-owner, --xattrs and --hardlinks also record the
+owner and group, the extended attributes and the hard links of every entry.
+
+With --volume-size, a file is written as a set of volumes of at most that size
+(<output>.001, <output>.002, ...) for media or channels that cap the size of
+a file. 'nokvault decrypt' takes the set by its first volume or by the output
+name and fails if a volume is missing or out of order.
+
+With --parity (or encryption.parity in the config), a Reed-Solomon parity file
+taking that percent of the output's size is written beside it (<output>.parity,
+or one per volume), and 'nokvault repair' can rebuild damaged ciphertext from
+it before decryption. A directory gets a parity file beside every file.
+
+With --sign-key, the output is signed with an Ed25519 key from 'nokvault keygen
+--signing', and the signature is written beside it (<output>.sig). 'nokvault
+decrypt' and 'nokvault verify' check it with --trusted-signers, proving who
+wrote the file where the password only proves that they knew it. A directory
+gets a signature beside every file.`,
 	Args: cobra.ExactArgs(1),
-	RunE: runEncrypt,
+	RunE: audited(core.AuditEncrypt, runEncrypt),
 }
 
 var (
@@ -30,6 +64,19 @@ var (
 	encryptVerbose    bool
 	encryptCompress   bool
 	encryptNoCompress bool
+	encryptAlgorithm  string
+	encryptRecipients []string
+	encryptTwoFactor  bool
+	encryptNames      bool
+	encryptOwner      bool
+	encryptXattrs     bool
+	encryptHardlinks  bool
+	encryptPad        bool
+	encryptNoPad      bool
+	encryptVolumeSize string
+	encryptParity     int
+	encryptNoParity   bool
+	encryptSignKey    string
 )
 
 func init() {
@@ -41,6 +88,19 @@ func init() {
 	encryptCmd.Flags().BoolVarP(&encryptVerbose, "verbose", "v", false, "Verbose output")
 	encryptCmd.Flags().BoolVar(&encryptCompress, "compress", false, "Compress data before encryption")
 	encryptCmd.Flags().BoolVar(&encryptNoCompress, "no-compress", false, "Disable compression (overrides config)")
+	encryptCmd.Flags().BoolVar(&encryptPad, "pad", false, "Pad the output to hide the exact size of the input (scheme from config, Padmé by default)")
+	encryptCmd.Flags().BoolVar(&encryptNoPad, "no-pad", false, "Disable padding (overrides config)")
+	encryptCmd.Flags().StringVar(&encryptVolumeSize, "volume-size", "", "Split the output of a file into volumes of at most this size (e.g. 700M, 2G)")
+	encryptCmd.Flags().IntVar(&encryptParity, "parity", 0, "Write a parity file beside the output taking this percent of its size, for 'nokvault repair' (default from config)")
+	encryptCmd.Flags().BoolVar(&encryptNoParity, "no-parity", false, "Disable parity files (overrides config)")
+	encryptCmd.Flags().StringVar(&encryptSignKey, "sign-key", "", "Sign the output with the signing key in this file, from 'nokvault keygen --signing'")
+	encryptCmd.Flags().StringVar(&encryptAlgorithm, "algorithm", "", "Encryption algorithm: aes256gcm, chacha20 or xchacha20 (default from config)")
+	encryptCmd.Flags().BoolVar(&encryptTwoFactor, "two-factor", false, "Require both the password and the --keyfile to decrypt")
+	encryptCmd.Flags().BoolVar(&encryptNames, "encrypt-names", false, "Hide file and directory names when encrypting a directory")
+	encryptCmd.Flags().BoolVar(&encryptOwner, "preserve-owner", false, "Record the owner and group of every entry when encrypting a directory (restored when decrypting as root)")
+	encryptCmd.Flags().BoolVar(&encryptXattrs, "xattrs", false, "Record extended attributes when encrypting a directory (Linux only)")
+	encryptCmd.Flags().BoolVar(&encryptHardlinks, "hardlinks", false, "Record files linked more than once as hard links when encrypting a directory")
+	encryptCmd.Flags().StringArrayVarP(&encryptRecipients, "recipient", "r", nil, "Encrypt to a public key or recipients file (repeatable); no password is asked for unless --password or --keyfile is given")
 
 	rootCmd.AddCommand(encryptCmd)
 }
@@ -49,9 +109,13 @@ func runEncrypt(cmd *cobra.Command, args []string) error {
 	inputPath := args[0]
 
 	// Validate input path
-	if _, err := os.Stat(inputPath); os.IsNotExist(err) {
+	inputInfo, err := os.Stat(inputPath)
+	if os.IsNotExist(err) {
 		return utils.NewError(utils.ErrInvalidPath.Code, fmt.Sprintf("Path does not exist: %s", inputPath), err)
 	}
+	if encryptVolumeSize != "" && err == nil && inputInfo.IsDir() {
+		return utils.NewErrorWithHint(utils.ErrInvalidArgument.Code, "--volume-size only applies to files", nil, "Use 'nokvault protect --volume-size' to split a directory archive into volumes.")
+	}
 
 	// Determine output path
 	outputPath := encryptOutput
@@ -64,23 +128,51 @@ func runEncrypt(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
-	// Get password
-	password, err := utils.GetPassword(encryptPassword, encryptKeyfile, encryptNoPrompt, true)
+	// Create encryption service using the configured cipher and key derivation settings
+	encryptionService, err := newEncryptionService(loadConfig())
 	if err != nil {
 		return err
 	}
-	defer utils.ZeroizePassword(password)
-
-	// Create encryption service
-	encryptionService := core.NewEncryptionService()
+	if encryptAlgorithm != "" {
+		if err := setCipher(encryptionService, encryptAlgorithm); err != nil {
+			return utils.NewError(utils.ErrInvalidArgument.Code, fmt.Sprintf("Unsupported algorithm: %s", encryptAlgorithm), err)
+		}
+	}
+	// Command line flags take precedence over the config
+	if encryptNoPad {
+		encryptionService.SetPadding(core.PaddingNone)
+	} else if encryptPad {
+		if err := setPadding(encryptionService, loadConfig()); err != nil {
+			return err
+		}
+	}
+	if encryptVolumeSize != "" {
+		if err := setVolumeSize(encryptionService, encryptVolumeSize); err != nil {
+			return err
+		}
+	}
+	if encryptNoParity {
+		encryptionService.SetParity(0)
+	} else if encryptParity != 0 {
+		if err := setParity(encryptionService, encryptParity); err != nil {
+			return err
+		}
+	}
+	if encryptSignKey != "" {
+		signingKey, err := loadSigningKey(encryptSignKey)
+		if err != nil {
+			return err
+		}
+		encryptionService.SetSigningKey(signingKey)
+	}
 	keyManager := encryptionService.GetKeyManager()
 
-	// Derive key from password
-	key, salt, err := keyManager.DeriveKeyFromPassword(password)
+	// Get the password and public keys that will unlock the output
+	recipients, err := resolveRecipients(keyManager, encryptRecipients, encryptPassword, encryptKeyfile, encryptNoPrompt, true, encryptTwoFactor)
 	if err != nil {
-		return utils.NewError(utils.ErrKeyDerivation.Code, "Failed to derive encryption key", err)
+		return err
 	}
-	defer utils.ZeroizeKey(key)
+	defer utils.ZeroizeKey(recipients.Key)
 
 	// Encrypt file or directory
 	info, err := os.Stat(inputPath)
@@ -89,17 +181,17 @@ func runEncrypt(cmd *cobra.Command, args []string) error {
 	}
 
 	if info.IsDir() {
-		return encryptDirectory(inputPath, outputPath, key, salt, encryptionService)
+		return encryptDirectory(inputPath, outputPath, recipients, encryptionService)
 	}
 
-	return encryptFile(inputPath, outputPath, key, salt, encryptionService)
+	return encryptFile(inputPath, outputPath, recipients, encryptionService)
 }
 
-func encryptFile(inputPath, outputPath string, key, salt []byte, encryptionService *core.EncryptionService) error {
-	return encryptFileWithCompression(inputPath, outputPath, key, salt, encryptionService, shouldCompress())
+func encryptFile(inputPath, outputPath string, recipients *core.Recipients, encryptionService *core.EncryptionService) error {
+	return encryptFileWithCompression(inputPath, outputPath, recipients, encryptionService, shouldCompress())
 }
 
-func encryptFileWithCompression(inputPath, outputPath string, key, salt []byte, encryptionService *core.EncryptionService, compress bool) error {
+func encryptFileWithCompression(inputPath, outputPath string, recipients *core.Recipients, encryptionService *core.EncryptionService, compress bool) error {
 	if encryptVerbose {
 		PrintInfo(fmt.Sprintf("Encrypting file: %s", inputPath))
 		if compress {
@@ -107,49 +199,6 @@ func encryptFileWithCompression(inputPath, outputPath string, key, salt []byte,
 		}
 	}
 
-	// Read file metadata
-	fileHandler := core.NewFileHandler()
-	metadata, err := fileHandler.ReadMetadata(inputPath)
-	if err != nil {
-		return fmt.Errorf("failed to read metadata: %w", err)
-	}
-
-	// Read file data
-	data, err := os.ReadFile(inputPath)
-	if err != nil {
-		return fmt.Errorf("failed to read file: %w", err)
-	}
-
-	// Compress if enabled
-	if compress {
-		compressionService := core.NewCompressionService()
-		if compressionService.ShouldCompress(data, 1024) { // Compress if > 1KB
-			compressed, err := compressionService.Compress(data)
-			if err != nil {
-				return fmt.Errorf("compression failed: %w", err)
-			}
-			if encryptVerbose {
-				PrintInfo(fmt.Sprintf("Compressed: %d -> %d bytes (%.1f%%)", len(data), len(compressed), float64(len(compressed))/float64(len(data))*100))
-			}
-			data = compressed
-		}
-	}
-
-	// Note: For single file operations, we process everything at once,
-	// so progress bars aren't very useful. We'll skip them for now.
-	// Progress bars work better for directory operations.
-	// Show progress for large files (disabled - not useful for single file ops)
-	// var progressBar *utils.ProgressBar
-	// if originalSize > 1024*1024 {
-	// 	progressBar = utils.NewProgressBar(originalSize, "Encrypting")
-	// }
-
-	// Encrypt data
-	ciphertext, err := encryptionService.EncryptData(data, key)
-	if err != nil {
-		return utils.NewError(utils.ErrEncryptionFailed.Code, "Encryption failed", err)
-	}
-
 	// Ensure output directory exists (only if not root directory)
 	if outputDir := filepath.Dir(outputPath); outputDir != "." && outputDir != "" {
 		if err := os.MkdirAll(outputDir, 0755); err != nil {
@@ -157,25 +206,27 @@ func encryptFileWithCompression(inputPath, outputPath string, key, salt []byte,
 		}
 	}
 
-	// Create output file with header
-	outputFile, err := os.Create(outputPath)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
+	// The file is streamed through the encryptor in fixed-size chunks,
+	// so memory use stays constant regardless of the file size
+	if err := encryptionService.EncryptFileForRecipients(inputPath, outputPath, recipients, compress); err != nil {
+		return utils.NewError(utils.ErrEncryptionFailed.Code, "Encryption failed", err)
 	}
-	defer outputFile.Close()
 
-	// Write header with metadata
-	if err := fileHandler.WriteHeader(outputFile, salt, metadata); err != nil {
-		return fmt.Errorf("failed to write header: %w", err)
-	}
+	PrintSuccess(fmt.Sprintf("Encrypted: %s -> %s", inputPath, describeOutput(outputPath, encryptionService)))
+	return nil
+}
 
-	// Write encrypted data
-	if _, err := outputFile.Write(ciphertext); err != nil {
-		return fmt.Errorf("failed to write encrypted data: %w", err)
+// describeOutput returns how an encrypted output is reported: its path, or
+// the range of its volumes if it was split
+func describeOutput(outputPath string, encryptionService *core.EncryptionService) string {
+	if encryptionService.VolumeSize() == 0 {
+		return outputPath
 	}
-
-	PrintSuccess(fmt.Sprintf("Encrypted: %s -> %s", inputPath, outputPath))
-	return nil
+	volumes, err := core.ListVolumes(outputPath)
+	if err != nil || len(volumes) == 1 {
+		return core.VolumePath(outputPath, 1)
+	}
+	return fmt.Sprintf("%s .. %s (%d volumes)", volumes[0], volumes[len(volumes)-1], len(volumes))
 }
 
 func shouldCompress() bool {
@@ -190,11 +241,29 @@ func shouldCompress() bool {
 	return false
 }
 
-func encryptDirectory(inputPath, outputPath string, key, salt []byte, encryptionService *core.EncryptionService) error {
-	return encryptDirectoryWithCompression(inputPath, outputPath, key, salt, encryptionService, shouldCompress())
+// shouldEncryptNames reports whether directories are encrypted with hidden names
+func shouldEncryptNames() bool {
+	return encryptNames || loadConfig().Encryption.EncryptNames
 }
 
-func encryptDirectoryWithCompression(inputPath, outputPath string, key, salt []byte, encryptionService *core.EncryptionService, compress bool) error {
+// newDirectoryEncryptor creates the directory encryptor used by encrypt and
+// schedule encrypt, hiding names and keeping metadata as configured
+func newDirectoryEncryptor(encryptionService *core.EncryptionService, verbose, compress bool) *core.DirectoryEncryptor {
+	encryptor := core.NewDirectoryEncryptor(encryptionService, verbose)
+	encryptor.SetCompression(compress)
+	encryptor.SetHideNames(shouldEncryptNames())
+	encryptor.SetPreserveOwner(encryptOwner)
+	encryptor.SetPreserveXattrs(encryptXattrs)
+	encryptor.SetDetectHardlinks(encryptHardlinks)
+	encryptor.SetOnWarning(PrintWarning)
+	return encryptor
+}
+
+func encryptDirectory(inputPath, outputPath string, recipients *core.Recipients, encryptionService *core.EncryptionService) error {
+	return encryptDirectoryWithCompression(inputPath, outputPath, recipients, encryptionService, shouldCompress())
+}
+
+func encryptDirectoryWithCompression(inputPath, outputPath string, recipients *core.Recipients, encryptionService *core.EncryptionService, compress bool) error {
 	fileHandler := core.NewFileHandler()
 
 	// Count files for progress
@@ -203,7 +272,8 @@ func encryptDirectoryWithCompression(inputPath, outputPath string, key, salt []b
 		return fmt.Errorf("failed to count files: %w", err)
 	}
 
-	if totalFiles == 0 {
+	// Directories are encrypted even if there are no files in them
+	if entries, err := os.ReadDir(inputPath); err == nil && len(entries) == 0 {
 		PrintInfo("No files found in directory")
 		return nil
 	}
@@ -214,15 +284,17 @@ func encryptDirectoryWithCompression(inputPath, outputPath string, key, salt []b
 
 	PrintInfo(fmt.Sprintf("Encrypting %d files in directory...", totalFiles))
 
-	// Create progress bar
-	progressBar := utils.NewProgressBar(int64(totalFiles), "Encrypting files")
-
 	// Create directory encryptor
-	encryptor := core.NewDirectoryEncryptor(encryptionService, encryptVerbose)
-	encryptor.SetCompression(compress)
-
-	// Encrypt directory with progress callback
-	err = encryptor.EncryptDirectory(inputPath, outputPath, key, salt, func(current, total int, currentFile string) {
+	encryptor := newDirectoryEncryptor(encryptionService, encryptVerbose, compress)
+
+	// Encrypt directory with progress callback. The progress bar is only
+	// created by the first file, since waiting for a bar that never moved
+	// doesn't return.
+	var progressBar *utils.ProgressBar
+	err = encryptor.EncryptDirectoryForRecipients(inputPath, outputPath, recipients, func(current, total int, currentFile string) {
+		if progressBar == nil {
+			progressBar = utils.NewProgressBar(int64(total), "Encrypting files")
+		}
 		progressBar.Increment(1)
 		if encryptVerbose {
 			PrintInfo(fmt.Sprintf("[%d/%d] %s", current, total, currentFile))
@@ -230,8 +302,16 @@ func encryptDirectoryWithCompression(inputPath, outputPath string, key, salt []b
 	})
 
 	// Complete and wait for progress bar before printing success message
-	progressBar.Wait()
+	if progressBar != nil {
+		progressBar.Wait()
+	}
 
+	if errors.Is(err, core.ErrNameMapExists) {
+		return utils.NewErrorWithHint(utils.ErrInvalidPath.Code, "Output directory already holds files with hidden names", err, "Encrypt into a new directory with --output.")
+	}
+	if errors.Is(err, core.ErrOutputNotManaged) {
+		return utils.NewErrorWithHint(utils.ErrInvalidPath.Code, "Output directory holds encrypted files but no manifest", err, "Encrypt into a new directory with --output, or remove the old output first.")
+	}
 	if err != nil {
 		PrintError(fmt.Sprintf("Directory encryption failed: %v", err))
 		return err
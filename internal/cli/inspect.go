@@ -0,0 +1,168 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jimididit/nokvault/internal/core"
+	"github.com/jimididit/nokvault/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect <file>",
+	Short: "Show the header and format details of an encrypted file",
+	Long: `Show what a .nokvault file, archive or volume set is without a password:
+its magic and format version, cipher, chunk size, compression, padding, key
+slots with their salts and key derivation parameters, the sizes of the header
+sections, the data offset, the ciphertext length and the plaintext metadata of
+files written before version 3.
+
+Structural problems, such as a file truncated inside its header or payload or
+a data offset past the end of the file, are listed after the details, and the
+command exits with a non-zero status if there are any. A file without problems
+may still fail to decrypt: use 'nokvault verify' to authenticate its contents.
+
+Example:
+  nokvault inspect report.pdf.nokvault
+  nokvault inspect backup.nokvault --json`,
+	Args: cobra.ExactArgs(1),
+	RunE: runInspect,
+}
+
+var inspectJSON bool
+
+func init() {
+	inspectCmd.Flags().BoolVar(&inspectJSON, "json", false, "Print the details as JSON")
+
+	rootCmd.AddCommand(inspectCmd)
+}
+
+func runInspect(cmd *cobra.Command, args []string) error {
+	inputPath := args[0]
+
+	// A volume set may be named by the path it was split from
+	info, err := os.Stat(inputPath)
+	if err != nil {
+		if _, ok := core.VolumeSetBase(inputPath); !ok {
+			PrintError(fmt.Sprintf("Path does not exist: %s", inputPath))
+			return utils.NewError(utils.ErrFileNotFound.Code, fmt.Sprintf("Path does not exist: %s", inputPath), err)
+		}
+	} else if info.IsDir() {
+		return utils.NewErrorWithHint(utils.ErrInvalidPath.Code, fmt.Sprintf("%s is a directory", inputPath), nil, "Inspect the .nokvault files inside it one at a time.")
+	}
+
+	inspection, err := core.InspectFile(inputPath)
+	if err != nil {
+		return utils.NewError(utils.ErrInvalidPath.Code, fmt.Sprintf("Failed to read %s", inputPath), err)
+	}
+
+	// Problems are findings, not misuse, so don't follow them with the usage
+	cmd.SilenceUsage = true
+
+	out := cmd.OutOrStdout()
+	if inspectJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(inspection); err != nil {
+			return fmt.Errorf("failed to encode details: %w", err)
+		}
+	} else {
+		printInspection(out, inspection)
+	}
+
+	if len(inspection.Problems) > 0 {
+		return utils.NewError(utils.ErrInvalidFormat.Code, fmt.Sprintf("Structural problems found in %s: %d", inspection.Path, len(inspection.Problems)), nil)
+	}
+	return nil
+}
+
+// printInspection prints the details of a file as aligned fields
+func printInspection(out io.Writer, inspection *core.Inspection) {
+	field := func(name string, format string, args ...interface{}) {
+		fmt.Fprintf(out, "%-16s %s\n", name+":", fmt.Sprintf(format, args...))
+	}
+
+	field("Path", "%s", inspection.Path)
+	if len(inspection.Volumes) > 0 {
+		field("Volumes", "%d", len(inspection.Volumes))
+	}
+	if inspection.Size > 0 {
+		field("Size", "%d bytes", inspection.Size)
+	}
+	field("Magic", "%q", inspection.Magic)
+	field("Version", "%d", inspection.Version)
+	if inspection.Salt != "" {
+		field("Salt", "%s", inspection.Salt)
+	}
+	if params := inspection.Params; params != nil {
+		field("Cipher", "%s", params.Cipher)
+		field("Chunk size", "%d bytes", params.ChunkSize)
+		field("Compression", "%s", params.Compression)
+		if params.Content != "" {
+			field("Content", "%s", params.Content)
+		}
+		if params.Padding != core.PaddingNone {
+			field("Padding", "%s", params.Padding)
+		}
+		if params.Generation > 0 {
+			field("Generation", "%d", params.Generation)
+		}
+	}
+	if len(inspection.KeySlots) > 0 {
+		fmt.Fprintln(out, "Key slots:")
+		for i, slot := range inspection.KeySlots {
+			fmt.Fprintf(out, "  %d: %s", i, slot.Type)
+			if slot.Keyfile {
+				fmt.Fprint(out, "+keyfile")
+			}
+			if slot.KDF != nil {
+				fmt.Fprintf(out, " (%s, memory %d KB, time %d, parallelism %d)", slot.KDF.Algorithm, slot.KDF.Memory, slot.KDF.Time, slot.KDF.Parallelism)
+			}
+			if slot.Salt != "" {
+				fmt.Fprintf(out, " salt %s", slot.Salt)
+			}
+			fmt.Fprintln(out)
+		}
+	}
+	// Every header that could be read has a data offset past itself
+	if inspection.DataOffset > 0 {
+		if inspection.Version > core.LegacyVersion {
+			field("Params size", "%d bytes", inspection.ParamsSize)
+			field("Key slots size", "%d bytes", inspection.KeysSize)
+		}
+		field("Metadata size", "%d bytes", inspection.MetadataSize)
+		field("Data offset", "%d", inspection.DataOffset)
+	}
+	if inspection.CiphertextSize > 0 {
+		field("Ciphertext", "%d bytes", inspection.CiphertextSize)
+	}
+	if inspection.Chunks > 0 {
+		field("Chunks", "%d", inspection.Chunks)
+		field("Payload", "%d bytes", inspection.PayloadSize)
+	}
+
+	switch {
+	case inspection.MetadataSealed:
+		field("Metadata", "sealed (needs the key)")
+	case inspection.Metadata != nil:
+		metadata := inspection.Metadata
+		fmt.Fprintln(out, "Metadata:")
+		fmt.Fprintf(out, "  name:     %s\n", metadata.Name)
+		if metadata.RelativePath != "" {
+			fmt.Fprintf(out, "  path:     %s\n", metadata.RelativePath)
+		}
+		fmt.Fprintf(out, "  size:     %d bytes\n", metadata.Size)
+		fmt.Fprintf(out, "  mode:     %s\n", os.FileMode(metadata.Mode))
+		fmt.Fprintf(out, "  modified: %s\n", metadata.ModTime.Format("2006-01-02 15:04:05"))
+	}
+
+	if len(inspection.Problems) > 0 {
+		fmt.Fprintln(out, "Problems:")
+		for _, problem := range inspection.Problems {
+			fmt.Fprintf(out, "  - %s\n", problem)
+		}
+	}
+}
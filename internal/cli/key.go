@@ -0,0 +1,252 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jimididit/nokvault/internal/core"
+	"github.com/jimididit/nokvault/internal/crypto"
+	"github.com/jimididit/nokvault/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+var keyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Manage the key slots of an encrypted file",
+	Long: `Manage the key slots of a nokvault encrypted file.
+
+Each key slot wraps the file's key under a different password or keyfile, so
+a file can be shared without sharing a secret. Any slot unlocks the file.`,
+}
+
+var (
+	keyAddCmd = &cobra.Command{
+		Use:   "add <path>",
+		Short: "Add a password or keyfile to an encrypted file",
+		Long: `Add a key slot for a new password or keyfile. An existing password, keyfile
+or identity is required to unlock the file key.
+
+Example:
+  nokvault key add file.nokvault --keyfile mine.key --new-keyfile colleague.key`,
+		Args: cobra.ExactArgs(1),
+		RunE: audited(core.AuditAddKey, runKeyAdd),
+	}
+
+	keyRemoveCmd = &cobra.Command{
+		Use:   "remove <path>",
+		Short: "Remove a password or keyfile from an encrypted file",
+		Long: `Remove a key slot. Without --slot, the slot unlocked by the supplied
+password, keyfile or identity is removed; with --slot, the secret may belong
+to any slot. The last slot cannot be removed.`,
+		Args: cobra.ExactArgs(1),
+		RunE: audited(core.AuditRemoveKey, runKeyRemove),
+	}
+
+	keyListCmd = &cobra.Command{
+		Use:   "list <path>",
+		Short: "List the key slots of an encrypted file",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runKeyList,
+	}
+
+	keyPassword    string
+	keyKeyfile     string
+	keyNewPassword string
+	keyNewKeyfile  string
+	keySlot        int
+	keyNoPrompt    bool
+	keyVerbose     bool
+	keyIdentities  []string
+	keyTwoFactor   bool
+)
+
+func init() {
+	for _, cmd := range []*cobra.Command{keyAddCmd, keyRemoveCmd} {
+		cmd.Flags().StringVarP(&keyPassword, "password", "p", "", "Existing password")
+		cmd.Flags().StringVarP(&keyKeyfile, "keyfile", "k", "", "Existing keyfile path")
+		cmd.Flags().StringArrayVarP(&keyIdentities, "identity", "i", nil, "Identity file that unlocks the file (repeatable)")
+		cmd.Flags().BoolVar(&keyNoPrompt, "no-prompt", false, "Don't prompt for passwords")
+		cmd.Flags().BoolVarP(&keyVerbose, "verbose", "v", false, "Verbose output")
+	}
+	keyAddCmd.Flags().StringVarP(&keyNewPassword, "new-password", "n", "", "Password for the new slot")
+	keyAddCmd.Flags().StringVar(&keyNewKeyfile, "new-keyfile", "", "Keyfile path for the new slot")
+	keyAddCmd.Flags().BoolVar(&keyTwoFactor, "two-factor", false, "Require both the new password and the new keyfile")
+	keyRemoveCmd.Flags().IntVar(&keySlot, "slot", -1, "Index of the slot to remove (see 'key list')")
+
+	keyCmd.AddCommand(keyAddCmd)
+	keyCmd.AddCommand(keyRemoveCmd)
+	keyCmd.AddCommand(keyListCmd)
+	rootCmd.AddCommand(keyCmd)
+}
+
+func runKeyAdd(cmd *cobra.Command, args []string) error {
+	path := args[0]
+
+	header, err := readKeySlots(path, true)
+	if err != nil {
+		return err
+	}
+
+	creds, err := resolveCredentials(keyPassword, keyKeyfile, keyIdentities, keyNoPrompt, core.RequiresKeyfile(header))
+	if err != nil {
+		return fmt.Errorf("failed to get password: %w", err)
+	}
+	defer zeroizeCredentials(creds)
+
+	var newPassword, newKeyfile []byte
+	if keyTwoFactor {
+		newPassword, newKeyfile, err = getPasswordAndKeyfile(keyNewPassword, keyNewKeyfile, keyNoPrompt, true)
+	} else {
+		newPassword, err = utils.GetPassword(keyNewPassword, keyNewKeyfile, keyNoPrompt, true)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get new password: %w", err)
+	}
+	defer utils.ZeroizePassword(newPassword)
+	defer utils.ZeroizePassword(newKeyfile)
+
+	// The new slot uses the configured key derivation settings
+	encryptionService, err := newEncryptionService(loadConfig())
+	if err != nil {
+		return err
+	}
+
+	slots, err := encryptionService.GetKeyManager().AddPasswordSlot(header, creds, newPassword, newKeyfile)
+	if err != nil {
+		PrintError("Failed to add key slot - incorrect password, keyfile or identity?")
+		return utils.NewError(utils.ErrInvalidPassword.Code, "Failed to add key slot", err)
+	}
+
+	if err := core.NewFileHandler().UpdateKeySlots(path, header, slots); err != nil {
+		return fmt.Errorf("failed to update key slots: %w", err)
+	}
+
+	PrintSuccess(fmt.Sprintf("Added key slot %d: %s", len(slots)-1, path))
+	return nil
+}
+
+func runKeyRemove(cmd *cobra.Command, args []string) error {
+	path := args[0]
+
+	header, err := readKeySlots(path, true)
+	if err != nil {
+		return err
+	}
+
+	if keySlot >= len(header.KeySlots) {
+		return utils.NewError(utils.ErrInvalidArgument.Code, fmt.Sprintf("Key slot %d does not exist", keySlot), nil)
+	}
+
+	creds, err := resolveCredentials(keyPassword, keyKeyfile, keyIdentities, keyNoPrompt, core.RequiresKeyfile(header))
+	if err != nil {
+		return fmt.Errorf("failed to get password: %w", err)
+	}
+	defer zeroizeCredentials(creds)
+
+	// Only holders of a working secret may remove slots
+	keyManager := core.NewKeyManager()
+	fileKey, unlocked, err := keyManager.UnlockFileKey(header, creds, nil)
+	if err != nil {
+		PrintError("Incorrect password, keyfile or identity")
+		return utils.NewError(utils.ErrInvalidPassword.Code, "Failed to unlock key slots", err)
+	}
+	utils.ZeroizeKey(fileKey)
+
+	index := keySlot
+	if index < 0 {
+		index = unlocked
+	}
+
+	slots, err := core.RemoveKeySlot(header, index)
+	if err != nil {
+		PrintError(err.Error())
+		return utils.NewError(utils.ErrInvalidArgument.Code, "Failed to remove key slot", err)
+	}
+
+	if err := core.NewFileHandler().UpdateKeySlots(path, header, slots); err != nil {
+		return fmt.Errorf("failed to update key slots: %w", err)
+	}
+
+	if keyVerbose && index == unlocked {
+		PrintInfo("Removed the slot for the supplied password or keyfile")
+	}
+
+	PrintSuccess(fmt.Sprintf("Removed key slot %d: %s", index, path))
+	return nil
+}
+
+func runKeyList(cmd *cobra.Command, args []string) error {
+	path := args[0]
+
+	header, err := readKeySlots(path, false)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Key slots for %s:\n", path)
+	for i, slot := range header.KeySlots {
+		fmt.Printf("  %d: %s", i, slot.Type)
+		if slot.Keyfile {
+			fmt.Print("+keyfile")
+		}
+		if slot.KDF != nil {
+			fmt.Printf(" (%s, memory %d KB, time %d, parallelism %d)", slot.KDF.Algorithm, slot.KDF.Memory, slot.KDF.Time, slot.KDF.Parallelism)
+		}
+		if len(slot.Salt) > 0 {
+			fmt.Printf(" salt %s", crypto.EncodeSalt(slot.Salt)[:8])
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+// readKeySlots reads the header and metadata of the nokvault file at path,
+// so its key slots can be listed or, with update, replaced. Volume sets can
+// only be listed.
+func readKeySlots(path string, update bool) (*core.NokvaultHeader, error) {
+	inputPath, _, err := statEncryptedInput(path)
+	if os.IsNotExist(err) {
+		PrintError(fmt.Sprintf("Path does not exist: %s", path))
+		return nil, utils.NewError(utils.ErrFileNotFound.Code, fmt.Sprintf("Path does not exist: %s", path), err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if update {
+		if err := refuseVolumeSet(path); err != nil {
+			return nil, err
+		}
+	}
+
+	var file io.ReadCloser
+	if _, ok := core.VolumeSetBase(path); ok {
+		file, err = core.OpenVolumes(inputPath)
+	} else {
+		file, err = os.Open(inputPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	header, _, err := core.NewFileHandler().ReadHeaderWithMetadata(file)
+	if err != nil {
+		PrintError("Invalid nokvault file format")
+		return nil, utils.NewError(utils.ErrInvalidFormat.Code, "Invalid nokvault file format", err)
+	}
+
+	if header.Version == core.LegacyVersion {
+		return nil, utils.NewErrorWithHint(utils.ErrInvalidFormat.Code, "Version 1 files have a single key and no key slots", nil, "Run 'nokvault rotate-key' to convert the file to the current format.")
+	}
+	return header, nil
+}
+
+// refuseVolumeSet returns an error if path names a volume set, whose header
+// can't be rewritten without splitting the whole set again
+func refuseVolumeSet(path string) error {
+	if _, ok := core.VolumeSetBase(path); !ok {
+		return nil
+	}
+	return utils.NewErrorWithHint(utils.ErrInvalidArgument.Code, fmt.Sprintf("The key slots of a volume set cannot be changed: %s", path), nil, "Decrypt the set and encrypt it again with the new password or keyfile.")
+}
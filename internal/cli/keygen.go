@@ -0,0 +1,310 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jimididit/nokvault/internal/core"
+	"github.com/jimididit/nokvault/internal/crypto"
+	"github.com/jimididit/nokvault/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+var keygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "Generate an X25519 identity for public-key encryption or an Ed25519 signing key",
+	Long: `Generate an X25519 identity (private key) and print its public key.
+
+Files encrypted with --recipient <public key> can only be decrypted with
+--identity <identity file>, so automated jobs can encrypt without holding
+a decryption secret.
+
+With --signing, generate an Ed25519 signing key instead and print its
+verifying key. Files encrypted with --sign-key <signing key file> are signed,
+and decrypt and verify check the signature against the verifying keys listed
+in a --trusted-signers file, proving who wrote a file rather than just that
+they knew the password.
+
+Example:
+  nokvault keygen -o ~/.keys/nokvault.key
+  nokvault encrypt report.pdf --recipient nokvault1...
+  nokvault decrypt report.pdf.nokvault --identity ~/.keys/nokvault.key
+  nokvault keygen --signing -o ~/.keys/signing.key
+  nokvault encrypt report.pdf --sign-key ~/.keys/signing.key
+  nokvault verify report.pdf.nokvault --trusted-signers team-signers.txt`,
+	Args: cobra.NoArgs,
+	RunE: runKeygen,
+}
+
+var (
+	keygenOutput  string
+	keygenSigning bool
+)
+
+func init() {
+	keygenCmd.Flags().StringVarP(&keygenOutput, "output", "o", "", "Identity or signing key file to write (default: standard output)")
+	keygenCmd.Flags().BoolVar(&keygenSigning, "signing", false, "Generate an Ed25519 signing key for --sign-key instead of an identity")
+
+	rootCmd.AddCommand(keygenCmd)
+}
+
+func runKeygen(cmd *cobra.Command, args []string) error {
+	if keygenSigning {
+		return runKeygenSigning()
+	}
+
+	identity, err := crypto.GenerateX25519Identity()
+	if err != nil {
+		return err
+	}
+
+	publicKey := identity.Recipient().String()
+	contents := fmt.Sprintf("# created: %s\n# public key: %s\n%s\n", time.Now().Format(time.RFC3339), publicKey, identity.String())
+
+	if keygenOutput == "" {
+		fmt.Print(contents)
+		return nil
+	}
+	if err := writeKeyFile(keygenOutput, contents); err != nil {
+		return err
+	}
+
+	PrintSuccess(fmt.Sprintf("Identity written to %s", keygenOutput))
+	PrintInfo(fmt.Sprintf("Public key: %s", publicKey))
+	return nil
+}
+
+// runKeygenSigning generates a signing key for 'nokvault keygen --signing'
+func runKeygenSigning() error {
+	key, err := crypto.GenerateSigningKey()
+	if err != nil {
+		return err
+	}
+
+	verifyingKey := key.Public().String()
+	contents := fmt.Sprintf("# created: %s\n# verifying key: %s\n%s\n", time.Now().Format(time.RFC3339), verifyingKey, key.String())
+
+	if keygenOutput == "" {
+		fmt.Print(contents)
+		return nil
+	}
+	if err := writeKeyFile(keygenOutput, contents); err != nil {
+		return err
+	}
+
+	PrintSuccess(fmt.Sprintf("Signing key written to %s", keygenOutput))
+	PrintInfo(fmt.Sprintf("Verifying key: %s", verifyingKey))
+	return nil
+}
+
+// writeKeyFile writes a new private key file readable only by its owner
+func writeKeyFile(path, contents string) error {
+	// Never overwrite an existing key
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			PrintError(fmt.Sprintf("File already exists: %s", path))
+			return utils.NewError(utils.ErrInvalidPath.Code, fmt.Sprintf("File already exists: %s", path), err)
+		}
+		return fmt.Errorf("failed to create key file: %w", err)
+	}
+	if _, err := file.WriteString(contents); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+	return nil
+}
+
+// resolveRecipients builds the recipients of newly encrypted files from
+// --recipient values and the password options. With recipients, a password
+// slot is only added when a password or keyfile is given explicitly, so
+// unattended jobs never prompt for or hold a decryption secret. With
+// twoFactor, the password slot needs both the password and the keyfile.
+func resolveRecipients(keyManager *core.KeyManager, recipientArgs []string, passwordFlag, keyfileFlag string, noPrompt, confirm, twoFactor bool) (*core.Recipients, error) {
+	publicKeys, err := parseRecipients(recipientArgs)
+	if err != nil {
+		return nil, utils.NewErrorWithHint(utils.ErrInvalidArgument.Code, "Invalid recipient", err, "Recipients are nokvault1... public keys or files containing them, as printed by 'nokvault keygen'.")
+	}
+
+	recipients := &core.Recipients{PublicKeys: publicKeys}
+	if twoFactor {
+		password, keyfile, err := getPasswordAndKeyfile(passwordFlag, keyfileFlag, noPrompt, confirm)
+		if err != nil {
+			return nil, err
+		}
+		defer utils.ZeroizePassword(password)
+		defer utils.ZeroizePassword(keyfile)
+
+		recipients.Key, recipients.Salt, err = keyManager.DeriveKeyWithKeyfile(password, keyfile)
+		if err != nil {
+			return nil, utils.NewError(utils.ErrKeyDerivation.Code, "Failed to derive encryption key", err)
+		}
+		recipients.Keyfile = true
+		return recipients, nil
+	}
+
+	if len(publicKeys) > 0 && passwordFlag == "" && keyfileFlag == "" {
+		return recipients, nil
+	}
+
+	password, err := utils.GetPassword(passwordFlag, keyfileFlag, noPrompt, confirm)
+	if err != nil {
+		return nil, err
+	}
+	defer utils.ZeroizePassword(password)
+
+	recipients.Key, recipients.Salt, err = keyManager.DeriveKeyFromPassword(password)
+	if err != nil {
+		return nil, utils.NewError(utils.ErrKeyDerivation.Code, "Failed to derive encryption key", err)
+	}
+	return recipients, nil
+}
+
+// resolveCredentials gathers the secrets to unlock files with: the identities
+// in the --identity files, a password and a keyfile. A keyfile on its own
+// works as a password, and with identities a password is only used when given
+// explicitly. With twoFactor, both a password and a keyfile are required.
+// The caller should zeroize the result with zeroizeCredentials.
+func resolveCredentials(passwordFlag, keyfileFlag string, identityPaths []string, noPrompt, twoFactor bool) (*core.Credentials, error) {
+	identities, err := loadIdentities(identityPaths)
+	if err != nil {
+		return nil, utils.NewError(utils.ErrInvalidArgument.Code, "Invalid identity file", err)
+	}
+
+	creds := &core.Credentials{Identities: identities}
+	if twoFactor {
+		creds.Password, creds.Keyfile, err = getPasswordAndKeyfile(passwordFlag, keyfileFlag, noPrompt, false)
+		if err != nil {
+			return nil, err
+		}
+		return creds, nil
+	}
+
+	if keyfileFlag != "" {
+		creds.Keyfile, err = utils.ReadKeyfile(keyfileFlag)
+		if err != nil {
+			return nil, err
+		}
+		if passwordFlag != "" {
+			creds.Password = []byte(passwordFlag)
+		}
+		return creds, nil
+	}
+
+	if len(identities) > 0 && passwordFlag == "" {
+		return creds, nil
+	}
+
+	creds.Password, err = utils.GetPassword(passwordFlag, "", noPrompt, false)
+	if err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// getPasswordAndKeyfile reads both factors of a password + keyfile secret.
+// The password comes from the flag, the environment or a prompt.
+func getPasswordAndKeyfile(passwordFlag, keyfileFlag string, noPrompt, confirm bool) ([]byte, []byte, error) {
+	if keyfileFlag == "" {
+		return nil, nil, utils.NewErrorWithHint(utils.ErrInvalidPassword.Code, "A password and a keyfile are both required", core.ErrKeyfileRequired, "Pass the keyfile with --keyfile; the password is read from --password, NOKVAULT_PASSWORD or a prompt.")
+	}
+
+	keyfile, err := utils.ReadKeyfile(keyfileFlag)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	password, err := utils.GetPassword(passwordFlag, "", noPrompt, confirm)
+	if err != nil {
+		utils.ZeroizePassword(keyfile)
+		return nil, nil, err
+	}
+	return password, keyfile, nil
+}
+
+// zeroizeCredentials zeroizes the password and keyfile in creds
+func zeroizeCredentials(creds *core.Credentials) {
+	utils.ZeroizePassword(creds.Password)
+	utils.ZeroizePassword(creds.Keyfile)
+}
+
+// parseRecipients parses --recipient values, each a public key or the path
+// of a file of public keys
+func parseRecipients(values []string) ([]*crypto.X25519Recipient, error) {
+	var recipients []*crypto.X25519Recipient
+	for _, value := range values {
+		if strings.HasPrefix(value, crypto.X25519RecipientPrefix) {
+			recipient, err := crypto.ParseX25519Recipient(value)
+			if err != nil {
+				return nil, err
+			}
+			recipients = append(recipients, recipient)
+			continue
+		}
+
+		file, err := os.Open(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open recipients file: %w", err)
+		}
+		parsed, err := crypto.ParseX25519Recipients(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", value, err)
+		}
+		recipients = append(recipients, parsed...)
+	}
+	return recipients, nil
+}
+
+// loadIdentities reads the identities in the --identity files
+func loadIdentities(paths []string) ([]*crypto.X25519Identity, error) {
+	var identities []*crypto.X25519Identity
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open identity file: %w", err)
+		}
+		parsed, err := crypto.ParseX25519Identities(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		identities = append(identities, parsed...)
+	}
+	return identities, nil
+}
+
+// loadSigningKey reads the signing key in the --sign-key file
+func loadSigningKey(path string) (*crypto.SigningKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, utils.NewError(utils.ErrInvalidArgument.Code, "Invalid signing key file", err)
+	}
+	defer file.Close()
+
+	key, err := crypto.ParseSigningKeyFile(file)
+	if err != nil {
+		return nil, utils.NewErrorWithHint(utils.ErrInvalidArgument.Code, "Invalid signing key file", fmt.Errorf("%s: %w", path, err), "Signing keys are created with 'nokvault keygen --signing'.")
+	}
+	return key, nil
+}
+
+// loadTrustedSigners reads the verifying keys in the --trusted-signers file
+func loadTrustedSigners(path string) ([]*crypto.VerifyingKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, utils.NewError(utils.ErrInvalidArgument.Code, "Invalid trusted signers file", err)
+	}
+	defer file.Close()
+
+	keys, err := crypto.ParseVerifyingKeys(file)
+	if err != nil {
+		return nil, utils.NewErrorWithHint(utils.ErrInvalidArgument.Code, "Invalid trusted signers file", fmt.Errorf("%s: %w", path, err), "List one nokvaultsig1... verifying key per line, as printed by 'nokvault keygen --signing'.")
+	}
+	return keys, nil
+}
@@ -0,0 +1,327 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/jimididit/nokvault/internal/core"
+	"github.com/jimididit/nokvault/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+var lsCmd = &cobra.Command{
+	Use:     "ls <path>",
+	Aliases: []string{"list"},
+	Short:   "List the contents of encrypted files, directories and archives",
+	Long: `List the original paths, sizes, modes and modification times of a .nokvault
+file, a directory of encrypted files or an archive created by 'nokvault protect',
+without writing any plaintext.
+
+Files and directories are listed from the metadata recorded in their headers.
+That metadata is encrypted, as are the contents of an archive and the names in
+a directory encrypted with --encrypt-names, so the password is asked for once
+and used for every file. Files written by releases that stored the metadata
+unencrypted are listed without it.
+
+Example:
+  nokvault ls ./vault --long
+  nokvault ls backup.nokvault --tree
+  nokvault ls ./vault --json`,
+	Args: cobra.ExactArgs(1),
+	RunE: runLs,
+}
+
+var (
+	lsLong       bool
+	lsJSON       bool
+	lsTree       bool
+	lsPassword   string
+	lsKeyfile    string
+	lsNoPrompt   bool
+	lsIdentities []string
+)
+
+func init() {
+	lsCmd.Flags().BoolVarP(&lsLong, "long", "l", false, "Show modes, sizes and modification times")
+	lsCmd.Flags().BoolVar(&lsJSON, "json", false, "Print the entries as JSON")
+	lsCmd.Flags().BoolVar(&lsTree, "tree", false, "Print the entries as a tree")
+	lsCmd.Flags().StringVarP(&lsPassword, "password", "p", "", "Password of the files")
+	lsCmd.Flags().StringVarP(&lsKeyfile, "keyfile", "k", "", "Path to keyfile")
+	lsCmd.Flags().BoolVar(&lsNoPrompt, "no-prompt", false, "Don't prompt for password")
+	lsCmd.Flags().StringArrayVarP(&lsIdentities, "identity", "i", nil, "Identity file from 'nokvault keygen' (repeatable); no password is asked for unless --password or --keyfile is given")
+	lsCmd.MarkFlagsMutuallyExclusive("long", "json", "tree")
+
+	rootCmd.AddCommand(lsCmd)
+}
+
+func runLs(cmd *cobra.Command, args []string) error {
+	inputPath, info, err := statEncryptedInput(args[0])
+	if os.IsNotExist(err) {
+		PrintError(fmt.Sprintf("Path does not exist: %s", inputPath))
+		return utils.NewError(utils.ErrFileNotFound.Code, fmt.Sprintf("Path does not exist: %s", inputPath), err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat path: %w", err)
+	}
+
+	unlocker := &lsUnlocker{encryptionService: core.NewEncryptionService()}
+	defer unlocker.clear()
+
+	var entries []core.FileMetadata
+	if info.IsDir() {
+		entries, err = listDirectory(inputPath, unlocker)
+	} else {
+		entries, err = listFile(inputPath, unlocker)
+	}
+	if err != nil {
+		return err
+	}
+
+	out := cmd.OutOrStdout()
+	switch {
+	case lsJSON:
+		return printEntriesJSON(out, entries)
+	case lsTree:
+		printEntriesTree(out, strings.TrimSuffix(filepath.Base(inputPath), ".nokvault"), entries)
+	case lsLong:
+		printEntriesLong(out, entries)
+	default:
+		for _, entry := range entries {
+			fmt.Fprintln(out, entryPath(&entry))
+		}
+	}
+	return nil
+}
+
+// lsUnlocker asks for the credentials the first time an encrypted name map or
+// sealed metadata has to be read, and reuses them for every later file
+type lsUnlocker struct {
+	encryptionService *core.EncryptionService
+	creds             *core.Credentials
+	keyCache          *core.KeyCache
+}
+
+// credentials returns the credentials, resolving them for header on first use
+func (u *lsUnlocker) credentials(header *core.NokvaultHeader) (*core.Credentials, *core.KeyCache, error) {
+	if u.creds == nil {
+		creds, err := resolveCredentials(lsPassword, lsKeyfile, lsIdentities, lsNoPrompt, header != nil && core.RequiresKeyfile(header))
+		if err != nil {
+			return nil, nil, err
+		}
+		u.creds = creds
+		u.keyCache = core.NewKeyCache(keyCacheTTL(loadConfig()))
+	}
+	return u.creds, u.keyCache, nil
+}
+
+// metadata returns the metadata recorded in header, unlocking it if it is sealed
+func (u *lsUnlocker) metadata(header *core.NokvaultHeader, metadata *core.FileMetadata) (*core.FileMetadata, error) {
+	if !header.MetadataSealed() || header.MetadataSize == 0 {
+		return metadata, nil
+	}
+
+	creds, keyCache, err := u.credentials(header)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err = u.encryptionService.UnlockMetadata(header, creds, keyCache)
+	if err != nil {
+		return nil, utils.NewErrorWithHint(utils.ErrDecryptionFailed.Code, "Failed to decrypt the file metadata - incorrect password or corrupted file", err, "Verify your password is correct. If using a keyfile or identity, ensure it hasn't changed.")
+	}
+	return metadata, nil
+}
+
+// clear zeroizes the credentials and cached keys
+func (u *lsUnlocker) clear() {
+	if u.creds != nil {
+		zeroizeCredentials(u.creds)
+		u.keyCache.Clear()
+	}
+}
+
+// listDirectory lists the .nokvault files below dir by the metadata in their
+// headers, with their original paths relative to dir. The paths of a directory
+// encrypted with hidden names come from its name map, which needs the password.
+func listDirectory(dir string, unlocker *lsUnlocker) ([]core.FileMetadata, error) {
+	var creds *core.Credentials
+	var keyCache *core.KeyCache
+	if core.HasNameMap(dir) {
+		var err error
+		creds, keyCache, err = unlocker.credentials(nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	files, err := unlocker.encryptionService.ResolveEncryptedFiles(dir, nil, creds, keyCache)
+	if err != nil {
+		if creds != nil {
+			return nil, utils.NewErrorWithHint(utils.ErrDecryptionFailed.Code, "Failed to decrypt the file names - incorrect password or corrupted name map", err, "Verify your password is correct. If using a keyfile or identity, ensure it hasn't changed.")
+		}
+		return nil, fmt.Errorf("failed to find files: %w", err)
+	}
+
+	fileHandler := core.NewFileHandler()
+	entries := make([]core.FileMetadata, 0, len(files))
+	for _, file := range files {
+		header, metadata, err := fileHandler.ReadMetadataFromFile(file.Path)
+		if err != nil {
+			PrintWarning(fmt.Sprintf("Skipping %s: %v", file.RelativePath, err))
+			continue
+		}
+		metadata, err = unlocker.metadata(header, metadata)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := unknownEntry(file.RelativePath)
+		if metadata != nil {
+			entry = *metadata
+			entry.Name = path.Base(file.RelativePath)
+			entry.RelativePath = file.RelativePath
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// listFile lists a single .nokvault file, or the contents of an archive after
+// decrypting its index
+func listFile(inputPath string, unlocker *lsUnlocker) ([]core.FileMetadata, error) {
+	header, metadata, err := core.NewFileHandler().ReadMetadataFromFile(inputPath)
+	if err != nil {
+		PrintError("Invalid nokvault file format")
+		return nil, utils.NewError(utils.ErrInvalidFormat.Code, "Invalid nokvault file format", err)
+	}
+
+	if !core.IsArchive(header) {
+		metadata, err = unlocker.metadata(header, metadata)
+		if err != nil {
+			return nil, err
+		}
+		entry := unknownEntry(filepath.Base(inputPath))
+		if metadata != nil {
+			entry = *metadata
+			entry.RelativePath = metadata.Name
+		}
+		return []core.FileMetadata{entry}, nil
+	}
+
+	creds, _, err := unlocker.credentials(header)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := core.NewArchiver(unlocker.encryptionService, false).ReadArchiveIndex(inputPath, creds)
+	if err != nil {
+		return nil, utils.NewErrorWithHint(utils.ErrDecryptionFailed.Code, "Failed to read archive index - incorrect password or corrupted file", err, "Verify your password is correct. If using a keyfile or identity, ensure it hasn't changed.")
+	}
+	return index.Entries, nil
+}
+
+// unknownEntry describes a .nokvault file whose header records no metadata
+func unknownEntry(relPath string) core.FileMetadata {
+	relPath = filepath.ToSlash(strings.TrimSuffix(relPath, ".nokvault"))
+	return core.FileMetadata{Name: filepath.Base(relPath), RelativePath: relPath}
+}
+
+// entryPath returns the path an entry is listed under, with a trailing slash
+// for directories
+func entryPath(entry *core.FileMetadata) string {
+	if entry.IsDir {
+		return entry.RelativePath + "/"
+	}
+	return entry.RelativePath
+}
+
+// printEntriesLong prints one entry per line with its mode, size and
+// modification time, and the targets of symbolic links
+func printEntriesLong(out io.Writer, entries []core.FileMetadata) {
+	width := 1
+	for _, entry := range entries {
+		width = max(width, len(fmt.Sprint(entry.Size)))
+	}
+
+	for _, entry := range entries {
+		mode, modTime := "?---------", "-"
+		if !entry.ModTime.IsZero() {
+			mode = os.FileMode(entry.Mode).String()
+			modTime = entry.ModTime.Local().Format("2006-01-02 15:04")
+		}
+		name := entryPath(&entry)
+		if entry.Symlink != "" {
+			name += " -> " + entry.Symlink
+		}
+		fmt.Fprintf(out, "%s  %*d  %16s  %s\n", mode, width, entry.Size, modTime, name)
+	}
+}
+
+// printEntriesJSON prints the entries as a JSON array
+func printEntriesJSON(out io.Writer, entries []core.FileMetadata) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(entries); err != nil {
+		return fmt.Errorf("failed to encode entries: %w", err)
+	}
+	return nil
+}
+
+// lsNode is a directory or file in the tree view
+type lsNode struct {
+	name     string
+	isDir    bool
+	children []*lsNode
+	byName   map[string]*lsNode
+}
+
+// child returns the child node called name, adding it if it doesn't exist
+func (n *lsNode) child(name string) *lsNode {
+	if node, ok := n.byName[name]; ok {
+		return node
+	}
+	node := &lsNode{name: name, byName: make(map[string]*lsNode)}
+	n.byName[name] = node
+	n.children = append(n.children, node)
+	return node
+}
+
+// printEntriesTree prints the entries as a tree below a root called rootName.
+// Directories that only appear as parents of entries are shown as well.
+func printEntriesTree(out io.Writer, rootName string, entries []core.FileMetadata) {
+	root := &lsNode{name: rootName, isDir: true, byName: make(map[string]*lsNode)}
+	for _, entry := range entries {
+		node := root
+		segments := strings.Split(entry.RelativePath, "/")
+		for i, segment := range segments {
+			node = node.child(segment)
+			if i < len(segments)-1 || entry.IsDir {
+				node.isDir = true
+			}
+		}
+	}
+
+	fmt.Fprintln(out, root.name+"/")
+	printTreeChildren(out, root, "")
+}
+
+// printTreeChildren prints the children of node, each line starting with prefix
+func printTreeChildren(out io.Writer, node *lsNode, prefix string) {
+	for i, child := range node.children {
+		branch, indent := "├── ", "│   "
+		if i == len(node.children)-1 {
+			branch, indent = "└── ", "    "
+		}
+
+		name := child.name
+		if child.isDir {
+			name += "/"
+		}
+		fmt.Fprintln(out, prefix+branch+name)
+		printTreeChildren(out, child, prefix+indent)
+	}
+}
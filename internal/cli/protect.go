@@ -3,7 +3,9 @@ package cli
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
+	"github.com/jimididit/nokvault/internal/core"
 	"github.com/jimididit/nokvault/internal/utils"
 	"github.com/spf13/cobra"
 )
@@ -14,19 +16,63 @@ var protectCmd = &cobra.Command{
 	Long: `Protect a folder by creating an encrypted .nokvault archive file.
 
 This command creates a single encrypted archive file containing all files
-from the specified directory. This is useful for backing up or sharing
-entire directory structures securely.`,
+and directories from the specified directory, with their modes and
+timestamps. The names, sizes and layout of the files are only visible after
+decryption. This is useful for backing up or sharing entire directory
+structures securely.
+
+With --volume-size, the archive is written as a set of volumes of at most that
+size (<output>.001, <output>.002, ...) for media or channels that cap the size
+of a file.
+
+With --parity (or encryption.parity in the config), a Reed-Solomon parity file
+taking that percent of the archive's size is written beside it, and 'nokvault
+repair' can rebuild damaged ciphertext from it before the archive is restored.
+
+With --sign-key, the archive is signed with an Ed25519 key from 'nokvault
+keygen --signing' (<output>.sig), for 'nokvault decrypt --trusted-signers'.
+
+Restore the directory with 'nokvault unprotect' or 'nokvault decrypt'.`,
+	Args: cobra.ExactArgs(1),
+	RunE: audited(core.AuditEncrypt, runProtect),
+}
+
+var unprotectCmd = &cobra.Command{
+	Use:   "unprotect <archive>",
+	Short: "Restore a folder from an encrypted archive",
+	Long: `Restore the directory tree stored in a .nokvault archive created by
+'nokvault protect', including empty directories, modes and timestamps.
+
+The directory is restored to the archive path without the .nokvault
+extension by default, or to the path specified by --output flag. An archive
+split into volumes is given by its first volume or by the archive path.`,
 	Args: cobra.ExactArgs(1),
-	RunE: runProtect,
+	RunE: audited(core.AuditDecrypt, runUnprotect),
 }
 
 var (
-	protectOutput   string
-	protectPassword string
-	protectKeyfile  string
-	protectNoPrompt bool
-	protectDryRun   bool
-	protectVerbose  bool
+	protectOutput     string
+	protectPassword   string
+	protectKeyfile    string
+	protectNoPrompt   bool
+	protectDryRun     bool
+	protectVerbose    bool
+	protectCompress   bool
+	protectRecipients []string
+	protectVolumeSize string
+	protectParity     int
+	protectNoParity   bool
+	protectSignKey    string
+)
+
+var (
+	unprotectOutput     string
+	unprotectPassword   string
+	unprotectKeyfile    string
+	unprotectNoPrompt   bool
+	unprotectDryRun     bool
+	unprotectVerbose    bool
+	unprotectIdentities []string
 )
 
 func init() {
@@ -36,12 +82,27 @@ func init() {
 	protectCmd.Flags().BoolVar(&protectNoPrompt, "no-prompt", false, "Don't prompt for password")
 	protectCmd.Flags().BoolVar(&protectDryRun, "dry-run", false, "Show what would be protected without actually protecting")
 	protectCmd.Flags().BoolVarP(&protectVerbose, "verbose", "v", false, "Verbose output")
+	protectCmd.Flags().BoolVar(&protectCompress, "compress", false, "Compress the archive before encryption")
+	protectCmd.Flags().StringVar(&protectVolumeSize, "volume-size", "", "Split the archive into volumes of at most this size (e.g. 700M, 2G)")
+	protectCmd.Flags().IntVar(&protectParity, "parity", 0, "Write a parity file beside the archive taking this percent of its size, for 'nokvault repair' (default from config)")
+	protectCmd.Flags().BoolVar(&protectNoParity, "no-parity", false, "Disable parity files (overrides config)")
+	protectCmd.Flags().StringVar(&protectSignKey, "sign-key", "", "Sign the archive with the signing key in this file, from 'nokvault keygen --signing'")
+	protectCmd.Flags().StringArrayVarP(&protectRecipients, "recipient", "r", nil, "Encrypt to a public key or recipients file (repeatable); no password is asked for unless --password or --keyfile is given")
+
+	unprotectCmd.Flags().StringVarP(&unprotectOutput, "output", "o", "", "Output directory path")
+	unprotectCmd.Flags().StringVarP(&unprotectPassword, "password", "p", "", "Decryption password")
+	unprotectCmd.Flags().StringVarP(&unprotectKeyfile, "keyfile", "k", "", "Path to keyfile")
+	unprotectCmd.Flags().BoolVar(&unprotectNoPrompt, "no-prompt", false, "Don't prompt for password")
+	unprotectCmd.Flags().BoolVar(&unprotectDryRun, "dry-run", false, "Show what would be restored without actually restoring")
+	unprotectCmd.Flags().BoolVarP(&unprotectVerbose, "verbose", "v", false, "Verbose output")
+	unprotectCmd.Flags().StringArrayVarP(&unprotectIdentities, "identity", "i", nil, "Identity file from 'nokvault keygen' (repeatable); no password is asked for unless --password or --keyfile is given")
 
 	rootCmd.AddCommand(protectCmd)
+	rootCmd.AddCommand(unprotectCmd)
 }
 
 func runProtect(cmd *cobra.Command, args []string) error {
-	inputPath := args[0]
+	inputPath := filepath.Clean(args[0])
 
 	// Validate input path
 	info, err := os.Stat(inputPath)
@@ -61,15 +122,158 @@ func runProtect(cmd *cobra.Command, args []string) error {
 		outputPath = inputPath + ".nokvault"
 	}
 
+	// Create encryption service using the configured cipher and key derivation settings
+	encryptionService, err := newEncryptionService(loadConfig())
+	if err != nil {
+		return err
+	}
+	if protectVolumeSize != "" {
+		if err := setVolumeSize(encryptionService, protectVolumeSize); err != nil {
+			return err
+		}
+	}
+	if protectNoParity {
+		encryptionService.SetParity(0)
+	} else if protectParity != 0 {
+		if err := setParity(encryptionService, protectParity); err != nil {
+			return err
+		}
+	}
+	if protectSignKey != "" {
+		signingKey, err := loadSigningKey(protectSignKey)
+		if err != nil {
+			return err
+		}
+		encryptionService.SetSigningKey(signingKey)
+	}
+	archiver := core.NewArchiver(encryptionService, protectVerbose)
+	archiver.SetCompression(protectCompress)
+	archiver.SetOnWarning(PrintWarning)
+
+	index, err := archiver.BuildIndex(inputPath, outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %w", err)
+	}
+	totalFiles := index.FileCount()
+
 	if protectDryRun {
-		PrintInfo(fmt.Sprintf("Would protect directory: %s -> %s", inputPath, outputPath))
+		PrintInfo(fmt.Sprintf("Would protect directory: %s -> %s (%d files, %d directories, %d bytes)", inputPath, outputPath, totalFiles, len(index.Entries)-totalFiles, index.TotalSize()))
 		return nil
 	}
 
-	PrintInfo("Directory protection (archive mode) is not yet fully implemented.")
-	PrintInfo("For now, use 'encrypt' command on individual files.")
-	return fmt.Errorf("directory protection not yet implemented - use 'encrypt' for files")
+	// Get the password and public keys that will unlock the archive
+	recipients, err := resolveRecipients(encryptionService.GetKeyManager(), protectRecipients, protectPassword, protectKeyfile, protectNoPrompt, true, false)
+	if err != nil {
+		return err
+	}
+	defer utils.ZeroizeKey(recipients.Key)
+
+	if outputDir := filepath.Dir(outputPath); outputDir != "." && outputDir != "" {
+		if err := os.MkdirAll(outputDir, 0755); err != nil {
+			return fmt.Errorf("failed to create output directory: %w", err)
+		}
+	}
+
+	PrintInfo(fmt.Sprintf("Protecting %d files in directory...", totalFiles))
+	// The bar is created on the first file, so an empty directory or an
+	// early failure does not leave it waiting for files that never come
+	var progressBar *utils.ProgressBar
+	err = archiver.EncryptArchive(inputPath, outputPath, recipients, func(current, total int, currentFile string) {
+		if progressBar == nil {
+			progressBar = utils.NewProgressBar(int64(total), "Archiving files")
+		}
+		progressBar.Increment(1)
+		if protectVerbose {
+			PrintInfo(fmt.Sprintf("[%d/%d] %s", current, total, currentFile))
+		}
+	})
+
+	// Complete and wait for progress bar before printing the result
+	if progressBar != nil {
+		progressBar.Wait()
+	}
+
+	if err != nil {
+		PrintError(fmt.Sprintf("Directory protection failed: %v", err))
+		return utils.NewError(utils.ErrEncryptionFailed.Code, "Directory protection failed", err)
+	}
+
+	PrintSuccess(fmt.Sprintf("Protected %d files: %s -> %s", totalFiles, inputPath, describeOutput(outputPath, encryptionService)))
+	return nil
+}
+
+func runUnprotect(cmd *cobra.Command, args []string) error {
+	inputPath, _, err := statEncryptedInput(args[0])
+	if os.IsNotExist(err) {
+		PrintError(fmt.Sprintf("Path does not exist: %s", inputPath))
+		return utils.NewError(utils.ErrFileNotFound.Code, fmt.Sprintf("Path does not exist: %s", inputPath), err)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Determine output path
+	outputPath := unprotectOutput
+	if outputPath == "" {
+		if filepath.Ext(inputPath) == ".nokvault" {
+			outputPath = inputPath[:len(inputPath)-len(".nokvault")]
+		} else {
+			outputPath = inputPath + ".restored"
+		}
+	}
+
+	header, err := core.NewFileHandler().ReadHeaderFromFile(inputPath)
+	if err != nil {
+		PrintError("Invalid nokvault file format")
+		return utils.NewError(utils.ErrInvalidFormat.Code, "Invalid nokvault file format", err)
+	}
+	if !core.IsArchive(header) {
+		return utils.NewErrorWithHint(utils.ErrInvalidFormat.Code, "Not a nokvault archive", core.ErrNotArchive, "Use 'nokvault decrypt' for files created by 'nokvault encrypt'.")
+	}
+
+	if unprotectDryRun {
+		PrintInfo(fmt.Sprintf("Would restore archive: %s -> %s", inputPath, outputPath))
+		return nil
+	}
+
+	creds, err := resolveCredentials(unprotectPassword, unprotectKeyfile, unprotectIdentities, unprotectNoPrompt, core.RequiresKeyfile(header))
+	if err != nil {
+		return err
+	}
+	defer zeroizeCredentials(creds)
+
+	return extractArchive(inputPath, outputPath, creds, nil, core.NewEncryptionService(), unprotectVerbose)
+}
+
+// extractArchive restores the entries of the directory archive at inputPath
+// selected by filter (all of them, if nil) to outputPath
+func extractArchive(inputPath, outputPath string, creds *core.Credentials, filter *core.PathFilter, encryptionService *core.EncryptionService, verbose bool) error {
+	if verbose {
+		PrintInfo(fmt.Sprintf("Restoring archive: %s", inputPath))
+	}
+
+	// The number of files is only known once the index has been decrypted
+	var progressBar *utils.ProgressBar
+	archiver := core.NewArchiver(encryptionService, verbose)
+	archiver.SetFilter(filter)
+	index, _, err := archiver.DecryptArchive(inputPath, outputPath, creds, func(current, total int, currentFile string) {
+		if progressBar == nil {
+			progressBar = utils.NewProgressBar(int64(total), "Restoring files")
+		}
+		progressBar.Increment(1)
+		if verbose {
+			PrintInfo(fmt.Sprintf("[%d/%d] %s", current, total, currentFile))
+		}
+	})
+
+	if progressBar != nil {
+		progressBar.Wait()
+	}
+
+	if err != nil {
+		return utils.NewErrorWithHint(utils.ErrDecryptionFailed.Code, "Failed to restore archive - incorrect password or corrupted file", err, "Verify your password is correct. If using a keyfile or identity, ensure it hasn't changed.")
+	}
 
-	// TODO: Implement directory archiving with compression
-	// This will be implemented in Phase 2
+	PrintSuccess(fmt.Sprintf("Restored %d files: %s -> %s", index.FileCount(), inputPath, outputPath))
+	return nil
 }
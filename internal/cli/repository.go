@@ -0,0 +1,359 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jimididit/nokvault/internal/core"
+	"github.com/jimididit/nokvault/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	backupCmd = &cobra.Command{
+		Use:   "backup <path>",
+		Short: "Record a snapshot of a path in a deduplicating repository",
+		Long: `Record a snapshot of a file or directory in an encrypted repository.
+
+Files are cut into content-defined chunks and every chunk is stored once,
+encrypted, under a keyed hash of its contents. Each backup adds a small
+encrypted snapshot listing the entries of the tree, so repeated backups only
+cost the data that changed. Files whose size and modification time are
+unchanged since the last snapshot of the same path are not read again.
+
+The repository is created by the first backup, with the password and
+recipients given. Its keys are kept in repository.nokvault, whose key slots
+are managed with 'nokvault key' like any other file.
+
+Example:
+  nokvault backup ./documents --repo /mnt/backup/vault
+  nokvault snapshots --repo /mnt/backup/vault
+  nokvault restore --repo /mnt/backup/vault --snapshot latest --output ./documents.restored`,
+		Args: cobra.ExactArgs(1),
+		RunE: audited(core.AuditBackup, runBackup),
+	}
+
+	snapshotsCmd = &cobra.Command{
+		Use:   "snapshots",
+		Short: "List the snapshots in a repository",
+		Args:  cobra.NoArgs,
+		RunE:  runSnapshots,
+	}
+
+	restoreCmd = &cobra.Command{
+		Use:   "restore",
+		Short: "Restore a snapshot from a repository",
+		Long: `Restore the files, directories and symbolic links of a snapshot, with their
+modes and modification times. --snapshot takes a snapshot ID, any unique
+prefix of one, or "latest".
+
+Example:
+  nokvault restore --repo ./vault --snapshot 3f2a --output ./restored --include 'docs/**'`,
+		Args: cobra.NoArgs,
+		RunE: audited(core.AuditRestore, runRestore),
+	}
+
+	pruneCmd = &cobra.Command{
+		Use:   "prune",
+		Short: "Remove old snapshots and the data only they use",
+		Long: `Remove the snapshots not selected by the --keep options, then the chunks no
+remaining snapshot refers to. The snapshots of each backed up path are
+considered separately. At least one --keep option is required.
+
+Example: keep 24 hourly, 7 daily and 4 weekly snapshots
+  nokvault prune --repo ./vault --keep-hourly 24 --keep-daily 7 --keep-weekly 4`,
+		Args: cobra.NoArgs,
+		RunE: audited(core.AuditPrune, runPrune),
+	}
+
+	repoDir        string
+	repoPassword   string
+	repoKeyfile    string
+	repoIdentities []string
+	repoNoPrompt   bool
+	repoVerbose    bool
+
+	backupCompress   bool
+	backupRecipients []string
+
+	snapshotsJSON bool
+
+	restoreSnapshot string
+	restoreOutput   string
+	restoreIncludes []string
+	restoreExcludes []string
+
+	pruneKeep   core.KeepPolicy
+	pruneDryRun bool
+)
+
+func init() {
+	for _, cmd := range []*cobra.Command{backupCmd, snapshotsCmd, restoreCmd, pruneCmd} {
+		usage := "Repository directory"
+		if cmd == backupCmd {
+			usage += " (created if it doesn't exist)"
+		}
+		cmd.Flags().StringVar(&repoDir, "repo", "", usage)
+		cmd.MarkFlagRequired("repo")
+		cmd.Flags().StringVarP(&repoPassword, "password", "p", "", "Password of the repository")
+		cmd.Flags().StringVarP(&repoKeyfile, "keyfile", "k", "", "Path to keyfile")
+		cmd.Flags().StringArrayVarP(&repoIdentities, "identity", "i", nil, "Identity file from 'nokvault keygen' (repeatable); no password is asked for unless --password or --keyfile is given")
+		cmd.Flags().BoolVar(&repoNoPrompt, "no-prompt", false, "Don't prompt for password")
+	}
+	for _, cmd := range []*cobra.Command{backupCmd, restoreCmd, pruneCmd} {
+		cmd.Flags().BoolVarP(&repoVerbose, "verbose", "v", false, "Verbose output")
+	}
+
+	backupCmd.Flags().BoolVar(&backupCompress, "compress", false, "Compress chunks before encryption")
+	backupCmd.Flags().StringArrayVarP(&backupRecipients, "recipient", "r", nil, "Public key or recipients file that can unlock a new repository (repeatable)")
+
+	snapshotsCmd.Flags().BoolVar(&snapshotsJSON, "json", false, "Print the snapshots as JSON")
+
+	restoreCmd.Flags().StringVar(&restoreSnapshot, "snapshot", "latest", "ID, ID prefix or \"latest\" of the snapshot to restore")
+	restoreCmd.Flags().StringVarP(&restoreOutput, "output", "o", "", "Output directory")
+	restoreCmd.Flags().StringArrayVar(&restoreIncludes, "include", nil, "Only restore paths matching this glob pattern (repeatable)")
+	restoreCmd.Flags().StringArrayVar(&restoreExcludes, "exclude", nil, "Skip paths matching this glob pattern (repeatable)")
+	restoreCmd.MarkFlagRequired("output")
+
+	pruneCmd.Flags().IntVar(&pruneKeep.Last, "keep-last", 0, "Keep the most recent n snapshots")
+	pruneCmd.Flags().IntVar(&pruneKeep.Hourly, "keep-hourly", 0, "Keep the most recent snapshot of each of the last n hours")
+	pruneCmd.Flags().IntVar(&pruneKeep.Daily, "keep-daily", 0, "Keep the most recent snapshot of each of the last n days")
+	pruneCmd.Flags().IntVar(&pruneKeep.Weekly, "keep-weekly", 0, "Keep the most recent snapshot of each of the last n weeks")
+	pruneCmd.Flags().BoolVar(&pruneDryRun, "dry-run", false, "Show what would be removed without removing it")
+
+	rootCmd.AddCommand(backupCmd)
+	rootCmd.AddCommand(snapshotsCmd)
+	rootCmd.AddCommand(restoreCmd)
+	rootCmd.AddCommand(pruneCmd)
+}
+
+func runBackup(cmd *cobra.Command, args []string) error {
+	inputPath := filepath.Clean(args[0])
+	if _, err := os.Lstat(inputPath); os.IsNotExist(err) {
+		PrintError(fmt.Sprintf("Path does not exist: %s", inputPath))
+		return utils.NewError(utils.ErrFileNotFound.Code, fmt.Sprintf("Path does not exist: %s", inputPath), err)
+	}
+
+	encryptionService, err := newEncryptionService(loadConfig())
+	if err != nil {
+		return err
+	}
+
+	var repo *core.Repository
+	if core.IsRepository(repoDir) {
+		repo, err = openRepository(repoDir, encryptionService, repoPassword, repoKeyfile, repoIdentities, repoNoPrompt)
+	} else {
+		repo, err = initRepository(repoDir, encryptionService, backupRecipients, repoPassword, repoKeyfile, repoNoPrompt)
+	}
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+	repo.SetCompression(backupCompress)
+	repo.SetVerbose(repoVerbose)
+	repo.SetOnWarning(PrintWarning)
+
+	var progressBar *utils.ProgressBar
+	snapshot, stats, err := repo.Backup(inputPath, func(current, total int, currentFile string) {
+		if progressBar == nil {
+			progressBar = utils.NewProgressBar(int64(total), "Backing up files")
+		}
+		progressBar.Increment(1)
+		if repoVerbose {
+			PrintInfo(fmt.Sprintf("[%d/%d] %s", current, total, currentFile))
+		}
+	})
+	if progressBar != nil {
+		progressBar.Wait()
+	}
+	if err != nil {
+		return repositoryError("Backup failed", err)
+	}
+
+	PrintSuccess(fmt.Sprintf("Snapshot %s saved: %d files, %d bytes (%d new chunks, %d bytes added)", shortSnapshotID(snapshot.ID), stats.Files, stats.Bytes, stats.NewChunks, stats.NewBytes))
+	return nil
+}
+
+func runSnapshots(cmd *cobra.Command, args []string) error {
+	repo, err := openRepository(repoDir, core.NewEncryptionService(), repoPassword, repoKeyfile, repoIdentities, repoNoPrompt)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	snapshots, err := repo.Snapshots()
+	if err != nil {
+		return repositoryError("Failed to read snapshots", err)
+	}
+
+	out := cmd.OutOrStdout()
+	if snapshotsJSON {
+		type snapshotSummary struct {
+			ID     string    `json:"id"`
+			Time   time.Time `json:"time"`
+			Source string    `json:"source"`
+			Files  int       `json:"files"`
+			Size   int64     `json:"size"`
+		}
+		summaries := make([]snapshotSummary, 0, len(snapshots))
+		for _, snapshot := range snapshots {
+			summaries = append(summaries, snapshotSummary{snapshot.ID, snapshot.Time, snapshot.Source, snapshot.FileCount(), snapshot.TotalSize()})
+		}
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(summaries); err != nil {
+			return fmt.Errorf("failed to encode snapshots: %w", err)
+		}
+		return nil
+	}
+
+	for _, snapshot := range snapshots {
+		fmt.Fprintf(out, "%s  %s  %6d files  %12d bytes  %s\n", shortSnapshotID(snapshot.ID), snapshot.Time.Local().Format("2006-01-02 15:04:05"), snapshot.FileCount(), snapshot.TotalSize(), snapshot.Source)
+	}
+	return nil
+}
+
+func runRestore(cmd *cobra.Command, args []string) error {
+	var filter *core.PathFilter
+	if len(restoreIncludes) > 0 || len(restoreExcludes) > 0 {
+		var err error
+		filter, err = core.NewPathFilter(restoreIncludes, restoreExcludes, nil)
+		if err != nil {
+			return utils.NewError(utils.ErrInvalidArgument.Code, "Invalid --include or --exclude pattern", err)
+		}
+	}
+
+	repo, err := openRepository(repoDir, core.NewEncryptionService(), repoPassword, repoKeyfile, repoIdentities, repoNoPrompt)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+	repo.SetVerbose(repoVerbose)
+	repo.SetOnWarning(PrintWarning)
+
+	snapshot, err := repo.LoadSnapshot(restoreSnapshot)
+	if err != nil {
+		return repositoryError("Failed to read snapshot", err)
+	}
+
+	var progressBar *utils.ProgressBar
+	err = repo.Restore(snapshot, restoreOutput, filter, func(current, total int, currentFile string) {
+		if progressBar == nil {
+			progressBar = utils.NewProgressBar(int64(total), "Restoring files")
+		}
+		progressBar.Increment(1)
+		if repoVerbose {
+			PrintInfo(fmt.Sprintf("[%d/%d] %s", current, total, currentFile))
+		}
+	})
+	if progressBar != nil {
+		progressBar.Wait()
+	}
+	if err != nil {
+		return repositoryError("Restore failed", err)
+	}
+
+	PrintSuccess(fmt.Sprintf("Restored snapshot %s: %s -> %s", shortSnapshotID(snapshot.ID), snapshot.Source, restoreOutput))
+	return nil
+}
+
+func runPrune(cmd *cobra.Command, args []string) error {
+	if pruneKeep.IsEmpty() {
+		return utils.NewErrorWithHint(utils.ErrInvalidArgument.Code, "No snapshots to keep", nil, "Pass at least one of --keep-last, --keep-hourly, --keep-daily and --keep-weekly.")
+	}
+
+	repo, err := openRepository(repoDir, core.NewEncryptionService(), repoPassword, repoKeyfile, repoIdentities, repoNoPrompt)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	result, err := repo.Prune(pruneKeep, pruneDryRun)
+	if err != nil {
+		return repositoryError("Prune failed", err)
+	}
+
+	if repoVerbose || pruneDryRun {
+		for _, snapshot := range result.Removed {
+			PrintInfo(fmt.Sprintf("Remove snapshot %s (%s)", shortSnapshotID(snapshot.ID), snapshot.Time.Local().Format("2006-01-02 15:04:05")))
+		}
+	}
+	if pruneDryRun {
+		PrintInfo(fmt.Sprintf("Would remove %d snapshots and %d chunks (%d bytes), keeping %d snapshots", len(result.Removed), result.Chunks, result.Bytes, len(result.Kept)))
+		return nil
+	}
+
+	PrintSuccess(fmt.Sprintf("Removed %d snapshots and %d chunks (%d bytes), kept %d snapshots", len(result.Removed), result.Chunks, result.Bytes, len(result.Kept)))
+	return nil
+}
+
+// openRepository opens the repository at repoPath with the credentials given
+// by the password, keyfile and identity options
+func openRepository(repoPath string, encryptionService *core.EncryptionService, passwordFlag, keyfileFlag string, identityPaths []string, noPrompt bool) (*core.Repository, error) {
+	header, err := core.NewFileHandler().ReadHeaderFromFile(filepath.Join(repoPath, core.RepositoryFile))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			PrintError(fmt.Sprintf("Not a nokvault repository: %s", repoPath))
+			return nil, utils.NewErrorWithHint(utils.ErrInvalidPath.Code, fmt.Sprintf("Not a nokvault repository: %s", repoPath), core.ErrNotRepository, "Create a repository with 'nokvault backup <path> --repo <dir>'.")
+		}
+		return nil, utils.NewError(utils.ErrInvalidFormat.Code, "Invalid repository key file", err)
+	}
+
+	creds, err := resolveCredentials(passwordFlag, keyfileFlag, identityPaths, noPrompt, core.RequiresKeyfile(header))
+	if err != nil {
+		return nil, err
+	}
+	defer zeroizeCredentials(creds)
+
+	repo, err := encryptionService.OpenRepository(repoPath, creds, nil)
+	if err != nil {
+		if errors.Is(err, core.ErrNotRepository) {
+			return nil, utils.NewError(utils.ErrInvalidFormat.Code, fmt.Sprintf("Not a nokvault repository: %s", repoPath), err)
+		}
+		return nil, utils.NewErrorWithHint(utils.ErrDecryptionFailed.Code, "Failed to unlock the repository - incorrect password or corrupted key file", err, "Verify your password is correct. If using a keyfile or identity, ensure it hasn't changed.")
+	}
+	return repo, nil
+}
+
+// initRepository creates a repository at repoPath that the password and
+// recipients given can unlock
+func initRepository(repoPath string, encryptionService *core.EncryptionService, recipientArgs []string, passwordFlag, keyfileFlag string, noPrompt bool) (*core.Repository, error) {
+	recipients, err := resolveRecipients(encryptionService.GetKeyManager(), recipientArgs, passwordFlag, keyfileFlag, noPrompt, true, false)
+	if err != nil {
+		return nil, err
+	}
+	defer utils.ZeroizeKey(recipients.Key)
+
+	repo, err := encryptionService.InitRepository(repoPath, recipients)
+	if err != nil {
+		return nil, utils.NewError(utils.ErrEncryptionFailed.Code, "Failed to create repository", err)
+	}
+	PrintInfo(fmt.Sprintf("Created repository: %s", repoPath))
+	return repo, nil
+}
+
+// repositoryError describes a failed repository operation, with a hint for a
+// repository left locked
+func repositoryError(message string, err error) error {
+	switch {
+	case errors.Is(err, core.ErrRepositoryLocked):
+		return utils.NewErrorWithHint(utils.ErrInvalidPath.Code, message, err, "Wait for the other backup or prune to finish. If none is running, remove the lock file named above.")
+	case errors.Is(err, core.ErrSnapshotNotFound):
+		return utils.NewErrorWithHint(utils.ErrInvalidArgument.Code, message, err, "List the snapshots with 'nokvault snapshots --repo <dir>'.")
+	default:
+		return utils.NewError(utils.ErrDecryptionFailed.Code, message, err)
+	}
+}
+
+// shortSnapshotID returns the prefix a snapshot is listed by
+func shortSnapshotID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
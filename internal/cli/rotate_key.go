@@ -2,7 +2,6 @@ package cli
 
 import (
 	"fmt"
-	"io"
 	"os"
 
 	"github.com/jimididit/nokvault/internal/core"
@@ -14,12 +13,13 @@ import (
 var rotateKeyCmd = &cobra.Command{
 	Use:   "rotate-key <path>",
 	Short: "Rotate the encryption key for an encrypted file",
-	Long: `Rotate the encryption key for a nokvault encrypted file by decrypting
-it with the old password and re-encrypting it with a new password.
+	Long: `Rotate the encryption key for a nokvault encrypted file. The file key
+is unwrapped with the old password and rewrapped with the new one, so only
+the header is rewritten. Version 1 files are re-encrypted into the current format.
 
 This is useful for password changes or key rotation policies.`,
 	Args: cobra.ExactArgs(1),
-	RunE: runRotateKey,
+	RunE: audited(core.AuditRotateKey, runRotateKey),
 }
 
 var (
@@ -46,27 +46,19 @@ func runRotateKey(cmd *cobra.Command, args []string) error {
 	inputPath := args[0]
 
 	// Validate input path
-	if _, err := os.Stat(inputPath); os.IsNotExist(err) {
+	if _, _, err := statEncryptedInput(inputPath); os.IsNotExist(err) {
 		PrintError(fmt.Sprintf("Path does not exist: %s", inputPath))
 		return utils.NewError(utils.ErrFileNotFound.Code, fmt.Sprintf("Path does not exist: %s", inputPath), err)
 	}
-
-	// Get old password
-	oldPassword, err := utils.GetPassword(rotateKeyOldPassword, rotateKeyOldKeyfile, rotateKeyNoPrompt, false)
-	if err != nil {
-		return fmt.Errorf("failed to get old password: %w", err)
+	if err := refuseVolumeSet(inputPath); err != nil {
+		return err
 	}
-	defer utils.ZeroizePassword(oldPassword)
 
-	// Get new password
-	newPassword, err := utils.GetPassword(rotateKeyNewPassword, rotateKeyNewKeyfile, rotateKeyNoPrompt, true)
+	// Create encryption service; the new key uses the configured key derivation settings
+	encryptionService, err := newEncryptionService(loadConfig())
 	if err != nil {
-		return fmt.Errorf("failed to get new password: %w", err)
+		return err
 	}
-	defer utils.ZeroizePassword(newPassword)
-
-	// Create encryption service
-	encryptionService := core.NewEncryptionService()
 	keyManager := encryptionService.GetKeyManager()
 
 	// Open input file
@@ -78,83 +70,108 @@ func runRotateKey(cmd *cobra.Command, args []string) error {
 
 	// Read header
 	fileHandler := core.NewFileHandler()
-	header, metadata, err := fileHandler.ReadHeaderWithMetadata(inputFile)
+	header, _, err := fileHandler.ReadHeaderWithMetadata(inputFile)
 	if err != nil {
 		PrintError("Invalid nokvault file format")
 		return utils.NewError(utils.ErrInvalidFormat.Code, "Invalid nokvault file format", err)
 	}
 
-	// Derive old key
-	oldKey, err := keyManager.DeriveKeyFromPasswordAndSalt(oldPassword, header.Salt[:])
-	if err != nil {
-		PrintError("Failed to derive old key")
-		return err
-	}
-	defer utils.ZeroizeKey(oldKey)
-
-	// Read encrypted data
-	inputFile.Seek(int64(header.DataOffset), io.SeekStart)
-	ciphertext, err := io.ReadAll(inputFile)
+	// Get old password, along with the old keyfile if the file requires both
+	oldCreds, err := resolveCredentials(rotateKeyOldPassword, rotateKeyOldKeyfile, nil, rotateKeyNoPrompt, core.RequiresKeyfile(header))
 	if err != nil {
-		return fmt.Errorf("failed to read encrypted data: %w", err)
+		return fmt.Errorf("failed to get old password: %w", err)
 	}
+	defer zeroizeCredentials(oldCreds)
 
-	// Decrypt with old key
-	plaintext, err := encryptionService.DecryptData(ciphertext, oldKey)
+	// Unlock the file key with the old password
+	fileKey, slotIndex, err := keyManager.UnlockFileKey(header, oldCreds, nil)
 	if err != nil {
 		PrintError("Decryption failed - incorrect old password")
 		return utils.NewError(utils.ErrDecryptionFailed.Code, "Decryption failed", err)
 	}
+	defer utils.ZeroizeKey(fileKey)
 
-	if rotateKeyVerbose {
-		PrintInfo("Successfully decrypted with old key")
+	// Get new password and derive the new key with a fresh salt. A slot that
+	// needed a password and a keyfile is replaced by one that needs both again.
+	twoFactor := slotIndex >= 0 && header.KeySlots[slotIndex].Keyfile
+	var newPassword, newKeyfile []byte
+	if twoFactor {
+		newPassword, newKeyfile, err = getPasswordAndKeyfile(rotateKeyNewPassword, rotateKeyNewKeyfile, rotateKeyNoPrompt, true)
+	} else {
+		newPassword, err = utils.GetPassword(rotateKeyNewPassword, rotateKeyNewKeyfile, rotateKeyNoPrompt, true)
 	}
-
-	// Generate new salt and derive new key
-	newSalt, err := crypto.GenerateSalt()
 	if err != nil {
-		return fmt.Errorf("failed to generate new salt: %w", err)
+		return fmt.Errorf("failed to get new password: %w", err)
 	}
+	defer utils.ZeroizePassword(newPassword)
+	defer utils.ZeroizePassword(newKeyfile)
 
-	newKey, _, err := keyManager.DeriveKeyFromPassword(newPassword)
+	var newKey, newSalt []byte
+	if twoFactor {
+		newKey, newSalt, err = keyManager.DeriveKeyWithKeyfile(newPassword, newKeyfile)
+	} else {
+		newKey, newSalt, err = keyManager.DeriveKeyFromPassword(newPassword)
+	}
 	if err != nil {
 		PrintError("Failed to derive new key")
 		return err
 	}
 	defer utils.ZeroizeKey(newKey)
 
-	// Encrypt with new key
-	newCiphertext, err := encryptionService.EncryptData(plaintext, newKey)
-	if err != nil {
-		PrintError("Encryption with new key failed")
-		return err
+	// Version 1 files have no key slots, so their payload is re-encrypted
+	if header.Version == core.LegacyVersion {
+		inputFile.Close()
+		if err := rotateLegacyFile(inputPath, fileKey, newKey, newSalt, encryptionService); err != nil {
+			return err
+		}
+		PrintSuccess(fmt.Sprintf("Key rotated successfully: %s", inputPath))
+		return nil
 	}
 
-	// Create temporary output file
-	tempPath := inputPath + ".tmp"
-	outputFile, err := os.Create(tempPath)
+	// Replace the slot the old password unlocked with one for the new password.
+	// The payload stays encrypted with the same file key.
+	slot, err := keyManager.NewPasswordSlot(newKey, newSalt, fileKey, header.Params.Cipher)
 	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
+		return fmt.Errorf("failed to create key slot: %w", err)
 	}
-	defer outputFile.Close()
+	slot.Keyfile = twoFactor
+	slots := append([]core.KeySlot(nil), header.KeySlots...)
+	slots[slotIndex] = slot
 
-	// Write header with new salt
-	if err := fileHandler.WriteHeader(outputFile, newSalt, metadata); err != nil {
-		return fmt.Errorf("failed to write header: %w", err)
+	inputFile.Close()
+	if err := fileHandler.UpdateKeySlots(inputPath, header, slots); err != nil {
+		return fmt.Errorf("failed to update key slots: %w", err)
 	}
 
-	// Write encrypted data
-	if _, err := outputFile.Write(newCiphertext); err != nil {
-		return fmt.Errorf("failed to write encrypted data: %w", err)
+	if rotateKeyVerbose {
+		PrintInfo(fmt.Sprintf("Key slot %d rewrapped with new key", slotIndex))
 	}
-	outputFile.Close()
 
-	// Atomic replace
-	if err := os.Rename(tempPath, inputPath); err != nil {
-		os.Remove(tempPath)
-		return fmt.Errorf("failed to replace file: %w", err)
+	PrintSuccess(fmt.Sprintf("Key rotated successfully: %s", inputPath))
+	return nil
+}
+
+// rotateLegacyFile re-encrypts a version 1 file into the current format under
+// a new file key wrapped with newKey
+func rotateLegacyFile(inputPath string, oldKey, newKey, newSalt []byte, encryptionService *core.EncryptionService) error {
+	fileKey, err := crypto.GenerateKey()
+	if err != nil {
+		return err
 	}
+	defer utils.ZeroizeKey(fileKey)
 
-	PrintSuccess(fmt.Sprintf("Key rotated successfully: %s", inputPath))
+	slot, err := encryptionService.GetKeyManager().NewPasswordSlot(newKey, newSalt, fileKey, encryptionService.Cipher())
+	if err != nil {
+		return fmt.Errorf("failed to create key slot: %w", err)
+	}
+
+	if err := encryptionService.RewriteFile(inputPath, oldKey, fileKey, []core.KeySlot{slot}); err != nil {
+		PrintError("Decryption failed - incorrect old password or corrupted file")
+		return utils.NewError(utils.ErrDecryptionFailed.Code, "Key rotation failed", err)
+	}
+
+	if rotateKeyVerbose {
+		PrintInfo("Version 1 file re-encrypted into the current format")
+	}
 	return nil
 }
@@ -1,6 +1,7 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
@@ -27,18 +28,31 @@ var (
 		Short: "Schedule periodic encryption of a path",
 		Long: `Schedule periodic encryption of a file or directory.
 
+Each run overwrites the previous output. With --repo, each run records a
+snapshot in a deduplicating repository instead, so only changed data is
+stored and earlier states stay restorable (see 'nokvault backup'). An existing
+repository is unlocked with --password, --keyfile or --identity; a new one is
+created for the password and recipients given.
+
 Example: Encrypt a directory every hour
-  nokvault schedule encrypt ./documents --interval 1h`,
+  nokvault schedule encrypt ./documents --interval 1h
+
+Example: Snapshot a directory every hour
+  nokvault schedule encrypt ./documents --interval 1h --repo /mnt/backup/vault`,
 		Args: cobra.ExactArgs(1),
 		RunE: runScheduleEncrypt,
 	}
 
-	scheduleInterval time.Duration
-	schedulePassword string
-	scheduleKeyfile  string
-	scheduleNoPrompt bool
-	scheduleVerbose  bool
-	scheduleCompress bool
+	scheduleInterval   time.Duration
+	schedulePassword   string
+	scheduleKeyfile    string
+	scheduleNoPrompt   bool
+	scheduleVerbose    bool
+	scheduleCompress   bool
+	schedulePad        bool
+	scheduleRecipients []string
+	scheduleRepo       string
+	scheduleIdentities []string
 )
 
 func init() {
@@ -48,6 +62,10 @@ func init() {
 	scheduleEncryptCmd.Flags().BoolVar(&scheduleNoPrompt, "no-prompt", false, "Don't prompt for password")
 	scheduleEncryptCmd.Flags().BoolVarP(&scheduleVerbose, "verbose", "v", false, "Verbose output")
 	scheduleEncryptCmd.Flags().BoolVar(&scheduleCompress, "compress", false, "Enable compression")
+	scheduleEncryptCmd.Flags().BoolVar(&schedulePad, "pad", false, "Pad the output to hide the exact size of the input (scheme from config, Padmé by default)")
+	scheduleEncryptCmd.Flags().StringArrayVarP(&scheduleRecipients, "recipient", "r", nil, "Encrypt to a public key or recipients file (repeatable)")
+	scheduleEncryptCmd.Flags().StringVar(&scheduleRepo, "repo", "", "Record snapshots in this repository instead of overwriting path.nokvault")
+	scheduleEncryptCmd.Flags().StringArrayVar(&scheduleIdentities, "identity", nil, "Identity file that unlocks an existing repository (repeatable)")
 
 	scheduleCmd.AddCommand(scheduleEncryptCmd)
 	rootCmd.AddCommand(scheduleCmd)
@@ -61,23 +79,82 @@ func runScheduleEncrypt(cmd *cobra.Command, args []string) error {
 		return utils.NewError(utils.ErrFileNotFound.Code, fmt.Sprintf("Path does not exist: %s", path), err)
 	}
 
-	// Get password/key
-	password, err := utils.GetPassword(schedulePassword, scheduleKeyfile, scheduleNoPrompt, false)
+	// Create encryption service using the configured key derivation settings
+	encryptionService, err := newEncryptionService(loadConfig())
 	if err != nil {
-		return fmt.Errorf("failed to get password: %w", err)
+		return err
+	}
+	if schedulePad {
+		if err := setPadding(encryptionService, loadConfig()); err != nil {
+			return err
+		}
+	}
+	if scheduleRepo != "" {
+		return runScheduleBackup(path, encryptionService)
 	}
-	defer utils.ZeroizePassword(password)
-
-	// Create encryption service
-	encryptionService := core.NewEncryptionService()
 	keyManager := encryptionService.GetKeyManager()
 
-	// Derive key
-	key, salt, err := keyManager.DeriveKeyFromPassword(password)
+	// Get the password or public keys to encrypt to
+	recipients, err := resolveRecipients(keyManager, scheduleRecipients, schedulePassword, scheduleKeyfile, scheduleNoPrompt, false, false)
 	if err != nil {
-		return fmt.Errorf("failed to derive key: %w", err)
+		return fmt.Errorf("failed to get password: %w", err)
+	}
+	defer utils.ZeroizeKey(recipients.Key)
+
+	return runSchedule(path, core.AuditEncrypt, func() error {
+		err := performScheduledEncrypt(path, encryptionService, recipients)
+		// Failures are only printed with --verbose, but an output that can't
+		// be encrypted into would fail every run without a word
+		if (errors.Is(err, core.ErrOutputNotManaged) || errors.Is(err, core.ErrNameMapExists)) && !scheduleVerbose {
+			PrintWarning(fmt.Sprintf("Encryption skipped: %v", err))
+		}
+		return err
+	})
+}
+
+// runScheduleBackup records a snapshot of path in the repository at every tick
+func runScheduleBackup(path string, encryptionService *core.EncryptionService) error {
+	var repo *core.Repository
+	var err error
+	if core.IsRepository(scheduleRepo) {
+		repo, err = openRepository(scheduleRepo, encryptionService, schedulePassword, scheduleKeyfile, scheduleIdentities, scheduleNoPrompt)
+	} else {
+		repo, err = initRepository(scheduleRepo, encryptionService, scheduleRecipients, schedulePassword, scheduleKeyfile, scheduleNoPrompt)
+	}
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+	repo.SetCompression(scheduleCompress)
+	repo.SetVerbose(scheduleVerbose)
+	repo.SetOnWarning(PrintWarning)
+
+	PrintInfo(fmt.Sprintf("Recording snapshots in: %s", scheduleRepo))
+	return runSchedule(path, core.AuditBackup, func() error {
+		snapshot, stats, err := repo.Backup(path, nil)
+		// Failures are only printed with --verbose, but a lock held by
+		// another process would skip every snapshot without a word
+		if errors.Is(err, core.ErrRepositoryLocked) && !scheduleVerbose {
+			PrintWarning(fmt.Sprintf("Snapshot skipped: %v", err))
+		}
+		if err != nil {
+			return err
+		}
+		if scheduleVerbose {
+			PrintInfo(fmt.Sprintf("Snapshot %s saved: %d files, %d bytes added", shortSnapshotID(snapshot.ID), stats.Files, stats.NewBytes))
+		}
+		return nil
+	})
+}
+
+// runSchedule runs perform now and at every tick of the interval until
+// interrupted, recording every run in the audit log as operation on path
+func runSchedule(path, operation string, perform func() error) error {
+	run := func() error {
+		err := perform()
+		recordAudit(operation, "schedule", path, err)
+		return err
 	}
-	defer utils.ZeroizeKey(key)
 
 	PrintInfo(fmt.Sprintf("Scheduling encryption of: %s", path))
 	PrintInfo(fmt.Sprintf("Interval: %v", scheduleInterval))
@@ -88,7 +165,7 @@ func runScheduleEncrypt(cmd *cobra.Command, args []string) error {
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
 	// Run initial encryption
-	if err := performScheduledEncrypt(path, encryptionService, key, salt); err != nil {
+	if err := run(); err != nil {
 		if scheduleVerbose {
 			PrintError(fmt.Sprintf("Initial encryption failed: %v", err))
 		}
@@ -101,7 +178,7 @@ func runScheduleEncrypt(cmd *cobra.Command, args []string) error {
 	for {
 		select {
 		case <-ticker.C:
-			if err := performScheduledEncrypt(path, encryptionService, key, salt); err != nil {
+			if err := run(); err != nil {
 				if scheduleVerbose {
 					PrintError(fmt.Sprintf("Scheduled encryption failed: %v", err))
 				}
@@ -115,7 +192,7 @@ func runScheduleEncrypt(cmd *cobra.Command, args []string) error {
 	}
 }
 
-func performScheduledEncrypt(path string, encryptionService *core.EncryptionService, key, salt []byte) error {
+func performScheduledEncrypt(path string, encryptionService *core.EncryptionService, recipients *core.Recipients) error {
 	info, err := os.Stat(path)
 	if err != nil {
 		return err
@@ -124,12 +201,11 @@ func performScheduledEncrypt(path string, encryptionService *core.EncryptionServ
 	if info.IsDir() {
 		// Encrypt directory
 		outputPath := path + ".nokvault"
-		encryptor := core.NewDirectoryEncryptor(encryptionService, scheduleVerbose)
-		encryptor.SetCompression(scheduleCompress)
-		return encryptor.EncryptDirectory(path, outputPath, key, salt, nil)
+		encryptor := newDirectoryEncryptor(encryptionService, scheduleVerbose, scheduleCompress)
+		return encryptor.EncryptDirectoryForRecipients(path, outputPath, recipients, nil)
 	}
 
 	// Encrypt file
 	outputPath := path + ".nokvault"
-	return encryptFileWithCompression(path, outputPath, key, salt, encryptionService, scheduleCompress)
+	return encryptFileWithCompression(path, outputPath, recipients, encryptionService, scheduleCompress)
 }
@@ -17,7 +17,7 @@ before deletion. This makes it much harder to recover the file contents.
 
 WARNING: This operation is irreversible!`,
 	Args: cobra.ExactArgs(1),
-	RunE: runSecureDelete,
+	RunE: audited(core.AuditSecureDelete, runSecureDelete),
 }
 
 var (
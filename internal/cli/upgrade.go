@@ -0,0 +1,149 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jimididit/nokvault/internal/core"
+	"github.com/jimididit/nokvault/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade <path>",
+	Short: "Upgrade encrypted files to the current format version",
+	Long: `Rewrite nokvault files written in an older format version in the current
+format. Given a directory, every .nokvault file in it is upgraded recursively.
+
+Each file is re-encrypted into a temporary file next to it, which is decrypted
+again and compared with the original contents before it replaces the original.
+The same password or keyfile keeps working. Files that are already current
+are left alone.
+
+Example:
+  nokvault upgrade ./vault --dry-run
+  nokvault upgrade ./vault`,
+	Args: cobra.ExactArgs(1),
+	RunE: audited(core.AuditUpgrade, runUpgrade),
+}
+
+var (
+	upgradePassword string
+	upgradeKeyfile  string
+	upgradeNoPrompt bool
+	upgradeDryRun   bool
+	upgradeVerbose  bool
+)
+
+func init() {
+	upgradeCmd.Flags().StringVarP(&upgradePassword, "password", "p", "", "Password of the files")
+	upgradeCmd.Flags().StringVarP(&upgradeKeyfile, "keyfile", "k", "", "Path to keyfile")
+	upgradeCmd.Flags().BoolVar(&upgradeNoPrompt, "no-prompt", false, "Don't prompt for password")
+	upgradeCmd.Flags().BoolVar(&upgradeDryRun, "dry-run", false, "Show which files would be upgraded without changing them")
+	upgradeCmd.Flags().BoolVarP(&upgradeVerbose, "verbose", "v", false, "Verbose output")
+
+	rootCmd.AddCommand(upgradeCmd)
+}
+
+func runUpgrade(cmd *cobra.Command, args []string) error {
+	inputPath := args[0]
+
+	info, err := os.Stat(inputPath)
+	if os.IsNotExist(err) {
+		PrintError(fmt.Sprintf("Path does not exist: %s", inputPath))
+		return utils.NewError(utils.ErrFileNotFound.Code, fmt.Sprintf("Path does not exist: %s", inputPath), err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat path: %w", err)
+	}
+
+	paths := []string{inputPath}
+	if info.IsDir() {
+		paths, err = core.NewFileHandler().FindEncryptedFiles(inputPath, nil)
+		if err != nil {
+			return fmt.Errorf("failed to find files: %w", err)
+		}
+		if len(paths) == 0 {
+			PrintInfo("No .nokvault files found in directory")
+			return nil
+		}
+	}
+
+	// Read every header first, so nothing is asked for when all files are current
+	fileHandler := core.NewFileHandler()
+	var outdated []string
+	var invalid int
+	for _, path := range paths {
+		header, err := fileHandler.ReadHeaderFromFile(path)
+		if err != nil {
+			PrintError(fmt.Sprintf("Skipping %s: %v", path, err))
+			invalid++
+			continue
+		}
+
+		if !header.NeedsUpgrade() {
+			if upgradeVerbose || upgradeDryRun {
+				PrintInfo(fmt.Sprintf("Up to date: %s (version %d)", path, header.Version))
+			}
+			continue
+		}
+
+		outdated = append(outdated, path)
+		if upgradeDryRun {
+			PrintInfo(fmt.Sprintf("Would upgrade: %s (version %d -> %d)", path, header.Version, core.CurrentVersion))
+		}
+	}
+
+	if upgradeDryRun {
+		PrintInfo(fmt.Sprintf("%d of %d file(s) would be upgraded", len(outdated), len(paths)))
+		return nil
+	}
+
+	if len(outdated) == 0 {
+		if invalid > 0 {
+			return fmt.Errorf("%d file(s) could not be read", invalid)
+		}
+		PrintSuccess("All files are up to date")
+		return nil
+	}
+
+	creds, err := resolveCredentials(upgradePassword, upgradeKeyfile, nil, upgradeNoPrompt, false)
+	if err != nil {
+		return err
+	}
+	defer zeroizeCredentials(creds)
+
+	// New key slots use the configured cipher and key derivation settings
+	encryptionService, err := newEncryptionService(loadConfig())
+	if err != nil {
+		return err
+	}
+
+	keyCache := core.NewKeyCache(keyCacheTTL(loadConfig()))
+	defer keyCache.Clear()
+
+	var failedFiles []string
+	for _, path := range outdated {
+		if upgradeVerbose {
+			PrintInfo(fmt.Sprintf("Upgrading: %s", path))
+		}
+
+		if _, err := encryptionService.UpgradeFile(path, creds, keyCache); err != nil {
+			PrintError(fmt.Sprintf("Failed to upgrade %s: %v", path, err))
+			failedFiles = append(failedFiles, path)
+			continue
+		}
+		PrintSuccess(fmt.Sprintf("Upgraded: %s", path))
+	}
+
+	if len(failedFiles) > 0 {
+		PrintError(fmt.Sprintf("Failed to upgrade %d file(s); the originals were left unchanged", len(failedFiles)))
+		return utils.NewErrorWithHint(utils.ErrDecryptionFailed.Code, fmt.Sprintf("Upgrade completed with %d error(s) out of %d file(s)", len(failedFiles), len(outdated)), nil, "Verify your password is correct. If using a keyfile, ensure it hasn't changed.")
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d file(s) could not be read", invalid)
+	}
+
+	PrintSuccess(fmt.Sprintf("Upgraded %d file(s) to format version %d", len(outdated), core.CurrentVersion))
+	return nil
+}
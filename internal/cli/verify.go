@@ -0,0 +1,302 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jimididit/nokvault/internal/core"
+	"github.com/jimididit/nokvault/internal/crypto"
+	"github.com/jimididit/nokvault/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify <path>",
+	Short: "Check that encrypted files are intact without decrypting them to disk",
+	Long: `Check the integrity of a .nokvault file, an archive, a volume set or every
+nokvault file under a directory, without writing any plaintext.
+
+Each file's key slots are unlocked with the password, keyfile or identities
+given, and its sealed metadata and every chunk of its payload are
+authenticated. Every file is reported as:
+
+  ok          the file is intact
+  corrupt     the file was unlocked but its metadata or contents are damaged
+  wrong-key   none of the file's key slots could be unlocked
+  bad-format  the file is not a nokvault file, or a volume is missing
+
+A directory with a manifest is also checked against it, and files that are
+missing, extra, swapped or replaced by an older version are reported.
+
+A damaged file with a parity file (see 'nokvault encrypt --parity') is also
+checked against its parity, and reported as repairable if 'nokvault repair'
+can rebuild it.
+
+With --trusted-signers, the signatures written by 'nokvault encrypt
+--sign-key' are checked against the verifying keys in that file, and files
+that are unsigned, signed by an unknown signer or changed since they were
+signed are reported.
+
+The command exits with a non-zero status if any file is not ok, the
+directory does not match its manifest or a signature check fails, so it can run in scheduled checks.
+--json prints the results and a summary as JSON.
+
+Example:
+  nokvault verify ./vault --keyfile ~/.keys/master.key --no-prompt
+  nokvault verify backup.nokvault --json
+  nokvault verify ./vault --trusted-signers team-signers.txt`,
+	Args: cobra.ExactArgs(1),
+	RunE: runVerify,
+}
+
+var (
+	verifyPassword   string
+	verifyKeyfile    string
+	verifyNoPrompt   bool
+	verifyIdentities []string
+	verifyJSON       bool
+	verifySigners    string
+)
+
+func init() {
+	verifyCmd.Flags().StringVarP(&verifyPassword, "password", "p", "", "Password of the files")
+	verifyCmd.Flags().StringVarP(&verifyKeyfile, "keyfile", "k", "", "Path to keyfile")
+	verifyCmd.Flags().BoolVar(&verifyNoPrompt, "no-prompt", false, "Don't prompt for password")
+	verifyCmd.Flags().StringArrayVarP(&verifyIdentities, "identity", "i", nil, "Identity file from 'nokvault keygen' (repeatable); no password is asked for unless --password or --keyfile is given")
+	verifyCmd.Flags().BoolVar(&verifyJSON, "json", false, "Print the results and a summary as JSON")
+	verifyCmd.Flags().StringVar(&verifySigners, "trusted-signers", "", "Check that the files are signed by a verifying key listed in this file")
+
+	rootCmd.AddCommand(verifyCmd)
+}
+
+// verifySummary counts the files verified by outcome
+type verifySummary struct {
+	Total             int `json:"total"`
+	OK                int `json:"ok"`
+	Corrupt           int `json:"corrupt"`
+	WrongKey          int `json:"wrong_key"`
+	BadFormat         int `json:"bad_format"`
+	Repairable        int `json:"repairable"`
+	ManifestProblems  int `json:"manifest_problems"`
+	SignatureProblems int `json:"signature_problems"`
+}
+
+// verifyManifest is the outcome of checking a directory against its manifest
+type verifyManifest struct {
+	Generation uint64                 `json:"generation"`
+	Problems   []core.ManifestProblem `json:"problems,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// add counts result
+func (s *verifySummary) add(result *core.VerifyResult) {
+	s.Total++
+	switch result.Status {
+	case core.VerifyOK:
+		s.OK++
+	case core.VerifyCorrupt:
+		s.Corrupt++
+	case core.VerifyWrongKey:
+		s.WrongKey++
+	default:
+		s.BadFormat++
+	}
+	if result.Repairable != nil && *result.Repairable {
+		s.Repairable++
+	}
+}
+
+func runVerify(cmd *cobra.Command, args []string) error {
+	inputPath := args[0]
+
+	// Failed files are results, not misuse, so don't follow them with the usage
+	cmd.SilenceUsage = true
+
+	// A volume set may be named by the path it was split from
+	paths := []string{inputPath}
+	info, err := os.Stat(inputPath)
+	if err != nil {
+		if _, ok := core.VolumeSetBase(inputPath); !ok {
+			PrintError(fmt.Sprintf("Path does not exist: %s", inputPath))
+			return utils.NewError(utils.ErrFileNotFound.Code, fmt.Sprintf("Path does not exist: %s", inputPath), err)
+		}
+	} else if info.IsDir() {
+		paths, err = core.FindNokvaultFiles(inputPath)
+		if err != nil {
+			return fmt.Errorf("failed to find files: %w", err)
+		}
+	}
+
+	var trusted []*crypto.VerifyingKey
+	if verifySigners != "" {
+		trusted, err = loadTrustedSigners(verifySigners)
+		if err != nil {
+			return err
+		}
+	}
+
+	// A directory is also checked against its manifest, if it has one
+	hasManifest := info != nil && info.IsDir() && core.HasManifest(inputPath)
+
+	// Files that need a password and a keyfile record it in their header
+	twoFactor := false
+	if len(paths) == 1 {
+		if header, err := core.NewFileHandler().ReadHeaderFromFile(paths[0]); err == nil {
+			twoFactor = core.RequiresKeyfile(header)
+		}
+	}
+
+	var results []*core.VerifyResult
+	var manifest *verifyManifest
+	var signatures []*core.SignatureCheck
+	summary := &verifySummary{}
+	if len(paths) > 0 || hasManifest {
+		creds, err := resolveCredentials(verifyPassword, verifyKeyfile, verifyIdentities, verifyNoPrompt, twoFactor)
+		if err != nil {
+			return err
+		}
+		defer zeroizeCredentials(creds)
+
+		keyCache := core.NewKeyCache(keyCacheTTL(loadConfig()))
+		defer keyCache.Clear()
+
+		encryptionService := core.NewEncryptionService()
+		out := cmd.OutOrStdout()
+		for _, path := range paths {
+			result := encryptionService.VerifyFile(path, creds, keyCache)
+			results = append(results, result)
+			summary.add(result)
+			if !verifyJSON {
+				printVerifyResult(out, result)
+			}
+		}
+
+		if hasManifest {
+			manifest = &verifyManifest{}
+			check, err := encryptionService.CheckManifest(inputPath, creds, keyCache)
+			if err != nil {
+				manifest.Error = err.Error()
+				summary.ManifestProblems++
+			} else {
+				manifest.Generation = check.Generation
+				manifest.Problems = check.Problems
+				summary.ManifestProblems += len(check.Problems)
+			}
+			if !verifyJSON {
+				printVerifyManifest(out, manifest)
+			}
+		}
+	}
+
+	if trusted != nil {
+		signatures, err = core.CheckSignatures(inputPath, trusted)
+		if err != nil {
+			return err
+		}
+		for _, check := range signatures {
+			if !check.OK() {
+				summary.SignatureProblems++
+			}
+			if !verifyJSON {
+				printSignatureCheck(cmd.OutOrStdout(), check)
+			}
+		}
+	}
+
+	if verifyJSON {
+		if err := printVerifyJSON(cmd.OutOrStdout(), results, manifest, signatures, summary); err != nil {
+			return err
+		}
+	}
+
+	if summary.OK < summary.Total {
+		message := fmt.Sprintf("%d of %d files failed verification (%d corrupt, %d wrong key, %d bad format)", summary.Total-summary.OK, summary.Total, summary.Corrupt, summary.WrongKey, summary.BadFormat)
+		if summary.Repairable > 0 {
+			return utils.NewErrorWithHint(utils.ErrVerification.Code, message, nil, fmt.Sprintf("%d damaged files can be rebuilt from their parity with 'nokvault repair %s'.", summary.Repairable, inputPath))
+		}
+		return utils.NewError(utils.ErrVerification.Code, message, nil)
+	}
+	if summary.ManifestProblems > 0 {
+		return utils.NewError(utils.ErrVerification.Code, fmt.Sprintf("Manifest check of %s failed (problems: %d)", inputPath, summary.ManifestProblems), core.ErrManifestMismatch)
+	}
+	if summary.SignatureProblems > 0 {
+		return utils.NewErrorWithHint(utils.ErrVerification.Code, fmt.Sprintf("Signature check of %s failed (problems: %d)", inputPath, summary.SignatureProblems), nil, "Sign files with 'nokvault encrypt --sign-key', and list the verifying keys of everyone allowed to write them in the trusted signers file.")
+	}
+	if !verifyJSON {
+		if summary.Total == 0 {
+			PrintInfo("No nokvault files found")
+		} else {
+			PrintSuccess(fmt.Sprintf("Verified %d files: all ok", summary.Total))
+		}
+	}
+	return nil
+}
+
+// printVerifyResult prints the outcome of verifying a file on one line
+func printVerifyResult(out io.Writer, result *core.VerifyResult) {
+	if result.OK() {
+		fmt.Fprintf(out, "%-11s %s\n", strings.ToUpper(result.Status), result.Path)
+		return
+	}
+	fmt.Fprintf(out, "%-11s %s: %s\n", strings.ToUpper(result.Status), result.Path, result.Error)
+	if result.Repairable != nil {
+		if *result.Repairable {
+			fmt.Fprintf(out, "%-11s %s can be rebuilt with 'nokvault repair'\n", "PARITY", result.Path)
+		} else {
+			fmt.Fprintf(out, "%-11s %s is too damaged for its parity to rebuild\n", "PARITY", result.Path)
+		}
+	}
+}
+
+// printVerifyManifest prints the outcome of checking a directory against its
+// manifest, one line per problem
+func printVerifyManifest(out io.Writer, manifest *verifyManifest) {
+	switch {
+	case manifest.Error != "":
+		fmt.Fprintf(out, "%-11s %s\n", "MANIFEST", manifest.Error)
+	case len(manifest.Problems) == 0:
+		fmt.Fprintf(out, "%-11s generation %d matches\n", "MANIFEST", manifest.Generation)
+	default:
+		for _, problem := range manifest.Problems {
+			fmt.Fprintf(out, "%-11s %s: %s\n", strings.ToUpper(problem.Kind), problem.Path, problem.Detail)
+		}
+		fmt.Fprintf(out, "%-11s generation %d does not match\n", "MANIFEST", manifest.Generation)
+	}
+}
+
+// printSignatureCheck prints the outcome of checking a file's signature on one line
+func printSignatureCheck(out io.Writer, check *core.SignatureCheck) {
+	switch check.Status {
+	case core.SignatureValid:
+		fmt.Fprintf(out, "%-11s %s: signed by %s\n", "SIGNATURE", check.Path, check.Signer)
+	case core.SignatureMissing:
+		fmt.Fprintf(out, "%-11s %s: not signed\n", "SIGNATURE", check.Path)
+	case core.SignatureUnknownSigner:
+		fmt.Fprintf(out, "%-11s %s: signed by an unknown signer %s\n", "SIGNATURE", check.Path, check.Signer)
+	default:
+		fmt.Fprintf(out, "%-11s %s: invalid: %s\n", "SIGNATURE", check.Path, check.Error)
+	}
+}
+
+// printVerifyJSON prints the results, the manifest check of a directory if
+// there was one, the signature checks if any and their summary as JSON
+func printVerifyJSON(out io.Writer, results []*core.VerifyResult, manifest *verifyManifest, signatures []*core.SignatureCheck, summary *verifySummary) error {
+	if results == nil {
+		results = []*core.VerifyResult{}
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(struct {
+		Files      []*core.VerifyResult   `json:"files"`
+		Manifest   *verifyManifest        `json:"manifest,omitempty"`
+		Signatures []*core.SignatureCheck `json:"signatures,omitempty"`
+		Summary    *verifySummary         `json:"summary"`
+	}{results, manifest, signatures, summary})
+	if err != nil {
+		return fmt.Errorf("failed to encode results: %w", err)
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -37,6 +38,7 @@ var (
 	watchPassword    string
 	watchKeyfile     string
 	watchNoPrompt    bool
+	watchRecipients  []string
 )
 
 func init() {
@@ -48,6 +50,7 @@ func init() {
 	watchCmd.Flags().StringVarP(&watchPassword, "password", "p", "", "Encryption password")
 	watchCmd.Flags().StringVarP(&watchKeyfile, "keyfile", "k", "", "Path to keyfile")
 	watchCmd.Flags().BoolVar(&watchNoPrompt, "no-prompt", false, "Don't prompt for password")
+	watchCmd.Flags().StringArrayVarP(&watchRecipients, "recipient", "r", nil, "Encrypt to a public key or recipients file (repeatable)")
 
 	rootCmd.AddCommand(watchCmd)
 }
@@ -83,25 +86,21 @@ func runWatch(cmd *cobra.Command, args []string) error {
 
 	// Setup auto-encrypt if enabled
 	if watchAutoEncrypt {
-		encryptionService := core.NewEncryptionService()
-		keyManager := encryptionService.GetKeyManager()
-
-		// Get password/key
-		password, err := utils.GetPassword(watchPassword, watchKeyfile, watchNoPrompt, false)
+		encryptionService, err := newEncryptionService(loadConfig())
 		if err != nil {
-			return fmt.Errorf("failed to get password: %w", err)
+			return err
 		}
-		defer utils.ZeroizePassword(password)
+		keyManager := encryptionService.GetKeyManager()
 
-		// Derive key (we'll use the same key for all files)
-		key, salt, err := keyManager.DeriveKeyFromPassword(password)
+		// Get the password or public keys (we'll use the same ones for all files)
+		recipients, err := resolveRecipients(keyManager, watchRecipients, watchPassword, watchKeyfile, watchNoPrompt, false, false)
 		if err != nil {
-			return fmt.Errorf("failed to derive key: %w", err)
+			return fmt.Errorf("failed to get password: %w", err)
 		}
-		defer utils.ZeroizeKey(key)
+		defer utils.ZeroizeKey(recipients.Key)
 
 		// Setup encryption callback
-		encryptCallback := createEncryptCallback(encryptionService, key, salt, watchDelay, watchExclude, watchVerbose)
+		encryptCallback := createEncryptCallback(encryptionService, recipients, watchDelay, watchExclude, watchVerbose)
 
 		if info.IsDir() {
 			watcher.OnEvent(watchPath, encryptCallback)
@@ -131,7 +130,7 @@ func runWatch(cmd *cobra.Command, args []string) error {
 // createEncryptCallback creates a callback function for auto-encryption
 func createEncryptCallback(
 	encryptionService *core.EncryptionService,
-	key, salt []byte,
+	recipients *core.Recipients,
 	delay time.Duration,
 	excludePatterns []string,
 	verbose bool,
@@ -172,8 +171,11 @@ func createEncryptCallback(
 			return
 		}
 
-		// Skip if already encrypted
-		if filepath.Ext(filePath) == ".nokvault" {
+		// Skip if already encrypted, or the parity or signature of an encrypted file
+		if ext := filepath.Ext(filePath); ext == ".nokvault" || ext == core.ParitySuffix {
+			return
+		}
+		if strings.HasSuffix(filePath, ".nokvault"+core.SignatureSuffix) {
 			return
 		}
 
@@ -190,7 +192,7 @@ func createEncryptCallback(
 			mu.Lock()
 			delete(pendingEncryptions, filePath)
 			mu.Unlock()
-			encryptFileAuto(filePath, encryptionService, key, salt, verbose)
+			encryptFileAuto(filePath, encryptionService, recipients, verbose)
 		})
 
 		pendingEncryptions[filePath] = timer
@@ -203,29 +205,11 @@ func createEncryptCallback(
 }
 
 // encryptFileAuto encrypts a file automatically (helper for watch callback)
-func encryptFileAuto(filePath string, encryptionService *core.EncryptionService, key, salt []byte, verbose bool) {
+func encryptFileAuto(filePath string, encryptionService *core.EncryptionService, recipients *core.Recipients, verbose bool) {
 	outputPath := filePath + ".nokvault"
 
-	fileHandler := core.NewFileHandler()
-	metadata, err := fileHandler.ReadMetadata(filePath)
-	if err != nil {
-		if verbose {
-			PrintError(fmt.Sprintf("Failed to read metadata for %s: %v", filePath, err))
-		}
-		return
-	}
-
-	// Read file data
-	data, err := os.ReadFile(filePath)
-	if err != nil {
-		if verbose {
-			PrintError(fmt.Sprintf("Failed to read file %s: %v", filePath, err))
-		}
-		return
-	}
-
-	// Encrypt data
-	ciphertext, err := encryptionService.EncryptData(data, key)
+	err := encryptionService.EncryptFileForRecipients(filePath, outputPath, recipients, false)
+	recordAudit(core.AuditEncrypt, "watch", filePath, err)
 	if err != nil {
 		if verbose {
 			PrintError(fmt.Sprintf("Encryption failed for %s: %v", filePath, err))
@@ -233,31 +217,5 @@ func encryptFileAuto(filePath string, encryptionService *core.EncryptionService,
 		return
 	}
 
-	// Create output file
-	outputFile, err := os.Create(outputPath)
-	if err != nil {
-		if verbose {
-			PrintError(fmt.Sprintf("Failed to create output file %s: %v", outputPath, err))
-		}
-		return
-	}
-	defer outputFile.Close()
-
-	// Write header with metadata
-	if err := fileHandler.WriteHeader(outputFile, salt, metadata); err != nil {
-		if verbose {
-			PrintError(fmt.Sprintf("Failed to write header for %s: %v", outputPath, err))
-		}
-		return
-	}
-
-	// Write encrypted data
-	if _, err := outputFile.Write(ciphertext); err != nil {
-		if verbose {
-			PrintError(fmt.Sprintf("Failed to write encrypted data for %s: %v", outputPath, err))
-		}
-		return
-	}
-
 	PrintSuccess(fmt.Sprintf("Auto-encrypted: %s -> %s", filePath, outputPath))
 }
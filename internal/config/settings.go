@@ -11,38 +11,44 @@ import (
 
 // Config holds the application configuration
 type Config struct {
-	Encryption    EncryptionConfig    `toml:"encryption"`
-	KeyDerivation KeyDerivationConfig `toml:"key_derivation"`
-	Security      SecurityConfig      `toml:"security"`
-	Paths         PathsConfig         `toml:"paths"`
+	Encryption    EncryptionConfig    `toml:"encryption" mapstructure:"encryption"`
+	KeyDerivation KeyDerivationConfig `toml:"key_derivation" mapstructure:"key_derivation"`
+	Security      SecurityConfig      `toml:"security" mapstructure:"security"`
+	Paths         PathsConfig         `toml:"paths" mapstructure:"paths"`
 }
 
 // EncryptionConfig holds encryption settings
 type EncryptionConfig struct {
-	Algorithm        string `toml:"algorithm"`         // "aes256gcm" or "chacha20"
-	Compression      bool   `toml:"compression"`       // Enable compression before encryption
-	PreserveMetadata bool   `toml:"preserve_metadata"` // Preserve file metadata
+	Algorithm        string `toml:"algorithm" mapstructure:"algorithm"`                 // "aes256gcm", "chacha20" or "xchacha20"
+	Compression      bool   `toml:"compression" mapstructure:"compression"`             // Enable compression before encryption
+	PreserveMetadata bool   `toml:"preserve_metadata" mapstructure:"preserve_metadata"` // Preserve file metadata
+	EncryptNames     bool   `toml:"encrypt_names" mapstructure:"encrypt_names"`         // Hide file and directory names in directory mode
+	Padding          bool   `toml:"padding" mapstructure:"padding"`                     // Pad new files to hide the size of their contents
+	PaddingScheme    string `toml:"padding_scheme" mapstructure:"padding_scheme"`       // "padme" or "buckets"
+	Parity           int    `toml:"parity" mapstructure:"parity"`                       // Parity written beside new files, in percent of their size (0 for none)
 }
 
 // KeyDerivationConfig holds key derivation settings
 type KeyDerivationConfig struct {
-	Algorithm   string `toml:"algorithm"`   // "argon2id"
-	MemoryCost  uint32 `toml:"memory_cost"` // Memory cost in KB
-	TimeCost    uint32 `toml:"time_cost"`   // Time cost
-	Parallelism uint8  `toml:"parallelism"` // Parallelism factor
+	Algorithm   string `toml:"algorithm" mapstructure:"algorithm"`     // "argon2id"
+	MemoryCost  uint32 `toml:"memory_cost" mapstructure:"memory_cost"` // Memory cost in KB
+	TimeCost    uint32 `toml:"time_cost" mapstructure:"time_cost"`     // Time cost
+	Parallelism uint8  `toml:"parallelism" mapstructure:"parallelism"` // Parallelism factor
 }
 
 // SecurityConfig holds security settings
 type SecurityConfig struct {
-	SecureDelete    bool `toml:"secure_delete"`     // Enable secure deletion
-	DeletePasses    int  `toml:"delete_passes"`     // Number of overwrite passes
-	KeyCacheTimeout int  `toml:"key_cache_timeout"` // Key cache timeout in seconds
+	SecureDelete    bool `toml:"secure_delete" mapstructure:"secure_delete"`         // Enable secure deletion
+	DeletePasses    int  `toml:"delete_passes" mapstructure:"delete_passes"`         // Number of overwrite passes
+	KeyCacheTimeout int  `toml:"key_cache_timeout" mapstructure:"key_cache_timeout"` // Key cache timeout in seconds
+	AuditLog        bool `toml:"audit_log" mapstructure:"audit_log"`                 // Record operations in the audit log
 }
 
 // PathsConfig holds path-related settings
 type PathsConfig struct {
-	DefaultKeyfile string `toml:"default_keyfile"` // Default keyfile path
-	BackupDir      string `toml:"backup_dir"`      // Backup directory
+	DefaultKeyfile string `toml:"default_keyfile" mapstructure:"default_keyfile"` // Default keyfile path
+	BackupDir      string `toml:"backup_dir" mapstructure:"backup_dir"`           // Backup directory
+	AuditLog       string `toml:"audit_log" mapstructure:"audit_log"`             // Audit log path (default: audit.log in the config directory)
 }
 
 // DefaultConfig returns a configuration with default values
@@ -52,6 +58,10 @@ func DefaultConfig() *Config {
 			Algorithm:        "aes256gcm",
 			Compression:      false,
 			PreserveMetadata: true,
+			EncryptNames:     false,
+			Padding:          false,
+			PaddingScheme:    "padme",
+			Parity:           0,
 		},
 		KeyDerivation: KeyDerivationConfig{
 			Algorithm:   "argon2id",
@@ -63,6 +73,7 @@ func DefaultConfig() *Config {
 			SecureDelete:    false,
 			DeletePasses:    3,
 			KeyCacheTimeout: 300, // 5 minutes
+			AuditLog:        true,
 		},
 		Paths: PathsConfig{
 			DefaultKeyfile: "",
@@ -171,3 +182,8 @@ func getConfigDir() string {
 func GetConfigPath() string {
 	return filepath.Join(getConfigDir(), "config.toml")
 }
+
+// GetAuditLogPath returns the default path of the audit log
+func GetAuditLogPath() string {
+	return filepath.Join(getConfigDir(), "audit.log")
+}
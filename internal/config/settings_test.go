@@ -69,6 +69,23 @@ func TestConfigManager_Save_Load(t *testing.T) {
 	require.NotNil(t, loadedConfig, "Loaded config should not be nil")
 }
 
+func TestConfigManager_Load_LocalConfig(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	local := "[encryption]\nencrypt_names = true\npadding = true\npadding_scheme = \"buckets\"\n\n[key_derivation]\nmemory_cost = 32768\n\n[security]\nkey_cache_timeout = 60\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".nokvault.toml"), []byte(local), 0644))
+
+	cm := NewConfigManager()
+	require.NoError(t, cm.Load(), "Failed to load config")
+
+	config := cm.Get()
+	assert.True(t, config.Encryption.EncryptNames, "Keys with underscores should be loaded")
+	assert.True(t, config.Encryption.Padding)
+	assert.Equal(t, "buckets", config.Encryption.PaddingScheme)
+	assert.Equal(t, uint32(32768), config.KeyDerivation.MemoryCost)
+	assert.Equal(t, 60, config.Security.KeyCacheTimeout)
+}
+
 func TestConfigManager_SetConfig(t *testing.T) {
 	cm := NewConfigManager()
 
@@ -0,0 +1,606 @@
+package core
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jimididit/nokvault/internal/crypto"
+)
+
+// Payload content types recorded in the format parameters
+const (
+	// ContentFile marks a payload holding the contents of a single file
+	ContentFile = ""
+	// ContentArchive marks a payload holding a directory archive
+	ContentArchive = "archive"
+	// ContentNameMap marks a payload holding the name map of a directory
+	// encrypted with hidden names
+	ContentNameMap = "names"
+	// ContentRepository marks a payload holding the keys of a snapshot
+	// repository
+	ContentRepository = "repository"
+	// ContentManifest marks a payload holding the manifest of an encrypted
+	// directory
+	ContentManifest = "manifest"
+
+	// archiveIndexName names the index, the first member of every archive
+	archiveIndexName = "NOKVAULT-INDEX.json"
+	// maxArchiveIndexSize limits the index read from an archive
+	maxArchiveIndexSize = 64 * 1024 * 1024
+)
+
+// ErrNotArchive is returned when a nokvault file holds a single file instead
+// of a directory archive
+var ErrNotArchive = errors.New("not a nokvault archive")
+
+// IsArchive reports whether the header belongs to a directory archive
+func IsArchive(header *NokvaultHeader) bool {
+	return header.Params != nil && header.Params.Content == ContentArchive
+}
+
+// ArchiveIndex lists the entries of a directory archive in the order they are
+// stored. RelativePath uses forward slashes on every platform.
+type ArchiveIndex struct {
+	Entries []FileMetadata `json:"entries"`
+}
+
+// Archiver packs directory trees into single encrypted archives and extracts them.
+// The payload is a tar stream whose first member is the JSON index, followed
+// by every directory and regular file of the tree with its mode and timestamp.
+// The whole stream is encrypted as one unit, so the archive reveals nothing
+// about the tree but its total size.
+type Archiver struct {
+	encryptionService *EncryptionService
+	fileHandler       *FileHandler
+	verbose           bool
+	compress          bool
+	filter            *PathFilter
+	onWarning         func(message string)
+}
+
+// NewArchiver creates a new archiver
+func NewArchiver(encryptionService *EncryptionService, verbose bool) *Archiver {
+	return &Archiver{
+		encryptionService: encryptionService,
+		fileHandler:       NewFileHandler(),
+		verbose:           verbose,
+		compress:          false,
+	}
+}
+
+// SetCompression enables or disables compression
+func (a *Archiver) SetCompression(compress bool) {
+	a.compress = compress
+}
+
+// SetFilter restricts extraction to the entries selected by filter; nil
+// extracts everything
+func (a *Archiver) SetFilter(filter *PathFilter) {
+	a.filter = filter
+}
+
+// SetOnWarning sets the function told about special files skipped in verbose
+// mode, such as sockets and devices
+func (a *Archiver) SetOnWarning(onWarning func(message string)) {
+	a.onWarning = onWarning
+}
+
+// BuildIndex walks inputDir and lists the directories, regular files and
+// symbolic links an archive of it would hold. Symbolic links are stored as
+// their targets, never followed. Other file types are skipped, as are
+// skipPath and the volumes split from it.
+func (a *Archiver) BuildIndex(inputDir, skipPath string) (*ArchiveIndex, error) {
+	skipAbs := ""
+	if skipPath != "" {
+		abs, err := filepath.Abs(skipPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve path: %w", err)
+		}
+		skipAbs = abs
+	}
+
+	index := &ArchiveIndex{}
+	err := a.fileHandler.WalkDirectory(inputDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("error accessing %s: %w", path, err)
+		}
+
+		relPath, err := a.fileHandler.GetRelativePath(inputDir, path)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path: %w", err)
+		}
+		if relPath == "." {
+			return nil
+		}
+
+		if skipAbs != "" {
+			if abs, err := filepath.Abs(path); err == nil && (abs == skipAbs || isVolumeOf(abs, skipAbs)) {
+				return nil
+			}
+		}
+
+		isSymlink := info.Mode()&os.ModeSymlink != 0
+		if !info.IsDir() && !isSymlink && !info.Mode().IsRegular() {
+			if a.verbose && a.onWarning != nil {
+				a.onWarning(fmt.Sprintf("Skipping special file %s", relPath))
+			}
+			return nil
+		}
+
+		entry := FileMetadata{
+			Name:         info.Name(),
+			Mode:         uint32(info.Mode()),
+			ModTime:      info.ModTime(),
+			IsDir:        info.IsDir(),
+			RelativePath: filepath.ToSlash(relPath),
+		}
+		switch {
+		case isSymlink:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return fmt.Errorf("failed to read link %s: %w", relPath, err)
+			}
+			entry.Symlink = target
+		case !info.IsDir():
+			entry.Size = info.Size()
+		}
+		index.Entries = append(index.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return index, nil
+}
+
+// FileCount returns the number of files and symbolic links in the index
+func (idx *ArchiveIndex) FileCount() int {
+	count := 0
+	for _, entry := range idx.Entries {
+		if !entry.IsDir {
+			count++
+		}
+	}
+	return count
+}
+
+// TotalSize returns the combined size of the files in the index
+func (idx *ArchiveIndex) TotalSize() int64 {
+	var total int64
+	for _, entry := range idx.Entries {
+		total += entry.Size
+	}
+	return total
+}
+
+// EncryptArchive packs inputDir into a single encrypted archive at outputPath,
+// with a key slot for each of the recipients. onProgress is called for every
+// file as it is added.
+func (a *Archiver) EncryptArchive(inputDir, outputPath string, recipients *Recipients, onProgress func(current, total int, currentFile string)) error {
+	dirInfo, err := os.Stat(inputDir)
+	if err != nil {
+		return fmt.Errorf("failed to stat directory: %w", err)
+	}
+	if !dirInfo.IsDir() {
+		return fmt.Errorf("%s is not a directory", inputDir)
+	}
+
+	// The output may be inside the tree, and must not archive itself
+	index, err := a.BuildIndex(inputDir, outputPath)
+	if err != nil {
+		return err
+	}
+
+	metadata := &FileMetadata{
+		Name:         dirInfo.Name(),
+		Size:         index.TotalSize(),
+		Mode:         uint32(dirInfo.Mode()),
+		ModTime:      dirInfo.ModTime(),
+		IsDir:        true,
+		RelativePath: dirInfo.Name(),
+	}
+
+	params := a.encryptionService.NewFormatParams()
+	params.Content = ContentArchive
+	if a.compress {
+		params.Compression = CompressionGzip
+	}
+
+	fileKey, err := crypto.GenerateKey()
+	if err != nil {
+		return err
+	}
+	defer zeroizeKey(fileKey)
+
+	slots, err := a.encryptionService.keyManager.NewKeySlots(recipients, fileKey, params.Cipher)
+	if err != nil {
+		return err
+	}
+
+	header, err := a.fileHandler.NewHeader(params, metadata, fileKey, slots)
+	if err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+
+	outputFile, err := a.encryptionService.createOutput(outputPath)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	if err := a.fileHandler.WriteRawHeader(outputFile, header); err != nil {
+		outputFile.Remove()
+		return err
+	}
+
+	// The tar stream is produced on the fly and fed to the stream encryptor
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		pipeWriter.CloseWithError(a.writeTar(pipeWriter, inputDir, index, onProgress))
+	}()
+
+	err = a.encryptionService.EncryptPayload(outputFile, pipeReader, fileKey, header)
+	pipeReader.CloseWithError(err)
+	if err == nil {
+		err = outputFile.Close()
+	}
+	if err != nil {
+		outputFile.Remove()
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+
+	return a.encryptionService.finishOutput(outputPath)
+}
+
+// writeTar writes the index and then every entry of index to writer as a tar stream
+func (a *Archiver) writeTar(writer io.Writer, inputDir string, index *ArchiveIndex, onProgress func(current, total int, currentFile string)) error {
+	tw := tar.NewWriter(writer)
+
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("failed to serialize archive index: %w", err)
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     archiveIndexName,
+		Mode:     0600,
+		Size:     int64(len(indexJSON)),
+		Format:   tar.FormatPAX,
+	}); err != nil {
+		return fmt.Errorf("failed to write archive index: %w", err)
+	}
+	if _, err := tw.Write(indexJSON); err != nil {
+		return fmt.Errorf("failed to write archive index: %w", err)
+	}
+
+	total := index.FileCount()
+	current := 0
+	for i := range index.Entries {
+		entry := &index.Entries[i]
+		hdr := &tar.Header{
+			Name:    entry.RelativePath,
+			Mode:    int64(os.FileMode(entry.Mode).Perm()),
+			ModTime: entry.ModTime,
+			Format:  tar.FormatPAX,
+		}
+
+		if entry.IsDir {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+			if err := tw.WriteHeader(hdr); err != nil {
+				return fmt.Errorf("failed to write %s: %w", entry.RelativePath, err)
+			}
+			continue
+		}
+
+		current++
+		if onProgress != nil {
+			onProgress(current, total, entry.RelativePath)
+		}
+
+		if entry.Symlink != "" {
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = entry.Symlink
+			if err := tw.WriteHeader(hdr); err != nil {
+				return fmt.Errorf("failed to write %s: %w", entry.RelativePath, err)
+			}
+			continue
+		}
+
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = entry.Size
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write %s: %w", entry.RelativePath, err)
+		}
+		if err := a.copyFile(tw, filepath.Join(inputDir, filepath.FromSlash(entry.RelativePath)), entry.Size); err != nil {
+			return fmt.Errorf("failed to archive %s: %w", entry.RelativePath, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to finish archive: %w", err)
+	}
+	return nil
+}
+
+// copyFile copies exactly size bytes of the file at path to writer, failing
+// if the file changed size since it was indexed
+func (a *Archiver) copyFile(writer io.Writer, path string, size int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.CopyN(writer, file, size); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("file shrank while being archived")
+		}
+		return err
+	}
+
+	var extra [1]byte
+	if n, _ := file.Read(extra[:]); n > 0 {
+		return fmt.Errorf("file grew while being archived")
+	}
+	return nil
+}
+
+// DecryptArchive extracts the archive at inputPath into outputDir, unlocking
+// it with creds, and returns the index of the extracted entries and the
+// metadata of the archived directory. Entries the filter does not select are
+// read past without being written. onProgress is called for every file as it
+// is extracted.
+func (a *Archiver) DecryptArchive(inputPath, outputDir string, creds *Credentials, onProgress func(current, total int, currentFile string)) (*ArchiveIndex, *FileMetadata, error) {
+	reader, metadata, err := a.openArchive(inputPath, creds)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.Close()
+
+	index, err := reader.readIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := a.fileHandler.EnsureDirectory(outputDir); err != nil {
+		return nil, nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	selected := &ArchiveIndex{}
+	for i := range index.Entries {
+		if a.filter.Match(index.Entries[i].RelativePath) {
+			selected.Entries = append(selected.Entries, index.Entries[i])
+		}
+	}
+
+	total := selected.FileCount()
+	current := 0
+	var symlinks []*FileMetadata
+	for i := range index.Entries {
+		entry := &index.Entries[i]
+		hdr, err := reader.tar.Next()
+		if err == io.EOF {
+			return nil, nil, fmt.Errorf("archive ends before %s", entry.RelativePath)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+		if err := checkArchiveEntry(hdr, entry); err != nil {
+			return nil, nil, err
+		}
+		if !a.filter.Match(entry.RelativePath) {
+			continue
+		}
+
+		target := filepath.Join(outputDir, filepath.FromSlash(entry.RelativePath))
+		if entry.IsDir {
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return nil, nil, fmt.Errorf("failed to create directory %s: %w", entry.RelativePath, err)
+			}
+			continue
+		}
+
+		current++
+		if onProgress != nil {
+			onProgress(current, total, entry.RelativePath)
+		}
+
+		// Links are created once every file is written, so no file is
+		// written through a link restored from the archive
+		if entry.Symlink != "" {
+			symlinks = append(symlinks, entry)
+			continue
+		}
+
+		if err := a.extractFile(reader.tar, target, entry); err != nil {
+			return nil, nil, fmt.Errorf("failed to extract %s: %w", entry.RelativePath, err)
+		}
+	}
+
+	if _, err := reader.tar.Next(); err != io.EOF {
+		return nil, nil, fmt.Errorf("archive has entries missing from its index")
+	}
+
+	for _, entry := range symlinks {
+		target, err := prepareRestorePath(outputDir, entry.RelativePath)
+		if err == nil {
+			err = a.fileHandler.CreateEntry(target, entry)
+		}
+		if err == nil {
+			err = a.fileHandler.WriteMetadata(target, entry)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to restore %s: %w", entry.RelativePath, err)
+		}
+	}
+
+	// Directory modes and times are restored last, deepest first, so that
+	// extracting their contents neither fails on read-only directories nor
+	// updates their modification times
+	for i := len(selected.Entries) - 1; i >= 0; i-- {
+		entry := &selected.Entries[i]
+		if !entry.IsDir {
+			continue
+		}
+		target := filepath.Join(outputDir, filepath.FromSlash(entry.RelativePath))
+		if err := a.fileHandler.WriteMetadata(target, entry); err != nil {
+			return nil, nil, fmt.Errorf("failed to restore %s: %w", entry.RelativePath, err)
+		}
+	}
+
+	return selected, metadata, nil
+}
+
+// ReadArchiveIndex unlocks the archive at inputPath with creds and returns its
+// index, without extracting any files
+func (a *Archiver) ReadArchiveIndex(inputPath string, creds *Credentials) (*ArchiveIndex, error) {
+	reader, _, err := a.openArchive(inputPath, creds)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return reader.readIndex()
+}
+
+// extractFile writes the current tar member to target and restores its mode
+// and modification time
+func (a *Archiver) extractFile(tr *tar.Reader, target string, entry *FileMetadata) error {
+	if err := a.fileHandler.EnsureDirectory(filepath.Dir(target)); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, tr); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return a.fileHandler.WriteMetadata(target, entry)
+}
+
+// archiveReader reads the decrypted tar stream of an archive
+type archiveReader struct {
+	file      io.ReadSeekCloser
+	plaintext io.ReadCloser
+	tar       *tar.Reader
+}
+
+// Close closes the archive
+func (r *archiveReader) Close() error {
+	r.plaintext.Close()
+	return r.file.Close()
+}
+
+// readIndex reads the index, which must be the first member of the archive
+func (r *archiveReader) readIndex() (*ArchiveIndex, error) {
+	hdr, err := r.tar.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive index: %w", err)
+	}
+	if hdr.Name != archiveIndexName || hdr.Typeflag != tar.TypeReg {
+		return nil, fmt.Errorf("archive does not start with an index")
+	}
+	if hdr.Size > maxArchiveIndexSize {
+		return nil, fmt.Errorf("archive index too large: %d bytes", hdr.Size)
+	}
+
+	indexJSON, err := io.ReadAll(r.tar)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive index: %w", err)
+	}
+	index := &ArchiveIndex{}
+	if err := json.Unmarshal(indexJSON, index); err != nil {
+		return nil, fmt.Errorf("failed to deserialize archive index: %w", err)
+	}
+
+	for i := range index.Entries {
+		if err := checkArchivePath(index.Entries[i].RelativePath); err != nil {
+			return nil, err
+		}
+	}
+	return index, nil
+}
+
+// openArchive opens the archive at inputPath and unlocks it with creds
+func (a *Archiver) openArchive(inputPath string, creds *Credentials) (*archiveReader, *FileMetadata, error) {
+	file, err := openEncryptedFile(inputPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open input file: %w", err)
+	}
+
+	header, _, err := a.fileHandler.ReadHeaderWithMetadata(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	if !IsArchive(header) {
+		file.Close()
+		return nil, nil, ErrNotArchive
+	}
+
+	fileKey, _, err := a.encryptionService.keyManager.UnlockFileKey(header, creds, nil)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	defer zeroizeKey(fileKey)
+
+	metadata, err := header.OpenMetadata(fileKey)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	if _, err := file.Seek(int64(header.DataOffset), io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to seek to encrypted data: %w", err)
+	}
+
+	plaintext, err := a.encryptionService.NewPlaintextReader(file, header, fileKey)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return &archiveReader{file: file, plaintext: plaintext, tar: tar.NewReader(plaintext)}, metadata, nil
+}
+
+// checkArchiveEntry checks that a tar member matches the index entry it should hold
+func checkArchiveEntry(hdr *tar.Header, entry *FileMetadata) error {
+	name := strings.TrimSuffix(hdr.Name, "/")
+	if name != entry.RelativePath {
+		return fmt.Errorf("archive entry %s does not match its index entry %s", name, entry.RelativePath)
+	}
+
+	switch {
+	case entry.IsDir && hdr.Typeflag == tar.TypeDir:
+	case entry.Symlink != "" && hdr.Typeflag == tar.TypeSymlink && hdr.Linkname == entry.Symlink:
+	case entry.IsRegular() && hdr.Typeflag == tar.TypeReg && hdr.Size == entry.Size:
+	default:
+		return fmt.Errorf("archive entry %s does not match its index entry", entry.RelativePath)
+	}
+	return nil
+}
+
+// checkArchivePath rejects archive paths that would escape the output directory
+func checkArchivePath(path string) error {
+	if path == "" || !filepath.IsLocal(filepath.FromSlash(path)) || strings.Contains(path, "\\") {
+		return fmt.Errorf("unsafe path in archive: %q", path)
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestArchiver returns an archiver with fast key derivation and the key
+// and salt of password
+func newTestArchiver(t *testing.T, password []byte) (*Archiver, *Recipients) {
+	service := NewEncryptionService()
+	service.GetKeyManager().SetParams(8*1024, 1, 1, 32)
+	key, salt, err := service.GetKeyManager().DeriveKeyFromPassword(password)
+	require.NoError(t, err, "Failed to derive key")
+	return NewArchiver(service, false), &Recipients{Key: key, Salt: salt}
+}
+
+func TestArchiver_RoundTrip(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		password := []byte("archive-password")
+		archiver, recipients := newTestArchiver(t, password)
+		archiver.SetCompression(compress)
+
+		tmpDir := t.TempDir()
+		inputDir := filepath.Join(tmpDir, "project")
+		require.NoError(t, os.MkdirAll(filepath.Join(inputDir, "src", "pkg"), 0755))
+		require.NoError(t, os.MkdirAll(filepath.Join(inputDir, "empty"), 0750))
+		require.NoError(t, os.WriteFile(filepath.Join(inputDir, "README.md"), []byte("# project"), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(inputDir, "src", "pkg", "main.go"), []byte("package main"), 0600))
+		require.NoError(t, os.WriteFile(filepath.Join(inputDir, "src", "empty.txt"), nil, 0644))
+
+		modTime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+		require.NoError(t, os.Chtimes(filepath.Join(inputDir, "README.md"), modTime, modTime))
+		require.NoError(t, os.Chtimes(filepath.Join(inputDir, "empty"), modTime, modTime))
+
+		archivePath := filepath.Join(tmpDir, "project.nokvault")
+		var progress []string
+		err := archiver.EncryptArchive(inputDir, archivePath, recipients, func(current, total int, currentFile string) {
+			assert.Equal(t, 3, total)
+			progress = append(progress, currentFile)
+		})
+		require.NoError(t, err, "EncryptArchive should succeed (compress=%v)", compress)
+		assert.Equal(t, []string{"README.md", "src/empty.txt", "src/pkg/main.go"}, progress)
+
+		header, err := NewFileHandler().ReadHeaderFromFile(archivePath)
+		require.NoError(t, err, "Failed to read header")
+		assert.True(t, IsArchive(header), "Header should mark an archive")
+
+		creds := &Credentials{Password: password}
+		index, err := archiver.ReadArchiveIndex(archivePath, creds)
+		require.NoError(t, err, "ReadArchiveIndex should succeed")
+		assert.Len(t, index.Entries, 6, "Index should list every directory and file")
+		assert.Equal(t, 3, index.FileCount())
+
+		outputDir := filepath.Join(tmpDir, "restored")
+		_, metadata, err := archiver.DecryptArchive(archivePath, outputDir, creds, nil)
+		require.NoError(t, err, "DecryptArchive should succeed (compress=%v)", compress)
+		assert.Equal(t, "project", metadata.Name)
+
+		content, err := os.ReadFile(filepath.Join(outputDir, "src", "pkg", "main.go"))
+		require.NoError(t, err)
+		assert.Equal(t, "package main", string(content))
+		content, err = os.ReadFile(filepath.Join(outputDir, "src", "empty.txt"))
+		require.NoError(t, err)
+		assert.Empty(t, content)
+
+		info, err := os.Stat(filepath.Join(outputDir, "src", "pkg", "main.go"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "File mode should be restored")
+
+		info, err = os.Stat(filepath.Join(outputDir, "README.md"))
+		require.NoError(t, err)
+		assert.True(t, modTime.Equal(info.ModTime()), "File time should be restored")
+
+		info, err = os.Stat(filepath.Join(outputDir, "empty"))
+		require.NoError(t, err, "Empty directories should be restored")
+		assert.True(t, info.IsDir())
+		assert.Equal(t, os.FileMode(0750), info.Mode().Perm(), "Directory mode should be restored")
+		assert.True(t, modTime.Equal(info.ModTime()), "Directory time should be restored")
+	}
+}
+
+func TestArchiver_Symlinks(t *testing.T) {
+	password := []byte("archive-password")
+	archiver, recipients := newTestArchiver(t, password)
+
+	tmpDir := t.TempDir()
+	inputDir := filepath.Join(tmpDir, "project")
+	require.NoError(t, os.MkdirAll(filepath.Join(inputDir, "src"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "src", "main.go"), []byte("package main"), 0644))
+	require.NoError(t, os.Symlink("main.go", filepath.Join(inputDir, "src", "link.go")))
+	require.NoError(t, os.Symlink("src", filepath.Join(inputDir, "current")))
+
+	index, err := archiver.BuildIndex(inputDir, "")
+	require.NoError(t, err)
+	assert.Equal(t, 3, index.FileCount(), "Links should be counted with the files")
+
+	archivePath := filepath.Join(tmpDir, "project.nokvault")
+	require.NoError(t, archiver.EncryptArchive(inputDir, archivePath, recipients, nil))
+
+	outputDir := filepath.Join(tmpDir, "restored")
+	_, _, err = archiver.DecryptArchive(archivePath, outputDir, &Credentials{Password: password}, nil)
+	require.NoError(t, err, "DecryptArchive should succeed")
+
+	for relPath, target := range map[string]string{"src/link.go": "main.go", "current": "src"} {
+		link, err := os.Readlink(filepath.Join(outputDir, filepath.FromSlash(relPath)))
+		require.NoError(t, err, "%s should be restored as a link", relPath)
+		assert.Equal(t, target, link)
+	}
+	content, err := os.ReadFile(filepath.Join(outputDir, "current", "main.go"))
+	require.NoError(t, err)
+	assert.Equal(t, "package main", string(content))
+}
+
+func TestArchiver_WrongPassword(t *testing.T) {
+	archiver, recipients := newTestArchiver(t, []byte("archive-password"))
+
+	tmpDir := t.TempDir()
+	inputDir := filepath.Join(tmpDir, "input")
+	require.NoError(t, os.MkdirAll(inputDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "secret.txt"), []byte("secret"), 0644))
+
+	archivePath := filepath.Join(tmpDir, "input.nokvault")
+	require.NoError(t, archiver.EncryptArchive(inputDir, archivePath, recipients, nil))
+
+	outputDir := filepath.Join(tmpDir, "output")
+	_, _, err := archiver.DecryptArchive(archivePath, outputDir, &Credentials{Password: []byte("wrong-password")}, nil)
+	assert.Error(t, err, "Wrong password should fail")
+	_, err = os.Stat(filepath.Join(outputDir, "secret.txt"))
+	assert.True(t, os.IsNotExist(err), "Nothing should be extracted")
+}
+
+func TestArchiver_SetFilter(t *testing.T) {
+	password := []byte("archive-password")
+	archiver, recipients := newTestArchiver(t, password)
+
+	tmpDir := t.TempDir()
+	inputDir := filepath.Join(tmpDir, "input")
+	require.NoError(t, os.MkdirAll(filepath.Join(inputDir, "configs"), 0750))
+	require.NoError(t, os.MkdirAll(filepath.Join(inputDir, "data"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "configs", "app.yaml"), []byte("app"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "configs", "debug.log"), []byte("log"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "data", "big.bin"), []byte("data"), 0644))
+
+	archivePath := filepath.Join(tmpDir, "input.nokvault")
+	require.NoError(t, archiver.EncryptArchive(inputDir, archivePath, recipients, nil))
+
+	filter, err := NewPathFilter([]string{"configs/**"}, []string{"*.log"}, nil)
+	require.NoError(t, err)
+	archiver.SetFilter(filter)
+
+	outputDir := filepath.Join(tmpDir, "output")
+	var progress []string
+	index, _, err := archiver.DecryptArchive(archivePath, outputDir, &Credentials{Password: password}, func(current, total int, currentFile string) {
+		assert.Equal(t, 1, total)
+		progress = append(progress, currentFile)
+	})
+	require.NoError(t, err, "DecryptArchive should succeed")
+	assert.Equal(t, []string{"configs/app.yaml"}, progress)
+	assert.Equal(t, 1, index.FileCount(), "Index should list the extracted entries")
+
+	content, err := os.ReadFile(filepath.Join(outputDir, "configs", "app.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, "app", string(content))
+	assert.NoFileExists(t, filepath.Join(outputDir, "configs", "debug.log"))
+	assert.NoDirExists(t, filepath.Join(outputDir, "data"))
+
+	info, err := os.Stat(filepath.Join(outputDir, "configs"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), info.Mode().Perm(), "Selected directory mode should be restored")
+}
+
+func TestArchiver_NotArchive(t *testing.T) {
+	password := []byte("archive-password")
+	archiver, recipients := newTestArchiver(t, password)
+
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, "file.txt")
+	require.NoError(t, os.WriteFile(inputPath, []byte("single file"), 0644))
+	encryptedPath := inputPath + ".nokvault"
+	require.NoError(t, archiver.encryptionService.EncryptFileForRecipients(inputPath, encryptedPath, recipients, false))
+
+	_, err := archiver.ReadArchiveIndex(encryptedPath, &Credentials{Password: password})
+	assert.ErrorIs(t, err, ErrNotArchive)
+}
+
+func TestCheckArchivePath(t *testing.T) {
+	for _, path := range []string{"file.txt", "dir/file.txt", "a/b/c"} {
+		assert.NoError(t, checkArchivePath(path), "%s should be allowed", path)
+	}
+	for _, path := range []string{"", "../escape", "dir/../../escape", "/etc/passwd", "dir\\file"} {
+		assert.Error(t, checkArchivePath(path), "%s should be rejected", path)
+	}
+}
@@ -0,0 +1,413 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The audit log records the operations run on a machine, one JSON record per
+// line. Every record holds the hash of the one before it, so editing,
+// removing or reordering records breaks the chain, and a head file beside the
+// log holds the number and hash of the last record, so cutting records off
+// the end is caught too. Paths are only recorded as hashes.
+
+const (
+	// auditHeadSuffix is appended to the path of the log to name its head file
+	auditHeadSuffix = ".head"
+	// auditLockSuffix is appended to the path of the log to name its lock file
+	auditLockSuffix = ".lock"
+	// auditLockTimeout is how long an append waits for another one to finish
+	auditLockTimeout = 5 * time.Second
+)
+
+// Operations recorded in the audit log
+const (
+	AuditEncrypt      = "encrypt"
+	AuditDecrypt      = "decrypt"
+	AuditRotateKey    = "rotate-key"
+	AuditSecureDelete = "secure-delete"
+	AuditBackup       = "backup"
+	AuditRestore      = "restore"
+	AuditPrune        = "prune"
+	AuditUpgrade      = "upgrade"
+	AuditAddKey       = "add-key"
+	AuditRemoveKey    = "remove-key"
+)
+
+// Results of recorded operations
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// auditGenesis is the previous hash of the first record of a log
+var auditGenesis = strings.Repeat("0", sha256.Size*2)
+
+// ErrAuditLocked is returned when another process holds the audit log lock for too long
+var ErrAuditLocked = errors.New("audit log is locked by another process")
+
+// AuditRecord is one record of the audit log
+type AuditRecord struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Command   string    `json:"command"`             // Command that ran the operation, e.g. watch
+	PathHash  string    `json:"path_hash,omitempty"` // AuditPathHash of the path operated on
+	Result    string    `json:"result"`
+	ErrorCode string    `json:"error_code,omitempty"`
+	Prev      string    `json:"prev"` // Hash of the previous record
+	Hash      string    `json:"hash,omitempty"`
+
+	line int // Line of the log the record was read from
+}
+
+// AuditProblem is a place where the audit log was changed or damaged
+type AuditProblem struct {
+	Line   int    `json:"line,omitempty"` // 0 for problems with the log as a whole
+	Detail string `json:"detail"`
+}
+
+// String describes the problem
+func (p AuditProblem) String() string {
+	if p.Line == 0 {
+		return p.Detail
+	}
+	return fmt.Sprintf("line %d: %s", p.Line, p.Detail)
+}
+
+// AuditCheck is the outcome of checking the chain of an audit log
+type AuditCheck struct {
+	Records  int            `json:"records"`
+	LastHash string         `json:"last_hash,omitempty"`
+	Problems []AuditProblem `json:"problems,omitempty"`
+}
+
+// OK reports whether the log is intact
+func (c *AuditCheck) OK() bool {
+	return len(c.Problems) == 0
+}
+
+// AuditFilter selects records of the audit log. Empty fields match every record.
+type AuditFilter struct {
+	Operation string
+	Result    string
+	PathHash  string
+	Since     time.Time // Inclusive
+	Until     time.Time // Exclusive
+}
+
+// Match reports whether record is selected by the filter
+func (f *AuditFilter) Match(record *AuditRecord) bool {
+	switch {
+	case f.Operation != "" && record.Operation != f.Operation:
+		return false
+	case f.Result != "" && record.Result != f.Result:
+		return false
+	case f.PathHash != "" && record.PathHash != f.PathHash:
+		return false
+	case !f.Since.IsZero() && record.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !record.Time.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// auditHead is the contents of the head file: the last record of the log
+type auditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// AuditLog is a hash-chained log of operations
+type AuditLog struct {
+	path string
+}
+
+// NewAuditLog returns the audit log at path, which is created by the first append
+func NewAuditLog(path string) *AuditLog {
+	return &AuditLog{path: path}
+}
+
+// Path returns the path of the log
+func (l *AuditLog) Path() string {
+	return l.path
+}
+
+// AuditPathHash returns the hash a path is recorded under: the SHA-256 of
+// its absolute form
+func AuditPathHash(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	sum := sha256.Sum256([]byte(filepath.Clean(path)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Append adds record to the end of the log, filling in its sequence number,
+// time (if unset) and hashes. Appends from several processes are serialized
+// with a lock file.
+func (l *AuditLog) Append(record *AuditRecord) error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0700); err != nil {
+		return fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	unlock, err := l.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	record.Seq, record.Prev = 1, auditGenesis
+	line, err := lastLine(file)
+	if err != nil {
+		return fmt.Errorf("failed to read audit log: %w", err)
+	}
+	if line != nil {
+		last, err := parseAuditRecord(line)
+		if err != nil {
+			return fmt.Errorf("the last record of the audit log is damaged: %w", err)
+		}
+		record.Seq, record.Prev = last.Seq+1, last.Hash
+	}
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	record.Time = record.Time.UTC()
+	record.Hash = ""
+	record.Hash = auditRecordHash(record)
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit record: %w", err)
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+	return l.writeHead(&auditHead{Seq: record.Seq, Hash: record.Hash})
+}
+
+// Records returns the records of the log that can be read, and the problems
+// with those that can't. A missing log has no records.
+func (l *AuditLog) Records() ([]*AuditRecord, []AuditProblem, error) {
+	file, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	var records []*AuditRecord
+	var problems []AuditProblem
+	reader := bufio.NewReader(file)
+	for number := 1; ; number++ {
+		line, err := reader.ReadBytes('\n')
+		if len(line) == 0 && err == io.EOF {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return nil, nil, fmt.Errorf("failed to read audit log: %w", err)
+		}
+		if err == io.EOF {
+			problems = append(problems, AuditProblem{Line: number, Detail: "the record is cut off"})
+			break
+		}
+		record, parseErr := parseAuditRecord(bytes.TrimSuffix(line, []byte("\n")))
+		if parseErr != nil {
+			problems = append(problems, AuditProblem{Line: number, Detail: parseErr.Error()})
+			continue
+		}
+		record.line = number
+		records = append(records, record)
+	}
+	return records, problems, nil
+}
+
+// Verify checks the chain of the log: that every record is unchanged and
+// follows the one before it, and that the log ends with the record its head
+// file names
+func (l *AuditLog) Verify() (*AuditCheck, error) {
+	records, problems, err := l.Records()
+	if err != nil {
+		return nil, err
+	}
+	check := &AuditCheck{Records: len(records), Problems: problems}
+
+	// The record after an unreadable line is not checked against it, so the
+	// line is only reported once
+	seq, prev, line := uint64(0), auditGenesis, 0
+	for _, record := range records {
+		switch {
+		case record.Hash != auditRecordHash(record):
+			check.Problems = append(check.Problems, AuditProblem{Line: record.line, Detail: "the record was changed after it was written"})
+		case record.line != line+1:
+		case record.Seq != seq+1:
+			check.Problems = append(check.Problems, AuditProblem{Line: record.line, Detail: fmt.Sprintf("expected record %d: records were removed or reordered", seq+1)})
+		case record.Prev != prev:
+			check.Problems = append(check.Problems, AuditProblem{Line: record.line, Detail: "the record does not follow the one before it"})
+		}
+		seq, prev, line = record.Seq, record.Hash, record.line
+	}
+	if len(records) > 0 {
+		check.LastHash = prev
+	}
+
+	head, err := l.readHead()
+	switch {
+	case os.IsNotExist(err):
+		if len(records) > 0 {
+			check.Problems = append(check.Problems, AuditProblem{Detail: "the head file is missing"})
+		}
+	case err != nil:
+		check.Problems = append(check.Problems, AuditProblem{Detail: fmt.Sprintf("the head file is damaged: %v", err)})
+	case head.Seq > seq:
+		check.Problems = append(check.Problems, AuditProblem{Detail: fmt.Sprintf("the log is truncated: it ends at record %d, but %d records were written", seq, head.Seq)})
+	case head.Seq < seq:
+		check.Problems = append(check.Problems, AuditProblem{Detail: fmt.Sprintf("the log continues past record %d, the last one in its head file", head.Seq)})
+	case head.Hash != prev:
+		check.Problems = append(check.Problems, AuditProblem{Detail: "the last record does not match the head file"})
+	}
+	return check, nil
+}
+
+// parseAuditRecord parses a line of the log, which must be exactly as it was
+// written, so nothing can be added to a record without changing its hash
+func parseAuditRecord(line []byte) (*AuditRecord, error) {
+	var record AuditRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		return nil, fmt.Errorf("malformed record: %w", err)
+	}
+	canonical, err := json.Marshal(&record)
+	if err != nil || !bytes.Equal(canonical, line) {
+		return nil, fmt.Errorf("the record is not in its written form")
+	}
+	return &record, nil
+}
+
+// auditRecordHash returns the hash of record, computed over its encoding
+// without the hash
+func auditRecordHash(record *AuditRecord) string {
+	unhashed := *record
+	unhashed.Hash = ""
+	data, _ := json.Marshal(&unhashed)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// lastLine returns the last line of file without its newline, or nil if the
+// file is empty
+func lastLine(file *os.File) ([]byte, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return nil, nil
+	}
+
+	// Read back from the end until the newline before the last line is found
+	var tail []byte
+	for block := int64(4096); ; block *= 2 {
+		offset := size - block
+		if offset < 0 {
+			offset = 0
+		}
+		tail = make([]byte, size-offset)
+		if _, err := file.ReadAt(tail, offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+		if tail[len(tail)-1] != '\n' {
+			return nil, fmt.Errorf("the last record is cut off")
+		}
+		if i := bytes.LastIndexByte(tail[:len(tail)-1], '\n'); i >= 0 {
+			return tail[i+1 : len(tail)-1], nil
+		}
+		if offset == 0 {
+			return tail[:len(tail)-1], nil
+		}
+	}
+}
+
+// readHead reads the head file of the log
+func (l *AuditLog) readHead() (*auditHead, error) {
+	data, err := os.ReadFile(l.path + auditHeadSuffix)
+	if err != nil {
+		return nil, err
+	}
+	var head auditHead
+	if err := json.Unmarshal(data, &head); err != nil {
+		return nil, err
+	}
+	return &head, nil
+}
+
+// writeHead atomically replaces the head file of the log
+func (l *AuditLog) writeHead(head *auditHead) error {
+	data, err := json.Marshal(head)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit log head: %w", err)
+	}
+
+	// The temporary file lives in the same directory so the rename is atomic
+	headPath := l.path + auditHeadSuffix
+	output, err := os.CreateTemp(filepath.Dir(headPath), "."+filepath.Base(headPath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create audit log head: %w", err)
+	}
+	tempPath := output.Name()
+	defer os.Remove(tempPath)
+
+	_, err = output.Write(append(data, '\n'))
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write audit log head: %w", err)
+	}
+	if err := os.Rename(tempPath, headPath); err != nil {
+		return fmt.Errorf("failed to replace audit log head: %w", err)
+	}
+	return nil
+}
+
+// lock takes the audit log lock, waiting for another append to finish, and
+// returns the function releasing it. A lock left by a process on this host
+// that is no longer running is broken rather than waited for.
+func (l *AuditLog) lock() (func(), error) {
+	path := l.path + auditLockSuffix
+	deadline := time.Now().Add(auditLockTimeout)
+	for {
+		unlock, holder, err := createLockFile(path)
+		if err == nil {
+			return unlock, nil
+		}
+		if err != errLockHeld {
+			return nil, fmt.Errorf("failed to lock audit log: %w", err)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w: held by %s (remove %s if no other nokvault process is running)", ErrAuditLocked, holder, path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,151 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestAuditLog appends n records to a new audit log and returns it
+func writeTestAuditLog(t *testing.T, n int) *AuditLog {
+	log := NewAuditLog(filepath.Join(t.TempDir(), "audit", "audit.log"))
+	operations := []string{AuditEncrypt, AuditDecrypt, AuditSecureDelete}
+	for i := 0; i < n; i++ {
+		record := &AuditRecord{
+			Operation: operations[i%len(operations)],
+			Command:   operations[i%len(operations)],
+			PathHash:  AuditPathHash(filepath.Join("docs", "report.pdf")),
+			Result:    AuditSuccess,
+		}
+		if i == 1 {
+			record.Result, record.ErrorCode = AuditFailure, "DECRYPTION_FAILED"
+		}
+		require.NoError(t, log.Append(record))
+	}
+	return log
+}
+
+func TestAuditLog_Chain(t *testing.T) {
+	log := writeTestAuditLog(t, 5)
+
+	records, problems, err := log.Records()
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+	require.Len(t, records, 5)
+	assert.Equal(t, auditGenesis, records[0].Prev)
+	for i, record := range records {
+		assert.Equal(t, uint64(i+1), record.Seq)
+		if i > 0 {
+			assert.Equal(t, records[i-1].Hash, record.Prev, "every record should hold the hash of the one before it")
+		}
+	}
+	assert.Equal(t, "DECRYPTION_FAILED", records[1].ErrorCode)
+
+	check, err := log.Verify()
+	require.NoError(t, err)
+	assert.True(t, check.OK(), "%v", check.Problems)
+	assert.Equal(t, 5, check.Records)
+	assert.Equal(t, records[4].Hash, check.LastHash)
+
+	// A missing log is empty and intact
+	check, err = NewAuditLog(filepath.Join(t.TempDir(), "audit.log")).Verify()
+	require.NoError(t, err)
+	assert.True(t, check.OK())
+	assert.Zero(t, check.Records)
+}
+
+func TestAuditLog_StaleLock(t *testing.T) {
+	log := writeTestAuditLog(t, 1)
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+
+	// A lock left by a process of this host that is gone is broken at once
+	lock := fmt.Sprintf("pid %d host %s since 2026-01-02T03:04:05Z\n", math.MaxInt32, hostname)
+	require.NoError(t, os.WriteFile(log.path+auditLockSuffix, []byte(lock), 0600))
+	start := time.Now()
+	require.NoError(t, log.Append(&AuditRecord{Operation: AuditBackup, Command: "backup", Result: AuditSuccess}))
+	assert.Less(t, time.Since(start), auditLockTimeout, "A stale lock should not be waited for")
+	assert.NoFileExists(t, log.path+auditLockSuffix, "Append should release the lock")
+
+	check, err := log.Verify()
+	require.NoError(t, err)
+	assert.True(t, check.OK(), "%v", check.Problems)
+	assert.Equal(t, 2, check.Records)
+}
+
+func TestAuditLog_Tampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(lines [][]byte) [][]byte
+		detail string
+	}{
+		{"edited", func(lines [][]byte) [][]byte {
+			lines[2] = bytes.Replace(lines[2], []byte(`"success"`), []byte(`"failure"`), 1)
+			return lines
+		}, "changed after it was written"},
+		{"reformatted", func(lines [][]byte) [][]byte {
+			lines[2] = bytes.Replace(lines[2], []byte(`,"result"`), []byte(`, "result"`), 1)
+			return lines
+		}, "not in its written form"},
+		{"removed", func(lines [][]byte) [][]byte {
+			return append(lines[:2], lines[3:]...)
+		}, "records were removed or reordered"},
+		{"swapped", func(lines [][]byte) [][]byte {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}, "records were removed or reordered"},
+		{"truncated", func(lines [][]byte) [][]byte {
+			return lines[:3]
+		}, "the log is truncated"},
+		{"cut off", func(lines [][]byte) [][]byte {
+			lines[4] = lines[4][:len(lines[4])-1]
+			return lines
+		}, "the record is cut off"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := writeTestAuditLog(t, 5)
+			data, err := os.ReadFile(log.Path())
+			require.NoError(t, err)
+			lines := bytes.SplitAfter(data, []byte("\n"))
+			lines = tt.change(lines[:len(lines)-1])
+			require.NoError(t, os.WriteFile(log.Path(), bytes.Join(lines, nil), 0600))
+
+			check, err := log.Verify()
+			require.NoError(t, err)
+			require.False(t, check.OK(), "tampering should be detected")
+			assert.Contains(t, check.Problems[0].String(), tt.detail)
+		})
+	}
+
+	// Appending to a log whose last record is damaged fails rather than
+	// chaining onto it
+	log := writeTestAuditLog(t, 2)
+	data, err := os.ReadFile(log.Path())
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(log.Path(), data[:len(data)-1], 0600))
+	assert.Error(t, log.Append(&AuditRecord{Operation: AuditEncrypt, Command: "encrypt", Result: AuditSuccess}))
+}
+
+func TestAuditFilter_Match(t *testing.T) {
+	now := time.Now()
+	record := &AuditRecord{Time: now, Operation: AuditDecrypt, Result: AuditFailure, PathHash: AuditPathHash("report.pdf")}
+
+	assert.True(t, (&AuditFilter{}).Match(record))
+	assert.True(t, (&AuditFilter{Operation: AuditDecrypt, Result: AuditFailure}).Match(record))
+	assert.False(t, (&AuditFilter{Operation: AuditEncrypt}).Match(record))
+	assert.False(t, (&AuditFilter{Result: AuditSuccess}).Match(record))
+	assert.True(t, (&AuditFilter{PathHash: AuditPathHash("./report.pdf")}).Match(record), "paths should be hashed in their absolute form")
+	assert.False(t, (&AuditFilter{PathHash: AuditPathHash("other.pdf")}).Match(record))
+	assert.True(t, (&AuditFilter{Since: now, Until: now.Add(time.Second)}).Match(record))
+	assert.False(t, (&AuditFilter{Since: now.Add(time.Second)}).Match(record))
+	assert.False(t, (&AuditFilter{Until: now}).Match(record))
+}
@@ -0,0 +1,151 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Default chunk sizes of a repository: chunks average 1 MB, so a change to a
+// file only costs the chunks around it
+const (
+	DefaultMinChunkSize = 512 * 1024
+	DefaultAvgChunkSize = 1024 * 1024
+	DefaultMaxChunkSize = 8 * 1024 * 1024
+)
+
+// ChunkerParams sets the sizes of the chunks a Chunker cuts
+type ChunkerParams struct {
+	MinSize int `json:"min_size"`
+	AvgSize int `json:"avg_size"` // A power of two
+	MaxSize int `json:"max_size"`
+}
+
+// DefaultChunkerParams returns the default chunk sizes
+func DefaultChunkerParams() ChunkerParams {
+	return ChunkerParams{MinSize: DefaultMinChunkSize, AvgSize: DefaultAvgChunkSize, MaxSize: DefaultMaxChunkSize}
+}
+
+// Validate checks the chunk sizes recorded in a repository
+func (p ChunkerParams) Validate() error {
+	if p.MinSize < 64 || p.AvgSize < 2*p.MinSize || p.MaxSize < 2*p.AvgSize || p.MaxSize > 64*1024*1024 {
+		return fmt.Errorf("invalid chunk sizes: %d/%d/%d", p.MinSize, p.AvgSize, p.MaxSize)
+	}
+	if p.AvgSize&(p.AvgSize-1) != 0 {
+		return fmt.Errorf("average chunk size must be a power of two: %d", p.AvgSize)
+	}
+	return nil
+}
+
+// Chunker cuts a stream into content-defined chunks with FastCDC: a rolling
+// gear hash picks cut points from the data itself, so inserting or removing
+// bytes only changes the chunks around the edit. The gear table is derived
+// from a secret key, so chunk boundaries don't reveal known file contents.
+type Chunker struct {
+	r      io.Reader
+	params ChunkerParams
+	gear   [256]uint64
+	maskS  uint64 // Harder to match, used below the average size
+	maskL  uint64 // Easier to match, used above it
+	buf    []byte
+	start  int
+	end    int
+	eof    bool
+}
+
+// NewChunker returns a chunker reading from r, with its gear table derived from key
+func NewChunker(r io.Reader, key []byte, params ChunkerParams) *Chunker {
+	c := &Chunker{
+		r:      r,
+		params: params,
+		buf:    make([]byte, params.MaxSize),
+	}
+
+	mac := hmac.New(sha256.New, key)
+	for i := range c.gear {
+		mac.Reset()
+		mac.Write([]byte{byte(i)})
+		c.gear[i] = binary.BigEndian.Uint64(mac.Sum(nil))
+	}
+
+	// The hash shifts left, so its top bits depend on the last 64 bytes
+	avgBits := bits.TrailingZeros(uint(params.AvgSize))
+	c.maskS = ^uint64(0) << (64 - (avgBits + 1))
+	c.maskL = ^uint64(0) << (64 - (avgBits - 1))
+	return c
+}
+
+// Reset makes the chunker read from r, keeping its buffer and gear table
+func (c *Chunker) Reset(r io.Reader) {
+	c.r = r
+	c.start = 0
+	c.end = 0
+	c.eof = false
+}
+
+// Next returns the next chunk, or io.EOF after the last one. The chunk is
+// only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	cut := c.cutPoint(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+cut]
+	c.start += cut
+	return chunk, nil
+}
+
+// fill reads until a whole maximum-size chunk is buffered or the input ends.
+// The buffer holds exactly one, so cut points never pass the maximum size.
+func (c *Chunker) fill() error {
+	if c.eof || c.end-c.start >= c.params.MaxSize {
+		return nil
+	}
+
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+	for c.end < len(c.buf) {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cutPoint returns the length of the chunk at the start of data
+func (c *Chunker) cutPoint(data []byte) int {
+	n := len(data)
+	if n <= c.params.MinSize {
+		return n
+	}
+	normal := min(n, c.params.AvgSize)
+
+	var hash uint64
+	i := c.params.MinSize
+	for ; i < normal; i++ {
+		hash = hash<<1 + c.gear[data[i]]
+		if hash&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = hash<<1 + c.gear[data[i]]
+		if hash&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testChunkerParams = ChunkerParams{MinSize: 256, AvgSize: 1024, MaxSize: 4096}
+
+// readChunks returns the chunks the chunker cuts data into
+func readChunks(t *testing.T, chunker *Chunker) [][]byte {
+	var chunks [][]byte
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		require.NoError(t, err)
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func TestChunker_Sizes(t *testing.T) {
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	// Short reads don't change the cut points
+	chunks := readChunks(t, NewChunker(bytes.NewReader(data), []byte("key"), testChunkerParams))
+	assert.Equal(t, chunks, readChunks(t, NewChunker(iotest.OneByteReader(bytes.NewReader(data)), []byte("key"), testChunkerParams)))
+
+	assert.Equal(t, data, bytes.Join(chunks, nil))
+	for i, chunk := range chunks {
+		if i < len(chunks)-1 {
+			assert.GreaterOrEqual(t, len(chunk), testChunkerParams.MinSize)
+		}
+		assert.LessOrEqual(t, len(chunk), testChunkerParams.MaxSize)
+	}
+	average := len(data) / len(chunks)
+	assert.InDelta(t, testChunkerParams.AvgSize, average, float64(testChunkerParams.AvgSize)/2, "chunks should average about the target size")
+
+	// A run of one byte settles on a fixed hash, which this key never matches,
+	// so it is cut at the maximum size
+	zeros := readChunks(t, NewChunker(bytes.NewReader(make([]byte, 10000)), []byte("key"), testChunkerParams))
+	require.Len(t, zeros, 3)
+	assert.Equal(t, []int{4096, 4096, 1808}, []int{len(zeros[0]), len(zeros[1]), len(zeros[2])})
+
+	assert.Empty(t, readChunks(t, NewChunker(bytes.NewReader(nil), []byte("key"), testChunkerParams)))
+}
+
+func TestChunker_EditOnlyChangesNearbyChunks(t *testing.T) {
+	data := make([]byte, 128*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+	edited := append(append(append([]byte(nil), data[:60000]...), "inserted"...), data[60000:]...)
+
+	chunker := NewChunker(bytes.NewReader(data), []byte("key"), testChunkerParams)
+	before := make(map[string]bool)
+	for _, chunk := range readChunks(t, chunker) {
+		before[string(chunk)] = true
+	}
+
+	chunker.Reset(bytes.NewReader(edited))
+	after := readChunks(t, chunker)
+	changed := 0
+	for _, chunk := range after {
+		if !before[string(chunk)] {
+			changed++
+		}
+	}
+	assert.LessOrEqual(t, changed, 2, "an insertion should only change the chunks around it")
+
+	// Another key cuts elsewhere
+	other := readChunks(t, NewChunker(bytes.NewReader(data), []byte("other key"), testChunkerParams))
+	assert.NotEqual(t, readChunks(t, NewChunker(bytes.NewReader(data), []byte("key"), testChunkerParams)), other)
+}
+
+func TestChunkerParams_Validate(t *testing.T) {
+	assert.NoError(t, DefaultChunkerParams().Validate())
+	assert.NoError(t, testChunkerParams.Validate())
+	assert.Error(t, ChunkerParams{MinSize: 256, AvgSize: 1000, MaxSize: 4096}.Validate(), "average must be a power of two")
+	assert.Error(t, ChunkerParams{MinSize: 1024, AvgSize: 1024, MaxSize: 4096}.Validate())
+	assert.Error(t, ChunkerParams{}.Validate())
+}
@@ -7,6 +7,17 @@ import (
 	"io"
 )
 
+// Compression algorithm IDs recorded in file headers
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// IsSupportedCompression reports whether id is a known compression algorithm ID
+func IsSupportedCompression(id string) bool {
+	return id == CompressionNone || id == CompressionGzip
+}
+
 // CompressionService handles compression/decompression
 type CompressionService struct {
 }
@@ -49,6 +60,40 @@ func (cs *CompressionService) Decompress(data []byte) ([]byte, error) {
 	return decompressed, nil
 }
 
+// NewCompressWriter returns a writer that gzip-compresses data written to it.
+// Closing it flushes the compressor but does not close w.
+func (cs *CompressionService) NewCompressWriter(w io.Writer) io.WriteCloser {
+	return gzip.NewWriter(w)
+}
+
+// NewDecompressReader returns a reader that decompresses gzip data from r.
+// Corrupt compressed data is reported as an error rather than passed through.
+func (cs *CompressionService) NewDecompressReader(r io.Reader) (io.ReadCloser, error) {
+	reader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("decompression failed: %w", err)
+	}
+	return &decompressReader{reader}, nil
+}
+
+// decompressReader labels read errors from the decompressor
+type decompressReader struct {
+	io.ReadCloser
+}
+
+func (dr *decompressReader) Read(p []byte) (int, error) {
+	n, err := dr.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("decompression failed: %w", err)
+	}
+	return n, err
+}
+
+// IsCompressed reports whether data starts with the gzip magic number
+func (cs *CompressionService) IsCompressed(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
 // ShouldCompress determines if compression should be used based on data size and type
 func (cs *CompressionService) ShouldCompress(data []byte, minSize int) bool {
 	// Only compress if data is larger than minimum size
@@ -57,7 +102,7 @@ func (cs *CompressionService) ShouldCompress(data []byte, minSize int) bool {
 	}
 
 	// Check if data is already compressed (heuristic: check for gzip magic number)
-	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+	if cs.IsCompressed(data) {
 		return false
 	}
 
@@ -4,25 +4,42 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
-// DirectoryEncryptor handles directory encryption operations
+// DirectoryEncryptor handles directory encryption operations. Every file,
+// directory and symbolic link of the tree gets its own .nokvault file:
+// directories are recorded in a DirEntryFile inside them, and symbolic links
+// and (if detected) further hard links of a file are recorded by their
+// metadata alone. The files written are recorded in a manifest (ManifestFile),
+// so DirectoryDecryptor can tell if any are deleted, added, swapped or
+// replaced by older versions.
 type DirectoryEncryptor struct {
-	encryptionService  *EncryptionService
-	fileHandler        *FileHandler
-	compressionService *CompressionService
-	verbose            bool
-	compress           bool
+	encryptionService *EncryptionService
+	fileHandler       *FileHandler
+	verbose           bool
+	compress          bool
+	hideNames         bool
+	preserveOwner     bool
+	preserveXattrs    bool
+	detectHardlinks   bool
+	onWarning         func(message string)
+}
+
+// fileID identifies a file across its hard links
+type fileID struct {
+	dev uint64
+	ino uint64
 }
 
 // NewDirectoryEncryptor creates a new directory encryptor
 func NewDirectoryEncryptor(encryptionService *EncryptionService, verbose bool) *DirectoryEncryptor {
 	return &DirectoryEncryptor{
-		encryptionService:  encryptionService,
-		fileHandler:        NewFileHandler(),
-		compressionService: NewCompressionService(),
-		verbose:            verbose,
-		compress:           false,
+		encryptionService: encryptionService,
+		fileHandler:       NewFileHandler(),
+		verbose:           verbose,
+		compress:          false,
 	}
 }
 
@@ -31,13 +48,76 @@ func (de *DirectoryEncryptor) SetCompression(compress bool) {
 	de.compress = compress
 }
 
+// SetHideNames enables or disables hidden names. With hidden names, every
+// file is written to the top of the output directory under a random name, its
+// header records no name, and the original paths are kept in an encrypted
+// name map (NameMapFile) that DirectoryDecryptor restores them from.
+func (de *DirectoryEncryptor) SetHideNames(hideNames bool) {
+	de.hideNames = hideNames
+}
+
+// SetPreserveOwner enables or disables recording the owner and group of
+// every entry, which are restored when decrypting as the superuser
+func (de *DirectoryEncryptor) SetPreserveOwner(preserveOwner bool) {
+	de.preserveOwner = preserveOwner
+}
+
+// SetPreserveXattrs enables or disables recording the extended attributes of
+// files and directories (on Linux)
+func (de *DirectoryEncryptor) SetPreserveXattrs(preserveXattrs bool) {
+	de.preserveXattrs = preserveXattrs
+}
+
+// SetDetectHardlinks enables or disables recording files linked more than
+// once as hard links to the first of their paths, instead of encrypting
+// their contents again
+func (de *DirectoryEncryptor) SetDetectHardlinks(detectHardlinks bool) {
+	de.detectHardlinks = detectHardlinks
+}
+
+// SetOnWarning sets the function told about special files skipped in verbose
+// mode, such as sockets and devices
+func (de *DirectoryEncryptor) SetOnWarning(onWarning func(message string)) {
+	de.onWarning = onWarning
+}
+
 // EncryptDirectory encrypts all files in a directory recursively
 func (de *DirectoryEncryptor) EncryptDirectory(inputDir, outputDir string, key, salt []byte, onProgress func(current, total int, currentFile string)) error {
+	return de.EncryptDirectoryForRecipients(inputDir, outputDir, &Recipients{Key: key, Salt: salt}, onProgress)
+}
+
+// EncryptDirectoryForRecipients encrypts all files in a directory recursively
+// with a key slot for each of the recipients. Encrypting into an output with a
+// manifest replaces it: files left from entries since deleted from inputDir
+// are removed along with their signatures and parity files. An output with
+// encrypted files but no manifest is refused with ErrOutputNotManaged.
+func (de *DirectoryEncryptor) EncryptDirectoryForRecipients(inputDir, outputDir string, recipients *Recipients, onProgress func(current, total int, currentFile string)) error {
 	// Ensure output directory exists
 	if err := de.fileHandler.EnsureDirectory(outputDir); err != nil {
 		return fmt.Errorf("failed to create output directory: %w", err)
 	}
 
+	// The name map of earlier files can't be extended without unlocking it
+	var names *NameMap
+	if de.hideNames {
+		if HasNameMap(outputDir) {
+			return ErrNameMapExists
+		}
+		names = &NameMap{Names: make(map[string]string)}
+	}
+
+	// Without a manifest, files in the output can't be told apart from ones
+	// that belong to something else
+	if !HasManifest(outputDir) {
+		existing, err := manifestPaths(outputDir)
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			return ErrOutputNotManaged
+		}
+	}
+
 	// Count total files for progress tracking
 	totalFiles, err := de.fileHandler.CountFiles(inputDir)
 	if err != nil {
@@ -45,28 +125,61 @@ func (de *DirectoryEncryptor) EncryptDirectory(inputDir, outputDir string, key,
 	}
 
 	currentFile := 0
+	links := make(map[fileID]string)
+	var written []string
 
-	// Walk directory and encrypt each file
+	// Walk directory and encrypt each entry. Symbolic links are not followed.
 	err = de.fileHandler.WalkDirectory(inputDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return fmt.Errorf("error accessing %s: %w", path, err)
 		}
 
-		// Skip directories
-		if info.IsDir() {
+		// Get relative path
+		relPath, err := de.fileHandler.GetRelativePath(inputDir, path)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path: %w", err)
+		}
+		if relPath == "." {
 			return nil
 		}
 
-		currentFile++
+		isSymlink := info.Mode()&os.ModeSymlink != 0
+		if !info.IsDir() && !isSymlink && !info.Mode().IsRegular() {
+			if de.verbose && de.onWarning != nil {
+				de.onWarning(fmt.Sprintf("Skipping special file %s", relPath))
+			}
+			return nil
+		}
 
-		// Get relative path
-		relPath, err := de.fileHandler.GetRelativePath(inputDir, path)
+		metadata, err := readEntryMetadata(path, info, de.preserveOwner, de.preserveXattrs)
 		if err != nil {
-			return fmt.Errorf("failed to get relative path: %w", err)
+			return fmt.Errorf("failed to read metadata of %s: %w", relPath, err)
+		}
+		if id, ok := fileLinkID(info); ok && de.detectHardlinks && info.Mode().IsRegular() {
+			if first, seen := links[id]; seen {
+				metadata.Hardlink = first
+			} else {
+				links[id] = filepath.ToSlash(relPath)
+			}
 		}
 
 		// Create output path maintaining directory structure
-		outputPath := filepath.Join(outputDir, relPath+".nokvault")
+		entryName := relPath + ".nokvault"
+		if info.IsDir() {
+			entryName = filepath.Join(relPath, DirEntryFile)
+		}
+		outputPath := filepath.Join(outputDir, entryName)
+		if names != nil {
+			name, err := newOpaqueName()
+			if err != nil {
+				return err
+			}
+			names.Names[name] = filepath.ToSlash(relPath)
+			if info.IsDir() {
+				names.Names[name] += "/"
+			}
+			outputPath = filepath.Join(outputDir, name+".nokvault")
+		}
 
 		// Ensure output directory exists
 		outputFileDir := filepath.Dir(outputPath)
@@ -75,217 +188,268 @@ func (de *DirectoryEncryptor) EncryptDirectory(inputDir, outputDir string, key,
 		}
 
 		// Report progress
-		if onProgress != nil {
-			onProgress(currentFile, totalFiles, relPath)
+		if !info.IsDir() {
+			currentFile++
+			if onProgress != nil {
+				onProgress(currentFile, totalFiles, relPath)
+			}
 		}
 
 		// Encrypt file
-		if err := de.encryptFileWithMetadata(path, outputPath, key, salt); err != nil {
+		if err := de.encryptEntry(path, outputPath, metadata, recipients); err != nil {
 			return fmt.Errorf("failed to encrypt %s: %w", relPath, err)
 		}
+		written = append(written, outputPath)
 
 		return nil
 	})
-
-	return err
-}
-
-// encryptFileWithMetadata encrypts a file and preserves metadata
-func (de *DirectoryEncryptor) encryptFileWithMetadata(inputPath, outputPath string, key, salt []byte) error {
-	// Read file metadata
-	metadata, err := de.fileHandler.ReadMetadata(inputPath)
 	if err != nil {
 		return err
 	}
 
-	// Set relative path
-	metadata.RelativePath = filepath.Base(inputPath)
+	if names != nil {
+		nameMapPath := filepath.Join(outputDir, NameMapFile)
+		if err := de.encryptionService.writeNameMap(nameMapPath, names, recipients); err != nil {
+			return err
+		}
+		written = append(written, nameMapPath)
+	}
 
-	// Read file data
-	data, err := os.ReadFile(inputPath)
-	if err != nil {
-		return fmt.Errorf("failed to read file: %w", err)
+	if err := removeStaleOutputs(outputDir, written); err != nil {
+		return err
 	}
+	return de.encryptionService.writeManifest(outputDir, written, recipients)
+}
 
-	// Compress if enabled
-	if de.compress && de.compressionService.ShouldCompress(data, 1024) {
-		compressed, err := de.compressionService.Compress(data)
-		if err != nil {
-			return fmt.Errorf("compression failed: %w", err)
-		}
-		data = compressed
+// removeStaleOutputs removes the files of the encrypted directory dir that
+// were not just written to it, with their signatures and parity files, and
+// the directories left empty. Otherwise they would be extra to the manifest.
+func removeStaleOutputs(dir string, written []string) error {
+	keep := make(map[string]bool, len(written))
+	for _, path := range written {
+		keep[filepath.Clean(path)] = true
 	}
 
-	// Encrypt data
-	ciphertext, err := de.encryptionService.EncryptData(data, key)
+	paths, err := manifestPaths(dir)
 	if err != nil {
-		return fmt.Errorf("encryption failed: %w", err)
+		return err
 	}
+	root := filepath.Clean(dir)
+	for _, path := range paths {
+		if keep[filepath.Clean(path)] {
+			continue
+		}
+		for _, stale := range []string{path, SignaturePath(path), ParityPath(path)} {
+			if err := os.Remove(stale); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove stale file %s: %w", stale, err)
+			}
+		}
+		// Removing a directory that isn't empty fails, which ends the climb
+		for parent := filepath.Dir(filepath.Clean(path)); parent != root && parent != filepath.Dir(parent); parent = filepath.Dir(parent) {
+			if os.Remove(parent) != nil {
+				break
+			}
+		}
+	}
+	return nil
+}
 
-	// Create output file
-	outputFile, err := os.Create(outputPath)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
+// readEntryMetadata returns the metadata of the entry at path, described by
+// info as returned by Lstat, including the owner and extended attributes if
+// they are preserved
+func readEntryMetadata(path string, info os.FileInfo, preserveOwner, preserveXattrs bool) (*FileMetadata, error) {
+	metadata := &FileMetadata{
+		Name:         info.Name(),
+		Mode:         uint32(info.Mode()),
+		ModTime:      info.ModTime(),
+		IsDir:        info.IsDir(),
+		RelativePath: info.Name(),
 	}
-	defer outputFile.Close()
 
-	// Write header with metadata
-	if err := de.fileHandler.WriteHeader(outputFile, salt, metadata); err != nil {
-		return fmt.Errorf("failed to write header: %w", err)
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read link: %w", err)
+		}
+		metadata.Symlink = target
+	} else if !info.IsDir() {
+		metadata.Size = info.Size()
 	}
 
-	// Write encrypted data
-	if _, err := outputFile.Write(ciphertext); err != nil {
-		return fmt.Errorf("failed to write encrypted data: %w", err)
+	if preserveOwner {
+		metadata.Owner = fileOwner(info)
 	}
+	// Linux only allows trusted and security attributes on symbolic links
+	if preserveXattrs && metadata.Symlink == "" {
+		xattrs, err := readXattrs(path)
+		if err != nil {
+			return nil, err
+		}
+		metadata.Xattrs = xattrs
+	}
+	return metadata, nil
+}
 
-	return nil
+// encryptEntry encrypts an entry of the tree with its metadata. Regular files
+// are encrypted with their contents; the payload of other entries is empty.
+// With hidden names, the name is left out of the metadata.
+func (de *DirectoryEncryptor) encryptEntry(inputPath, outputPath string, metadata *FileMetadata, recipients *Recipients) error {
+	if de.hideNames {
+		metadata.Name = ""
+		metadata.RelativePath = ""
+	}
+	if metadata.IsRegular() {
+		return de.encryptionService.encryptFile(inputPath, outputPath, metadata, recipients, de.compress)
+	}
+	return de.encryptionService.writeFile(outputPath, strings.NewReader(""), de.encryptionService.NewFormatParams(), metadata, recipients)
 }
 
 // DirectoryDecryptor handles directory decryption operations
 type DirectoryDecryptor struct {
-	encryptionService  *EncryptionService
-	fileHandler        *FileHandler
-	compressionService *CompressionService
-	verbose            bool
+	encryptionService *EncryptionService
+	fileHandler       *FileHandler
+	verbose           bool
+	filter            *PathFilter
+	ignoreManifest    bool
+	onWarning         func(message string)
 }
 
 // NewDirectoryDecryptor creates a new directory decryptor
 func NewDirectoryDecryptor(encryptionService *EncryptionService, verbose bool) *DirectoryDecryptor {
 	return &DirectoryDecryptor{
-		encryptionService:  encryptionService,
-		fileHandler:        NewFileHandler(),
-		compressionService: NewCompressionService(),
-		verbose:            verbose,
+		encryptionService: encryptionService,
+		fileHandler:       NewFileHandler(),
+		verbose:           verbose,
 	}
 }
 
+// SetFilter restricts decryption to the files the filter selects by their
+// original relative paths. A nil filter selects every file.
+func (dd *DirectoryDecryptor) SetFilter(filter *PathFilter) {
+	dd.filter = filter
+}
+
+// SetIgnoreManifest sets whether a directory that does not match its
+// manifest is decrypted anyway. The differences are then reported as warnings
+// instead of failing with ErrManifestMismatch before anything is written.
+func (dd *DirectoryDecryptor) SetIgnoreManifest(ignoreManifest bool) {
+	dd.ignoreManifest = ignoreManifest
+}
+
+// SetOnWarning sets the function told about the differences from an ignored
+// manifest and, in verbose mode, metadata that could not be restored
+func (dd *DirectoryDecryptor) SetOnWarning(onWarning func(message string)) {
+	dd.onWarning = onWarning
+}
+
 // DecryptDirectory decrypts all .nokvault files in a directory recursively
 func (dd *DirectoryDecryptor) DecryptDirectory(inputDir, outputDir string, key []byte, onProgress func(current, total int, currentFile string)) error {
-	// Ensure output directory exists
-	if err := dd.fileHandler.EnsureDirectory(outputDir); err != nil {
-		return fmt.Errorf("failed to create output directory: %w", err)
-	}
+	return dd.decryptDirectory(inputDir, outputDir, func(header *NokvaultHeader) ([]byte, error) {
+		return dd.encryptionService.keyManager.OpenFileKey(header, key)
+	}, onProgress)
+}
 
-	// Count total .nokvault files
-	totalFiles := 0
-	err := dd.fileHandler.WalkDirectory(inputDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() && filepath.Ext(path) == ".nokvault" {
-			totalFiles++
-		}
-		return nil
-	})
-	if err != nil {
-		return fmt.Errorf("failed to count files: %w", err)
-	}
+// DecryptDirectoryWithPassword decrypts all .nokvault files in a directory
+// recursively, deriving slot keys from the salt and key derivation parameters
+// recorded in each file's key slots. Slot keys are cached so files sharing a
+// salt and parameters only pay for key derivation once.
+func (dd *DirectoryDecryptor) DecryptDirectoryWithPassword(inputDir, outputDir string, password []byte, onProgress func(current, total int, currentFile string)) error {
+	return dd.DecryptDirectoryWithCredentials(inputDir, outputDir, &Credentials{Password: password}, onProgress)
+}
 
-	currentFile := 0
+// DecryptDirectoryWithCredentials decrypts all .nokvault files in a directory
+// recursively, unlocking each file's key slots with creds
+func (dd *DirectoryDecryptor) DecryptDirectoryWithCredentials(inputDir, outputDir string, creds *Credentials, onProgress func(current, total int, currentFile string)) error {
+	cache := NewKeyCache(time.Hour)
+	defer cache.Clear()
 
-	// Walk directory and decrypt each .nokvault file
-	err = dd.fileHandler.WalkDirectory(inputDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return fmt.Errorf("error accessing %s: %w", path, err)
-		}
+	return dd.decryptDirectory(inputDir, outputDir, func(header *NokvaultHeader) ([]byte, error) {
+		fileKey, _, err := dd.encryptionService.keyManager.UnlockFileKey(header, creds, cache)
+		return fileKey, err
+	}, onProgress)
+}
 
-		// Skip directories and non-.nokvault files
-		if info.IsDir() || filepath.Ext(path) != ".nokvault" {
-			return nil
+// decryptDirectory decrypts every .nokvault file in inputDir selected by the
+// filter, unlocking the file keys (and the name map of a directory with hidden
+// names) with unlock
+func (dd *DirectoryDecryptor) decryptDirectory(inputDir, outputDir string, unlock func(header *NokvaultHeader) ([]byte, error), onProgress func(current, total int, currentFile string)) error {
+	// Directories written before manifests were recorded have none
+	if HasManifest(inputDir) {
+		if err := dd.checkManifest(inputDir, unlock); err != nil {
+			return err
 		}
+	}
 
-		currentFile++
-
-		// Get relative path
-		relPath, err := dd.fileHandler.GetRelativePath(inputDir, path)
-		if err != nil {
-			return fmt.Errorf("failed to get relative path: %w", err)
-		}
+	// Ensure output directory exists
+	if err := dd.fileHandler.EnsureDirectory(outputDir); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
 
-		// Remove .nokvault extension
-		outputRelPath := relPath[:len(relPath)-len(".nokvault")]
-		outputPath := filepath.Join(outputDir, outputRelPath)
+	// Every file is resolved, since a selected hard link may need the file it
+	// links to; files the filter does not select are never opened
+	files, err := dd.encryptionService.resolveEncryptedFiles(inputDir, nil, unlock)
+	if err != nil {
+		return fmt.Errorf("failed to find files: %w", err)
+	}
 
-		// Ensure output directory exists
-		outputFileDir := filepath.Dir(outputPath)
-		if err := dd.fileHandler.EnsureDirectory(outputFileDir); err != nil {
-			return fmt.Errorf("failed to create output directory: %w", err)
+	var selected []EncryptedFile
+	totalFiles := 0
+	for _, file := range files {
+		if dd.filter.Match(file.RelativePath) {
+			selected = append(selected, file)
+			if !file.IsDir {
+				totalFiles++
+			}
 		}
+	}
 
+	var onWarning func(message string)
+	if dd.verbose {
+		onWarning = dd.onWarning
+	}
+	restorer := newTreeRestorer(dd.encryptionService, files, outputDir, unlock, onWarning)
+	currentFile := 0
+	for _, file := range selected {
 		// Report progress
-		if onProgress != nil {
-			onProgress(currentFile, totalFiles, outputRelPath)
+		if !file.IsDir {
+			currentFile++
+			if onProgress != nil {
+				onProgress(currentFile, totalFiles, file.RelativePath)
+			}
 		}
 
 		// Decrypt file
-		if err := dd.decryptFileWithMetadata(path, outputPath, key); err != nil {
-			return fmt.Errorf("failed to decrypt %s: %w", relPath, err)
+		if err := restorer.Restore(file); err != nil {
+			return fmt.Errorf("failed to decrypt %s: %w", file.RelativePath, err)
 		}
-
-		return nil
-	})
-
-	return err
-}
-
-// decryptFileWithMetadata decrypts a file and restores metadata
-func (dd *DirectoryDecryptor) decryptFileWithMetadata(inputPath, outputPath string, key []byte) error {
-	// Open input file
-	inputFile, err := os.Open(inputPath)
-	if err != nil {
-		return fmt.Errorf("failed to open input file: %w", err)
 	}
-	defer inputFile.Close()
 
-	// Read header with metadata
-	header, metadata, err := dd.fileHandler.ReadHeaderWithMetadata(inputFile)
-	if err != nil {
-		return fmt.Errorf("failed to read header: %w", err)
-	}
-
-	// Derive key from salt (if we have the salt from header)
-	// Note: In practice, we already have the key, but we verify it matches
-	// For now, we'll use the provided key directly
+	return restorer.Finish()
+}
 
-	// Read encrypted data
-	ciphertext, err := os.ReadFile(inputPath)
-	if err != nil {
-		return fmt.Errorf("failed to read encrypted data: %w", err)
+// checkManifest checks inputDir against its manifest. If the manifest is
+// ignored, the differences are reported as warnings instead.
+func (dd *DirectoryDecryptor) checkManifest(inputDir string, unlock func(header *NokvaultHeader) ([]byte, error)) error {
+	check, err := dd.encryptionService.checkManifest(inputDir, unlock)
+	if err == nil && !dd.ignoreManifest {
+		return check.Err()
 	}
-
-	// Skip header and metadata
-	dataStart := int64(header.DataOffset)
-	ciphertext = ciphertext[dataStart:]
-
-	// Decrypt data
-	plaintext, err := dd.encryptionService.DecryptData(ciphertext, key)
 	if err != nil {
-		return fmt.Errorf("decryption failed: %w", err)
-	}
-
-	// Try to decompress if data appears to be compressed
-	if len(plaintext) >= 2 && plaintext[0] == 0x1f && plaintext[1] == 0x8b {
-		decompressed, err := dd.compressionService.Decompress(plaintext)
-		if err == nil {
-			plaintext = decompressed
+		if !dd.ignoreManifest {
+			return fmt.Errorf("failed to check manifest: %w", err)
 		}
+		dd.warn(fmt.Sprintf("Failed to check manifest: %v", err))
+		return nil
 	}
-
-	// Write decrypted data
-	if err := os.WriteFile(outputPath, plaintext, 0600); err != nil {
-		return fmt.Errorf("failed to write output file: %w", err)
+	for _, problem := range check.Problems {
+		dd.warn(problem.String())
 	}
+	return nil
+}
 
-	// Restore metadata if available
-	if metadata != nil {
-		if err := dd.fileHandler.WriteMetadata(outputPath, metadata); err != nil {
-			// Log warning but don't fail
-			if dd.verbose {
-				fmt.Fprintf(os.Stderr, "Warning: Could not restore metadata for %s: %v\n", outputPath, err)
-			}
-		}
+// warn reports a warning to the warning function, if there is one
+func (dd *DirectoryDecryptor) warn(message string) {
+	if dd.onWarning != nil {
+		dd.onWarning(message)
 	}
-
-	return nil
 }
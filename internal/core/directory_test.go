@@ -3,7 +3,9 @@ package core
 import (
 	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -197,3 +199,323 @@ func TestDirectoryEncryptor_EncryptDirectory_NonExistentInput(t *testing.T) {
 	err = encryptor.EncryptDirectory(nonExistentDir, outputDir, key, salt, nil)
 	assert.Error(t, err, "Expected error when encrypting non-existent directory")
 }
+
+func TestDirectoryDecryptor_DecryptDirectoryWithPassword(t *testing.T) {
+	password := []byte("test-password-123")
+	inputDir := t.TempDir()
+	encryptedDir := t.TempDir()
+	outputDir := t.TempDir()
+
+	originalFiles := map[string][]byte{
+		"file1.txt":        []byte("content of file 1"),
+		"subdir/file2.txt": []byte("content of file 2"),
+	}
+	for relPath, content := range originalFiles {
+		filePath := filepath.Join(inputDir, relPath)
+		require.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755), "Failed to create subdirectory")
+		require.NoError(t, os.WriteFile(filePath, content, 0644), "Failed to create test file")
+	}
+
+	// Encrypt with non-default parameters
+	encryptionService := NewEncryptionService()
+	encryptionService.GetKeyManager().SetParams(8*1024, 1, 1, 32)
+	key, salt, err := encryptionService.GetKeyManager().DeriveKeyFromPassword(password)
+	require.NoError(t, err, "Failed to derive key")
+
+	err = NewDirectoryEncryptor(encryptionService, false).EncryptDirectory(inputDir, encryptedDir, key, salt, nil)
+	require.NoError(t, err, "Failed to encrypt directory")
+
+	// Decrypt with a default service; keys come from each file's header
+	decryptor := NewDirectoryDecryptor(NewEncryptionService(), false)
+	progressCount := 0
+	err = decryptor.DecryptDirectoryWithPassword(encryptedDir, outputDir, password, func(current, total int, currentFile string) {
+		progressCount++
+	})
+	require.NoError(t, err, "Failed to decrypt directory")
+	assert.Equal(t, len(originalFiles), progressCount, "Progress callback should be called for each file")
+
+	for relPath, originalContent := range originalFiles {
+		decryptedContent, err := os.ReadFile(filepath.Join(outputDir, relPath))
+		require.NoError(t, err, "Failed to read decrypted file: %s", relPath)
+		assert.Equal(t, originalContent, decryptedContent, "Decrypted content should match original for: %s", relPath)
+	}
+
+	// A wrong password fails
+	err = decryptor.DecryptDirectoryWithPassword(encryptedDir, t.TempDir(), []byte("wrong-password"), nil)
+	assert.Error(t, err, "Decryption with wrong password should fail")
+}
+
+func TestDirectoryEncryptor_ReencryptAfterDelete(t *testing.T) {
+	password := []byte("test-password-123")
+	inputDir := t.TempDir()
+	encryptedDir := t.TempDir()
+
+	for _, relPath := range []string{"a.txt", "sub/b.txt", "sub/deep/c.txt"} {
+		filePath := filepath.Join(inputDir, relPath)
+		require.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755), "Failed to create subdirectory")
+		require.NoError(t, os.WriteFile(filePath, []byte(relPath), 0644), "Failed to create test file")
+	}
+
+	encryptionService := NewEncryptionService()
+	encryptionService.GetKeyManager().SetParams(8*1024, 1, 1, 32)
+	encryptor := NewDirectoryEncryptor(encryptionService, false)
+	key, salt, err := encryptionService.GetKeyManager().DeriveKeyFromPassword(password)
+	require.NoError(t, err, "Failed to derive key")
+	require.NoError(t, encryptor.EncryptDirectory(inputDir, encryptedDir, key, salt, nil))
+
+	// Delete a file and a directory, then encrypt again with a new salt
+	require.NoError(t, os.Remove(filepath.Join(inputDir, "sub", "b.txt")))
+	require.NoError(t, os.RemoveAll(filepath.Join(inputDir, "sub", "deep")))
+	key, salt, err = encryptionService.GetKeyManager().DeriveKeyFromPassword(password)
+	require.NoError(t, err, "Failed to derive key")
+	require.NoError(t, encryptor.EncryptDirectory(inputDir, encryptedDir, key, salt, nil))
+
+	assert.NoFileExists(t, filepath.Join(encryptedDir, "sub", "b.txt.nokvault"), "Outputs of deleted files should be removed")
+	assert.NoDirExists(t, filepath.Join(encryptedDir, "sub", "deep"), "Directories left empty should be removed")
+	assert.FileExists(t, filepath.Join(encryptedDir, "sub", DirEntryFile))
+
+	outputDir := t.TempDir()
+	require.NoError(t, NewDirectoryDecryptor(NewEncryptionService(), false).DecryptDirectoryWithPassword(encryptedDir, outputDir, password, nil), "The output should match its new manifest")
+	assert.FileExists(t, filepath.Join(outputDir, "a.txt"))
+	assert.NoFileExists(t, filepath.Join(outputDir, "sub", "b.txt"))
+
+	// An output with encrypted files but no manifest is refused
+	require.NoError(t, os.Remove(filepath.Join(encryptedDir, ManifestFile)))
+	err = encryptor.EncryptDirectory(inputDir, encryptedDir, key, salt, nil)
+	assert.ErrorIs(t, err, ErrOutputNotManaged)
+}
+
+func TestDirectoryDecryptor_SetFilter(t *testing.T) {
+	password := []byte("test-password-123")
+	inputDir := t.TempDir()
+	encryptedDir := t.TempDir()
+	outputDir := t.TempDir()
+
+	for _, relPath := range []string{"configs/app.yaml", "configs/debug.log", "data/big.bin"} {
+		filePath := filepath.Join(inputDir, relPath)
+		require.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755), "Failed to create subdirectory")
+		require.NoError(t, os.WriteFile(filePath, []byte(relPath), 0644), "Failed to create test file")
+	}
+
+	encryptionService := NewEncryptionService()
+	encryptionService.GetKeyManager().SetParams(8*1024, 1, 1, 32)
+	key, salt, err := encryptionService.GetKeyManager().DeriveKeyFromPassword(password)
+	require.NoError(t, err, "Failed to derive key")
+	require.NoError(t, NewDirectoryEncryptor(encryptionService, false).EncryptDirectory(inputDir, encryptedDir, key, salt, nil))
+
+	// The manifest notices a corrupt file outside the selection
+	require.NoError(t, os.WriteFile(filepath.Join(encryptedDir, "data", "big.bin.nokvault"), []byte("garbage"), 0644))
+
+	filter, err := NewPathFilter([]string{"configs/**"}, []string{"*.log"}, nil)
+	require.NoError(t, err)
+	decryptor := NewDirectoryDecryptor(NewEncryptionService(), false)
+	decryptor.SetFilter(filter)
+	err = decryptor.DecryptDirectoryWithPassword(encryptedDir, outputDir, password, nil)
+	assert.ErrorIs(t, err, ErrManifestMismatch)
+
+	// Otherwise files outside the selection are never opened, so it is only
+	// reported as a warning
+	decryptor.SetIgnoreManifest(true)
+	var warnings []string
+	decryptor.SetOnWarning(func(message string) {
+		warnings = append(warnings, message)
+	})
+
+	var decrypted []string
+	err = decryptor.DecryptDirectoryWithPassword(encryptedDir, outputDir, password, func(current, total int, currentFile string) {
+		assert.Equal(t, 1, total)
+		decrypted = append(decrypted, filepath.ToSlash(currentFile))
+	})
+	require.NoError(t, err, "Failed to decrypt directory")
+	assert.Equal(t, []string{"configs/app.yaml"}, decrypted)
+	require.Len(t, warnings, 1)
+	assert.Contains(t, warnings[0], "data/big.bin.nokvault: stale")
+
+	content, err := os.ReadFile(filepath.Join(outputDir, "configs", "app.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, "configs/app.yaml", string(content))
+	assert.NoFileExists(t, filepath.Join(outputDir, "configs", "debug.log"))
+	assert.NoDirExists(t, filepath.Join(outputDir, "data"))
+}
+
+func TestDirectoryEncryptor_SetHideNames(t *testing.T) {
+	password := []byte("test-password-123")
+	inputDir := t.TempDir()
+	encryptedDir := t.TempDir()
+	outputDir := t.TempDir()
+
+	originalFiles := map[string][]byte{
+		"2025-layoffs-draft.docx": []byte("draft"),
+		"plans/q3/budget.xlsx":    []byte("budget"),
+		"plans/q3/notes/todo.txt": []byte("todo"),
+	}
+	for relPath, content := range originalFiles {
+		filePath := filepath.Join(inputDir, filepath.FromSlash(relPath))
+		require.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755), "Failed to create subdirectory")
+		require.NoError(t, os.WriteFile(filePath, content, 0640), "Failed to create test file")
+	}
+
+	encryptionService := NewEncryptionService()
+	encryptionService.GetKeyManager().SetParams(8*1024, 1, 1, 32)
+	key, salt, err := encryptionService.GetKeyManager().DeriveKeyFromPassword(password)
+	require.NoError(t, err, "Failed to derive key")
+
+	encryptor := NewDirectoryEncryptor(encryptionService, false)
+	encryptor.SetHideNames(true)
+	require.NoError(t, encryptor.EncryptDirectory(inputDir, encryptedDir, key, salt, nil), "Failed to encrypt directory")
+
+	// Nothing in the output reveals the original names
+	assert.True(t, HasNameMap(encryptedDir), "A name map should be written")
+	entries, err := os.ReadDir(encryptedDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, len(originalFiles)+3+2, "Files and the 3 directories should be stored flat next to the name map and manifest")
+	for _, entry := range entries {
+		assert.False(t, entry.IsDir(), "No directories should be created")
+		if entry.Name() == NameMapFile {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(encryptedDir, entry.Name()))
+		require.NoError(t, err)
+		for relPath := range originalFiles {
+			assert.NotContains(t, entry.Name(), filepath.Base(relPath))
+			assert.NotContains(t, string(content), filepath.Base(relPath), "Headers should not record names")
+		}
+	}
+
+	// Encrypting into the same directory again would orphan the name map
+	err = encryptor.EncryptDirectory(inputDir, encryptedDir, key, salt, nil)
+	assert.ErrorIs(t, err, ErrNameMapExists)
+
+	// The real names are restored, and filters match them
+	filter, err := NewPathFilter([]string{"plans/**"}, []string{"*.txt"}, nil)
+	require.NoError(t, err)
+	decryptor := NewDirectoryDecryptor(NewEncryptionService(), false)
+	decryptor.SetFilter(filter)
+	require.NoError(t, decryptor.DecryptDirectoryWithPassword(encryptedDir, outputDir, password, nil), "Failed to decrypt directory")
+	content, err := os.ReadFile(filepath.Join(outputDir, "plans", "q3", "budget.xlsx"))
+	require.NoError(t, err)
+	assert.Equal(t, "budget", string(content))
+	assert.NoFileExists(t, filepath.Join(outputDir, "plans", "q3", "notes", "todo.txt"))
+	assert.NoFileExists(t, filepath.Join(outputDir, "2025-layoffs-draft.docx"))
+
+	decryptor.SetFilter(nil)
+	outputDir = t.TempDir()
+	require.NoError(t, decryptor.DecryptDirectory(encryptedDir, outputDir, key, nil), "Failed to decrypt directory with the key")
+	for relPath, originalContent := range originalFiles {
+		decryptedContent, err := os.ReadFile(filepath.Join(outputDir, filepath.FromSlash(relPath)))
+		require.NoError(t, err, "Failed to read decrypted file: %s", relPath)
+		assert.Equal(t, originalContent, decryptedContent)
+	}
+
+	// The names stay hidden without the password
+	err = decryptor.DecryptDirectoryWithPassword(encryptedDir, t.TempDir(), []byte("wrong-password"), nil)
+	assert.Error(t, err, "Decryption with wrong password should fail")
+}
+
+func TestDirectoryDecryptor_RestoresTree(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic and hard links need a Unix file system")
+	}
+
+	inputDir := t.TempDir()
+	encryptedDir := t.TempDir()
+	outputDir := t.TempDir()
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(inputDir, "src", "empty"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "src", "main.go"), []byte("package main"), 0644))
+	require.NoError(t, os.Symlink("main.go", filepath.Join(inputDir, "src", "link.go")))
+	require.NoError(t, os.Link(filepath.Join(inputDir, "src", "main.go"), filepath.Join(inputDir, "main.go")))
+	require.NoError(t, os.Chmod(filepath.Join(inputDir, "src", "empty"), 0750))
+	require.NoError(t, os.Chmod(filepath.Join(inputDir, "src"), 0711))
+	require.NoError(t, os.Chtimes(filepath.Join(inputDir, "src"), modTime, modTime))
+
+	encryptionService := NewEncryptionService()
+	encryptionService.GetKeyManager().SetParams(8*1024, 1, 1, 32)
+	key, salt, err := encryptionService.GetKeyManager().DeriveKeyFromPassword([]byte("test-password-123"))
+	require.NoError(t, err)
+
+	encryptor := NewDirectoryEncryptor(encryptionService, false)
+	encryptor.SetPreserveOwner(true)
+	encryptor.SetDetectHardlinks(true)
+	require.NoError(t, encryptor.EncryptDirectory(inputDir, encryptedDir, key, salt, nil))
+	assert.FileExists(t, filepath.Join(encryptedDir, "src", "empty", DirEntryFile), "Empty directories should get an entry")
+
+	// Links are recorded by their metadata alone
+	metadata, err := encryptionService.DecryptFileWithMetadata(filepath.Join(encryptedDir, "src", "link.go.nokvault"), filepath.Join(t.TempDir(), "link.go"), key)
+	require.NoError(t, err)
+	assert.Equal(t, "main.go", metadata.Symlink)
+	require.NotNil(t, metadata.Owner, "The owner should be recorded")
+	assert.Equal(t, os.Getuid(), metadata.Owner.UID)
+
+	var restored []string
+	decryptor := NewDirectoryDecryptor(NewEncryptionService(), false)
+	require.NoError(t, decryptor.DecryptDirectory(encryptedDir, outputDir, key, func(current, total int, currentFile string) {
+		restored = append(restored, currentFile)
+	}))
+	assert.Len(t, restored, 3, "Progress should only count files and links")
+
+	info, err := os.Stat(filepath.Join(outputDir, "src", "empty"))
+	require.NoError(t, err, "Empty directories should be restored")
+	assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+
+	info, err = os.Stat(filepath.Join(outputDir, "src"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0711), info.Mode().Perm(), "Directory modes should be restored")
+	assert.True(t, modTime.Equal(info.ModTime()), "Directory times should survive the files written into them")
+
+	target, err := os.Readlink(filepath.Join(outputDir, "src", "link.go"))
+	require.NoError(t, err, "Symbolic links should be restored as links")
+	assert.Equal(t, "main.go", target)
+
+	first, err := os.Stat(filepath.Join(outputDir, "src", "main.go"))
+	require.NoError(t, err)
+	second, err := os.Stat(filepath.Join(outputDir, "main.go"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(first, second), "Hard links should be restored as links")
+
+	// A hard link selected without the file it links to gets its contents
+	partialDir := t.TempDir()
+	filter, err := NewPathFilter([]string{"main.go"}, []string{"src"}, nil)
+	require.NoError(t, err)
+	decryptor.SetFilter(filter)
+	require.NoError(t, decryptor.DecryptDirectory(encryptedDir, partialDir, key, nil))
+	content, err := os.ReadFile(filepath.Join(partialDir, "main.go"))
+	require.NoError(t, err)
+	assert.Equal(t, "package main", string(content))
+	assert.NoDirExists(t, filepath.Join(partialDir, "src"))
+}
+
+func TestTreeRestorer_ReplacesSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links need a Unix file system")
+	}
+
+	inputDir := t.TempDir()
+	encryptedDir := t.TempDir()
+	outputDir := t.TempDir()
+	outsideDir := t.TempDir()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(inputDir, "data"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "data", "secret.txt"), []byte("secret"), 0600))
+
+	encryptionService := NewEncryptionService()
+	encryptionService.GetKeyManager().SetParams(8*1024, 1, 1, 32)
+	key, salt, err := encryptionService.GetKeyManager().DeriveKeyFromPassword([]byte("test-password-123"))
+	require.NoError(t, err)
+	require.NoError(t, NewDirectoryEncryptor(encryptionService, false).EncryptDirectory(inputDir, encryptedDir, key, salt, nil))
+
+	// A link left in the output directory must not redirect restored files
+	require.NoError(t, os.Symlink(outsideDir, filepath.Join(outputDir, "data")))
+	require.NoError(t, NewDirectoryDecryptor(NewEncryptionService(), false).DecryptDirectory(encryptedDir, outputDir, key, nil))
+	assert.NoFileExists(t, filepath.Join(outsideDir, "secret.txt"))
+	info, err := os.Lstat(filepath.Join(outputDir, "data"))
+	require.NoError(t, err)
+	assert.True(t, info.IsDir(), "The link should be replaced by the directory")
+
+	// Nor may a link restored from the tree
+	restorer := newTreeRestorer(NewEncryptionService(), nil, outputDir, nil, nil)
+	require.NoError(t, os.Symlink(outsideDir, filepath.Join(outputDir, "link")))
+	_, err = restorer.prepare("link/secret.txt")
+	assert.ErrorContains(t, err, "symbolic link")
+}
@@ -1,6 +1,8 @@
 package core
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"os"
@@ -8,16 +10,154 @@ import (
 	"github.com/jimididit/nokvault/internal/crypto"
 )
 
+// compressionMinSize is the smallest input that is worth compressing
+const compressionMinSize = 1024
+
 // EncryptionService handles file encryption/decryption operations
 type EncryptionService struct {
-	keyManager *KeyManager
+	keyManager         *KeyManager
+	compressionService *CompressionService
+	cipher             string
+	padding            string
+	volumeSize         int64
+	parity             int
+	signingKey         *crypto.SigningKey
 }
 
 // NewEncryptionService creates a new encryption service
 func NewEncryptionService() *EncryptionService {
 	return &EncryptionService{
-		keyManager: NewKeyManager(),
+		keyManager:         NewKeyManager(),
+		compressionService: NewCompressionService(),
+		cipher:             crypto.DefaultCipher,
+	}
+}
+
+// SetCipher sets the cipher used for new files and headerless streams
+func (es *EncryptionService) SetCipher(cipherID string) error {
+	if !crypto.IsSupportedCipher(cipherID) {
+		return fmt.Errorf("unsupported cipher: %q", cipherID)
 	}
+	es.cipher = cipherID
+	return nil
+}
+
+// Cipher returns the cipher ID used for new files
+func (es *EncryptionService) Cipher() string {
+	return es.cipher
+}
+
+// SetPadding sets the padding scheme used for new files, PaddingNone to
+// write files whose size reveals the size of their contents
+func (es *EncryptionService) SetPadding(scheme string) error {
+	if !IsSupportedPadding(scheme) {
+		return fmt.Errorf("unsupported padding scheme: %q", scheme)
+	}
+	es.padding = scheme
+	return nil
+}
+
+// Padding returns the padding scheme used for new files
+func (es *EncryptionService) Padding() string {
+	return es.padding
+}
+
+// SetVolumeSize splits new files into volumes of size bytes (see
+// NewVolumeWriter), or writes them whole when size is 0
+func (es *EncryptionService) SetVolumeSize(size int64) error {
+	if size != 0 && size < MinVolumeSize {
+		return fmt.Errorf("volume size must be at least %d bytes", MinVolumeSize)
+	}
+	es.volumeSize = size
+	return nil
+}
+
+// VolumeSize returns the size of the volumes new files are split into, 0
+// if they are written whole
+func (es *EncryptionService) VolumeSize() int64 {
+	return es.volumeSize
+}
+
+// SetParity writes a parity file beside every new file (see WriteParity),
+// with parity taking percent of its size, or none when percent is 0
+func (es *EncryptionService) SetParity(percent int) error {
+	if percent != 0 && (percent < MinParity || percent > MaxParity) {
+		return fmt.Errorf("parity overhead must be between %d and %d percent", MinParity, MaxParity)
+	}
+	es.parity = percent
+	return nil
+}
+
+// Parity returns the parity overhead of new files in percent, 0 if they
+// are written without parity
+func (es *EncryptionService) Parity() int {
+	return es.parity
+}
+
+// finishOutput signs the new file at outputPath and writes its parity files
+func (es *EncryptionService) finishOutput(outputPath string) error {
+	if err := es.signOutput(outputPath); err != nil {
+		return err
+	}
+	return es.writeOutputParity(outputPath)
+}
+
+// writeOutputParity writes the parity files of the new file at outputPath,
+// one per volume if it was split. Without parity, stale parity files of a
+// file it replaced are removed, so a repair can't bring that file back.
+func (es *EncryptionService) writeOutputParity(outputPath string) error {
+	paths := []string{outputPath}
+	if es.volumeSize > 0 {
+		volumes, err := ListVolumes(outputPath)
+		if err != nil {
+			return err
+		}
+		paths = volumes
+	}
+
+	for _, path := range paths {
+		if es.parity == 0 {
+			if err := os.Remove(ParityPath(path)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove stale parity file: %w", err)
+			}
+			continue
+		}
+		if err := WriteParity(path, es.parity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outputFile is a new nokvault file being written
+type outputFile interface {
+	io.WriteCloser
+	// Remove closes the file and removes everything written to it
+	Remove()
+}
+
+// singleOutputFile is an outputFile written whole
+type singleOutputFile struct {
+	*os.File
+}
+
+// Remove closes and removes the file
+func (f singleOutputFile) Remove() {
+	f.File.Close()
+	os.Remove(f.Name())
+}
+
+// createOutput creates a new nokvault file at outputPath, split into volumes
+// if a volume size is set
+func (es *EncryptionService) createOutput(outputPath string) (outputFile, error) {
+	if es.volumeSize > 0 {
+		return NewVolumeWriter(outputPath, es.volumeSize)
+	}
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output file: %w", err)
+	}
+	return singleOutputFile{file}, nil
 }
 
 // EncryptData encrypts data using AES-256-GCM
@@ -50,83 +190,444 @@ func (es *EncryptionService) DecryptData(ciphertext []byte, key []byte) ([]byte,
 	return plaintext, nil
 }
 
-// EncryptFile encrypts a file
+// EncryptFile encrypts a file as a chunked stream without a nokvault header
 func (es *EncryptionService) EncryptFile(inputPath string, outputPath string, key []byte) error {
-	data, err := os.ReadFile(inputPath)
+	inputFile, err := os.Open(inputPath)
 	if err != nil {
 		return fmt.Errorf("failed to read input file: %w", err)
 	}
+	defer inputFile.Close()
 
-	ciphertext, err := es.EncryptData(data, key)
+	outputFile, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to write output file: %w", err)
 	}
+	defer outputFile.Close()
 
-	if err := os.WriteFile(outputPath, ciphertext, 0600); err != nil {
-		return fmt.Errorf("failed to write output file: %w", err)
+	if err := es.EncryptStream(inputFile, outputFile, key); err != nil {
+		return err
 	}
 
-	return nil
+	return outputFile.Close()
 }
 
-// DecryptFile decrypts a file
+// DecryptFile decrypts a file produced by EncryptFile
 func (es *EncryptionService) DecryptFile(inputPath string, outputPath string, key []byte) error {
-	ciphertext, err := os.ReadFile(inputPath)
+	inputFile, err := os.Open(inputPath)
 	if err != nil {
 		return fmt.Errorf("failed to read input file: %w", err)
 	}
+	defer inputFile.Close()
 
-	plaintext, err := es.DecryptData(ciphertext, key)
+	outputFile, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to write output file: %w", err)
 	}
+	defer outputFile.Close()
 
-	if err := os.WriteFile(outputPath, plaintext, 0600); err != nil {
-		return fmt.Errorf("failed to write output file: %w", err)
+	if err := es.DecryptStream(inputFile, outputFile, key); err != nil {
+		return err
 	}
 
-	return nil
+	return outputFile.Close()
 }
 
-// EncryptStream encrypts data from a reader and writes to a writer
+// EncryptStream encrypts data from a reader and writes it to a writer as a
+// chunked stream with the service's cipher, using constant memory regardless
+// of input size
 func (es *EncryptionService) EncryptStream(reader io.Reader, writer io.Writer, key []byte) error {
-	data, err := io.ReadAll(reader)
+	return es.encryptChunks(writer, reader, es.cipher, key, crypto.DefaultChunkSize, nil)
+}
+
+// DecryptStream decrypts a chunked stream from a reader and writes it to a writer.
+// Plaintext is only written once the chunk containing it has been authenticated.
+func (es *EncryptionService) DecryptStream(reader io.Reader, writer io.Writer, key []byte) error {
+	plaintext, err := es.newChunkReader(reader, es.cipher, key, crypto.DefaultChunkSize, nil)
 	if err != nil {
-		return fmt.Errorf("failed to read data: %w", err)
+		return err
+	}
+
+	if _, err := io.Copy(writer, plaintext); err != nil {
+		return fmt.Errorf("failed to write decrypted data: %w", err)
 	}
 
-	ciphertext, err := es.EncryptData(data, key)
+	return nil
+}
+
+// EncryptPayload encrypts the payload of a nokvault file using the format
+// parameters of header, compressing and padding it as recorded there.
+// The header (built by FileHandler.NewHeader) is authenticated with every chunk.
+func (es *EncryptionService) EncryptPayload(writer io.Writer, reader io.Reader, key []byte, header *NokvaultHeader) error {
+	if header.Params == nil {
+		return fmt.Errorf("unsupported version for new payloads: %d", header.Version)
+	}
+	ad, err := header.AssociatedData()
 	if err != nil {
 		return err
 	}
+	cipherID := header.Params.Cipher
+	chunkSize := int(header.Params.ChunkSize)
 
-	if _, err := writer.Write(ciphertext); err != nil {
-		return fmt.Errorf("failed to write encrypted data: %w", err)
+	if !IsSupportedPadding(header.Params.Padding) {
+		return fmt.Errorf("unsupported padding scheme: %q", header.Params.Padding)
 	}
 
-	return nil
+	switch header.Params.Compression {
+	case CompressionNone:
+		return es.encryptChunks(writer, padPayload(reader, header.Params.Padding), cipherID, key, chunkSize, ad)
+	case CompressionGzip:
+	default:
+		return fmt.Errorf("unsupported compression algorithm: %q", header.Params.Compression)
+	}
+
+	// Compress on the fly: the compressor feeds the stream encryptor
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		compressor := es.compressionService.NewCompressWriter(pipeWriter)
+		if _, err := io.Copy(compressor, reader); err != nil {
+			pipeWriter.CloseWithError(fmt.Errorf("compression failed: %w", err))
+			return
+		}
+		if err := compressor.Close(); err != nil {
+			pipeWriter.CloseWithError(fmt.Errorf("compression failed: %w", err))
+			return
+		}
+		pipeWriter.Close()
+	}()
+
+	err = es.encryptChunks(writer, padPayload(pipeReader, header.Params.Padding), cipherID, key, chunkSize, ad)
+	pipeReader.CloseWithError(err)
+	return err
 }
 
-// DecryptStream decrypts data from a reader and writes to a writer
-func (es *EncryptionService) DecryptStream(reader io.Reader, writer io.Writer, key []byte) error {
-	ciphertext, err := io.ReadAll(reader)
+// padPayload returns reader padded by scheme, or reader itself without padding
+func padPayload(reader io.Reader, scheme string) io.Reader {
+	if scheme == PaddingNone {
+		return reader
+	}
+	return newPadReader(reader, scheme)
+}
+
+// NewPayloadReader returns a reader of the decrypted payload of a nokvault file.
+// The reader must be positioned at header.DataOffset. Version 1 payloads are a
+// single message and are decrypted in memory; later versions are streamed and
+// fail authentication if the header or metadata was modified.
+func (es *EncryptionService) NewPayloadReader(reader io.Reader, header *NokvaultHeader, key []byte) (io.Reader, error) {
+	if header.Version == LegacyVersion {
+		ciphertext, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encrypted data: %w", err)
+		}
+
+		plaintext, err := es.DecryptData(ciphertext, key)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(plaintext), nil
+	}
+
+	ad, err := header.AssociatedData()
+	if err != nil {
+		return nil, err
+	}
+
+	return es.newChunkReader(reader, header.Params.Cipher, key, int(header.Params.ChunkSize), ad)
+}
+
+// NewPlaintextReader returns a reader of the decrypted, unpadded and
+// decompressed contents of a nokvault file. The reader must be positioned at header.DataOffset.
+// The compression algorithm comes from the header; version 1 files did not
+// record it, so their payload is checked for the gzip magic number instead.
+func (es *EncryptionService) NewPlaintextReader(reader io.Reader, header *NokvaultHeader, key []byte) (io.ReadCloser, error) {
+	plaintext, _, err := es.newPlaintextReader(reader, header, key)
+	return plaintext, err
+}
+
+// newPlaintextReader is NewPlaintextReader, also returning the compression
+// algorithm of the payload
+func (es *EncryptionService) newPlaintextReader(reader io.Reader, header *NokvaultHeader, key []byte) (io.ReadCloser, string, error) {
+	payload, err := es.NewPayloadReader(reader, header, key)
 	if err != nil {
-		return fmt.Errorf("failed to read data: %w", err)
+		return nil, "", err
+	}
+
+	compression := CompressionNone
+	if header.Params != nil {
+		compression = header.Params.Compression
+		if header.Params.Padding != PaddingNone {
+			payload = newUnpadReader(payload)
+		}
+	} else {
+		buffered := bufio.NewReader(payload)
+		head, err := buffered.Peek(2)
+		if err != nil && err != io.EOF {
+			return nil, "", err
+		}
+		if es.compressionService.IsCompressed(head) {
+			compression = CompressionGzip
+		}
+		payload = buffered
 	}
 
-	plaintext, err := es.DecryptData(ciphertext, key)
+	switch compression {
+	case CompressionNone:
+		return io.NopCloser(payload), compression, nil
+	case CompressionGzip:
+		decompressor, err := es.compressionService.NewDecompressReader(payload)
+		return decompressor, compression, err
+	default:
+		return nil, "", fmt.Errorf("unsupported compression algorithm: %q", compression)
+	}
+}
+
+// DecryptPayload decrypts the payload of a nokvault file into writer,
+// decompressing it if needed. The reader must be positioned at header.DataOffset.
+func (es *EncryptionService) DecryptPayload(writer io.Writer, reader io.Reader, header *NokvaultHeader, key []byte) error {
+	plaintext, err := es.NewPlaintextReader(reader, header, key)
 	if err != nil {
 		return err
 	}
+	defer plaintext.Close()
 
-	if _, err := writer.Write(plaintext); err != nil {
+	if _, err := io.Copy(writer, plaintext); err != nil {
 		return fmt.Errorf("failed to write decrypted data: %w", err)
 	}
 
 	return nil
 }
 
+// EncryptFileWithMetadata encrypts a file into a nokvault file with a header
+// carrying the file's metadata. The payload is encrypted with a random file
+// key, which is stored in a key slot wrapped under key (derived from a password
+// with salt). The input is streamed, so memory use does not depend on the file size.
+func (es *EncryptionService) EncryptFileWithMetadata(inputPath, outputPath string, key, salt []byte, compress bool) error {
+	return es.EncryptFileForRecipients(inputPath, outputPath, &Recipients{Key: key, Salt: salt}, compress)
+}
+
+// EncryptFileForRecipients encrypts a file like EncryptFileWithMetadata, with
+// a key slot for each of the recipients
+func (es *EncryptionService) EncryptFileForRecipients(inputPath, outputPath string, recipients *Recipients, compress bool) error {
+	metadata, err := NewFileHandler().ReadMetadata(inputPath)
+	if err != nil {
+		return err
+	}
+	return es.encryptFile(inputPath, outputPath, metadata, recipients, compress)
+}
+
+// encryptFile encrypts the file at inputPath with metadata recorded in the header
+func (es *EncryptionService) encryptFile(inputPath, outputPath string, metadata *FileMetadata, recipients *Recipients, compress bool) error {
+	inputFile, err := os.Open(inputPath)
+	if err != nil {
+		return fmt.Errorf("failed to open input file: %w", err)
+	}
+	defer inputFile.Close()
+
+	// Only compress inputs that are large enough and not already compressed
+	input := bufio.NewReaderSize(inputFile, crypto.DefaultChunkSize)
+	if compress {
+		head, err := input.Peek(compressionMinSize)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+		compress = es.compressionService.ShouldCompress(head, compressionMinSize)
+	}
+
+	params := es.NewFormatParams()
+	if compress {
+		params.Compression = CompressionGzip
+	}
+	return es.writeFile(outputPath, input, params, metadata, recipients)
+}
+
+// writeFile encrypts everything read from input into a new nokvault file at
+// outputPath with the given format parameters and metadata, under a random
+// file key wrapped for each of the recipients
+func (es *EncryptionService) writeFile(outputPath string, input io.Reader, params *FormatParams, metadata *FileMetadata, recipients *Recipients) error {
+	fileHandler := NewFileHandler()
+
+	fileKey, err := crypto.GenerateKey()
+	if err != nil {
+		return err
+	}
+	defer zeroizeKey(fileKey)
+
+	slots, err := es.keyManager.NewKeySlots(recipients, fileKey, params.Cipher)
+	if err != nil {
+		return err
+	}
+
+	header, err := fileHandler.NewHeader(params, metadata, fileKey, slots)
+	if err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+
+	// A partly written output is removed, so a failure leaves no file that
+	// looks encrypted but doesn't decrypt
+	outputFile, err := es.createOutput(outputPath)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	if err := fileHandler.WriteRawHeader(outputFile, header); err != nil {
+		outputFile.Remove()
+		return err
+	}
+
+	if err := es.EncryptPayload(outputFile, input, fileKey, header); err != nil {
+		outputFile.Remove()
+		return err
+	}
+
+	if err := outputFile.Close(); err != nil {
+		outputFile.Remove()
+		return fmt.Errorf("failed to write encrypted data: %w", err)
+	}
+
+	return es.finishOutput(outputPath)
+}
+
+// DecryptFileWithMetadata decrypts a nokvault file to outputPath and returns
+// the metadata stored in its header. key is the key derived from the password
+// for one of the file's key slots. Restoring the metadata is left to the caller.
+func (es *EncryptionService) DecryptFileWithMetadata(inputPath, outputPath string, key []byte) (*FileMetadata, error) {
+	return es.decryptFile(inputPath, outputPath, func(header *NokvaultHeader) ([]byte, error) {
+		return es.keyManager.OpenFileKey(header, key)
+	})
+}
+
+// DecryptFileWithCredentials decrypts a nokvault file to outputPath, deriving
+// key slot keys from creds, and returns the metadata stored in its header.
+// Slot keys are cached in cache when it is not nil.
+func (es *EncryptionService) DecryptFileWithCredentials(inputPath, outputPath string, creds *Credentials, cache *KeyCache) (*FileMetadata, error) {
+	return es.decryptFile(inputPath, outputPath, func(header *NokvaultHeader) ([]byte, error) {
+		fileKey, _, err := es.keyManager.UnlockFileKey(header, creds, cache)
+		return fileKey, err
+	})
+}
+
+// decryptFile decrypts a nokvault file with the file key returned by unlock.
+// Nothing is written to outputPath for files recording a directory or a link.
+func (es *EncryptionService) decryptFile(inputPath, outputPath string, unlock func(header *NokvaultHeader) ([]byte, error)) (*FileMetadata, error) {
+	inputFile, err := openEncryptedFile(inputPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open input file: %w", err)
+	}
+	defer inputFile.Close()
+
+	header, _, err := NewFileHandler().ReadHeaderWithMetadata(inputFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	fileKey, err := unlock(header)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroizeKey(fileKey)
+
+	metadata, err := header.OpenMetadata(fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := inputFile.Seek(int64(header.DataOffset), io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek to encrypted data: %w", err)
+	}
+
+	// Directories and links are described by their metadata alone; their
+	// payload is still authenticated
+	if metadata != nil && !metadata.IsRegular() {
+		if err := es.DecryptPayload(io.Discard, inputFile, header, fileKey); err != nil {
+			return nil, err
+		}
+		return metadata, nil
+	}
+
+	outputFile, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write output file: %w", err)
+	}
+	defer outputFile.Close()
+
+	if err := es.DecryptPayload(outputFile, inputFile, header, fileKey); err != nil {
+		outputFile.Close()
+		os.Remove(outputPath)
+		return nil, err
+	}
+
+	if err := outputFile.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write output file: %w", err)
+	}
+
+	return metadata, nil
+}
+
+// UnlockMetadata returns the metadata recorded in header, which must have been
+// read with ReadHeaderWithMetadata, unlocking the file with creds if the
+// metadata is sealed. Slot keys are cached in cache when it is not nil.
+func (es *EncryptionService) UnlockMetadata(header *NokvaultHeader, creds *Credentials, cache *KeyCache) (*FileMetadata, error) {
+	if !header.MetadataSealed() {
+		return header.OpenMetadata(nil)
+	}
+
+	fileKey, _, err := es.keyManager.UnlockFileKey(header, creds, cache)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroizeKey(fileKey)
+
+	return header.OpenMetadata(fileKey)
+}
+
+// NewFormatParams returns the format parameters for a new file using this
+// service's cipher and padding scheme
+func (es *EncryptionService) NewFormatParams() *FormatParams {
+	params := DefaultFormatParams()
+	params.Cipher = es.cipher
+	params.Padding = es.padding
+	return params
+}
+
 // GetKeyManager returns the key manager
 func (es *EncryptionService) GetKeyManager() *KeyManager {
 	return es.keyManager
 }
+
+// encryptChunks seals everything from reader into writer as a chunked stream
+func (es *EncryptionService) encryptChunks(writer io.Writer, reader io.Reader, cipherID string, key []byte, chunkSize int, ad []byte) error {
+	aead, err := crypto.NewAEAD(cipherID, key)
+	if err != nil {
+		return fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	stream, err := crypto.NewStreamWriter(writer, aead.AEAD(), chunkSize, ad)
+	if err != nil {
+		return fmt.Errorf("encryption failed: %w", err)
+	}
+
+	if _, err := io.Copy(stream, reader); err != nil {
+		return fmt.Errorf("encryption failed: %w", err)
+	}
+
+	if err := stream.Close(); err != nil {
+		return fmt.Errorf("encryption failed: %w", err)
+	}
+
+	return nil
+}
+
+// newChunkReader opens a chunked stream for decryption
+func (es *EncryptionService) newChunkReader(reader io.Reader, cipherID string, key []byte, chunkSize int, ad []byte) (io.Reader, error) {
+	aead, err := crypto.NewAEAD(cipherID, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	stream, err := crypto.NewStreamReader(reader, aead.AEAD(), chunkSize, ad)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %w", err)
+	}
+
+	return stream, nil
+}
@@ -1,8 +1,17 @@
 package core
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"testing"
+	"testing/iotest"
 
+	"github.com/jimididit/nokvault/internal/crypto"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -71,3 +80,321 @@ func TestEncryptionServiceWrongKey(t *testing.T) {
 	_, err = service.DecryptData(ciphertext, key2)
 	assert.Error(t, err, "Decryption with wrong key should fail")
 }
+
+func TestEncryptionServiceStreamEncryptDecrypt(t *testing.T) {
+	service := NewEncryptionService()
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+
+	// Larger than one chunk so the payload spans several chunks
+	plaintext := bytes.Repeat([]byte("stream data "), 20000)
+
+	var encrypted bytes.Buffer
+	err := service.EncryptStream(bytes.NewReader(plaintext), &encrypted, key)
+	require.NoError(t, err, "Stream encryption should succeed")
+
+	var decrypted bytes.Buffer
+	err = service.DecryptStream(&encrypted, &decrypted, key)
+	require.NoError(t, err, "Stream decryption should succeed")
+
+	assert.Equal(t, plaintext, decrypted.Bytes(), "Decrypted stream should match original")
+}
+
+func TestEncryptionServiceEncryptFileWithMetadata(t *testing.T) {
+	service := NewEncryptionService()
+	keyManager := service.GetKeyManager()
+
+	key, salt, err := keyManager.DeriveKeyFromPassword([]byte("test-password-123"))
+	require.NoError(t, err, "Failed to derive key")
+
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, "input.txt")
+	encryptedPath := inputPath + ".nokvault"
+	outputPath := filepath.Join(tmpDir, "output.txt")
+
+	plaintext := bytes.Repeat([]byte("compressible content "), 10000)
+	require.NoError(t, os.WriteFile(inputPath, plaintext, 0644), "Failed to create test file")
+
+	for _, compress := range []bool{false, true} {
+		err = service.EncryptFileWithMetadata(inputPath, encryptedPath, key, salt, compress)
+		require.NoError(t, err, "Encryption should succeed (compress=%v)", compress)
+
+		metadata, err := service.DecryptFileWithMetadata(encryptedPath, outputPath, key)
+		require.NoError(t, err, "Decryption should succeed (compress=%v)", compress)
+		require.NotNil(t, metadata, "Metadata should be returned")
+		assert.Equal(t, "input.txt", metadata.Name, "Metadata name should match")
+
+		decrypted, err := os.ReadFile(outputPath)
+		require.NoError(t, err, "Failed to read decrypted file")
+		assert.Equal(t, plaintext, decrypted, "Decrypted content should match original (compress=%v)", compress)
+	}
+}
+
+func TestEncryptionServiceRemovesPartialOutput(t *testing.T) {
+	service := NewEncryptionService()
+	service.GetKeyManager().SetParams(8*1024, 1, 1, 32)
+	key, salt, err := service.GetKeyManager().DeriveKeyFromPassword([]byte("test-password-123"))
+	require.NoError(t, err, "Failed to derive key")
+	recipients := &Recipients{Key: key, Salt: salt}
+
+	readErr := errors.New("read failed")
+	for _, volumeSize := range []int64{0, MinVolumeSize} {
+		service.volumeSize = volumeSize
+		outputPath := filepath.Join(t.TempDir(), "input.txt.nokvault")
+
+		// The input fails after a few chunks have been written
+		input := io.MultiReader(bytes.NewReader(make([]byte, 4*crypto.DefaultChunkSize)), iotest.ErrReader(readErr))
+		err := service.writeFile(outputPath, input, service.NewFormatParams(), &FileMetadata{Name: "input.txt"}, recipients)
+		assert.ErrorIs(t, err, readErr)
+
+		entries, err := os.ReadDir(filepath.Dir(outputPath))
+		require.NoError(t, err)
+		assert.Empty(t, entries, "A failed encryption should leave no output (volume size %d)", volumeSize)
+	}
+}
+
+func TestEncryptionServiceDecryptLegacyFile(t *testing.T) {
+	service := NewEncryptionService()
+	key := make([]byte, 32)
+	salt := make([]byte, 16)
+
+	plaintext := []byte("written by nokvault 0.1")
+	ciphertext, err := service.EncryptData(plaintext, key)
+	require.NoError(t, err, "Encryption should succeed")
+
+	// Build a version 1 file by hand: header followed by a single AES-GCM message
+	var buf bytes.Buffer
+	fields := headerFieldsV1{}
+	copy(fields.Salt[:], salt)
+	fields.DataOffset = uint64(binary.Size(headerPrelude{}) + binary.Size(fields))
+	prelude := headerPrelude{Version: LegacyVersion}
+	copy(prelude.Magic[:], NokvaultMagic)
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, &prelude))
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, &fields))
+	buf.Write(ciphertext)
+
+	tmpDir := t.TempDir()
+	encryptedPath := filepath.Join(tmpDir, "legacy.nokvault")
+	outputPath := filepath.Join(tmpDir, "legacy.txt")
+	require.NoError(t, os.WriteFile(encryptedPath, buf.Bytes(), 0600))
+
+	_, err = service.DecryptFileWithMetadata(encryptedPath, outputPath, key)
+	require.NoError(t, err, "Version 1 files should still decrypt")
+
+	decrypted, err := os.ReadFile(outputPath)
+	require.NoError(t, err, "Failed to read decrypted file")
+	assert.Equal(t, plaintext, decrypted, "Decrypted content should match original")
+}
+
+func TestEncryptionServiceDecryptWithRecordedKDFParams(t *testing.T) {
+	service := NewEncryptionService()
+	service.GetKeyManager().SetParams(8*1024, 1, 1, 32)
+
+	password := []byte("test-password-123")
+	key, salt, err := service.GetKeyManager().DeriveKeyFromPassword(password)
+	require.NoError(t, err, "Failed to derive key")
+
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, "input.txt")
+	encryptedPath := inputPath + ".nokvault"
+	outputPath := filepath.Join(tmpDir, "output.txt")
+
+	plaintext := []byte("encrypted with custom key derivation parameters")
+	require.NoError(t, os.WriteFile(inputPath, plaintext, 0644), "Failed to create test file")
+	require.NoError(t, service.EncryptFileWithMetadata(inputPath, encryptedPath, key, salt, false), "Encryption should succeed")
+
+	header, err := NewFileHandler().ReadHeaderFromFile(encryptedPath)
+	require.NoError(t, err, "Failed to read header")
+	require.Len(t, header.KeySlots, 1, "Header should have one key slot")
+	kdf := header.KeySlots[0].KDF
+	require.NotNil(t, kdf, "Key slot should record KDF parameters")
+	assert.Equal(t, "argon2id", kdf.Algorithm)
+	assert.Equal(t, uint32(8*1024), kdf.Memory)
+	assert.Equal(t, uint32(1), kdf.Time)
+	assert.Equal(t, uint8(1), kdf.Parallelism)
+	assert.Equal(t, uint32(32), kdf.KeyLength)
+
+	// A key manager with default parameters must still derive the right key
+	fresh := NewEncryptionService()
+	derived, err := fresh.GetKeyManager().DeriveSlotKey(password, &header.KeySlots[0])
+	require.NoError(t, err, "Key derivation from key slot should succeed")
+	assert.Equal(t, key, derived, "Key derived from key slot should match original key")
+
+	_, err = fresh.DecryptFileWithCredentials(encryptedPath, outputPath, &Credentials{Password: password}, nil)
+	require.NoError(t, err, "Decryption should succeed")
+
+	decrypted, err := os.ReadFile(outputPath)
+	require.NoError(t, err, "Failed to read decrypted file")
+	assert.Equal(t, plaintext, decrypted)
+}
+
+func TestEncryptionServiceHeaderTampering(t *testing.T) {
+	service := NewEncryptionService()
+	key, salt, err := service.GetKeyManager().DeriveKeyFromPassword([]byte("test-password-123"))
+	require.NoError(t, err, "Failed to derive key")
+
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, "input.txt")
+	require.NoError(t, os.WriteFile(inputPath, []byte("header tampering test"), 0644), "Failed to create test file")
+
+	encryptedPath := filepath.Join(tmpDir, "input.txt.nokvault")
+	require.NoError(t, service.EncryptFileWithMetadata(inputPath, encryptedPath, key, salt, false), "Encryption should succeed")
+	original, err := os.ReadFile(encryptedPath)
+	require.NoError(t, err, "Failed to read encrypted file")
+
+	decryptModified := func(data []byte) error {
+		modifiedPath := filepath.Join(tmpDir, "modified.nokvault")
+		require.NoError(t, os.WriteFile(modifiedPath, data, 0644), "Failed to write modified file")
+		_, err := service.DecryptFileWithMetadata(modifiedPath, filepath.Join(tmpDir, "output.txt"), key)
+		return err
+	}
+
+	require.NoError(t, decryptModified(original), "Unmodified file should decrypt")
+
+	// The metadata is sealed, so the name is not visible and flipping a bit
+	// of the metadata section must fail
+	assert.NotContains(t, string(original), "input.txt", "Metadata should not be stored in plaintext")
+	header, err := NewFileHandler().ReadHeaderFromFile(encryptedPath)
+	require.NoError(t, err, "Failed to read header")
+	tampered := append([]byte(nil), original...)
+	tampered[header.DataOffset-uint64(header.MetadataSize)] ^= 0x01
+	assert.Error(t, decryptModified(tampered), "Modified metadata should fail authentication")
+
+	// Change a byte of the format parameters
+	tampered = bytes.Replace(original, []byte(`"chunk_size":65536`), []byte(`"chunk_size":65537`), 1)
+	require.NotEqual(t, original, tampered, "Chunk size should have been replaced")
+	assert.Error(t, decryptModified(tampered), "Modified format parameters should fail authentication")
+
+	// Graft the header of another file encrypted with the same key onto this payload
+	otherPath := filepath.Join(tmpDir, "other.txt")
+	require.NoError(t, os.WriteFile(otherPath, []byte("another file!!!!!!!!!"), 0600), "Failed to create test file")
+	otherEncrypted := filepath.Join(tmpDir, "other.txt.nokvault")
+	require.NoError(t, service.EncryptFileWithMetadata(otherPath, otherEncrypted, key, salt, false), "Encryption should succeed")
+	other, err := os.ReadFile(otherEncrypted)
+	require.NoError(t, err, "Failed to read encrypted file")
+
+	originalHeader, err := NewFileHandler().ReadHeaderFromFile(encryptedPath)
+	require.NoError(t, err, "Failed to read header")
+	otherHeader, err := NewFileHandler().ReadHeaderFromFile(otherEncrypted)
+	require.NoError(t, err, "Failed to read header")
+
+	grafted := append(append([]byte{}, other[:otherHeader.DataOffset]...), original[originalHeader.DataOffset:]...)
+	assert.Error(t, decryptModified(grafted), "A header from another file should fail authentication")
+}
+
+func TestEncryptionServiceCompressionFromHeader(t *testing.T) {
+	service := NewEncryptionService()
+	key, salt, err := service.GetKeyManager().DeriveKeyFromPassword([]byte("test-password-123"))
+	require.NoError(t, err, "Failed to derive key")
+
+	tmpDir := t.TempDir()
+	outputPath := filepath.Join(tmpDir, "output")
+
+	// A gzip file encrypted without compression must come back unchanged
+	gzipped, err := service.compressionService.Compress(bytes.Repeat([]byte("already compressed "), 200))
+	require.NoError(t, err, "Failed to compress test data")
+	gzipPath := filepath.Join(tmpDir, "data.gz")
+	require.NoError(t, os.WriteFile(gzipPath, gzipped, 0644), "Failed to create test file")
+
+	encryptedPath := gzipPath + ".nokvault"
+	require.NoError(t, service.EncryptFileWithMetadata(gzipPath, encryptedPath, key, salt, false), "Encryption should succeed")
+
+	header, err := NewFileHandler().ReadHeaderFromFile(encryptedPath)
+	require.NoError(t, err, "Failed to read header")
+	assert.Equal(t, CompressionNone, header.Params.Compression, "Header should record no compression")
+
+	_, err = service.DecryptFileWithMetadata(encryptedPath, outputPath, key)
+	require.NoError(t, err, "Decryption should succeed")
+	decrypted, err := os.ReadFile(outputPath)
+	require.NoError(t, err, "Failed to read decrypted file")
+	assert.Equal(t, gzipped, decrypted, "Gzip input should not be decompressed")
+
+	// A payload that claims gzip but isn't must fail instead of passing through
+	params := DefaultFormatParams()
+	params.Compression = CompressionGzip
+	slot, err := service.GetKeyManager().NewPasswordSlot(key, salt, key, params.Cipher)
+	require.NoError(t, err)
+	badHeader, err := NewFileHandler().NewHeader(params, nil, key, []KeySlot{slot})
+	require.NoError(t, err, "NewHeader should succeed")
+	ad, err := badHeader.AssociatedData()
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, NewFileHandler().WriteRawHeader(&buf, badHeader))
+	require.NoError(t, service.encryptChunks(&buf, bytes.NewReader([]byte("not gzip data")), params.Cipher, key, int(params.ChunkSize), ad))
+
+	badPath := filepath.Join(tmpDir, "bad.nokvault")
+	require.NoError(t, os.WriteFile(badPath, buf.Bytes(), 0644), "Failed to write test file")
+	_, err = service.DecryptFileWithMetadata(badPath, outputPath, key)
+	require.Error(t, err, "Corrupt compressed data should fail decryption")
+	assert.Contains(t, err.Error(), "decompression failed")
+}
+
+func TestEncryptionServiceCipherFromHeader(t *testing.T) {
+	service := NewEncryptionService()
+	require.NoError(t, service.SetCipher(crypto.CipherXChaCha20Poly1305))
+	assert.Error(t, service.SetCipher("des"), "Unknown cipher should be rejected")
+
+	key, salt, err := service.GetKeyManager().DeriveKeyFromPassword([]byte("test-password-123"))
+	require.NoError(t, err, "Failed to derive key")
+
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, "input.txt")
+	encryptedPath := inputPath + ".nokvault"
+	outputPath := filepath.Join(tmpDir, "output.txt")
+
+	plaintext := bytes.Repeat([]byte("xchacha "), 20000)
+	require.NoError(t, os.WriteFile(inputPath, plaintext, 0644), "Failed to create test file")
+	require.NoError(t, service.EncryptFileWithMetadata(inputPath, encryptedPath, key, salt, true), "Encryption should succeed")
+
+	header, err := NewFileHandler().ReadHeaderFromFile(encryptedPath)
+	require.NoError(t, err, "Failed to read header")
+	assert.Equal(t, crypto.CipherXChaCha20Poly1305, header.Params.Cipher, "Header should record the cipher")
+
+	// A service with the default cipher follows the header
+	_, err = NewEncryptionService().DecryptFileWithMetadata(encryptedPath, outputPath, key)
+	require.NoError(t, err, "Decryption should succeed")
+
+	decrypted, err := os.ReadFile(outputPath)
+	require.NoError(t, err, "Failed to read decrypted file")
+	assert.Equal(t, plaintext, decrypted)
+}
+
+func TestEncryptionServicePaddingFromHeader(t *testing.T) {
+	service := NewEncryptionService()
+	require.NoError(t, service.SetPadding(PaddingBuckets))
+	assert.Error(t, service.SetPadding("random"), "Unknown padding schemes should be rejected")
+
+	key, salt, err := service.GetKeyManager().DeriveKeyFromPassword([]byte("test-password-123"))
+	require.NoError(t, err, "Failed to derive key")
+
+	tmpDir := t.TempDir()
+	var sizes []int64
+	for _, size := range []int{10, 1000} {
+		inputPath := filepath.Join(tmpDir, fmt.Sprintf("input-%d.txt", size))
+		encryptedPath := inputPath + ".nokvault"
+		outputPath := inputPath + ".out"
+
+		plaintext := bytes.Repeat([]byte{'x'}, size)
+		require.NoError(t, os.WriteFile(inputPath, plaintext, 0644), "Failed to create test file")
+		require.NoError(t, service.EncryptFileWithMetadata(inputPath, encryptedPath, key, salt, false), "Encryption should succeed")
+
+		header, err := NewFileHandler().ReadHeaderFromFile(encryptedPath)
+		require.NoError(t, err, "Failed to read header")
+		assert.Equal(t, PaddingBuckets, header.Params.Padding, "Header should record the padding scheme")
+
+		// A service without padding follows the header
+		_, err = NewEncryptionService().DecryptFileWithMetadata(encryptedPath, outputPath, key)
+		require.NoError(t, err, "Decryption should succeed")
+		decrypted, err := os.ReadFile(outputPath)
+		require.NoError(t, err, "Failed to read decrypted file")
+		assert.Equal(t, plaintext, decrypted, "Padding should be stripped")
+
+		info, err := os.Stat(encryptedPath)
+		require.NoError(t, err)
+		sizes = append(sizes, info.Size()-int64(header.DataOffset))
+	}
+	assert.Equal(t, sizes[0], sizes[1], "Payloads in the same bucket should have the same size")
+}
@@ -1,39 +1,357 @@
 package core
 
 import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
+
+	"github.com/jimididit/nokvault/internal/crypto"
 )
 
 // FileMetadata stores file metadata
 type FileMetadata struct {
-	Name         string    `json:"name"`
-	Size         int64     `json:"size"`
-	Mode         uint32    `json:"mode"`
-	ModTime      time.Time `json:"mod_time"`
-	IsDir        bool      `json:"is_dir"`
-	RelativePath string    `json:"relative_path"`
+	Name         string            `json:"name"`
+	Size         int64             `json:"size"`
+	Mode         uint32            `json:"mode"`
+	ModTime      time.Time         `json:"mod_time"`
+	IsDir        bool              `json:"is_dir"`
+	RelativePath string            `json:"relative_path"`
+	Symlink      string            `json:"symlink,omitempty"`  // Target of a symbolic link
+	Hardlink     string            `json:"hardlink,omitempty"` // Relative path of the file this is a hard link to
+	Owner        *FileOwner        `json:"owner,omitempty"`    // Owner and group, if recorded
+	Xattrs       map[string][]byte `json:"xattrs,omitempty"`   // Extended attributes, if recorded
+}
+
+// FileOwner is the numeric owner and group of a file
+type FileOwner struct {
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+}
+
+// IsRegular reports whether the metadata describes a regular file, whose
+// contents are the payload, rather than a directory or a link
+func (m *FileMetadata) IsRegular() bool {
+	return !m.IsDir && m.Symlink == "" && m.Hardlink == ""
 }
 
 // NokvaultHeader represents the header of a nokvault encrypted file
 type NokvaultHeader struct {
 	Magic        [8]byte // "NOKVAULT"
 	Version      uint16
+	Salt         [16]byte      // Key derivation salt (version 1; later versions keep salts in key slots)
+	ParamsSize   uint32        // Size of JSON format parameters (version 2+)
+	KeysSize     uint32        // Size of the JSON key slot section, including padding (version 2+)
+	MetadataSize uint32        // Size of the metadata section (JSON, sealed from version 3)
+	DataOffset   uint64        // Offset to encrypted data
+	Params       *FormatParams // Format parameters (nil for version 1 files)
+	KeySlots     []KeySlot     // Slots wrapping the file key (version 2+)
+
+	paramsJSON   []byte // Serialized format parameters, as authenticated
+	metadataData []byte // Metadata section, as authenticated
+	metadataRead bool   // Whether metadataData holds the file's metadata section
+}
+
+// ErrUnsupportedVersion is returned for headers of a format version this
+// release cannot read
+var ErrUnsupportedVersion = errors.New("unsupported version")
+
+// NeedsUpgrade reports whether the header is from an older format version
+// that 'nokvault upgrade' rewrites into the current one
+func (h *NokvaultHeader) NeedsUpgrade() bool {
+	return h.Version < CurrentVersion
+}
+
+// MetadataSealed reports whether the metadata is sealed with the file key, so
+// it can only be read with OpenMetadata once the file has been unlocked
+func (h *NokvaultHeader) MetadataSealed() bool {
+	return h.Version >= SealedMetadataVersion
+}
+
+// OpenMetadata returns the metadata of the original file, or nil if the
+// header records none. Sealed metadata is decrypted and authenticated with
+// fileKey; older versions store it as plain JSON and fileKey is not used. The
+// metadata must have been read (see ReadHeaderWithMetadata).
+func (h *NokvaultHeader) OpenMetadata(fileKey []byte) (*FileMetadata, error) {
+	if h.MetadataSize == 0 {
+		return nil, nil
+	}
+	if !h.metadataRead {
+		return nil, fmt.Errorf("header is incomplete: metadata has not been read")
+	}
+
+	metadataJSON := h.metadataData
+	if h.MetadataSealed() {
+		aead, err := h.metadataAEAD(fileKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(metadataJSON) < aead.NonceSize()+aead.Overhead() {
+			return nil, fmt.Errorf("sealed metadata too short")
+		}
+		nonce, sealed := metadataJSON[:aead.NonceSize()], metadataJSON[aead.NonceSize():]
+		metadataJSON, err = aead.Open(nil, nonce, sealed, h.metadataAD())
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt metadata: %w", err)
+		}
+	}
+
+	metadata := &FileMetadata{}
+	if err := json.Unmarshal(metadataJSON, metadata); err != nil {
+		return nil, fmt.Errorf("failed to deserialize metadata: %w", err)
+	}
+	return metadata, nil
+}
+
+// sealMetadata encrypts serialized metadata for the metadata section
+func (h *NokvaultHeader) sealMetadata(metadataJSON, fileKey []byte) ([]byte, error) {
+	aead, err := h.metadataAEAD(fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(metadataJSON)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, metadataJSON, h.metadataAD()), nil
+}
+
+// metadataAEAD returns the cipher sealing the metadata, keyed with a key
+// derived from the file key so it never shares nonces with the payload
+func (h *NokvaultHeader) metadataAEAD(fileKey []byte) (cipher.AEAD, error) {
+	if len(fileKey) == 0 {
+		return nil, fmt.Errorf("the file key is needed to seal or open the metadata")
+	}
+	key, err := crypto.DeriveSubkey(fileKey, metadataKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroizeKey(key)
+
+	aead, err := crypto.NewAEAD(h.Params.Cipher, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return aead.AEAD(), nil
+}
+
+// metadataAD returns the associated data of sealed metadata: the magic,
+// version and format parameters
+func (h *NokvaultHeader) metadataAD() []byte {
+	var ad bytes.Buffer
+	binary.Write(&ad, binary.LittleEndian, headerPrelude{Magic: h.Magic, Version: h.Version})
+	binary.Write(&ad, binary.LittleEndian, uint32(len(h.paramsJSON)))
+	ad.Write(h.paramsJSON)
+	return ad.Bytes()
+}
+
+// AssociatedData returns the data version 2+ files bind to every payload chunk
+// as AEAD associated data: the magic, version, format parameters and metadata
+// section.
+// Key slots are left out so they can be changed without re-encrypting the
+// payload; they are protected by the key wrapping instead. The metadata must
+// have been read (see ReadHeaderWithMetadata) or given to NewHeader.
+// Version 1 files have no associated data.
+func (h *NokvaultHeader) AssociatedData() ([]byte, error) {
+	if h.Version == LegacyVersion {
+		return nil, nil
+	}
+	if !h.metadataRead {
+		return nil, fmt.Errorf("header is incomplete: metadata has not been read")
+	}
+
+	var ad bytes.Buffer
+	binary.Write(&ad, binary.LittleEndian, headerPrelude{Magic: h.Magic, Version: h.Version})
+	binary.Write(&ad, binary.LittleEndian, uint32(len(h.paramsJSON)))
+	ad.Write(h.paramsJSON)
+	binary.Write(&ad, binary.LittleEndian, uint32(len(h.metadataData)))
+	ad.Write(h.metadataData)
+	return ad.Bytes(), nil
+}
+
+// SetKeySlots replaces the key slots and updates the section size and data offset
+func (h *NokvaultHeader) SetKeySlots(slots []KeySlot) error {
+	if len(slots) == 0 {
+		return fmt.Errorf("at least one key slot is required")
+	}
+	if len(slots) > MaxKeySlots {
+		return fmt.Errorf("too many key slots: %d (maximum %d)", len(slots), MaxKeySlots)
+	}
+
+	keysJSON, err := json.Marshal(keySection{Slots: slots})
+	if err != nil {
+		return fmt.Errorf("failed to serialize key slots: %w", err)
+	}
+
+	// The key section only grows, so slots can usually be replaced in place
+	h.KeySlots = slots
+	if size := uint32(paddedKeysSize(len(keysJSON))); size > h.KeysSize {
+		h.KeysSize = size
+	}
+	h.DataOffset = uint64(binary.Size(headerPrelude{})) + uint64(binary.Size(headerFieldsV2{})) +
+		uint64(h.ParamsSize) + uint64(h.KeysSize) + uint64(h.MetadataSize)
+	return nil
+}
+
+// Encode serializes a version 2+ header, including its metadata
+func (h *NokvaultHeader) Encode() ([]byte, error) {
+	if h.Version == LegacyVersion || h.Params == nil {
+		return nil, fmt.Errorf("cannot encode version %d headers", h.Version)
+	}
+	if !h.metadataRead {
+		return nil, fmt.Errorf("header is incomplete: metadata has not been read")
+	}
+
+	keysJSON, err := json.Marshal(keySection{Slots: h.KeySlots})
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize key slots: %w", err)
+	}
+	if len(keysJSON) > int(h.KeysSize) {
+		return nil, fmt.Errorf("key slots changed without updating the header")
+	}
+
+	prelude := headerPrelude{Magic: h.Magic, Version: h.Version}
+	fields := headerFieldsV2{
+		ParamsSize:   h.ParamsSize,
+		KeysSize:     h.KeysSize,
+		MetadataSize: h.MetadataSize,
+		DataOffset:   h.DataOffset,
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &prelude)
+	binary.Write(&buf, binary.LittleEndian, &fields)
+	buf.Write(h.paramsJSON)
+	buf.Write(keysJSON)
+	buf.Write(bytes.Repeat([]byte{' '}, int(h.KeysSize)-len(keysJSON)))
+	buf.Write(h.metadataData)
+	return buf.Bytes(), nil
+}
+
+// keySection is the JSON layout of the key slot section
+type keySection struct {
+	Slots []KeySlot `json:"slots"`
+}
+
+// paddedKeysSize rounds the key section up so that replacing key slots
+// usually leaves the header size, and so the payload offset, unchanged
+func paddedKeysSize(size int) int {
+	return (size + keySectionAlign - 1) / keySectionAlign * keySectionAlign
+}
+
+// FormatParams holds the format parameters stored in version 2+ headers
+type FormatParams struct {
+	Cipher      string `json:"cipher"`               // AEAD cipher ID used for the payload and key wrapping
+	ChunkSize   uint32 `json:"chunk_size"`           // Plaintext size of each sealed payload chunk
+	Compression string `json:"compression"`          // Compression applied to the payload before encryption
+	Content     string `json:"content,omitempty"`    // What the payload holds: ContentFile, ContentArchive, ContentNameMap, ContentRepository or ContentManifest
+	Padding     string `json:"padding,omitempty"`    // Padding scheme hiding the payload size, applied after compression
+	Generation  uint64 `json:"generation,omitempty"` // Generation of a directory manifest, also sealed in its payload
+}
+
+// KDFParams records how a key slot's key was derived from the password
+type KDFParams struct {
+	Algorithm   string `json:"algorithm"`   // "argon2id"
+	Memory      uint32 `json:"memory"`      // Memory cost in KB
+	Time        uint32 `json:"time"`        // Time cost
+	Parallelism uint8  `json:"parallelism"` // Parallelism factor
+	KeyLength   uint32 `json:"key_length"`  // Derived key length in bytes
+}
+
+// NewKDFParams creates a header KDF record from Argon2id parameters
+func NewKDFParams(params *crypto.Argon2Params) *KDFParams {
+	return &KDFParams{
+		Algorithm:   crypto.KDFArgon2id,
+		Memory:      params.Memory,
+		Time:        params.Time,
+		Parallelism: params.Parallelism,
+		KeyLength:   params.KeyLength,
+	}
+}
+
+// Argon2Params converts the record back to Argon2id parameters, rejecting
+// unknown algorithms and out-of-range values from untrusted headers
+func (p *KDFParams) Argon2Params() (*crypto.Argon2Params, error) {
+	if p.Algorithm != crypto.KDFArgon2id {
+		return nil, fmt.Errorf("unsupported key derivation algorithm: %q", p.Algorithm)
+	}
+
+	params := &crypto.Argon2Params{
+		Memory:      p.Memory,
+		Time:        p.Time,
+		Parallelism: p.Parallelism,
+		KeyLength:   p.KeyLength,
+	}
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+
+	return params, nil
+}
+
+// DefaultFormatParams returns the format parameters used for new files
+func DefaultFormatParams() *FormatParams {
+	return &FormatParams{
+		Cipher:      crypto.DefaultCipher,
+		ChunkSize:   crypto.DefaultChunkSize,
+		Compression: CompressionNone,
+	}
+}
+
+// headerPrelude is the part of the header shared by all format versions
+type headerPrelude struct {
+	Magic   [8]byte
+	Version uint16
+}
+
+// headerFieldsV1 is the on-disk layout following the prelude in version 1 files.
+// Version 1 payloads are a single AES-GCM message.
+type headerFieldsV1 struct {
 	Salt         [16]byte
-	MetadataSize uint32 // Size of JSON metadata
-	DataOffset   uint64 // Offset to encrypted data
+	MetadataSize uint32
+	DataOffset   uint64
+}
+
+// headerFieldsV2 is the on-disk layout following the prelude in version 2 files.
+// It is followed by the JSON format parameters, key slots and metadata, and
+// version 2 payloads are a chunked stream (see crypto.StreamWriter).
+type headerFieldsV2 struct {
+	ParamsSize   uint32
+	KeysSize     uint32
+	MetadataSize uint32
+	DataOffset   uint64
 }
 
 const (
 	// NokvaultMagic is the magic number for nokvault files
 	NokvaultMagic = "NOKVAULT"
 	// CurrentVersion is the current file format version
-	CurrentVersion = 1
+	CurrentVersion = 3
+	// SealedMetadataVersion is the first version whose metadata is sealed with the file key
+	SealedMetadataVersion = 3
+	// StreamVersion is the first version with key slots and a chunked payload
+	StreamVersion = 2
+	// LegacyVersion is the original single-message file format version
+	LegacyVersion = 1
+
+	// metadataKeyInfo separates the key sealing the metadata from the file key
+	metadataKeyInfo = "nokvault/metadata"
+
+	// maxHeaderSectionSize limits the params, key and metadata sections read from a header
+	maxHeaderSectionSize = 16 * 1024 * 1024
+	// keySectionAlign is the size the key section is padded to a multiple of
+	keySectionAlign = 512
+	// MaxKeySlots is the maximum number of key slots in a header
+	MaxKeySlots = 32
 )
 
 // FileHandler handles file operations
@@ -62,16 +380,35 @@ func (fh *FileHandler) ReadMetadata(path string) (*FileMetadata, error) {
 	}, nil
 }
 
-// WriteMetadata writes metadata to a file
+// WriteMetadata writes metadata to a file, directory or symbolic link. The
+// owner and extended attributes are restored when they were recorded; like
+// tar, only the superuser restores the owner. Symbolic links only get their
+// owner restored, since changing their mode or times would follow them.
 func (fh *FileHandler) WriteMetadata(path string, metadata *FileMetadata) error {
 	if metadata == nil {
 		return nil
 	}
 
+	// The owner goes first, since changing it can clear setuid and setgid bits
+	if metadata.Owner != nil {
+		if err := restoreOwner(path, metadata.Owner); err != nil {
+			return fmt.Errorf("failed to set owner: %w", err)
+		}
+	}
+	if metadata.Symlink != "" {
+		return nil
+	}
+
 	if err := os.Chmod(path, os.FileMode(metadata.Mode)); err != nil {
 		return fmt.Errorf("failed to set file mode: %w", err)
 	}
 
+	if len(metadata.Xattrs) > 0 {
+		if err := restoreXattrs(path, metadata.Xattrs); err != nil {
+			return fmt.Errorf("failed to set extended attributes: %w", err)
+		}
+	}
+
 	if err := os.Chtimes(path, metadata.ModTime, metadata.ModTime); err != nil {
 		return fmt.Errorf("failed to set file times: %w", err)
 	}
@@ -79,69 +416,244 @@ func (fh *FileHandler) WriteMetadata(path string, metadata *FileMetadata) error
 	return nil
 }
 
-// WriteHeader writes a nokvault header to a file with optional metadata
-func (fh *FileHandler) WriteHeader(writer io.Writer, salt []byte, metadata *FileMetadata) error {
-	header := NokvaultHeader{
-		Version: CurrentVersion,
+// CreateEntry creates the directory or symbolic link described by metadata
+// at path, replacing a file or link already there. Regular files are written
+// by decryption instead, and hard links need the file they link to.
+func (fh *FileHandler) CreateEntry(path string, metadata *FileMetadata) error {
+	switch {
+	case metadata.IsDir:
+		return os.MkdirAll(path, 0700)
+	case metadata.Symlink != "":
+		if info, err := os.Lstat(path); err == nil && !info.IsDir() {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("failed to replace %s: %w", path, err)
+			}
+		}
+		return os.Symlink(metadata.Symlink, path)
+	default:
+		return fmt.Errorf("%s is not a directory or symbolic link", path)
 	}
+}
 
-	copy(header.Magic[:], NokvaultMagic)
-	if len(salt) != 16 {
+// WriteHeader writes a nokvault header to a file with optional metadata, in
+// the default format. The header gets a single password key slot for salt
+// that wraps key under itself, meaning key encrypts the payload and metadata
+// directly. key must be derived from the password with the default Argon2id
+// parameters, which the slot records; other files are written with NewHeader.
+func (fh *FileHandler) WriteHeader(writer io.Writer, salt, key []byte, metadata *FileMetadata) error {
+	if len(salt) != crypto.SaltLength {
 		return fmt.Errorf("salt must be 16 bytes")
 	}
-	copy(header.Salt[:], salt)
+	if len(key) == 0 {
+		return fmt.Errorf("key is required")
+	}
 
-	// Serialize metadata to JSON if provided
-	var metadataJSON []byte
-	if metadata != nil {
-		var err error
-		metadataJSON, err = json.Marshal(metadata)
-		if err != nil {
-			return fmt.Errorf("failed to serialize metadata: %w", err)
-		}
-		header.MetadataSize = uint32(len(metadataJSON))
+	params := DefaultFormatParams()
+	wrapped, err := wrapKey(key, key, params.Cipher)
+	if err != nil {
+		return err
+	}
+	slot := KeySlot{
+		Type:       KeySlotPassword,
+		Salt:       append([]byte(nil), salt...),
+		KDF:        NewKDFParams(crypto.DefaultArgon2Params()),
+		WrappedKey: wrapped,
 	}
+	header, err := fh.NewHeader(params, metadata, key, []KeySlot{slot})
+	if err != nil {
+		return err
+	}
+	return fh.WriteRawHeader(writer, header)
+}
 
-	// Calculate data offset (header size + metadata size)
-	header.DataOffset = uint64(binary.Size(header)) + uint64(header.MetadataSize)
+// NewHeader builds a header for a new file whose payload is encrypted with
+// fileKey, which seals the metadata. The result is written with
+// WriteRawHeader and supplies the payload's associated data.
+func (fh *FileHandler) NewHeader(params *FormatParams, metadata *FileMetadata, fileKey []byte, slots []KeySlot) (*NokvaultHeader, error) {
+	if params == nil {
+		return nil, fmt.Errorf("format parameters are required")
+	}
 
-	// Write header
-	if err := binary.Write(writer, binary.LittleEndian, &header); err != nil {
-		return fmt.Errorf("failed to write header: %w", err)
+	paramsJSON, err := json.Marshal(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize format parameters: %w", err)
+	}
+
+	header := &NokvaultHeader{
+		Version:      CurrentVersion,
+		ParamsSize:   uint32(len(paramsJSON)),
+		Params:       params,
+		paramsJSON:   paramsJSON,
+		metadataRead: true,
 	}
+	copy(header.Magic[:], NokvaultMagic)
 
-	// Write metadata JSON if present
-	if len(metadataJSON) > 0 {
-		if _, err := writer.Write(metadataJSON); err != nil {
-			return fmt.Errorf("failed to write metadata: %w", err)
+	// Serialize and seal metadata if provided
+	if metadata != nil {
+		metadataJSON, err := json.Marshal(metadata)
+		if err != nil {
+			return nil, fmt.Errorf("failed to serialize metadata: %w", err)
 		}
+		header.metadataData, err = header.sealMetadata(metadataJSON, fileKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to seal metadata: %w", err)
+		}
+		header.MetadataSize = uint32(len(header.metadataData))
 	}
 
+	// Setting the key slots also calculates the data offset
+	if err := header.SetKeySlots(slots); err != nil {
+		return nil, err
+	}
+
+	return header, nil
+}
+
+// WriteRawHeader writes a header built by NewHeader, including its metadata
+func (fh *FileHandler) WriteRawHeader(writer io.Writer, header *NokvaultHeader) error {
+	encoded, err := header.Encode()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(encoded); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
 	return nil
 }
 
-// ReadHeader reads a nokvault header from a file
+// ReadHeader reads a nokvault header from a file, including the format
+// parameters and key slots of version 2+ files. The reader is left at the
+// start of the metadata. Every format version in headerReaders can be read,
+// so files written by older releases can still be decrypted and upgraded.
 func (fh *FileHandler) ReadHeader(reader io.Reader) (*NokvaultHeader, error) {
-	header := &NokvaultHeader{}
-
-	if err := binary.Read(reader, binary.LittleEndian, header); err != nil {
+	prelude := headerPrelude{}
+	if err := binary.Read(reader, binary.LittleEndian, &prelude); err != nil {
 		return nil, fmt.Errorf("failed to read header: %w", err)
 	}
 
 	// Verify magic number
-	if string(header.Magic[:]) != NokvaultMagic {
+	if string(prelude.Magic[:]) != NokvaultMagic {
 		return nil, fmt.Errorf("invalid magic number: not a nokvault file")
 	}
 
-	// Verify version
-	if header.Version != CurrentVersion {
-		return nil, fmt.Errorf("unsupported version: %d", header.Version)
+	readFields, ok := headerReaders[prelude.Version]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, prelude.Version)
+	}
+
+	header := &NokvaultHeader{
+		Magic:   prelude.Magic,
+		Version: prelude.Version,
+	}
+	if err := readFields(reader, header); err != nil {
+		return nil, err
 	}
 
 	return header, nil
 }
 
-// ReadHeaderWithMetadata reads header and metadata from a file
+// headerReaders decode the part of a header following the prelude, by format version
+var headerReaders = map[uint16]func(reader io.Reader, header *NokvaultHeader) error{
+	LegacyVersion:         readHeaderV1,
+	StreamVersion:         readHeaderV2,
+	SealedMetadataVersion: readHeaderV2,
+}
+
+// readHeaderV1 reads the fields of a version 1 header
+func readHeaderV1(reader io.Reader, header *NokvaultHeader) error {
+	fields := headerFieldsV1{}
+	if err := binary.Read(reader, binary.LittleEndian, &fields); err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+	header.Salt = fields.Salt
+	header.MetadataSize = fields.MetadataSize
+	header.DataOffset = fields.DataOffset
+	return nil
+}
+
+// readHeaderV2 reads the fields, format parameters and key slots of a version
+// 2 or 3 header, which only differ in whether the metadata is sealed
+func readHeaderV2(reader io.Reader, header *NokvaultHeader) error {
+	fields := headerFieldsV2{}
+	if err := binary.Read(reader, binary.LittleEndian, &fields); err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+	header.ParamsSize = fields.ParamsSize
+	header.KeysSize = fields.KeysSize
+	header.MetadataSize = fields.MetadataSize
+	header.DataOffset = fields.DataOffset
+
+	if fields.ParamsSize > maxHeaderSectionSize {
+		return fmt.Errorf("format parameters too large: %d bytes", fields.ParamsSize)
+	}
+	if fields.KeysSize > maxHeaderSectionSize {
+		return fmt.Errorf("key slots too large: %d bytes", fields.KeysSize)
+	}
+	if fields.MetadataSize > maxHeaderSectionSize {
+		return fmt.Errorf("metadata too large: %d bytes", fields.MetadataSize)
+	}
+
+	// The payload must start right after the metadata
+	expectedOffset := uint64(binary.Size(headerPrelude{})) + uint64(binary.Size(fields)) +
+		uint64(fields.ParamsSize) + uint64(fields.KeysSize) + uint64(fields.MetadataSize)
+	if fields.DataOffset != expectedOffset {
+		return fmt.Errorf("invalid data offset: %d", fields.DataOffset)
+	}
+
+	paramsJSON := make([]byte, fields.ParamsSize)
+	if _, err := io.ReadFull(reader, paramsJSON); err != nil {
+		return fmt.Errorf("failed to read format parameters: %w", err)
+	}
+	header.paramsJSON = paramsJSON
+	header.Params = &FormatParams{}
+	if err := json.Unmarshal(paramsJSON, header.Params); err != nil {
+		return fmt.Errorf("failed to deserialize format parameters: %w", err)
+	}
+	if !crypto.IsSupportedCipher(header.Params.Cipher) {
+		return fmt.Errorf("unsupported cipher: %q", header.Params.Cipher)
+	}
+	if header.Params.ChunkSize == 0 || header.Params.ChunkSize > crypto.MaxChunkSize {
+		return fmt.Errorf("invalid chunk size: %d", header.Params.ChunkSize)
+	}
+	if !IsSupportedCompression(header.Params.Compression) {
+		return fmt.Errorf("unsupported compression algorithm: %q", header.Params.Compression)
+	}
+	if !IsSupportedPadding(header.Params.Padding) {
+		return fmt.Errorf("unsupported padding scheme: %q", header.Params.Padding)
+	}
+	switch header.Params.Content {
+	case ContentFile, ContentArchive, ContentNameMap, ContentRepository, ContentManifest:
+	default:
+		return fmt.Errorf("unsupported content type: %q", header.Params.Content)
+	}
+
+	keysJSON := make([]byte, fields.KeysSize)
+	if _, err := io.ReadFull(reader, keysJSON); err != nil {
+		return fmt.Errorf("failed to read key slots: %w", err)
+	}
+	var keys keySection
+	if err := json.Unmarshal(keysJSON, &keys); err != nil {
+		return fmt.Errorf("failed to deserialize key slots: %w", err)
+	}
+	if len(keys.Slots) == 0 {
+		return fmt.Errorf("no key slots in header")
+	}
+	if len(keys.Slots) > MaxKeySlots {
+		return fmt.Errorf("too many key slots: %d", len(keys.Slots))
+	}
+	for i := range keys.Slots {
+		if err := keys.Slots[i].validate(); err != nil {
+			return fmt.Errorf("invalid key slot %d: %w", i, err)
+		}
+	}
+	header.KeySlots = keys.Slots
+	header.metadataRead = fields.MetadataSize == 0
+	return nil
+}
+
+// ReadHeaderWithMetadata reads header and metadata from a file. Sealed
+// metadata (see MetadataSealed) is read into the header but only returned by
+// OpenMetadata once the file key is known, so the metadata returned is nil.
 func (fh *FileHandler) ReadHeaderWithMetadata(reader io.Reader) (*NokvaultHeader, *FileMetadata, error) {
 	header, err := fh.ReadHeader(reader)
 	if err != nil {
@@ -151,20 +663,112 @@ func (fh *FileHandler) ReadHeaderWithMetadata(reader io.Reader) (*NokvaultHeader
 	// Read metadata if present
 	var metadata *FileMetadata
 	if header.MetadataSize > 0 {
-		metadataJSON := make([]byte, header.MetadataSize)
-		if _, err := io.ReadFull(reader, metadataJSON); err != nil {
+		if header.MetadataSize > maxHeaderSectionSize {
+			return nil, nil, fmt.Errorf("metadata too large: %d bytes", header.MetadataSize)
+		}
+		metadataData := make([]byte, header.MetadataSize)
+		if _, err := io.ReadFull(reader, metadataData); err != nil {
 			return nil, nil, fmt.Errorf("failed to read metadata: %w", err)
 		}
-
-		metadata = &FileMetadata{}
-		if err := json.Unmarshal(metadataJSON, metadata); err != nil {
-			return nil, nil, fmt.Errorf("failed to deserialize metadata: %w", err)
+		header.metadataData = metadataData
+		header.metadataRead = true
+
+		if !header.MetadataSealed() {
+			metadata, err = header.OpenMetadata(nil)
+			if err != nil {
+				return nil, nil, err
+			}
 		}
 	}
 
 	return header, metadata, nil
 }
 
+// UpdateKeySlots replaces the key slots of the nokvault file at path, whose
+// header (including metadata) was read into header. The payload is left
+// untouched, but the file is rewritten through a temporary file beside it
+// that is synced and renamed over it, so a crash leaves the old file or the
+// new one. A parity file is rewritten to match.
+func (fh *FileHandler) UpdateKeySlots(path string, header *NokvaultHeader, slots []KeySlot) error {
+	oldOffset := header.DataOffset
+	if err := header.SetKeySlots(slots); err != nil {
+		return err
+	}
+	encoded, err := header.Encode()
+	if err != nil {
+		return err
+	}
+
+	input, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer input.Close()
+
+	info, err := input.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	if _, err := input.Seek(int64(oldOffset), io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek to encrypted data: %w", err)
+	}
+
+	output, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tempPath := output.Name()
+
+	err = output.Chmod(info.Mode().Perm())
+	if err == nil {
+		_, err = output.Write(encoded)
+	}
+	if err == nil {
+		_, err = io.Copy(output, input)
+	}
+	if err == nil {
+		err = output.Sync()
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to rewrite file: %w", err)
+	}
+
+	input.Close()
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+	return RefreshParity(path)
+}
+
+// ReadHeaderFromFile reads the header of the nokvault file or volume set at path
+func (fh *FileHandler) ReadHeaderFromFile(path string) (*NokvaultHeader, error) {
+	file, err := openEncryptedFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	return fh.ReadHeader(file)
+}
+
+// ReadMetadataFromFile reads the header and the metadata of the original file
+// recorded in the nokvault file at path, without decrypting anything. Like
+// ReadHeaderWithMetadata, it returns nil metadata when the metadata is sealed.
+func (fh *FileHandler) ReadMetadataFromFile(path string) (*NokvaultHeader, *FileMetadata, error) {
+	file, err := openEncryptedFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	return fh.ReadHeaderWithMetadata(file)
+}
+
 // EnsureDirectory ensures a directory exists
 func (fh *FileHandler) EnsureDirectory(path string) error {
 	return os.MkdirAll(path, 0755)
@@ -206,6 +810,36 @@ func (fh *FileHandler) WalkDirectory(root string, fn func(path string, info os.F
 	})
 }
 
+// FindEncryptedFiles returns the .nokvault files in root and its
+// subdirectories whose original relative paths (without the extension) the
+// filter selects. Directories the filter cannot select anything in are not
+// entered. A nil filter selects every file.
+func (fh *FileHandler) FindEncryptedFiles(root string, filter *PathFilter) ([]string, error) {
+	var paths []string
+	err := fh.WalkDirectory(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := fh.GetRelativePath(root, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if relPath != "." && !filter.MatchDir(relPath) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if filepath.Ext(path) == ".nokvault" && filter.Match(strings.TrimSuffix(relPath, ".nokvault")) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	return paths, err
+}
+
 // CountFiles counts the number of files in a directory (excluding directories)
 func (fh *FileHandler) CountFiles(root string) (int, error) {
 	count := 0
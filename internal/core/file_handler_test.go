@@ -2,11 +2,13 @@ package core
 
 import (
 	"bytes"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/jimididit/nokvault/internal/crypto"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -79,11 +81,15 @@ func TestFileHandler_WriteHeader(t *testing.T) {
 		IsDir:   false,
 	}
 
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+
 	var buf bytes.Buffer
 
 	// Write header with metadata
-	err := fh.WriteHeader(&buf, salt, metadata)
+	err = fh.WriteHeader(&buf, salt, key, metadata)
 	require.NoError(t, err, "Failed to write header")
+	assert.NotContains(t, buf.String(), "test.txt", "Metadata should not be stored in plaintext")
 
 	// Verify header can be read back
 	header, readMetadata, err := fh.ReadHeaderWithMetadata(&buf)
@@ -91,10 +97,55 @@ func TestFileHandler_WriteHeader(t *testing.T) {
 
 	assert.Equal(t, NokvaultMagic, string(header.Magic[:]), "Magic should match")
 	assert.Equal(t, uint16(CurrentVersion), header.Version, "Version should match")
+	assert.True(t, header.MetadataSealed(), "Metadata should be sealed")
+	assert.Nil(t, readMetadata, "Sealed metadata should not be returned before unlocking")
+
+	readMetadata, err = header.OpenMetadata(key)
+	require.NoError(t, err, "Failed to open metadata")
 	require.NotNil(t, readMetadata, "Expected metadata to be read")
 	assert.Equal(t, metadata.Name, readMetadata.Name, "Metadata name should match")
 }
 
+func TestNokvaultHeader_OpenMetadata(t *testing.T) {
+	fh := NewFileHandler()
+	metadata := &FileMetadata{Name: "secret.txt", Size: 42, Mode: 0600, ModTime: time.Now()}
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, fh.WriteHeader(&buf, make([]byte, 16), key, metadata))
+	encoded := buf.Bytes()
+
+	header, _, err := fh.ReadHeaderWithMetadata(bytes.NewReader(encoded))
+	require.NoError(t, err)
+
+	_, err = header.OpenMetadata(nil)
+	assert.Error(t, err, "Sealed metadata should need the file key")
+
+	wrongKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	_, err = header.OpenMetadata(wrongKey)
+	assert.Error(t, err, "A wrong key should fail to open the metadata")
+
+	// Flipping a bit of the sealed metadata must fail authentication
+	tampered := append([]byte(nil), encoded...)
+	tampered[header.DataOffset-1] ^= 0x01
+	header, _, err = fh.ReadHeaderWithMetadata(bytes.NewReader(tampered))
+	require.NoError(t, err)
+	_, err = header.OpenMetadata(key)
+	assert.Error(t, err, "Modified metadata should fail authentication")
+
+	// Metadata can only be opened once it has been read
+	header, err = fh.ReadHeader(bytes.NewReader(encoded))
+	require.NoError(t, err)
+	_, err = header.OpenMetadata(key)
+	assert.Error(t, err, "Metadata that has not been read should not be opened")
+
+	// Sealing needs the file key
+	_, err = fh.NewHeader(DefaultFormatParams(), metadata, nil, header.KeySlots)
+	assert.Error(t, err, "Metadata should not be written without a file key")
+}
+
 func TestFileHandler_WriteHeader_NoMetadata(t *testing.T) {
 	fh := NewFileHandler()
 
@@ -103,10 +154,13 @@ func TestFileHandler_WriteHeader_NoMetadata(t *testing.T) {
 		salt[i] = byte(i)
 	}
 
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+
 	var buf bytes.Buffer
 
 	// Write header without metadata
-	err := fh.WriteHeader(&buf, salt, nil)
+	err = fh.WriteHeader(&buf, salt, key, nil)
 	require.NoError(t, err, "Failed to write header")
 
 	// Verify header can be read back
@@ -117,6 +171,32 @@ func TestFileHandler_WriteHeader_NoMetadata(t *testing.T) {
 	assert.Nil(t, metadata, "Expected no metadata when none was written")
 }
 
+func TestFileHandler_ReadMetadataFromFile(t *testing.T) {
+	fh := NewFileHandler()
+	metadata := &FileMetadata{Name: "report.pdf", Size: 4096, Mode: 0600, ModTime: time.Now()}
+
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, fh.WriteHeader(&buf, make([]byte, 16), key, metadata), "Failed to write header")
+	path := filepath.Join(t.TempDir(), "report.pdf.nokvault")
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0644))
+
+	header, readMetadata, err := fh.ReadMetadataFromFile(path)
+	require.NoError(t, err, "Failed to read metadata")
+	assert.Equal(t, uint16(CurrentVersion), header.Version)
+	assert.Nil(t, readMetadata, "Sealed metadata should not be returned without the key")
+	readMetadata, err = header.OpenMetadata(key)
+	require.NoError(t, err)
+	require.NotNil(t, readMetadata)
+	assert.Equal(t, "report.pdf", readMetadata.Name)
+	assert.Equal(t, int64(4096), readMetadata.Size)
+
+	_, _, err = fh.ReadMetadataFromFile(filepath.Join(t.TempDir(), "missing.nokvault"))
+	assert.Error(t, err, "Missing files should fail")
+}
+
 func TestFileHandler_ReadHeader_InvalidMagic(t *testing.T) {
 	fh := NewFileHandler()
 
@@ -133,7 +213,7 @@ func TestFileHandler_ReadHeader_InvalidSalt(t *testing.T) {
 	var buf bytes.Buffer
 	invalidSalt := make([]byte, 8) // Wrong size
 
-	err := fh.WriteHeader(&buf, invalidSalt, nil)
+	err := fh.WriteHeader(&buf, invalidSalt, nil, nil)
 	assert.Error(t, err, "Expected error for invalid salt size")
 }
 
@@ -290,3 +370,97 @@ func TestFileHandler_GetTotalSize(t *testing.T) {
 
 	assert.Equal(t, expectedTotal, totalSize, "Total size should match expected")
 }
+
+func TestFileHandler_ReadHeader_UnsupportedVersion(t *testing.T) {
+	fh := NewFileHandler()
+
+	var buf bytes.Buffer
+	buf.WriteString(NokvaultMagic)
+	buf.Write([]byte{0xFF, 0x00})
+
+	_, err := fh.ReadHeader(&buf)
+	assert.ErrorIs(t, err, ErrUnsupportedVersion, "Expected error for unsupported version")
+}
+
+// writeTestHeader writes a header in the format params, with a password
+// slot wrapping a zero key under itself
+func writeTestHeader(t *testing.T, writer io.Writer, params *FormatParams) {
+	fh := NewFileHandler()
+	key := make([]byte, 32)
+	wrapped, err := wrapKey(key, key, params.Cipher)
+	require.NoError(t, err)
+	slot := KeySlot{Type: KeySlotPassword, Salt: make([]byte, 16), KDF: NewKDFParams(crypto.DefaultArgon2Params()), WrappedKey: wrapped}
+	header, err := fh.NewHeader(params, nil, key, []KeySlot{slot})
+	require.NoError(t, err, "NewHeader should succeed")
+	require.NoError(t, fh.WriteRawHeader(writer, header), "Failed to write header")
+}
+
+func TestFileHandler_FormatParams(t *testing.T) {
+	fh := NewFileHandler()
+
+	params := DefaultFormatParams()
+	params.ChunkSize = 4096
+
+	var buf bytes.Buffer
+	writeTestHeader(t, &buf, params)
+	headerLen := buf.Len()
+
+	header, err := fh.ReadHeader(&buf)
+	require.NoError(t, err, "Failed to read header")
+
+	require.NotNil(t, header.Params, "Version 2 headers should carry format parameters")
+	assert.Equal(t, uint32(4096), header.Params.ChunkSize, "Chunk size should match")
+	assert.Equal(t, uint64(headerLen), header.DataOffset, "Data offset should point past the header")
+}
+
+func TestFileHandler_AssociatedData(t *testing.T) {
+	fh := NewFileHandler()
+	salt := make([]byte, 16)
+	metadata := &FileMetadata{Name: "test.txt", Size: 42}
+
+	key := make([]byte, 32)
+	wrapped, err := wrapKey(key, key, DefaultFormatParams().Cipher)
+	require.NoError(t, err)
+	slot := KeySlot{Type: KeySlotPassword, Salt: salt, KDF: NewKDFParams(crypto.DefaultArgon2Params()), WrappedKey: wrapped}
+	header, err := fh.NewHeader(DefaultFormatParams(), metadata, key, []KeySlot{slot})
+	require.NoError(t, err, "NewHeader should succeed")
+
+	var buf bytes.Buffer
+	require.NoError(t, fh.WriteRawHeader(&buf, header), "WriteRawHeader should succeed")
+
+	written, err := header.AssociatedData()
+	require.NoError(t, err)
+	assert.Equal(t, header.DataOffset, uint64(buf.Len()), "Data offset should follow the header")
+
+	// Key slots are not part of the associated data, so they can be replaced
+	// without touching the payload
+	require.NoError(t, header.SetKeySlots([]KeySlot{slot, slot}))
+	replaced, err := header.AssociatedData()
+	require.NoError(t, err)
+	assert.Equal(t, written, replaced, "Associated data should not cover key slots")
+
+	// Reading the header alone leaves the metadata out of the associated data
+	readHeader, err := fh.ReadHeader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	_, err = readHeader.AssociatedData()
+	assert.Error(t, err, "Associated data requires the metadata to be read")
+
+	readHeader, _, err = fh.ReadHeaderWithMetadata(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	read, err := readHeader.AssociatedData()
+	require.NoError(t, err)
+	assert.Equal(t, written, read, "Associated data should match after reading")
+}
+
+func TestFileHandler_ReadHeader_UnsupportedCompression(t *testing.T) {
+	fh := NewFileHandler()
+	params := DefaultFormatParams()
+	params.Compression = "zstd"
+
+	var buf bytes.Buffer
+	writeTestHeader(t, &buf, params)
+
+	_, err := fh.ReadHeader(&buf)
+	require.Error(t, err, "Unknown compression algorithm should be rejected")
+	assert.Contains(t, err.Error(), "unsupported compression algorithm")
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package core
+
+import "os"
+
+// fileOwner returns nil: file ownership is not recorded on this platform
+func fileOwner(info os.FileInfo) *FileOwner {
+	return nil
+}
+
+// fileLinkID returns false: hard links are not detected on this platform
+func fileLinkID(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+// restoreOwner does nothing: file ownership is not restored on this platform
+func restoreOwner(path string, owner *FileOwner) error {
+	return nil
+}
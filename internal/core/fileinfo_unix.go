@@ -0,0 +1,36 @@
+//go:build unix
+
+package core
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the owner and group recorded in info
+func fileOwner(info os.FileInfo) *FileOwner {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return &FileOwner{UID: int(stat.Uid), GID: int(stat.Gid)}
+}
+
+// fileLinkID returns the identity shared by all hard links of a file, and
+// false if the file has no other links
+func fileLinkID(info os.FileInfo) (fileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
+
+// restoreOwner sets the owner and group of path without following symbolic
+// links. Other users than the superuser keep owning what they create.
+func restoreOwner(path string, owner *FileOwner) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	return os.Lchown(path, owner.UID, owner.GID)
+}
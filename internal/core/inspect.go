@@ -0,0 +1,208 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jimididit/nokvault/internal/crypto"
+)
+
+// Inspection describes the structure of a nokvault file, read without any
+// key. Problems lists what is wrong with the structure; a file without
+// problems may still fail to decrypt, since only decryption authenticates it.
+type Inspection struct {
+	Path           string        `json:"path"`
+	Volumes        []string      `json:"volumes,omitempty"`
+	Size           int64         `json:"size"` // Size of the file, or of the contents of its volumes
+	Magic          string        `json:"magic"`
+	Version        uint16        `json:"version"`
+	Salt           string        `json:"salt,omitempty"` // Version 1 files; later versions keep salts in key slots
+	Params         *FormatParams `json:"params,omitempty"`
+	KeySlots       []KeySlotInfo `json:"key_slots,omitempty"`
+	ParamsSize     uint32        `json:"params_size"`
+	KeysSize       uint32        `json:"keys_size"`
+	MetadataSize   uint32        `json:"metadata_size"`
+	MetadataSealed bool          `json:"metadata_sealed"`
+	Metadata       *FileMetadata `json:"metadata,omitempty"` // Only files older than version 3 store it in plaintext
+	DataOffset     uint64        `json:"data_offset"`
+	CiphertextSize int64         `json:"ciphertext_size"`
+	Chunks         int64         `json:"chunks,omitempty"`
+	PayloadSize    int64         `json:"payload_size,omitempty"` // Size of the payload before encryption, after compression and padding
+	Problems       []string      `json:"problems,omitempty"`
+}
+
+// KeySlotInfo describes a key slot without its wrapped key
+type KeySlotInfo struct {
+	Type    string     `json:"type"`
+	Salt    string     `json:"salt,omitempty"`
+	KDF     *KDFParams `json:"kdf,omitempty"`
+	Keyfile bool       `json:"keyfile,omitempty"`
+}
+
+// addProblem records a structural problem
+func (i *Inspection) addProblem(format string, args ...interface{}) {
+	i.Problems = append(i.Problems, fmt.Sprintf(format, args...))
+}
+
+// InspectFile describes the nokvault file or volume set at path without
+// unlocking it. Structural problems, such as a truncated header or payload,
+// are recorded in the result; an error is only returned if path can't be read.
+func InspectFile(path string) (*Inspection, error) {
+	inspection := &Inspection{Path: path}
+
+	basePath, isSet := VolumeSetBase(path)
+	if !isSet {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file: %w", err)
+		}
+		defer file.Close()
+		inspection.inspect(file, true)
+		return inspection, nil
+	}
+
+	inspection.Path = basePath
+	volumes, err := ListVolumes(basePath)
+	if err == nil {
+		reader, err := OpenVolumes(basePath)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		inspection.Volumes = volumes
+		inspection.inspect(reader, true)
+		return inspection, nil
+	}
+
+	// The header of an incomplete set can still be read from its first volume
+	inspection.addProblem("%v", err)
+	file, err := os.Open(VolumePath(basePath, 1))
+	if err != nil {
+		return inspection, nil
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat volume: %w", err)
+	}
+	contents := max(info.Size()-int64(volumeHeaderSize), 0)
+	inspection.inspect(io.NewSectionReader(file, int64(volumeHeaderSize), contents), false)
+	return inspection, nil
+}
+
+// inspect reads the header from reader, positioned at the start of the file,
+// and checks the payload layout against the size of the file if complete
+func (i *Inspection) inspect(reader io.ReadSeeker, complete bool) {
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = reader.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		i.addProblem("failed to read file: %v", err)
+		return
+	}
+	if complete {
+		i.Size = size
+	}
+
+	// The magic and version are shown even if the rest of the header is broken
+	var prelude [len(NokvaultMagic) + 2]byte
+	n, _ := io.ReadFull(reader, prelude[:])
+	i.Magic = printableMagic(prelude[:min(n, len(NokvaultMagic))])
+	if n == len(prelude) {
+		i.Version = binary.LittleEndian.Uint16(prelude[len(NokvaultMagic):])
+	}
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		i.addProblem("failed to read file: %v", err)
+		return
+	}
+
+	header, metadata, err := NewFileHandler().ReadHeaderWithMetadata(reader)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			i.addProblem("the file is truncated inside the header: %v", err)
+		} else {
+			i.addProblem("invalid header: %v", err)
+		}
+		return
+	}
+
+	if header.Version == LegacyVersion {
+		i.Salt = crypto.EncodeSalt(header.Salt[:])
+	}
+	i.Params = header.Params
+	for _, slot := range header.KeySlots {
+		info := KeySlotInfo{Type: slot.Type, KDF: slot.KDF, Keyfile: slot.Keyfile}
+		if len(slot.Salt) > 0 {
+			info.Salt = crypto.EncodeSalt(slot.Salt)
+		}
+		i.KeySlots = append(i.KeySlots, info)
+	}
+	i.ParamsSize = header.ParamsSize
+	i.KeysSize = header.KeysSize
+	i.MetadataSize = header.MetadataSize
+	i.MetadataSealed = header.MetadataSealed() && header.MetadataSize > 0
+	i.Metadata = metadata
+	i.DataOffset = header.DataOffset
+
+	if !complete {
+		return
+	}
+	if header.DataOffset > uint64(size) {
+		i.addProblem("the data offset %d is past the end of the file (%d bytes)", header.DataOffset, size)
+		return
+	}
+	i.CiphertextSize = size - int64(header.DataOffset)
+	i.checkPayload(header)
+}
+
+// checkPayload checks that the size of the payload fits its encryption
+func (i *Inspection) checkPayload(header *NokvaultHeader) {
+	if header.Version == LegacyVersion {
+		// A single AES-GCM message: nonce, ciphertext and tag
+		if minSize := int64(12 + 16); i.CiphertextSize < minSize {
+			i.addProblem("the payload is truncated: %d bytes, a version 1 payload has at least %d", i.CiphertextSize, minSize)
+		}
+		return
+	}
+
+	// Only the sizes of the cipher are needed, so any key will do
+	sealer, err := crypto.NewAEAD(header.Params.Cipher, make([]byte, crypto.DefaultKeyLength))
+	if err != nil {
+		i.addProblem("%v", err)
+		return
+	}
+	aead := sealer.AEAD()
+	overhead := int64(aead.Overhead())
+	sealedChunk := int64(header.Params.ChunkSize) + overhead
+
+	// A stream is a nonce prefix and at least one chunk; every chunk but the
+	// last is full
+	sealed := i.CiphertextSize - int64(crypto.StreamNoncePrefixSize(aead))
+	if sealed < overhead {
+		i.addProblem("the payload is truncated: %d bytes is shorter than a stream of one chunk", i.CiphertextSize)
+		return
+	}
+	i.Chunks = (sealed + sealedChunk - 1) / sealedChunk
+	if rest := sealed % sealedChunk; rest != 0 && rest < overhead {
+		i.addProblem("the payload ends inside chunk %d: the file is truncated or has data appended", i.Chunks)
+		return
+	}
+	i.PayloadSize = sealed - i.Chunks*overhead
+	if header.Params.Padding != PaddingNone && i.PayloadSize < paddingTrailerSize {
+		i.addProblem("the payload is too short for its padding: %d bytes", i.PayloadSize)
+	}
+}
+
+// printableMagic returns magic as text, or in hex if it isn't printable
+func printableMagic(magic []byte) string {
+	for _, b := range magic {
+		if b < 0x20 || b > 0x7e {
+			return fmt.Sprintf("%x", magic)
+		}
+	}
+	return string(magic)
+}
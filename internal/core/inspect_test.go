@@ -0,0 +1,107 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jimididit/nokvault/internal/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectFile(t *testing.T) {
+	archiver, recipients := newTestArchiver(t, []byte("inspect-password"))
+	service := archiver.encryptionService
+
+	data := make([]byte, 150*1024)
+	rand.New(rand.NewSource(9)).Read(data)
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, "data.bin")
+	require.NoError(t, os.WriteFile(inputPath, data, 0644))
+	path := filepath.Join(tmpDir, "data.nokvault")
+	require.NoError(t, service.EncryptFileForRecipients(inputPath, path, recipients, false))
+
+	inspection, err := InspectFile(path)
+	require.NoError(t, err)
+	assert.Empty(t, inspection.Problems)
+	assert.Equal(t, NokvaultMagic, inspection.Magic)
+	assert.Equal(t, uint16(CurrentVersion), inspection.Version)
+	assert.True(t, inspection.MetadataSealed)
+	assert.Nil(t, inspection.Metadata, "sealed metadata can't be shown without the key")
+	require.Len(t, inspection.KeySlots, 1)
+	assert.Equal(t, crypto.EncodeSalt(recipients.Salt), inspection.KeySlots[0].Salt)
+	assert.Equal(t, int64(3), inspection.Chunks)
+	assert.Equal(t, int64(len(data)), inspection.PayloadSize)
+	assert.Equal(t, inspection.Size-int64(inspection.DataOffset), inspection.CiphertextSize)
+
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	// Cut inside the header
+	truncatedPath := filepath.Join(tmpDir, "header.nokvault")
+	require.NoError(t, os.WriteFile(truncatedPath, contents[:40], 0644))
+	inspection, err = InspectFile(truncatedPath)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(CurrentVersion), inspection.Version, "the version should be read from a broken header")
+	require.Len(t, inspection.Problems, 1)
+	assert.Contains(t, inspection.Problems[0], "truncated inside the header")
+
+	// Cut inside the tag of the last chunk
+	require.NoError(t, os.WriteFile(truncatedPath, contents[:len(contents)-(len(data)-2*crypto.DefaultChunkSize)-8], 0644))
+	inspection, err = InspectFile(truncatedPath)
+	require.NoError(t, err)
+	require.Len(t, inspection.Problems, 1)
+	assert.Contains(t, inspection.Problems[0], "ends inside chunk 3")
+
+	inspection, err = InspectFile(inputPath)
+	require.NoError(t, err)
+	assert.NotEmpty(t, inspection.Problems, "a file that isn't a nokvault file should have problems")
+	assert.NotEqual(t, NokvaultMagic, inspection.Magic)
+}
+
+func TestInspectFile_LegacyAndVolumes(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	// A version 1 header pointing past the end of the file
+	var buf bytes.Buffer
+	fields := headerFieldsV1{DataOffset: 1000, MetadataSize: 0}
+	copy(fields.Salt[:], "0123456789abcdef")
+	prelude := headerPrelude{Version: LegacyVersion}
+	copy(prelude.Magic[:], NokvaultMagic)
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, &prelude))
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, &fields))
+	legacyPath := filepath.Join(tmpDir, "legacy.nokvault")
+	require.NoError(t, os.WriteFile(legacyPath, buf.Bytes(), 0644))
+
+	inspection, err := InspectFile(legacyPath)
+	require.NoError(t, err)
+	assert.Equal(t, crypto.EncodeSalt([]byte("0123456789abcdef")), inspection.Salt)
+	require.Len(t, inspection.Problems, 1)
+	assert.Contains(t, inspection.Problems[0], "past the end of the file")
+
+	archiver, recipients := newTestArchiver(t, []byte("inspect-password"))
+	require.NoError(t, archiver.encryptionService.SetVolumeSize(MinVolumeSize))
+	data := make([]byte, 2*MinVolumeSize)
+	inputPath := filepath.Join(tmpDir, "data.bin")
+	require.NoError(t, os.WriteFile(inputPath, data, 0644))
+	path := filepath.Join(tmpDir, "data.nokvault")
+	require.NoError(t, archiver.encryptionService.EncryptFileForRecipients(inputPath, path, recipients, false))
+
+	inspection, err = InspectFile(VolumePath(path, 1))
+	require.NoError(t, err)
+	assert.Equal(t, path, inspection.Path)
+	assert.Len(t, inspection.Volumes, 3)
+	assert.Empty(t, inspection.Problems)
+	assert.Equal(t, int64(len(data)), inspection.PayloadSize)
+
+	require.NoError(t, os.Remove(VolumePath(path, 3)))
+	inspection, err = InspectFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(CurrentVersion), inspection.Version, "the header should be read from the first volume")
+	require.Len(t, inspection.Problems, 1)
+	assert.Contains(t, inspection.Problems[0], ErrVolumeMissing.Error())
+}
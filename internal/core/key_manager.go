@@ -65,6 +65,11 @@ func (km *KeyManager) SetParams(memory uint32, time uint32, parallelism uint8, k
 	}
 }
 
+// Params returns the Argon2 parameters used for new keys
+func (km *KeyManager) Params() *crypto.Argon2Params {
+	return km.params
+}
+
 // CachedKey represents a cached encryption key
 type CachedKey struct {
 	Key       []byte
@@ -93,6 +98,7 @@ func (kc *KeyCache) Get(keyID string) ([]byte, bool) {
 	}
 
 	if time.Now().After(cached.ExpiresAt) {
+		zeroizeKey(cached.Key)
 		delete(kc.cache, keyID)
 		return nil, false
 	}
@@ -108,7 +114,17 @@ func (kc *KeyCache) Set(keyID string, key []byte) {
 	}
 }
 
-// Clear removes all cached keys
+// Clear removes all cached keys, zeroizing them
 func (kc *KeyCache) Clear() {
+	for _, cached := range kc.cache {
+		zeroizeKey(cached.Key)
+	}
 	kc.cache = make(map[string]*CachedKey)
 }
+
+// zeroizeKey overwrites key material that is no longer needed
+func zeroizeKey(key []byte) {
+	for i := range key {
+		key[i] = 0
+	}
+}
@@ -0,0 +1,420 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jimididit/nokvault/internal/crypto"
+)
+
+// Key slot types
+const (
+	// KeySlotPassword wraps the file key under a key derived from a password or keyfile
+	KeySlotPassword = "password"
+	// KeySlotX25519 wraps the file key to an X25519 public key
+	KeySlotX25519 = "x25519"
+)
+
+// KeySlot stores the file key of a version 2+ file wrapped under a key that
+// is derived from a user secret. The payload is encrypted with the file key,
+// so slots can be added or replaced without re-encrypting it.
+type KeySlot struct {
+	Type       string     `json:"type"`                  // Slot type, e.g. "password"
+	Salt       []byte     `json:"salt,omitempty"`        // Key derivation salt
+	KDF        *KDFParams `json:"kdf,omitempty"`         // Key derivation parameters
+	Keyfile    bool       `json:"keyfile,omitempty"`     // Slot key also requires a keyfile (password + keyfile)
+	Ephemeral  []byte     `json:"ephemeral,omitempty"`   // Ephemeral X25519 public key
+	WrappedKey []byte     `json:"wrapped_key,omitempty"` // File key sealed with the slot key
+}
+
+// validate checks the structure of a slot read from a header
+func (s *KeySlot) validate() error {
+	switch s.Type {
+	case KeySlotPassword:
+		if len(s.Salt) != crypto.SaltLength {
+			return fmt.Errorf("invalid salt length: %d", len(s.Salt))
+		}
+		if s.KDF == nil {
+			return fmt.Errorf("missing key derivation parameters")
+		}
+		if len(s.WrappedKey) == 0 {
+			return fmt.Errorf("missing wrapped key")
+		}
+	case KeySlotX25519:
+		if len(s.Ephemeral) != 32 {
+			return fmt.Errorf("invalid ephemeral key length: %d", len(s.Ephemeral))
+		}
+		if len(s.WrappedKey) == 0 {
+			return fmt.Errorf("missing wrapped key")
+		}
+	default:
+		return fmt.Errorf("unsupported key slot type: %q", s.Type)
+	}
+	return nil
+}
+
+// ErrKeyfileRequired is returned when a file can only be unlocked with both a
+// password and a keyfile and one of them was not supplied
+var ErrKeyfileRequired = errors.New("file requires both a password and a keyfile")
+
+// RequiresKeyfile reports whether every password slot of a file needs both a
+// password and a keyfile, so both must be asked for to unlock it
+func RequiresKeyfile(header *NokvaultHeader) bool {
+	required := false
+	for i := range header.KeySlots {
+		if header.KeySlots[i].Type != KeySlotPassword {
+			continue
+		}
+		if !header.KeySlots[i].Keyfile {
+			return false
+		}
+		required = true
+	}
+	return required
+}
+
+// SlotKeyID identifies the key derivation inputs of a slot, so slot keys
+// derived for one file can be cached and reused for files sharing them
+func SlotKeyID(slot *KeySlot) string {
+	id := crypto.EncodeSalt(slot.Salt)
+	if slot.KDF != nil {
+		id += fmt.Sprintf(":%s:%d:%d:%d:%d", slot.KDF.Algorithm, slot.KDF.Memory, slot.KDF.Time, slot.KDF.Parallelism, slot.KDF.KeyLength)
+	}
+	return id
+}
+
+// Credentials holds the secrets supplied to unlock files
+type Credentials struct {
+	Password   []byte                   // Password, or keyfile contents used as a password
+	Keyfile    []byte                   // Keyfile contents; used as the second factor, or alone as a password
+	Identities []*crypto.X25519Identity // Private keys for X25519 slots
+}
+
+// slotSecret is a password, optionally combined with a keyfile, to derive a slot key from
+type slotSecret struct {
+	id       string // Distinguishes keys derived from different secrets in the cache
+	password []byte
+	keyfile  []byte
+}
+
+// secretsFor returns the secrets to try on a password slot
+func (c *Credentials) secretsFor(slot *KeySlot) []slotSecret {
+	if slot.Keyfile {
+		if len(c.Password) == 0 || len(c.Keyfile) == 0 {
+			return nil
+		}
+		return []slotSecret{{id: "password+keyfile", password: c.Password, keyfile: c.Keyfile}}
+	}
+
+	var secrets []slotSecret
+	if len(c.Password) > 0 {
+		secrets = append(secrets, slotSecret{id: "password", password: c.Password})
+	}
+	if len(c.Keyfile) > 0 {
+		secrets = append(secrets, slotSecret{id: "keyfile", password: c.Keyfile})
+	}
+	return secrets
+}
+
+// Recipients lists who can unlock a newly encrypted file: the holder of the
+// password a key was derived from, and the owners of X25519 public keys
+type Recipients struct {
+	Key        []byte                    // Key derived from a password with Salt; nil for no password slot
+	Salt       []byte                    // Salt Key was derived with
+	Keyfile    bool                      // Key was combined with a keyfile (see DeriveKeyWithKeyfile)
+	PublicKeys []*crypto.X25519Recipient // Public keys to wrap the file key to
+}
+
+// NewKeySlots wraps fileKey for every recipient
+func (km *KeyManager) NewKeySlots(recipients *Recipients, fileKey []byte, cipherID string) ([]KeySlot, error) {
+	var slots []KeySlot
+	if recipients.Key != nil {
+		slot, err := km.NewPasswordSlot(recipients.Key, recipients.Salt, fileKey, cipherID)
+		if err != nil {
+			return nil, err
+		}
+		slot.Keyfile = recipients.Keyfile
+		slots = append(slots, slot)
+	}
+
+	for _, recipient := range recipients.PublicKeys {
+		slot, err := NewRecipientSlot(recipient, fileKey)
+		if err != nil {
+			return nil, err
+		}
+		slots = append(slots, slot)
+	}
+
+	if len(slots) == 0 {
+		return nil, fmt.Errorf("no password or recipients to encrypt to")
+	}
+	return slots, nil
+}
+
+// NewRecipientSlot wraps fileKey to an X25519 public key
+func NewRecipientSlot(recipient *crypto.X25519Recipient, fileKey []byte) (KeySlot, error) {
+	ephemeral, wrapped, err := recipient.Wrap(fileKey)
+	if err != nil {
+		return KeySlot{}, err
+	}
+	return KeySlot{Type: KeySlotX25519, Ephemeral: ephemeral, WrappedKey: wrapped}, nil
+}
+
+// NewPasswordSlot wraps fileKey under slotKey, which was derived from a
+// password with salt and this key manager's parameters
+func (km *KeyManager) NewPasswordSlot(slotKey, salt, fileKey []byte, cipherID string) (KeySlot, error) {
+	if len(salt) != crypto.SaltLength {
+		return KeySlot{}, fmt.Errorf("salt must be %d bytes", crypto.SaltLength)
+	}
+
+	wrapped, err := wrapKey(slotKey, fileKey, cipherID)
+	if err != nil {
+		return KeySlot{}, err
+	}
+
+	return KeySlot{
+		Type:       KeySlotPassword,
+		Salt:       append([]byte(nil), salt...),
+		KDF:        NewKDFParams(km.params),
+		WrappedKey: wrapped,
+	}, nil
+}
+
+// AddPasswordSlot returns the key slots of header with a new slot for
+// password appended, which also requires keyfile when it is not nil. creds
+// must unlock one of the existing slots.
+func (km *KeyManager) AddPasswordSlot(header *NokvaultHeader, creds *Credentials, password, keyfile []byte) ([]KeySlot, error) {
+	if header.Version == LegacyVersion {
+		return nil, fmt.Errorf("version %d files have no key slots", header.Version)
+	}
+	if len(header.KeySlots) >= MaxKeySlots {
+		return nil, fmt.Errorf("file already has the maximum of %d key slots", MaxKeySlots)
+	}
+
+	fileKey, _, err := km.UnlockFileKey(header, creds, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroizeKey(fileKey)
+
+	var slotKey, salt []byte
+	if keyfile != nil {
+		slotKey, salt, err = km.DeriveKeyWithKeyfile(password, keyfile)
+	} else {
+		slotKey, salt, err = km.DeriveKeyFromPassword(password)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer zeroizeKey(slotKey)
+
+	slot, err := km.NewPasswordSlot(slotKey, salt, fileKey, header.Params.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	slot.Keyfile = keyfile != nil
+
+	slots := append([]KeySlot(nil), header.KeySlots...)
+	return append(slots, slot), nil
+}
+
+// RemoveKeySlot returns the key slots of header without the slot at index.
+// The last slot cannot be removed, since the file could no longer be decrypted.
+func RemoveKeySlot(header *NokvaultHeader, index int) ([]KeySlot, error) {
+	if index < 0 || index >= len(header.KeySlots) {
+		return nil, fmt.Errorf("key slot %d does not exist", index)
+	}
+	if len(header.KeySlots) == 1 {
+		return nil, fmt.Errorf("cannot remove the last key slot")
+	}
+
+	slots := append([]KeySlot(nil), header.KeySlots[:index]...)
+	return append(slots, header.KeySlots[index+1:]...), nil
+}
+
+// DeriveKeyWithKeyfile derives a key from a password with a fresh salt and
+// combines it with a keyfile, so both are needed to derive it again
+func (km *KeyManager) DeriveKeyWithKeyfile(password, keyfile []byte) ([]byte, []byte, error) {
+	passwordKey, salt, err := km.DeriveKeyFromPassword(password)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer zeroizeKey(passwordKey)
+
+	key, err := crypto.CombineKeyfile(passwordKey, keyfile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, salt, nil
+}
+
+// DeriveSlotKeyWithKeyfile derives the key of a password + keyfile slot
+func (km *KeyManager) DeriveSlotKeyWithKeyfile(password, keyfile []byte, slot *KeySlot) ([]byte, error) {
+	passwordKey, err := km.DeriveSlotKey(password, slot)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroizeKey(passwordKey)
+
+	return crypto.CombineKeyfile(passwordKey, keyfile)
+}
+
+// DeriveSlotKey derives the key of a password slot using the salt and key
+// derivation parameters recorded in the slot
+func (km *KeyManager) DeriveSlotKey(password []byte, slot *KeySlot) ([]byte, error) {
+	params, err := slot.KDF.Argon2Params()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := crypto.DeriveKey(password, slot.Salt, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	return key, nil
+}
+
+// OpenFileKey returns the file key of a file given a key derived from a
+// password for one of its slots. Version 1 files are encrypted with that key
+// directly. The returned key is a new slice that the caller should zeroize.
+func (km *KeyManager) OpenFileKey(header *NokvaultHeader, slotKey []byte) ([]byte, error) {
+	if header.Version == LegacyVersion {
+		return append([]byte(nil), slotKey...), nil
+	}
+
+	for i := range header.KeySlots {
+		if header.KeySlots[i].Type != KeySlotPassword {
+			continue
+		}
+		if fileKey, err := openSlot(&header.KeySlots[i], slotKey, header.Params.Cipher); err == nil {
+			return fileKey, nil
+		}
+	}
+	return nil, fmt.Errorf("no key slot could be unlocked: wrong password or keyfile")
+}
+
+// UnlockFileKey derives slot keys from the credentials and returns the file
+// key along with the index of the slot that unlocked it (-1 for version 1
+// files). Derived slot keys are cached in cache when it is not nil. The
+// returned key is a new slice that the caller should zeroize.
+func (km *KeyManager) UnlockFileKey(header *NokvaultHeader, creds *Credentials, cache *KeyCache) ([]byte, int, error) {
+	if header.Version == LegacyVersion {
+		slot := legacySlot(header)
+		secrets := creds.secretsFor(&slot)
+		if len(secrets) == 0 {
+			return nil, -1, fmt.Errorf("version %d files can only be unlocked with a password or keyfile", header.Version)
+		}
+
+		// Version 1 files have no way to tell a wrong key apart until decryption,
+		// so the first secret is used
+		slotKey, err := km.cachedSlotKey(secrets[0], &slot, cache)
+		if err != nil {
+			return nil, -1, err
+		}
+		fileKey := append([]byte(nil), slotKey...)
+		if cache == nil {
+			zeroizeKey(slotKey)
+		}
+		return fileKey, -1, nil
+	}
+
+	missingFactor := false
+	for i := range header.KeySlots {
+		slot := &header.KeySlots[i]
+		switch slot.Type {
+		case KeySlotPassword:
+			secrets := creds.secretsFor(slot)
+			if len(secrets) == 0 && slot.Keyfile {
+				missingFactor = true
+			}
+
+			for _, secret := range secrets {
+				slotKey, err := km.cachedSlotKey(secret, slot, cache)
+				if err != nil {
+					return nil, -1, err
+				}
+
+				fileKey, err := openSlot(slot, slotKey, header.Params.Cipher)
+				if cache == nil {
+					zeroizeKey(slotKey)
+				}
+				if err == nil {
+					return fileKey, i, nil
+				}
+			}
+		case KeySlotX25519:
+			for _, identity := range creds.Identities {
+				if fileKey, err := identity.Unwrap(slot.Ephemeral, slot.WrappedKey); err == nil {
+					return fileKey, i, nil
+				}
+			}
+		}
+	}
+
+	if missingFactor {
+		return nil, -1, fmt.Errorf("no key slot could be unlocked: %w", ErrKeyfileRequired)
+	}
+	return nil, -1, fmt.Errorf("no key slot could be unlocked: wrong password, keyfile or identity")
+}
+
+// legacySlot describes the key of a version 1 file as a password slot.
+// Version 1 files were always written with the default parameters.
+func legacySlot(header *NokvaultHeader) KeySlot {
+	return KeySlot{Type: KeySlotPassword, Salt: header.Salt[:], KDF: NewKDFParams(crypto.DefaultArgon2Params())}
+}
+
+// cachedSlotKey derives the key of a slot from a secret, reusing a cached key
+// when possible. Keys are zeroized by the cache when a cache is used, and by
+// the caller otherwise.
+func (km *KeyManager) cachedSlotKey(secret slotSecret, slot *KeySlot, cache *KeyCache) ([]byte, error) {
+	derive := func() ([]byte, error) {
+		if secret.keyfile != nil {
+			return km.DeriveSlotKeyWithKeyfile(secret.password, secret.keyfile, slot)
+		}
+		return km.DeriveSlotKey(secret.password, slot)
+	}
+
+	if cache == nil {
+		return derive()
+	}
+
+	keyID := secret.id + ":" + SlotKeyID(slot)
+	if key, ok := cache.Get(keyID); ok {
+		return key, nil
+	}
+
+	key, err := derive()
+	if err != nil {
+		return nil, err
+	}
+	cache.Set(keyID, key)
+	return key, nil
+}
+
+// openSlot unwraps the file key of a slot with its slot key
+func openSlot(slot *KeySlot, slotKey []byte, cipherID string) ([]byte, error) {
+	aead, err := crypto.NewAEAD(cipherID, slotKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	fileKey, err := aead.Decrypt(slot.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap file key: %w", err)
+	}
+	return fileKey, nil
+}
+
+// wrapKey seals fileKey with slotKey
+func wrapKey(slotKey, fileKey []byte, cipherID string) ([]byte, error) {
+	aead, err := crypto.NewAEAD(cipherID, slotKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	wrapped, err := aead.Encrypt(fileKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap file key: %w", err)
+	}
+	return wrapped, nil
+}
@@ -0,0 +1,305 @@
+package core
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jimididit/nokvault/internal/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encryptTestFile encrypts content with password and returns the encrypted path
+func encryptTestFile(t *testing.T, service *EncryptionService, dir, name string, content, password []byte) string {
+	t.Helper()
+
+	key, salt, err := service.GetKeyManager().DeriveKeyFromPassword(password)
+	require.NoError(t, err, "Failed to derive key")
+
+	inputPath := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(inputPath, content, 0644), "Failed to create test file")
+
+	encryptedPath := inputPath + ".nokvault"
+	require.NoError(t, service.EncryptFileWithMetadata(inputPath, encryptedPath, key, salt, false), "Encryption should succeed")
+	return encryptedPath
+}
+
+// rewrapSlots returns the slots of header with the slot unlocked by
+// oldPassword replaced by n slots for newPassword
+func rewrapSlots(t *testing.T, service *EncryptionService, header *NokvaultHeader, oldPassword, newPassword []byte, n int) []KeySlot {
+	t.Helper()
+	km := service.GetKeyManager()
+
+	fileKey, index, err := km.UnlockFileKey(header, &Credentials{Password: oldPassword}, nil)
+	require.NoError(t, err, "Old password should unlock the file key")
+
+	newKey, newSalt, err := km.DeriveKeyFromPassword(newPassword)
+	require.NoError(t, err, "Failed to derive key")
+
+	slots := append([]KeySlot(nil), header.KeySlots[:index]...)
+	for i := 0; i < n; i++ {
+		slot, err := km.NewPasswordSlot(newKey, newSalt, fileKey, header.Params.Cipher)
+		require.NoError(t, err, "NewPasswordSlot should succeed")
+		slots = append(slots, slot)
+	}
+	return append(slots, header.KeySlots[index+1:]...)
+}
+
+func TestKeySlot_RewrapKeepsPayload(t *testing.T) {
+	service := NewEncryptionService()
+	service.GetKeyManager().SetParams(8*1024, 1, 1, 32)
+	tmpDir := t.TempDir()
+
+	content := []byte("the payload is not re-encrypted when the password changes")
+	encryptedPath := encryptTestFile(t, service, tmpDir, "input.txt", content, []byte("old-password"))
+	original, err := os.ReadFile(encryptedPath)
+	require.NoError(t, err, "Failed to read encrypted file")
+	require.NoError(t, os.Chmod(encryptedPath, 0640))
+
+	fh := NewFileHandler()
+	file, err := os.Open(encryptedPath)
+	require.NoError(t, err)
+	header, _, err := fh.ReadHeaderWithMetadata(file)
+	file.Close()
+	require.NoError(t, err, "Failed to read header")
+	dataOffset := header.DataOffset
+
+	slots := rewrapSlots(t, service, header, []byte("old-password"), []byte("new-password"), 1)
+	require.NoError(t, fh.UpdateKeySlots(encryptedPath, header, slots), "UpdateKeySlots should succeed")
+
+	rotated, err := os.ReadFile(encryptedPath)
+	require.NoError(t, err, "Failed to read rotated file")
+	assert.Equal(t, len(original), len(rotated), "Padding should keep the file size")
+	assert.Equal(t, original[dataOffset:], rotated[dataOffset:], "Payload should be unchanged")
+	info, err := os.Stat(encryptedPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm(), "The file mode should be kept")
+	entries, err := os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2, "No temporary file should be left beside the input and its encrypted file")
+
+	outputPath := filepath.Join(tmpDir, "output.txt")
+	_, err = service.DecryptFileWithCredentials(encryptedPath, outputPath, &Credentials{Password: []byte("old-password")}, nil)
+	assert.Error(t, err, "Old password should no longer unlock the file")
+
+	_, err = service.DecryptFileWithCredentials(encryptedPath, outputPath, &Credentials{Password: []byte("new-password")}, nil)
+	require.NoError(t, err, "New password should unlock the file")
+	decrypted, err := os.ReadFile(outputPath)
+	require.NoError(t, err, "Failed to read decrypted file")
+	assert.Equal(t, content, decrypted)
+}
+
+func TestKeySlot_UpdateGrowsHeader(t *testing.T) {
+	service := NewEncryptionService()
+	service.GetKeyManager().SetParams(8*1024, 1, 1, 32)
+	tmpDir := t.TempDir()
+
+	content := []byte("enough slots to outgrow the padded key section")
+	encryptedPath := encryptTestFile(t, service, tmpDir, "input.txt", content, []byte("old-password"))
+
+	fh := NewFileHandler()
+	file, err := os.Open(encryptedPath)
+	require.NoError(t, err)
+	header, _, err := fh.ReadHeaderWithMetadata(file)
+	file.Close()
+	require.NoError(t, err, "Failed to read header")
+	dataOffset := header.DataOffset
+
+	slots := rewrapSlots(t, service, header, []byte("old-password"), []byte("new-password"), 8)
+	require.NoError(t, fh.UpdateKeySlots(encryptedPath, header, slots), "UpdateKeySlots should succeed")
+	assert.Greater(t, header.DataOffset, dataOffset, "Header should have grown")
+
+	outputPath := filepath.Join(tmpDir, "output.txt")
+	_, err = service.DecryptFileWithCredentials(encryptedPath, outputPath, &Credentials{Password: []byte("new-password")}, nil)
+	require.NoError(t, err, "New password should unlock the file")
+	decrypted, err := os.ReadFile(outputPath)
+	require.NoError(t, err, "Failed to read decrypted file")
+	assert.Equal(t, content, decrypted)
+}
+
+func TestKeySlot_SlotsAreBoundToFile(t *testing.T) {
+	service := NewEncryptionService()
+	service.GetKeyManager().SetParams(8*1024, 1, 1, 32)
+	tmpDir := t.TempDir()
+	password := []byte("shared-password")
+
+	first := encryptTestFile(t, service, tmpDir, "first.txt", []byte("first file"), password)
+	second := encryptTestFile(t, service, tmpDir, "second.txt", []byte("second file"), password)
+
+	fh := NewFileHandler()
+	firstHeader, err := fh.ReadHeaderFromFile(first)
+	require.NoError(t, err, "Failed to read header")
+
+	file, err := os.Open(second)
+	require.NoError(t, err)
+	secondHeader, _, err := fh.ReadHeaderWithMetadata(file)
+	file.Close()
+	require.NoError(t, err, "Failed to read header")
+
+	// Each file has its own file key, so another file's slot cannot decrypt it
+	require.NoError(t, fh.UpdateKeySlots(second, secondHeader, firstHeader.KeySlots))
+	_, err = service.DecryptFileWithCredentials(second, filepath.Join(tmpDir, "output.txt"), &Credentials{Password: password}, nil)
+	assert.Error(t, err, "A key slot from another file should not decrypt the payload")
+}
+
+func TestKeySlot_WrappedKeyRequired(t *testing.T) {
+	service := NewEncryptionService()
+	service.GetKeyManager().SetParams(8*1024, 1, 1, 32)
+	km := service.GetKeyManager()
+	fh := NewFileHandler()
+
+	// WriteHeader wraps the key in a real slot, so only its password opens it
+	key, salt, err := km.DeriveKeyFromPassword([]byte("right-password"))
+	require.NoError(t, err, "Failed to derive key")
+	var buf bytes.Buffer
+	require.NoError(t, fh.WriteHeader(&buf, salt, key, nil))
+	header, err := fh.ReadHeader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err, "Failed to read header")
+	require.NotEmpty(t, header.KeySlots[0].WrappedKey)
+
+	_, _, err = km.UnlockFileKey(header, &Credentials{Password: []byte("wrong-password")}, nil)
+	assert.Error(t, err, "A wrong password should not unlock the slot")
+
+	// A password slot without a wrapped key is rejected when read
+	slot := KeySlot{Type: KeySlotPassword, Salt: salt, KDF: NewKDFParams(km.Params())}
+	unwrapped, err := fh.NewHeader(DefaultFormatParams(), nil, key, []KeySlot{slot})
+	require.NoError(t, err)
+	buf.Reset()
+	require.NoError(t, fh.WriteRawHeader(&buf, unwrapped))
+	_, err = fh.ReadHeader(&buf)
+	require.Error(t, err, "A password slot without a wrapped key should be rejected")
+	assert.Contains(t, err.Error(), "missing wrapped key")
+}
+
+func TestKeySlot_AddAndRemove(t *testing.T) {
+	service := NewEncryptionService()
+	km := service.GetKeyManager()
+	km.SetParams(8*1024, 1, 1, 32)
+	tmpDir := t.TempDir()
+
+	encryptedPath := encryptTestFile(t, service, tmpDir, "input.txt", []byte("two passwords"), []byte("first"))
+	fh := NewFileHandler()
+	file, err := os.Open(encryptedPath)
+	require.NoError(t, err)
+	header, _, err := fh.ReadHeaderWithMetadata(file)
+	file.Close()
+	require.NoError(t, err, "Failed to read header")
+
+	_, err = km.AddPasswordSlot(header, &Credentials{Password: []byte("wrong")}, []byte("second"), nil)
+	assert.Error(t, err, "Adding a slot requires a working password")
+
+	slots, err := km.AddPasswordSlot(header, &Credentials{Password: []byte("first")}, []byte("second"), nil)
+	require.NoError(t, err, "AddPasswordSlot should succeed")
+	require.Len(t, slots, 2)
+	require.NoError(t, fh.UpdateKeySlots(encryptedPath, header, slots))
+
+	outputPath := filepath.Join(tmpDir, "output.txt")
+	for _, password := range []string{"first", "second"} {
+		_, err = service.DecryptFileWithCredentials(encryptedPath, outputPath, &Credentials{Password: []byte(password)}, nil)
+		assert.NoError(t, err, "Password %q should unlock the file", password)
+	}
+
+	slots, err = RemoveKeySlot(header, 0)
+	require.NoError(t, err, "RemoveKeySlot should succeed")
+	require.NoError(t, fh.UpdateKeySlots(encryptedPath, header, slots))
+
+	_, err = service.DecryptFileWithCredentials(encryptedPath, outputPath, &Credentials{Password: []byte("first")}, nil)
+	assert.Error(t, err, "Removed password should no longer unlock the file")
+	_, err = service.DecryptFileWithCredentials(encryptedPath, outputPath, &Credentials{Password: []byte("second")}, nil)
+	assert.NoError(t, err, "Remaining password should unlock the file")
+
+	_, err = RemoveKeySlot(header, 0)
+	assert.Error(t, err, "The last slot should not be removable")
+	_, err = RemoveKeySlot(header, 5)
+	assert.Error(t, err, "Out of range slots should be rejected")
+}
+
+func TestKeySlot_Recipients(t *testing.T) {
+	service := NewEncryptionService()
+	service.GetKeyManager().SetParams(8*1024, 1, 1, 32)
+	tmpDir := t.TempDir()
+
+	identity, err := crypto.GenerateX25519Identity()
+	require.NoError(t, err)
+	other, err := crypto.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	content := []byte("encrypted to a public key")
+	inputPath := filepath.Join(tmpDir, "input.txt")
+	require.NoError(t, os.WriteFile(inputPath, content, 0644), "Failed to create test file")
+
+	// Encrypting to a public key needs no secret
+	encryptedPath := inputPath + ".nokvault"
+	recipients := &Recipients{PublicKeys: []*crypto.X25519Recipient{identity.Recipient()}}
+	require.NoError(t, service.EncryptFileForRecipients(inputPath, encryptedPath, recipients, false), "Encryption should succeed")
+
+	header, err := NewFileHandler().ReadHeaderFromFile(encryptedPath)
+	require.NoError(t, err, "Failed to read header")
+	require.Len(t, header.KeySlots, 1)
+	assert.Equal(t, KeySlotX25519, header.KeySlots[0].Type)
+
+	outputPath := filepath.Join(tmpDir, "output.txt")
+	_, err = service.DecryptFileWithCredentials(encryptedPath, outputPath, &Credentials{Identities: []*crypto.X25519Identity{other}}, nil)
+	assert.Error(t, err, "Another identity should not decrypt the file")
+	_, err = service.DecryptFileWithCredentials(encryptedPath, outputPath, &Credentials{Password: []byte("password")}, nil)
+	assert.Error(t, err, "A password should not decrypt the file")
+
+	_, err = service.DecryptFileWithCredentials(encryptedPath, outputPath, &Credentials{Identities: []*crypto.X25519Identity{other, identity}}, nil)
+	require.NoError(t, err, "The recipient's identity should decrypt the file")
+	decrypted, err := os.ReadFile(outputPath)
+	require.NoError(t, err, "Failed to read decrypted file")
+	assert.Equal(t, content, decrypted)
+
+	_, err = service.GetKeyManager().NewKeySlots(&Recipients{}, make([]byte, 32), crypto.DefaultCipher)
+	assert.Error(t, err, "Encrypting to nobody should fail")
+}
+
+func TestKeySlot_PasswordAndKeyfile(t *testing.T) {
+	service := NewEncryptionService()
+	km := service.GetKeyManager()
+	km.SetParams(8*1024, 1, 1, 32)
+	tmpDir := t.TempDir()
+
+	password := []byte("password")
+	keyfile := []byte("keyfile contents")
+	key, salt, err := km.DeriveKeyWithKeyfile(password, keyfile)
+	require.NoError(t, err, "DeriveKeyWithKeyfile should succeed")
+
+	content := []byte("needs two factors")
+	inputPath := filepath.Join(tmpDir, "input.txt")
+	require.NoError(t, os.WriteFile(inputPath, content, 0644), "Failed to create test file")
+	encryptedPath := inputPath + ".nokvault"
+	require.NoError(t, service.EncryptFileForRecipients(inputPath, encryptedPath, &Recipients{Key: key, Salt: salt, Keyfile: true}, false))
+
+	header, err := NewFileHandler().ReadHeaderFromFile(encryptedPath)
+	require.NoError(t, err, "Failed to read header")
+	assert.True(t, header.KeySlots[0].Keyfile, "Slot should record the keyfile factor")
+	assert.True(t, RequiresKeyfile(header), "File should require a keyfile")
+
+	outputPath := filepath.Join(tmpDir, "output.txt")
+	_, err = service.DecryptFileWithCredentials(encryptedPath, outputPath, &Credentials{Password: password}, nil)
+	assert.ErrorIs(t, err, ErrKeyfileRequired, "A password alone should report the missing keyfile")
+	_, err = service.DecryptFileWithCredentials(encryptedPath, outputPath, &Credentials{Keyfile: keyfile}, nil)
+	assert.ErrorIs(t, err, ErrKeyfileRequired, "A keyfile alone should report the missing password")
+	_, err = service.DecryptFileWithCredentials(encryptedPath, outputPath, &Credentials{Password: password, Keyfile: []byte("wrong")}, nil)
+	assert.Error(t, err, "A wrong keyfile should fail")
+
+	_, err = service.DecryptFileWithCredentials(encryptedPath, outputPath, &Credentials{Password: password, Keyfile: keyfile}, nil)
+	require.NoError(t, err, "Both factors should decrypt the file")
+	decrypted, err := os.ReadFile(outputPath)
+	require.NoError(t, err, "Failed to read decrypted file")
+	assert.Equal(t, content, decrypted)
+
+	// A single-factor slot added alongside lifts the requirement
+	file, err := os.Open(encryptedPath)
+	require.NoError(t, err)
+	header, _, err = NewFileHandler().ReadHeaderWithMetadata(file)
+	file.Close()
+	require.NoError(t, err)
+	slots, err := km.AddPasswordSlot(header, &Credentials{Password: password, Keyfile: keyfile}, []byte("recovery"), nil)
+	require.NoError(t, err, "AddPasswordSlot should succeed")
+	require.NoError(t, header.SetKeySlots(slots))
+	assert.False(t, RequiresKeyfile(header), "A password-only slot should lift the keyfile requirement")
+}
@@ -0,0 +1,99 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Lock files are created exclusively and record the process holding them as
+// "pid <pid> host <host> since <time>". A lock left behind by a process on
+// this host that is no longer running is stale, and the next process that
+// needs the lock breaks it.
+
+// unknownHost is recorded in a lock when the host name can't be found
+const unknownHost = "unknown"
+
+// maxLockAttempts bounds how many stale locks createLockFile breaks before
+// giving up, in case other processes keep taking the lock in between
+const maxLockAttempts = 3
+
+// errLockHeld is returned by createLockFile when a running process, or one
+// that can't be checked, holds the lock
+var errLockHeld = errors.New("lock held")
+
+// createLockFile creates the lock file at path for this process, breaking a
+// stale lock first, and returns the function removing it. If the lock is
+// held, it returns errLockHeld and a description of the holder.
+func createLockFile(path string) (func(), string, error) {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = unknownHost
+	}
+
+	for attempt := 0; attempt < maxLockAttempts; attempt++ {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			fmt.Fprintf(file, "pid %d host %s since %s\n", os.Getpid(), hostname, time.Now().UTC().Format(time.RFC3339))
+			file.Close()
+			return func() { os.Remove(path) }, "", nil
+		}
+		if !os.IsExist(err) {
+			return nil, "", err
+		}
+
+		holder, stale := readLockFile(path, hostname)
+		if !stale {
+			return nil, holder, errLockHeld
+		}
+		if holder, err := breakLockFile(path, hostname); err != nil {
+			return nil, holder, err
+		}
+	}
+	return nil, "another process", errLockHeld
+}
+
+// breakLockFile removes the stale lock at path. The lock is first renamed to
+// a name of this process, so only one process breaks it, and checked again,
+// since another process may have broken it and taken the lock in between. A
+// lock found to be live is put back unless the lock has been taken since, and
+// its holder returned with errLockHeld.
+func breakLockFile(path, hostname string) (string, error) {
+	broken := fmt.Sprintf("%s.stale-%d-%d", path, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(path, broken); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to break stale lock %s: %w", path, err)
+	}
+
+	holder, stale := readLockFile(broken, hostname)
+	if !stale {
+		if err := os.Link(broken, path); err != nil && !os.IsExist(err) {
+			return "", fmt.Errorf("failed to restore lock %s: %w", path, err)
+		}
+		os.Remove(broken)
+		return holder, errLockHeld
+	}
+	if err := os.Remove(broken); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to remove stale lock %s: %w", broken, err)
+	}
+	return "", nil
+}
+
+// readLockFile describes the holder of the lock at path, and reports whether
+// the lock is stale: held by a process on hostname that is gone
+func readLockFile(path, hostname string) (string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "an unknown process", false
+	}
+	var pid int
+	var host, since string
+	if n, _ := fmt.Sscanf(string(data), "pid %d host %s since %s", &pid, &host, &since); n < 3 {
+		return "an unknown process", false
+	}
+	holder := fmt.Sprintf("pid %d on %s since %s", pid, host, since)
+	return holder, pid > 0 && host == hostname && hostname != unknownHost && !processExists(pid)
+}
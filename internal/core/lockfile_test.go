@@ -0,0 +1,51 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreakLockFile(t *testing.T) {
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "lock")
+
+	// A lock taken by a running process after the stale one was found is put back
+	live := fmt.Sprintf("pid %d host %s since 2026-01-02T03:04:05Z\n", os.Getpid(), hostname)
+	require.NoError(t, os.WriteFile(path, []byte(live), 0600))
+	holder, err := breakLockFile(path, hostname)
+	assert.Equal(t, errLockHeld, err)
+	assert.Contains(t, holder, fmt.Sprintf("pid %d", os.Getpid()))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err, "The live lock should be put back")
+	assert.Equal(t, live, string(data))
+
+	// A lock already broken by another process is left alone
+	require.NoError(t, os.Remove(path))
+	_, err = breakLockFile(path, hostname)
+	assert.NoError(t, err)
+
+	stale := fmt.Sprintf("pid %d host %s since 2026-01-02T03:04:05Z\n", math.MaxInt32, hostname)
+	require.NoError(t, os.WriteFile(path, []byte(stale), 0600))
+	unlock, _, err := createLockFile(path)
+	require.NoError(t, err, "A stale lock should be broken")
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), fmt.Sprintf("pid %d ", os.Getpid()))
+
+	_, holder, err = createLockFile(path)
+	assert.Equal(t, errLockHeld, err, "The lock should not be taken twice")
+	assert.Contains(t, holder, fmt.Sprintf("pid %d", os.Getpid()))
+
+	unlock()
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "No lock files should be left behind")
+}
@@ -0,0 +1,271 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ManifestFile names the encrypted manifest in the root of an encrypted
+// directory. Like the name map, it has no .nokvault extension, so it is not
+// taken for one of the directory's files.
+const ManifestFile = ".nokvault-manifest"
+
+// Kinds of differences between an encrypted directory and its manifest
+const (
+	// ManifestMissing means a file recorded in the manifest is not there
+	ManifestMissing = "missing"
+	// ManifestExtra means a file is not recorded in the manifest
+	ManifestExtra = "extra"
+	// ManifestSwapped means a file holds the payload recorded for another path
+	ManifestSwapped = "swapped"
+	// ManifestStale means a file's payload is not the one recorded for it,
+	// such as an older version of the file
+	ManifestStale = "stale"
+)
+
+// ErrManifestMismatch is returned when an encrypted directory does not match
+// its manifest
+var ErrManifestMismatch = errors.New("directory does not match its manifest")
+
+// ErrOutputNotManaged is returned when encrypting a directory into an output
+// that holds encrypted files but no manifest, such as one written by an older
+// release, whose files can't be told apart from stale ones
+var ErrOutputNotManaged = errors.New("output directory holds encrypted files but no manifest")
+
+// Manifest records every file of an encrypted directory, so files deleted,
+// added, swapped or replaced by another version can be found. It is sealed
+// like any other file, so it can't be changed without the key.
+type Manifest struct {
+	// Generation counts the times a directory was encrypted into the same
+	// output, starting at 1
+	Generation uint64 `json:"generation"`
+	// Entries maps the path of each file relative to the directory, with
+	// forward slashes, to the SHA-256 hash of its encrypted payload
+	Entries map[string]string `json:"entries"`
+}
+
+// ManifestProblem is a difference between an encrypted directory and its manifest
+type ManifestProblem struct {
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// String describes the problem on one line
+func (p ManifestProblem) String() string {
+	return fmt.Sprintf("%s: %s (%s)", p.Path, p.Kind, p.Detail)
+}
+
+// ManifestCheck is the outcome of checking an encrypted directory against its manifest
+type ManifestCheck struct {
+	Generation uint64            `json:"generation"`
+	Problems   []ManifestProblem `json:"problems,omitempty"`
+}
+
+// OK reports whether the directory matches its manifest
+func (c *ManifestCheck) OK() bool {
+	return len(c.Problems) == 0
+}
+
+// Err returns an error wrapping ErrManifestMismatch that lists the
+// problems, or nil if there are none
+func (c *ManifestCheck) Err() error {
+	if c.OK() {
+		return nil
+	}
+	problems := make([]string, len(c.Problems))
+	for i, problem := range c.Problems {
+		problems[i] = problem.String()
+	}
+	return fmt.Errorf("%w (generation %d): %s", ErrManifestMismatch, c.Generation, strings.Join(problems, "; "))
+}
+
+// HasManifest reports whether dir has a manifest
+func HasManifest(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, ManifestFile))
+	return err == nil
+}
+
+// CheckManifest checks the files in the encrypted directory dir against its
+// manifest, which is unlocked with creds. Slot keys are cached in cache when
+// it is not nil.
+func (es *EncryptionService) CheckManifest(dir string, creds *Credentials, cache *KeyCache) (*ManifestCheck, error) {
+	return es.checkManifest(dir, func(header *NokvaultHeader) ([]byte, error) {
+		fileKey, _, err := es.keyManager.UnlockFileKey(header, creds, cache)
+		return fileKey, err
+	})
+}
+
+// checkManifest is CheckManifest with the manifest unlocked by unlock
+func (es *EncryptionService) checkManifest(dir string, unlock func(header *NokvaultHeader) ([]byte, error)) (*ManifestCheck, error) {
+	manifest, err := es.readManifest(filepath.Join(dir, ManifestFile), unlock)
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := manifestPaths(dir)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[string]string, len(paths))
+	for _, path := range paths {
+		relPath, err := manifestRelPath(dir, path)
+		if err != nil {
+			return nil, err
+		}
+		hashes[relPath], err = payloadHash(path)
+		if err != nil {
+			// An unreadable file can't be the one recorded
+			hashes[relPath] = ""
+		}
+	}
+
+	recorded := make(map[string]string, len(manifest.Entries))
+	for relPath, hash := range manifest.Entries {
+		recorded[hash] = relPath
+	}
+
+	check := &ManifestCheck{Generation: manifest.Generation}
+	for _, relPath := range sortedKeys(hashes) {
+		hash := hashes[relPath]
+		expected, listed := manifest.Entries[relPath]
+		other, known := recorded[hash]
+		switch {
+		case listed && hash == expected:
+		case known && other != relPath:
+			check.Problems = append(check.Problems, ManifestProblem{Path: relPath, Kind: ManifestSwapped, Detail: fmt.Sprintf("holds the file recorded as %s", other)})
+		case listed:
+			check.Problems = append(check.Problems, ManifestProblem{Path: relPath, Kind: ManifestStale, Detail: fmt.Sprintf("not the version recorded in generation %d", manifest.Generation)})
+		default:
+			check.Problems = append(check.Problems, ManifestProblem{Path: relPath, Kind: ManifestExtra, Detail: "not recorded in the manifest"})
+		}
+	}
+	for _, relPath := range sortedKeys(manifest.Entries) {
+		if _, ok := hashes[relPath]; !ok {
+			check.Problems = append(check.Problems, ManifestProblem{Path: relPath, Kind: ManifestMissing, Detail: "recorded in the manifest but not found"})
+		}
+	}
+	return check, nil
+}
+
+// writeManifest records the files at paths, below dir, in a new manifest in
+// dir for the recipients. Its generation follows the one of the manifest it
+// replaces.
+func (es *EncryptionService) writeManifest(dir string, paths []string, recipients *Recipients) error {
+	manifestPath := filepath.Join(dir, ManifestFile)
+	generation, err := manifestGeneration(manifestPath)
+	if err != nil {
+		return err
+	}
+
+	manifest := &Manifest{Generation: generation + 1, Entries: make(map[string]string, len(paths))}
+	for _, path := range paths {
+		relPath, err := manifestRelPath(dir, path)
+		if err != nil {
+			return err
+		}
+		manifest.Entries[relPath], err = payloadHash(path)
+		if err != nil {
+			return fmt.Errorf("failed to hash %s: %w", relPath, err)
+		}
+	}
+
+	// The generation is also kept outside the payload, so the next manifest
+	// can follow it without the key
+	params := es.NewFormatParams()
+	params.Content = ContentManifest
+	params.Generation = manifest.Generation
+	return es.writeSealedJSON(manifestPath, params, "manifest", manifest, recipients)
+}
+
+// readManifest decrypts the manifest at path with the file key returned by unlock
+func (es *EncryptionService) readManifest(path string, unlock func(header *NokvaultHeader) ([]byte, error)) (*Manifest, error) {
+	var manifest Manifest
+	header, err := es.readSealedJSON(path, ContentManifest, "manifest", unlock, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	if header.Params.Generation != manifest.Generation {
+		return nil, fmt.Errorf("the generation in the manifest header (%d) does not match its contents (%d)", header.Params.Generation, manifest.Generation)
+	}
+	return &manifest, nil
+}
+
+// manifestGeneration returns the generation recorded in the header of the
+// manifest at path, or 0 if there is none
+func manifestGeneration(path string) (uint64, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return 0, nil
+	}
+	header, err := NewFileHandler().ReadHeaderFromFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read manifest header: %w", err)
+	}
+	if header.Params == nil || header.Params.Content != ContentManifest {
+		return 0, fmt.Errorf("%s is not a manifest", path)
+	}
+	return header.Params.Generation, nil
+}
+
+// manifestPaths returns the files of the encrypted directory dir that are
+// recorded in its manifest: its .nokvault files and its name map
+func manifestPaths(dir string) ([]string, error) {
+	paths, err := NewFileHandler().FindEncryptedFiles(dir, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find files: %w", err)
+	}
+	if HasNameMap(dir) {
+		paths = append(paths, filepath.Join(dir, NameMapFile))
+	}
+	return paths, nil
+}
+
+// manifestRelPath returns the path of a file in a manifest: relative to
+// dir, with forward slashes
+func manifestRelPath(dir, path string) (string, error) {
+	relPath, err := filepath.Rel(dir, path)
+	if err != nil {
+		return "", fmt.Errorf("failed to get relative path for %s: %w", path, err)
+	}
+	return filepath.ToSlash(relPath), nil
+}
+
+// payloadHash returns the hex SHA-256 hash of the encrypted payload of the
+// nokvault file at path. Key slots can be changed without changing it.
+func payloadHash(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	header, err := NewFileHandler().ReadHeader(file)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(int64(header.DataOffset), io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to seek to encrypted data: %w", err)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to read encrypted data: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
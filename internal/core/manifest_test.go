@@ -0,0 +1,114 @@
+package core
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifest_Check(t *testing.T) {
+	password := []byte("manifest-password")
+	archiver, recipients := newTestArchiver(t, password)
+	service := archiver.encryptionService
+	creds := &Credentials{Password: password}
+
+	inputDir := t.TempDir()
+	for _, relPath := range []string{"a.txt", "b.txt", "docs/c.txt"} {
+		filePath := filepath.Join(inputDir, filepath.FromSlash(relPath))
+		require.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+		require.NoError(t, os.WriteFile(filePath, []byte(relPath+" v1"), 0644))
+	}
+
+	encryptedDir := t.TempDir()
+	encryptor := NewDirectoryEncryptor(service, false)
+	require.NoError(t, encryptor.EncryptDirectoryForRecipients(inputDir, encryptedDir, recipients, nil))
+	require.True(t, HasManifest(encryptedDir), "A manifest should be written")
+
+	check, err := service.CheckManifest(encryptedDir, creds, nil)
+	require.NoError(t, err)
+	assert.True(t, check.OK(), "an untouched directory should match: %v", check.Err())
+	assert.Equal(t, uint64(1), check.Generation)
+
+	// Keep the first version of a.txt, then encrypt again
+	oldA, err := os.ReadFile(filepath.Join(encryptedDir, "a.txt.nokvault"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "a.txt"), []byte("a.txt v2"), 0644))
+	require.NoError(t, encryptor.EncryptDirectoryForRecipients(inputDir, encryptedDir, recipients, nil))
+	check, err = service.CheckManifest(encryptedDir, creds, nil)
+	require.NoError(t, err)
+	assert.True(t, check.OK())
+	assert.Equal(t, uint64(2), check.Generation, "the generation should count up")
+
+	// Roll a.txt back, swap b.txt with docs/c.txt, delete docs/.nokvault and add a file
+	require.NoError(t, os.WriteFile(filepath.Join(encryptedDir, "a.txt.nokvault"), oldA, 0644))
+	bPath := filepath.Join(encryptedDir, "b.txt.nokvault")
+	cPath := filepath.Join(encryptedDir, "docs", "c.txt.nokvault")
+	require.NoError(t, os.Rename(bPath, bPath+".tmp"))
+	require.NoError(t, os.Rename(cPath, bPath))
+	require.NoError(t, os.Rename(bPath+".tmp", cPath))
+	require.NoError(t, os.Remove(filepath.Join(encryptedDir, "docs", DirEntryFile)))
+	require.NoError(t, service.EncryptFileForRecipients(filepath.Join(inputDir, "a.txt"), filepath.Join(encryptedDir, "new.txt.nokvault"), recipients, false))
+
+	check, err = service.CheckManifest(encryptedDir, creds, nil)
+	require.NoError(t, err)
+	kinds := make(map[string]string)
+	for _, problem := range check.Problems {
+		kinds[problem.Path] = problem.Kind
+	}
+	assert.Equal(t, map[string]string{
+		"a.txt.nokvault":      ManifestStale,
+		"b.txt.nokvault":      ManifestSwapped,
+		"docs/c.txt.nokvault": ManifestSwapped,
+		"docs/.nokvault":      ManifestMissing,
+		"new.txt.nokvault":    ManifestExtra,
+	}, kinds)
+
+	// Decryption fails before writing anything unless the manifest is ignored
+	decryptor := NewDirectoryDecryptor(service, false)
+	outputDir := filepath.Join(t.TempDir(), "out")
+	err = decryptor.DecryptDirectoryWithPassword(encryptedDir, outputDir, password, nil)
+	assert.ErrorIs(t, err, ErrManifestMismatch)
+	assert.NoFileExists(t, filepath.Join(outputDir, "a.txt"))
+	decryptor.SetIgnoreManifest(true)
+	assert.NoError(t, decryptor.DecryptDirectoryWithPassword(encryptedDir, outputDir, password, nil))
+
+	_, err = service.CheckManifest(encryptedDir, &Credentials{Password: []byte("wrong")}, nil)
+	assert.Error(t, err, "the manifest should not open with a wrong password")
+}
+
+func TestManifest_HeaderGeneration(t *testing.T) {
+	password := []byte("manifest-password")
+	archiver, recipients := newTestArchiver(t, password)
+	service := archiver.encryptionService
+
+	inputDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "a.txt"), []byte("a"), 0644))
+	encryptedDir := t.TempDir()
+	require.NoError(t, NewDirectoryEncryptor(service, false).EncryptDirectoryForRecipients(inputDir, encryptedDir, recipients, nil))
+
+	manifestPath := filepath.Join(encryptedDir, ManifestFile)
+	header, err := NewFileHandler().ReadHeaderFromFile(manifestPath)
+	require.NoError(t, err)
+	assert.Equal(t, ContentManifest, header.Params.Content)
+	assert.Equal(t, uint64(1), header.Params.Generation, "the header should record the generation")
+
+	// The format parameters are authenticated with the payload, so the
+	// generation can't be changed to skip or repeat generations
+	contents, err := os.ReadFile(manifestPath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(manifestPath, replaceOnce(t, contents, `"generation":1`, `"generation":7`), 0644))
+	_, err = service.CheckManifest(encryptedDir, &Credentials{Password: password}, nil)
+	assert.Error(t, err)
+}
+
+// replaceOnce replaces the only occurrence of old in data with new, of the same length
+func replaceOnce(t *testing.T, data []byte, old, new string) []byte {
+	require.Len(t, new, len(old))
+	require.Equal(t, 1, bytes.Count(data, []byte(old)), "%s should occur once", old)
+	copy(data[bytes.Index(data, []byte(old)):], new)
+	return data
+}
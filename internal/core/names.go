@@ -0,0 +1,220 @@
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// NameMapFile names the encrypted name map in the root of a directory
+// encrypted with hidden names. It has no .nokvault extension, so it is not
+// taken for one of the directory's files.
+const NameMapFile = ".nokvault-names"
+
+// opaqueNameEncoding encodes the random names of files encrypted with hidden names
+var opaqueNameEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// ErrNameMapExists is returned when encrypting with hidden names into a
+// directory that already holds files with hidden names
+var ErrNameMapExists = errors.New("output directory already holds files with hidden names")
+
+// NameMap maps the random names of the files in a directory encrypted with
+// hidden names to their original relative paths, using forward slashes. The
+// paths of directory entries end with a slash.
+type NameMap struct {
+	Names map[string]string `json:"names"`
+}
+
+// DirEntryFile names the file holding the metadata of a directory inside the
+// directory in an encrypted tree. It is the .nokvault file of an empty name,
+// so it can't be mistaken for the file of anything else.
+const DirEntryFile = ".nokvault"
+
+// EncryptedFile is a .nokvault file of an encrypted directory
+type EncryptedFile struct {
+	Path         string // Path of the .nokvault file
+	RelativePath string // Original path relative to the directory, with forward slashes
+	IsDir        bool   // Whether the file holds the metadata of a directory
+}
+
+// splitDirEntry strips the trailing slash that marks the path of a directory
+// entry in an encrypted tree, and reports whether it was there
+func splitDirEntry(relPath string) (string, bool) {
+	if relPath == "" || strings.HasSuffix(relPath, "/") {
+		return strings.TrimSuffix(relPath, "/"), true
+	}
+	return relPath, false
+}
+
+// HasNameMap reports whether dir was encrypted with hidden names
+func HasNameMap(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, NameMapFile))
+	return err == nil
+}
+
+// newOpaqueName returns a random name for a file encrypted with hidden names
+func newOpaqueName() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate name: %w", err)
+	}
+	return strings.ToLower(opaqueNameEncoding.EncodeToString(id)), nil
+}
+
+// ResolveEncryptedFiles returns the .nokvault files below root selected by
+// filter, with their original relative paths. For directories encrypted with
+// hidden names, the name map is decrypted with creds; otherwise creds are not
+// used and may be nil.
+func (es *EncryptionService) ResolveEncryptedFiles(root string, filter *PathFilter, creds *Credentials, cache *KeyCache) ([]EncryptedFile, error) {
+	return es.resolveEncryptedFiles(root, filter, func(header *NokvaultHeader) ([]byte, error) {
+		if creds == nil {
+			return nil, fmt.Errorf("the names are encrypted and no credentials were given")
+		}
+		fileKey, _, err := es.keyManager.UnlockFileKey(header, creds, cache)
+		return fileKey, err
+	})
+}
+
+// resolveEncryptedFiles is ResolveEncryptedFiles with the name map unlocked by unlock
+func (es *EncryptionService) resolveEncryptedFiles(root string, filter *PathFilter, unlock func(header *NokvaultHeader) ([]byte, error)) ([]EncryptedFile, error) {
+	fileHandler := NewFileHandler()
+	if !HasNameMap(root) {
+		paths, err := fileHandler.FindEncryptedFiles(root, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		files := make([]EncryptedFile, 0, len(paths))
+		for _, path := range paths {
+			relPath, err := fileHandler.GetRelativePath(root, path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get relative path for %s: %w", path, err)
+			}
+			// The root directory's own entry is not restored
+			name, isDir := splitDirEntry(filepath.ToSlash(strings.TrimSuffix(relPath, ".nokvault")))
+			if name != "" {
+				files = append(files, EncryptedFile{Path: path, RelativePath: name, IsDir: isDir})
+			}
+		}
+		return files, nil
+	}
+
+	names, err := es.readNameMap(filepath.Join(root, NameMapFile), unlock)
+	if err != nil {
+		return nil, err
+	}
+
+	// The layout on disk says nothing about the original one, so every file
+	// is looked up before filtering
+	paths, err := fileHandler.FindEncryptedFiles(root, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []EncryptedFile
+	for _, path := range paths {
+		relPath, err := fileHandler.GetRelativePath(root, path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get relative path for %s: %w", path, err)
+		}
+		name, ok := names.Names[filepath.ToSlash(strings.TrimSuffix(relPath, ".nokvault"))]
+		if !ok {
+			return nil, fmt.Errorf("no name recorded for %s", relPath)
+		}
+		name, isDir := splitDirEntry(name)
+		if filter.Match(name) {
+			files = append(files, EncryptedFile{Path: path, RelativePath: name, IsDir: isDir})
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].RelativePath < files[j].RelativePath })
+	return files, nil
+}
+
+// writeNameMap encrypts names into a new name map at path for the recipients
+func (es *EncryptionService) writeNameMap(path string, names *NameMap, recipients *Recipients) error {
+	params := es.NewFormatParams()
+	params.Content = ContentNameMap
+	return es.writeSealedJSON(path, params, "name map", names, recipients)
+}
+
+// readNameMap decrypts the name map at path with the file key returned by unlock
+func (es *EncryptionService) readNameMap(path string, unlock func(header *NokvaultHeader) ([]byte, error)) (*NameMap, error) {
+	var names NameMap
+	if _, err := es.readSealedJSON(path, ContentNameMap, "name map", unlock, &names); err != nil {
+		return nil, err
+	}
+
+	for id, name := range names.Names {
+		if err := checkArchivePath(name); err != nil {
+			return nil, fmt.Errorf("name map entry %s: %w", id, err)
+		}
+	}
+	return &names, nil
+}
+
+// writeSealedJSON encrypts v as JSON into a new file at path for the
+// recipients, with params recording what the payload holds. what names the
+// file in errors.
+func (es *EncryptionService) writeSealedJSON(path string, params *FormatParams, what string, v interface{}, recipients *Recipients) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", what, err)
+	}
+
+	if err := es.writeFile(path, bytes.NewReader(data), params, nil, recipients); err != nil {
+		return fmt.Errorf("failed to write %s: %w", what, err)
+	}
+	return nil
+}
+
+// readSealedJSON decrypts the file at path, whose payload must be of the
+// content type content, with the file key returned by unlock and decodes it
+// as JSON into v. It returns the header of the file.
+func (es *EncryptionService) readSealedJSON(path, content, what string, unlock func(header *NokvaultHeader) ([]byte, error), v interface{}) (*NokvaultHeader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", what, err)
+	}
+	defer file.Close()
+
+	header, err := NewFileHandler().ReadHeader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s header: %w", what, err)
+	}
+	if header.Params == nil || header.Params.Content != content {
+		return nil, fmt.Errorf("%s is not a %s", path, what)
+	}
+
+	fileKey, err := unlock(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unlock %s: %w", what, err)
+	}
+	defer zeroizeKey(fileKey)
+
+	if _, err := file.Seek(int64(header.DataOffset), io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek to encrypted data: %w", err)
+	}
+	plaintext, err := es.NewPlaintextReader(file, header, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	defer plaintext.Close()
+
+	if err := json.NewDecoder(io.LimitReader(plaintext, maxArchiveIndexSize)).Decode(v); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", what, err)
+	}
+	// Reading to the end authenticates the final chunk
+	if _, err := io.Copy(io.Discard, plaintext); err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w", what, err)
+	}
+	return header, nil
+}
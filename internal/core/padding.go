@@ -0,0 +1,187 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Padding scheme IDs recorded in file headers. Files without padding record
+// none, like files written before padding existed.
+const (
+	PaddingNone    = ""
+	PaddingPadme   = "padme"
+	PaddingBuckets = "buckets"
+)
+
+// paddingBucketSize is the size the payloads of the buckets scheme are
+// rounded up to a multiple of: one default chunk
+const paddingBucketSize = 64 * 1024
+
+// paddingTrailerSize is the size of the padding length at the end of a
+// padded payload
+const paddingTrailerSize = 8
+
+// IsSupportedPadding reports whether id is a known padding scheme ID
+func IsSupportedPadding(id string) bool {
+	return id == PaddingNone || id == PaddingPadme || id == PaddingBuckets
+}
+
+// PaddedSize returns the size a payload of size bytes is padded to by scheme.
+//
+// Padmé rounds sizes up so that only the top O(log log size) bits of the size
+// are kept, which hides the exact size at a cost of at most 12% (less for
+// larger files). Buckets round sizes up to a multiple of 64 KB, hiding small
+// files among each other at a cost of up to 64 KB per file.
+func PaddedSize(scheme string, size int64) int64 {
+	switch scheme {
+	case PaddingPadme:
+		if size < 2 {
+			return size
+		}
+		e := 63 - bits.LeadingZeros64(uint64(size))
+		s := 64 - bits.LeadingZeros64(uint64(e))
+		mask := int64(1)<<(e-s) - 1
+		return (size + mask) &^ mask
+	case PaddingBuckets:
+		return (size + paddingBucketSize - 1) / paddingBucketSize * paddingBucketSize
+	default:
+		return size
+	}
+}
+
+// padReader appends padding to everything read from r: zero bytes followed
+// by their count as a big-endian uint64, so the whole payload is as large as
+// the scheme pads it to. The padding is encrypted with the payload, so zero
+// bytes are as good as random ones.
+type padReader struct {
+	r       io.Reader
+	scheme  string
+	size    int64
+	zeros   int64
+	trailer []byte
+	done    bool
+}
+
+// newPadReader returns a reader of r's contents padded by scheme
+func newPadReader(r io.Reader, scheme string) io.Reader {
+	return &padReader{r: r, scheme: scheme}
+}
+
+func (pr *padReader) Read(p []byte) (int, error) {
+	if !pr.done {
+		n, err := pr.r.Read(p)
+		pr.size += int64(n)
+		if err != io.EOF {
+			return n, err
+		}
+
+		pr.done = true
+		pr.zeros = PaddedSize(pr.scheme, pr.size+paddingTrailerSize) - pr.size - paddingTrailerSize
+		pr.trailer = binary.BigEndian.AppendUint64(nil, uint64(pr.zeros))
+		if n > 0 {
+			return n, nil
+		}
+	}
+
+	if pr.zeros > 0 {
+		n := int(min(int64(len(p)), pr.zeros))
+		clear(p[:n])
+		pr.zeros -= int64(n)
+		return n, nil
+	}
+	if len(pr.trailer) > 0 {
+		n := copy(p, pr.trailer)
+		pr.trailer = pr.trailer[n:]
+		return n, nil
+	}
+	return 0, io.EOF
+}
+
+// unpadReader strips the padding added by padReader. The length of the
+// padding is only known at the end, so runs of zero bytes are held back (as a
+// count) until something else follows them; memory use stays constant.
+type unpadReader struct {
+	r     io.Reader
+	buf   []byte
+	tail  int   // Bytes at the start of buf held back as a possible trailer
+	zeros int64 // Zero bytes held back before the tail
+	pre   int64 // Zero bytes to return before out
+	out   []byte
+	post  int64 // Zero bytes to return after out, at the end
+	eof   bool
+}
+
+// newUnpadReader returns a reader of the contents of the padded payload r
+func newUnpadReader(r io.Reader) io.Reader {
+	return &unpadReader{r: r, buf: make([]byte, 32*1024+paddingTrailerSize)}
+}
+
+func (ur *unpadReader) Read(p []byte) (int, error) {
+	for {
+		switch {
+		case ur.pre > 0:
+			n := int(min(int64(len(p)), ur.pre))
+			clear(p[:n])
+			ur.pre -= int64(n)
+			return n, nil
+		case len(ur.out) > 0:
+			n := copy(p, ur.out)
+			ur.out = ur.out[n:]
+			return n, nil
+		case ur.post > 0:
+			n := int(min(int64(len(p)), ur.post))
+			clear(p[:n])
+			ur.post -= int64(n)
+			return n, nil
+		case ur.eof:
+			return 0, io.EOF
+		}
+
+		if err := ur.fill(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// fill reads the next part of the payload, moving everything but the last
+// bytes (a possible trailer) and trailing zero bytes to the output
+func (ur *unpadReader) fill() error {
+	n, err := ur.r.Read(ur.buf[ur.tail:])
+	if err != nil && err != io.EOF {
+		return err
+	}
+	data := ur.buf[:ur.tail+n]
+
+	if len(data) > paddingTrailerSize {
+		committed := data[:len(data)-paddingTrailerSize]
+		last := len(committed) - 1
+		for last >= 0 && committed[last] == 0 {
+			last--
+		}
+		if last >= 0 {
+			// The zeros held back so far were part of the contents
+			ur.pre = ur.zeros
+			ur.out = append(ur.out[:0], committed[:last+1]...)
+			ur.zeros = 0
+		}
+		ur.zeros += int64(len(committed) - last - 1)
+		ur.tail = copy(ur.buf, data[len(committed):])
+	} else {
+		ur.tail = len(data)
+	}
+
+	if err == io.EOF {
+		if ur.tail != paddingTrailerSize {
+			return fmt.Errorf("invalid padding: payload too short")
+		}
+		padding := binary.BigEndian.Uint64(ur.buf[:paddingTrailerSize])
+		if padding > uint64(ur.zeros) {
+			return fmt.Errorf("invalid padding")
+		}
+		ur.post = ur.zeros - int64(padding)
+		ur.eof = true
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPaddedSize(t *testing.T) {
+	tests := []struct {
+		scheme string
+		size   int64
+		want   int64
+	}{
+		{PaddingNone, 1000, 1000},
+		{PaddingPadme, 0, 0},
+		{PaddingPadme, 9, 10},
+		{PaddingPadme, 1000, 1024},
+		{PaddingPadme, 1 << 20, 1 << 20},
+		{PaddingPadme, 1<<20 + 1, 1<<20 + 1<<15},
+		{PaddingBuckets, 1, 64 * 1024},
+		{PaddingBuckets, 64 * 1024, 64 * 1024},
+		{PaddingBuckets, 64*1024 + 1, 128 * 1024},
+	}
+	for _, tt := range tests {
+		got := PaddedSize(tt.scheme, tt.size)
+		assert.Equal(t, tt.want, got, "PaddedSize(%q, %d)", tt.scheme, tt.size)
+		assert.GreaterOrEqual(t, got, tt.size)
+	}
+
+	// Padmé costs at most 12%
+	for size := int64(100); size < 1<<30; size = size*3 + 7 {
+		assert.LessOrEqual(t, float64(PaddedSize(PaddingPadme, size)), float64(size)*1.12)
+	}
+}
+
+func TestPadReader_RoundTrip(t *testing.T) {
+	inputs := map[string][]byte{
+		"empty":          {},
+		"short":          []byte("abc"),
+		"trailing zeros": append([]byte("data"), make([]byte, 5000)...),
+		"only zeros":     make([]byte, 70000),
+		"large":          bytes.Repeat([]byte("0123456789\x00\x00"), 20000),
+	}
+
+	for name, input := range inputs {
+		for _, scheme := range []string{PaddingPadme, PaddingBuckets} {
+			padded, err := io.ReadAll(newPadReader(bytes.NewReader(input), scheme))
+			require.NoError(t, err, name)
+			assert.Equal(t, PaddedSize(scheme, int64(len(input))+paddingTrailerSize), int64(len(padded)), "%s with %s", name, scheme)
+
+			// Short reads exercise every way the held back zeros can be split
+			unpadded, err := io.ReadAll(newUnpadReader(iotest.HalfReader(bytes.NewReader(padded))))
+			require.NoError(t, err, name)
+			assert.Equal(t, input, unpadded, "%s with %s", name, scheme)
+		}
+	}
+}
+
+func TestUnpadReader_InvalidPadding(t *testing.T) {
+	_, err := io.ReadAll(newUnpadReader(bytes.NewReader([]byte{0, 0, 1})))
+	assert.Error(t, err, "Payloads shorter than the trailer should be rejected")
+
+	// The trailer claims more padding than there are zero bytes
+	payload := binary.BigEndian.AppendUint64([]byte("data\x00"), 2)
+	_, err = io.ReadAll(newUnpadReader(bytes.NewReader(payload)))
+	assert.Error(t, err)
+}
@@ -0,0 +1,551 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Parity data lets a damaged nokvault file be repaired before it is
+// authenticated. It is kept beside the file in <path>.parity: the file is cut
+// into blocks, every block is checksummed, and the blocks are interleaved
+// into stripes, each with Reed-Solomon parity blocks. A damaged block is
+// found by its checksum and rebuilt from the rest of its stripe, and
+// interleaving spreads a run of damaged blocks over many stripes.
+//
+// The parity file is an index (header, the CRC-32C of every data and parity
+// block and a SHA-256 of both), the parity blocks stripe by stripe, a copy of
+// the index and the size of the index, so it survives damage to either copy.
+// It only holds ciphertext, so it reveals nothing the file doesn't.
+
+const (
+	// ParitySuffix is appended to the path of a file to name its parity file
+	ParitySuffix = ".parity"
+
+	// parityMagic identifies a parity file
+	parityMagic = "NOKVPRTY"
+	// parityVersion is the version of the parity file format
+	parityVersion = 1
+	// parityHeaderSize is the size of the header: magic, version, overhead,
+	// block size, file size, data and parity blocks per stripe
+	parityHeaderSize = len(parityMagic) + 2 + 4 + 8 + 2 + 2
+	// parityMinBlockSize is the smallest block size, doubled for large files
+	parityMinBlockSize = 4096
+	// parityMaxBlocks is the most data blocks a file is cut into
+	parityMaxBlocks = 65536
+
+	// MinParity and MaxParity bound the parity overhead, in percent of the file
+	MinParity = 1
+	MaxParity = 100
+)
+
+var (
+	// ErrParityDamaged is returned when both copies of the index of a parity
+	// file are damaged
+	ErrParityDamaged = errors.New("parity file is damaged")
+	// ErrUnrepairable is returned when a file has more damaged blocks than its
+	// parity can rebuild
+	ErrUnrepairable = errors.New("too much damage to repair")
+)
+
+// crcTable is the CRC-32C table used for block checksums
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ParityPath returns the path of the parity file of the file at path
+func ParityPath(path string) string {
+	return path + ParitySuffix
+}
+
+// HasParity reports whether the file at path has a parity file
+func HasParity(path string) bool {
+	_, err := os.Stat(ParityPath(path))
+	return err == nil
+}
+
+// ParityReport describes the damage found in a file with parity
+type ParityReport struct {
+	Path          string `json:"path"`
+	Blocks        int    `json:"blocks"`
+	DamagedBlocks int    `json:"damaged_blocks"`
+	// DamagedParity counts damaged parity blocks and copies of the index
+	DamagedParity int   `json:"damaged_parity"`
+	ExtraBytes    int64 `json:"extra_bytes,omitempty"` // Data appended past the recorded size
+	Repairable    bool  `json:"repairable"`
+	Repaired      bool  `json:"repaired"`
+}
+
+// Damaged reports whether anything is wrong with the file or its parity
+func (r *ParityReport) Damaged() bool {
+	return r.DamagedBlocks > 0 || r.DamagedParity > 0 || r.ExtraBytes > 0
+}
+
+// FilesWithParity returns the files of the nokvault file or volume set at
+// path that have parity files: the file itself, or the volumes of the set,
+// which each have their own. Volumes are found by their parity files, so
+// damaged or missing volumes are included.
+func FilesWithParity(path string) []string {
+	if HasParity(path) {
+		return []string{path}
+	}
+	basePath := path
+	if base, ok := VolumeSetBase(path); ok {
+		basePath = base
+	}
+	var paths []string
+	for index := 1; HasParity(VolumePath(basePath, index)); index++ {
+		paths = append(paths, VolumePath(basePath, index))
+	}
+	return paths
+}
+
+// FindParityFiles returns the files under root that have parity files, in order
+func FindParityFiles(root string) ([]string, error) {
+	var paths []string
+	err := NewFileHandler().WalkDirectory(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && strings.HasSuffix(path, ParitySuffix) {
+			paths = append(paths, strings.TrimSuffix(path, ParitySuffix))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// parityIndex is the index of a parity file
+type parityIndex struct {
+	overhead     int
+	blockSize    int
+	fileSize     int64
+	dataShards   int // Per stripe
+	parityShards int // Per stripe
+	dataCRCs     []uint32
+	parityCRCs   []uint32 // Stripe by stripe
+}
+
+// newParityIndex lays out the parity of a file of fileSize bytes with an
+// overhead of percent
+func newParityIndex(fileSize int64, percent int) *parityIndex {
+	index := &parityIndex{overhead: percent, blockSize: parityMinBlockSize, fileSize: fileSize}
+	for (fileSize+int64(index.blockSize)-1)/int64(index.blockSize) > parityMaxBlocks {
+		index.blockSize *= 2
+	}
+	blocks := index.blocks()
+
+	// As many stripes as needed to keep each one within 256 blocks
+	maxShards := 255 * 100 / (100 + percent)
+	stripes := (blocks + maxShards - 1) / maxShards
+	index.dataShards = (blocks + stripes - 1) / stripes
+	index.parityShards = max((index.dataShards*percent+99)/100, 1)
+	return index
+}
+
+// blocks returns the number of data blocks, at least one
+func (p *parityIndex) blocks() int {
+	return max(int((p.fileSize+int64(p.blockSize)-1)/int64(p.blockSize)), 1)
+}
+
+// stripes returns the number of stripes
+func (p *parityIndex) stripes() int {
+	return (p.blocks() + p.dataShards - 1) / p.dataShards
+}
+
+// block returns the index of data block shard of stripe, which may be past
+// the last block: those blocks are zeros
+func (p *parityIndex) block(stripe, shard int) int {
+	return shard*p.stripes() + stripe
+}
+
+// size returns the encoded size of the index
+func (p *parityIndex) size() int {
+	return parityHeaderSize + 4*(p.blocks()+p.stripes()*p.parityShards) + sha256.Size
+}
+
+// encode returns the binary form of the index
+func (p *parityIndex) encode() []byte {
+	buf := make([]byte, 0, p.size())
+	buf = append(buf, parityMagic...)
+	buf = append(buf, parityVersion, byte(p.overhead))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(p.blockSize))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(p.fileSize))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(p.dataShards))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(p.parityShards))
+	for _, crc := range p.dataCRCs {
+		buf = binary.BigEndian.AppendUint32(buf, crc)
+	}
+	for _, crc := range p.parityCRCs {
+		buf = binary.BigEndian.AppendUint32(buf, crc)
+	}
+	sum := sha256.Sum256(buf)
+	return append(buf, sum[:]...)
+}
+
+// decodeParityHeader reads the header at the start of an encoded index
+func decodeParityHeader(buf []byte) (*parityIndex, error) {
+	if len(buf) < parityHeaderSize || string(buf[:len(parityMagic)]) != parityMagic {
+		return nil, fmt.Errorf("%w: not a parity file", ErrParityDamaged)
+	}
+	buf = buf[len(parityMagic):]
+	if buf[0] != parityVersion {
+		return nil, fmt.Errorf("unsupported parity version: %d", buf[0])
+	}
+	index := &parityIndex{
+		overhead:     int(buf[1]),
+		blockSize:    int(binary.BigEndian.Uint32(buf[2:])),
+		fileSize:     int64(binary.BigEndian.Uint64(buf[6:])),
+		dataShards:   int(binary.BigEndian.Uint16(buf[14:])),
+		parityShards: int(binary.BigEndian.Uint16(buf[16:])),
+	}
+	if index.blockSize < parityMinBlockSize || index.fileSize < 0 || index.dataShards < 1 || index.parityShards < 1 ||
+		index.dataShards+index.parityShards > 256 || int64(index.blocks()) > parityMaxBlocks {
+		return nil, fmt.Errorf("%w: invalid layout", ErrParityDamaged)
+	}
+	return index, nil
+}
+
+// decodeParityIndex decodes a whole index and checks its hash
+func decodeParityIndex(buf []byte) (*parityIndex, error) {
+	index, err := decodeParityHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) != index.size() {
+		return nil, fmt.Errorf("%w: index is %d bytes, expected %d", ErrParityDamaged, len(buf), index.size())
+	}
+	body := buf[:len(buf)-sha256.Size]
+	if sum := sha256.Sum256(body); !bytes.Equal(sum[:], buf[len(body):]) {
+		return nil, fmt.Errorf("%w: index checksum mismatch", ErrParityDamaged)
+	}
+
+	crcs := body[parityHeaderSize:]
+	index.dataCRCs = make([]uint32, index.blocks())
+	for i := range index.dataCRCs {
+		index.dataCRCs[i] = binary.BigEndian.Uint32(crcs[4*i:])
+	}
+	crcs = crcs[4*len(index.dataCRCs):]
+	index.parityCRCs = make([]uint32, index.stripes()*index.parityShards)
+	for i := range index.parityCRCs {
+		index.parityCRCs[i] = binary.BigEndian.Uint32(crcs[4*i:])
+	}
+	return index, nil
+}
+
+// readBlock reads data block index of file into buf, zero-filling whatever
+// is past the end of the file
+func (p *parityIndex) readBlock(file *os.File, index int, buf []byte) error {
+	clear(buf)
+	n, err := file.ReadAt(buf, int64(index)*int64(p.blockSize))
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read block %d: %w", index, err)
+	}
+	// The recorded size ends the file, whatever was appended to it
+	if end := p.fileSize - int64(index)*int64(p.blockSize); int64(n) > end {
+		clear(buf[max(end, 0):])
+	}
+	return nil
+}
+
+// WriteParity writes the parity file of the file at path, with parity blocks
+// taking percent of the size of the file. An existing parity file is replaced.
+func WriteParity(path string, percent int) error {
+	if percent < MinParity || percent > MaxParity {
+		return fmt.Errorf("parity overhead must be between %d and %d percent", MinParity, MaxParity)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	index := newParityIndex(info.Size(), percent)
+	rs, err := newReedSolomon(index.dataShards, index.parityShards)
+	if err != nil {
+		return err
+	}
+
+	// The temporary file lives in the same directory so the rename is atomic
+	parityPath := ParityPath(path)
+	output, err := os.CreateTemp(filepath.Dir(parityPath), "."+filepath.Base(parityPath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create parity file: %w", err)
+	}
+	tempPath := output.Name()
+	defer os.Remove(tempPath)
+	defer output.Close()
+
+	// The index is written once the checksums are known
+	indexSize := index.size()
+	if _, err := output.Seek(int64(indexSize), io.SeekStart); err != nil {
+		return fmt.Errorf("failed to write parity file: %w", err)
+	}
+
+	index.dataCRCs = make([]uint32, index.blocks())
+	block := make([]byte, index.blockSize)
+	parity := make([][]byte, index.parityShards)
+	for i := range parity {
+		parity[i] = make([]byte, index.blockSize)
+	}
+	for stripe := 0; stripe < index.stripes(); stripe++ {
+		for i := range parity {
+			clear(parity[i])
+		}
+		for shard := 0; shard < index.dataShards; shard++ {
+			blockIndex := index.block(stripe, shard)
+			if blockIndex >= index.blocks() {
+				break
+			}
+			if err := index.readBlock(file, blockIndex, block); err != nil {
+				return err
+			}
+			index.dataCRCs[blockIndex] = crc32.Checksum(block, crcTable)
+			rs.encodeShard(shard, block, parity)
+		}
+		for i := range parity {
+			index.parityCRCs = append(index.parityCRCs, crc32.Checksum(parity[i], crcTable))
+			if _, err := output.Write(parity[i]); err != nil {
+				return fmt.Errorf("failed to write parity file: %w", err)
+			}
+		}
+	}
+
+	encoded := index.encode()
+	if _, err := output.Write(encoded); err == nil {
+		_, err = output.Write(binary.BigEndian.AppendUint32(nil, uint32(indexSize)))
+	}
+	if err == nil {
+		_, err = output.WriteAt(encoded, 0)
+	}
+	if err == nil {
+		err = output.Sync()
+	}
+	if err == nil {
+		err = output.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write parity file: %w", err)
+	}
+
+	if err := os.Rename(tempPath, parityPath); err != nil {
+		return fmt.Errorf("failed to replace parity file: %w", err)
+	}
+	return nil
+}
+
+// RefreshParity rewrites the parity file of the file at path, if it has one,
+// with the same overhead. It is called after a file is changed in place, so
+// a repair can't bring back what was changed, such as a revoked key slot.
+func RefreshParity(path string) error {
+	if !HasParity(path) {
+		return nil
+	}
+	parityFile, err := os.Open(ParityPath(path))
+	if err != nil {
+		return fmt.Errorf("failed to open parity file: %w", err)
+	}
+	index, _, _, err := readParityIndex(parityFile)
+	parityFile.Close()
+	if err != nil {
+		return err
+	}
+	return WriteParity(path, index.overhead)
+}
+
+// readParityIndex reads the index of a parity file from the first copy that
+// is intact, and returns the offset of the parity blocks and how many copies
+// were damaged
+func readParityIndex(file *os.File) (*parityIndex, int64, int, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to stat parity file: %w", err)
+	}
+
+	header := make([]byte, parityHeaderSize)
+	if _, err := file.ReadAt(header, 0); err == nil {
+		if index, err := decodeParityHeader(header); err == nil {
+			if index, err := readIndexAt(file, 0, int64(index.size())); err == nil {
+				return index, int64(index.size()), 0, nil
+			}
+		}
+	}
+
+	// The trailing copy is found from the size recorded after it
+	var trailer [4]byte
+	if _, err := file.ReadAt(trailer[:], info.Size()-4); err == nil {
+		size := int64(binary.BigEndian.Uint32(trailer[:]))
+		if size >= int64(parityHeaderSize) && size <= info.Size()-4 {
+			if index, err := readIndexAt(file, info.Size()-4-size, size); err == nil {
+				return index, size, 1, nil
+			}
+		}
+	}
+	return nil, 0, 2, fmt.Errorf("%w: both copies of the index are unreadable", ErrParityDamaged)
+}
+
+// readIndexAt reads and decodes an index of size bytes at offset in file
+func readIndexAt(file *os.File, offset, size int64) (*parityIndex, error) {
+	buf := make([]byte, size)
+	if _, err := file.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	return decodeParityIndex(buf)
+}
+
+// CheckParity checks the file at path against its parity file and reports
+// the damage found and whether it can be repaired. The file is not changed.
+func CheckParity(path string) (*ParityReport, error) {
+	return checkParity(path, false)
+}
+
+// RepairFile rebuilds the damaged blocks of the file at path from its parity
+// file, removes anything appended to it and rewrites a damaged parity file.
+// If the damage is more than the parity can rebuild, nothing is changed and
+// ErrUnrepairable is returned with the report.
+func RepairFile(path string) (*ParityReport, error) {
+	return checkParity(path, true)
+}
+
+// checkParity checks and, if repair is set, repairs the file at path
+func checkParity(path string, repair bool) (*ParityReport, error) {
+	report := &ParityReport{Path: path}
+
+	parityFile, err := os.Open(ParityPath(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open parity file: %w", err)
+	}
+	defer parityFile.Close()
+	index, parityOffset, damagedIndexes, err := readParityIndex(parityFile)
+	if err != nil {
+		return nil, err
+	}
+	report.Blocks = index.blocks()
+	report.DamagedParity = damagedIndexes
+
+	mode := os.O_RDONLY
+	if repair {
+		mode = os.O_RDWR
+	}
+	file, err := os.OpenFile(path, mode, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file: %w", err)
+	}
+	report.ExtraBytes = max(info.Size()-index.fileSize, 0)
+
+	rs, err := newReedSolomon(index.dataShards, index.parityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	// Repairs are only written once every stripe is known to be repairable
+	repaired := make(map[int][]byte)
+	report.Repairable = true
+	for stripe := 0; stripe < index.stripes(); stripe++ {
+		data := make([][]byte, index.dataShards)
+		dataPresent := make([]bool, index.dataShards)
+		damaged := 0
+		for shard := range data {
+			data[shard] = make([]byte, index.blockSize)
+			blockIndex := index.block(stripe, shard)
+			if blockIndex >= index.blocks() {
+				dataPresent[shard] = true
+				continue
+			}
+			if err := index.readBlock(file, blockIndex, data[shard]); err != nil {
+				return nil, err
+			}
+			dataPresent[shard] = crc32.Checksum(data[shard], crcTable) == index.dataCRCs[blockIndex]
+			if !dataPresent[shard] {
+				damaged++
+			}
+		}
+
+		parity := make([][]byte, index.parityShards)
+		parityPresent := make([]bool, index.parityShards)
+		for i := range parity {
+			parity[i] = make([]byte, index.blockSize)
+			number := stripe*index.parityShards + i
+			_, err := parityFile.ReadAt(parity[i], parityOffset+int64(number)*int64(index.blockSize))
+			parityPresent[i] = err == nil && crc32.Checksum(parity[i], crcTable) == index.parityCRCs[number]
+			if !parityPresent[i] {
+				report.DamagedParity++
+			}
+		}
+
+		report.DamagedBlocks += damaged
+		if damaged == 0 || !report.Repairable {
+			continue
+		}
+		if err := rs.reconstruct(data, dataPresent, parity, parityPresent); err != nil {
+			if !errors.Is(err, ErrUnrepairable) {
+				return nil, err
+			}
+			report.Repairable = false
+			continue
+		}
+		for shard, present := range dataPresent {
+			if present {
+				continue
+			}
+			blockIndex := index.block(stripe, shard)
+			if crc32.Checksum(data[shard], crcTable) != index.dataCRCs[blockIndex] {
+				return nil, fmt.Errorf("block %d was rebuilt but does not match its checksum", blockIndex)
+			}
+			repaired[blockIndex] = data[shard]
+		}
+	}
+
+	if !report.Repairable {
+		return report, fmt.Errorf("%w: %d of %d blocks damaged", ErrUnrepairable, report.DamagedBlocks, report.Blocks)
+	}
+	if !repair || !report.Damaged() {
+		return report, nil
+	}
+
+	for blockIndex, data := range repaired {
+		offset := int64(blockIndex) * int64(index.blockSize)
+		size := min(int64(index.blockSize), index.fileSize-offset)
+		if _, err := file.WriteAt(data[:size], offset); err != nil {
+			return nil, fmt.Errorf("failed to write block %d: %w", blockIndex, err)
+		}
+	}
+	if err := file.Truncate(index.fileSize); err != nil {
+		return nil, fmt.Errorf("failed to truncate file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return nil, fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write file: %w", err)
+	}
+
+	if report.DamagedParity > 0 {
+		parityFile.Close()
+		if err := WriteParity(path, index.overhead); err != nil {
+			return nil, err
+		}
+	}
+	report.Repaired = true
+	return report, nil
+}
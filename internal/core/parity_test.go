@@ -0,0 +1,218 @@
+package core
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReedSolomon_Reconstruct(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	rs, err := newReedSolomon(10, 4)
+	require.NoError(t, err)
+
+	data := make([][]byte, 10)
+	parity := make([][]byte, 4)
+	for i := range data {
+		data[i] = make([]byte, 64)
+		rng.Read(data[i])
+	}
+	for i := range parity {
+		parity[i] = make([]byte, 64)
+	}
+	for i, shard := range data {
+		rs.encodeShard(i, shard, parity)
+	}
+
+	// Any four lost shards can be rebuilt
+	original := make([][]byte, len(data))
+	for i := range data {
+		original[i] = append([]byte(nil), data[i]...)
+	}
+	dataPresent := []bool{true, false, true, true, false, true, true, false, true, true}
+	parityPresent := []bool{true, false, true, true}
+	for i, present := range dataPresent {
+		if !present {
+			rng.Read(data[i])
+		}
+	}
+	require.NoError(t, rs.reconstruct(data, dataPresent, parity, parityPresent))
+	assert.Equal(t, original, data)
+
+	dataPresent[0] = false
+	assert.ErrorIs(t, rs.reconstruct(data, dataPresent, parity, parityPresent), ErrUnrepairable)
+
+	_, err = newReedSolomon(200, 57)
+	assert.Error(t, err, "a code is limited to 256 shards")
+}
+
+func TestParity_Repair(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	contents := make([]byte, 1024*1024+123)
+	rng.Read(contents)
+	path := filepath.Join(t.TempDir(), "data.nokvault")
+	require.NoError(t, os.WriteFile(path, contents, 0644))
+	require.NoError(t, WriteParity(path, 10))
+	require.True(t, HasParity(path))
+
+	report, err := CheckParity(path)
+	require.NoError(t, err)
+	assert.False(t, report.Damaged())
+	assert.Equal(t, 257, report.Blocks)
+
+	// Flip bits here and there, overwrite a run of blocks and cut the end off
+	damaged := append([]byte(nil), contents...)
+	for _, offset := range []int{0, 5000, 300000, 700001} {
+		damaged[offset] ^= 0x40
+	}
+	copy(damaged[400000:], make([]byte, 5*4096))
+	damaged = damaged[:len(damaged)-2000]
+	require.NoError(t, os.WriteFile(path, damaged, 0644))
+
+	report, err = CheckParity(path)
+	require.NoError(t, err)
+	assert.Greater(t, report.DamagedBlocks, 5)
+	assert.True(t, report.Repairable)
+	assert.False(t, report.Repaired)
+
+	report, err = RepairFile(path)
+	require.NoError(t, err)
+	assert.True(t, report.Repaired)
+	repaired, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, contents, repaired)
+
+	// Data appended to the file is removed
+	require.NoError(t, os.WriteFile(path, append(append([]byte(nil), contents...), "junk"...), 0644))
+	report, err = RepairFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), report.ExtraBytes)
+	repaired, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, contents, repaired)
+}
+
+func TestParity_Unrepairable(t *testing.T) {
+	contents := make([]byte, 200*1024)
+	rand.New(rand.NewSource(3)).Read(contents)
+	path := filepath.Join(t.TempDir(), "data.nokvault")
+	require.NoError(t, os.WriteFile(path, contents, 0644))
+	require.NoError(t, WriteParity(path, 5))
+
+	// Half of the file is gone
+	require.NoError(t, os.WriteFile(path, contents[:len(contents)/2], 0644))
+	report, err := RepairFile(path)
+	assert.ErrorIs(t, err, ErrUnrepairable)
+	require.NotNil(t, report)
+	assert.False(t, report.Repairable)
+	assert.False(t, report.Repaired)
+	size, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(contents)/2), size.Size(), "an unrepairable file should be left alone")
+
+	assert.Error(t, WriteParity(path, 0))
+	assert.Error(t, WriteParity(path, MaxParity+1))
+}
+
+func TestParity_DamagedParityFile(t *testing.T) {
+	contents := make([]byte, 100*1024)
+	rand.New(rand.NewSource(4)).Read(contents)
+	path := filepath.Join(t.TempDir(), "data.nokvault")
+	require.NoError(t, os.WriteFile(path, contents, 0644))
+	require.NoError(t, WriteParity(path, 20))
+	parity, err := os.ReadFile(ParityPath(path))
+	require.NoError(t, err)
+
+	// The first copy of the index and a data block are damaged; the trailing
+	// copy still finds the data block
+	damagedParity := append([]byte(nil), parity...)
+	damagedParity[parityHeaderSize+2] ^= 1
+	require.NoError(t, os.WriteFile(ParityPath(path), damagedParity, 0644))
+	damaged := append([]byte(nil), contents...)
+	damaged[10] ^= 1
+	require.NoError(t, os.WriteFile(path, damaged, 0644))
+
+	report, err := RepairFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.DamagedBlocks)
+	assert.Equal(t, 1, report.DamagedParity)
+	repaired, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, contents, repaired)
+	rewritten, err := os.ReadFile(ParityPath(path))
+	require.NoError(t, err)
+	assert.Equal(t, parity, rewritten, "the parity file should be rewritten")
+
+	// Both copies of the index are gone
+	require.NoError(t, os.WriteFile(ParityPath(path), damagedParity[:len(parity)/2], 0644))
+	_, err = CheckParity(path)
+	assert.ErrorIs(t, err, ErrParityDamaged)
+}
+
+func TestParity_EncryptionService(t *testing.T) {
+	password := []byte("parity-password")
+	archiver, recipients := newTestArchiver(t, password)
+	service := archiver.encryptionService
+	creds := &Credentials{Password: password}
+	require.NoError(t, service.SetParity(10))
+	assert.Error(t, service.SetParity(MaxParity+1))
+
+	contents := make([]byte, 300*1024)
+	rand.New(rand.NewSource(5)).Read(contents)
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, "data.bin")
+	require.NoError(t, os.WriteFile(inputPath, contents, 0644))
+	path := filepath.Join(tmpDir, "data.nokvault")
+	require.NoError(t, service.EncryptFileForRecipients(inputPath, path, recipients, false))
+	require.True(t, HasParity(path), "a parity file should be written beside the output")
+
+	encrypted, err := os.ReadFile(path)
+	require.NoError(t, err)
+	encrypted[len(encrypted)/2] ^= 1
+	require.NoError(t, os.WriteFile(path, encrypted, 0644))
+	result := service.VerifyFile(path, creds, nil)
+	assert.Equal(t, VerifyCorrupt, result.Status)
+	require.NotNil(t, result.Repairable)
+	assert.True(t, *result.Repairable)
+
+	_, err = RepairFile(path)
+	require.NoError(t, err)
+	result = service.VerifyFile(path, creds, nil)
+	assert.True(t, result.OK(), result.Error)
+	assert.Nil(t, result.Repairable)
+
+	// Changing the key slots rewrites the parity, so a repair can't restore
+	// the old slots
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	header, _, err := NewFileHandler().ReadHeaderWithMetadata(file)
+	file.Close()
+	require.NoError(t, err)
+	slots, err := service.GetKeyManager().AddPasswordSlot(header, creds, []byte("second-password"), nil)
+	require.NoError(t, err)
+	require.NoError(t, NewFileHandler().UpdateKeySlots(path, header, slots))
+	report, err := CheckParity(path)
+	require.NoError(t, err)
+	assert.False(t, report.Damaged())
+
+	// Volumes each get a parity file
+	require.NoError(t, service.SetVolumeSize(MinVolumeSize))
+	setPath := filepath.Join(tmpDir, "set.nokvault")
+	require.NoError(t, service.EncryptFileForRecipients(inputPath, setPath, recipients, false))
+	volumes, err := ListVolumes(setPath)
+	require.NoError(t, err)
+	assert.Equal(t, volumes, FilesWithParity(setPath))
+	found, err := FindParityFiles(tmpDir)
+	require.NoError(t, err)
+	assert.Equal(t, append([]string{path}, volumes...), found)
+
+	// Without parity, a stale parity file of the replaced file is removed
+	require.NoError(t, service.SetParity(0))
+	require.NoError(t, service.SetVolumeSize(0))
+	require.NoError(t, service.EncryptFileForRecipients(inputPath, path, recipients, false))
+	assert.False(t, HasParity(path))
+}
@@ -0,0 +1,204 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// PathFilter selects entries of an encrypted tree by their original relative
+// path, using forward slashes.
+//
+// Patterns are shell globs matched segment by segment, where ** matches any
+// number of segments. A pattern without a slash matches the last segment, so
+// '*.log' matches log files at any depth. A pattern that matches a directory
+// also matches everything below it.
+type PathFilter struct {
+	includes []string
+	excludes []string
+	files    map[string]bool
+}
+
+// NewPathFilter creates a filter selecting paths that match one of includes
+// or are listed in files (everything, if both are empty) and match none of
+// excludes
+func NewPathFilter(includes, excludes, files []string) (*PathFilter, error) {
+	for _, pattern := range append(append([]string(nil), includes...), excludes...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	filter := &PathFilter{
+		includes: normalizePatterns(includes),
+		excludes: normalizePatterns(excludes),
+	}
+	if len(files) > 0 {
+		filter.files = make(map[string]bool, len(files))
+		for _, file := range files {
+			filter.files[normalizeFilterPath(file)] = true
+		}
+	}
+	return filter, nil
+}
+
+// ReadFileList reads a --files-from list: one path per line, with blank lines
+// and lines starting with # ignored
+func ReadFileList(r io.Reader) ([]string, error) {
+	var files []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		files = append(files, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read file list: %w", err)
+	}
+	return files, nil
+}
+
+// Match reports whether the filter selects relPath. A nil filter selects everything.
+func (f *PathFilter) Match(relPath string) bool {
+	if f == nil {
+		return true
+	}
+	relPath = normalizeFilterPath(relPath)
+
+	if len(f.includes) > 0 || f.files != nil {
+		selected := matchAny(f.includes, relPath)
+		if !selected && f.files != nil {
+			for p := relPath; p != "." && !selected; p = path.Dir(p) {
+				selected = f.files[p]
+			}
+		}
+		if !selected {
+			return false
+		}
+	}
+
+	return !matchAny(f.excludes, relPath)
+}
+
+// MatchDir reports whether the filter could select something inside the
+// directory dirPath, so directories that cannot can be skipped entirely
+func (f *PathFilter) MatchDir(dirPath string) bool {
+	if f == nil {
+		return true
+	}
+	dirPath = normalizeFilterPath(dirPath)
+	if dirPath == "." {
+		return true
+	}
+	if matchAny(f.excludes, dirPath) {
+		return false
+	}
+	if len(f.includes) == 0 && f.files == nil {
+		return true
+	}
+
+	// Includes may match the directory, something below it, or be below it
+	for _, pattern := range f.includes {
+		if matchPrefix(strings.Split(pattern, "/"), strings.Split(dirPath, "/")) {
+			return true
+		}
+	}
+	for file := range f.files {
+		if file == dirPath || strings.HasPrefix(file, dirPath+"/") || strings.HasPrefix(dirPath, file+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny reports whether one of the patterns matches relPath or one of its
+// parent directories
+func matchAny(patterns []string, relPath string) bool {
+	for _, pattern := range patterns {
+		for p := relPath; p != "."; p = path.Dir(p) {
+			if matchPattern(pattern, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchPattern matches a single pattern against a slash-separated path
+func matchPattern(pattern, relPath string) bool {
+	if !strings.Contains(pattern, "/") {
+		matched, _ := path.Match(pattern, path.Base(relPath))
+		return matched
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(relPath, "/"))
+}
+
+// matchSegments matches pattern segments against path segments, with **
+// standing for any number of segments
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], segments[0]); !matched {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// matchPrefix reports whether the pattern segments could match a path
+// starting with the directory segments
+func matchPrefix(pattern, dir []string) bool {
+	if len(pattern) == 1 {
+		// Patterns without a slash match at any depth
+		return true
+	}
+	for len(dir) > 0 {
+		if len(pattern) == 0 {
+			// The pattern matched a parent directory
+			return true
+		}
+		if pattern[0] == "**" {
+			return true
+		}
+		if matched, _ := path.Match(pattern[0], dir[0]); !matched {
+			return false
+		}
+		pattern, dir = pattern[1:], dir[1:]
+	}
+	return true
+}
+
+// normalizePatterns cleans patterns for matching against normalized paths
+func normalizePatterns(patterns []string) []string {
+	normalized := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		pattern = strings.TrimPrefix(filepath.ToSlash(pattern), "./")
+		pattern = strings.TrimSuffix(pattern, "/")
+		if pattern != "" {
+			normalized = append(normalized, pattern)
+		}
+	}
+	return normalized
+}
+
+// normalizeFilterPath turns a relative path into the slash-separated form
+// paths are matched in
+func normalizeFilterPath(relPath string) string {
+	return strings.TrimPrefix(path.Clean(filepath.ToSlash(relPath)), "/")
+}
@@ -0,0 +1,115 @@
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathFilter_Match(t *testing.T) {
+	tests := []struct {
+		name     string
+		includes []string
+		excludes []string
+		files    []string
+		matches  map[string]bool
+	}{
+		{
+			name: "no patterns",
+			matches: map[string]bool{
+				"a.txt":         true,
+				"deep/down/b.c": true,
+			},
+		},
+		{
+			name:     "double star",
+			includes: []string{"configs/**"},
+			matches: map[string]bool{
+				"configs/app.yaml":     true,
+				"configs/prod/db.yaml": true,
+				"other/configs/x.yaml": false,
+				"configs.yaml":         false,
+				"src/configs/app.yaml": false,
+			},
+		},
+		{
+			name:     "basename pattern",
+			excludes: []string{"*.log"},
+			matches: map[string]bool{
+				"app.log":        false,
+				"logs/today.log": false,
+				"logs/today.txt": true,
+			},
+		},
+		{
+			name:     "include with exclude",
+			includes: []string{"configs/**"},
+			excludes: []string{"*.log"},
+			matches: map[string]bool{
+				"configs/app.yaml":  true,
+				"configs/debug.log": false,
+				"data/app.yaml":     false,
+			},
+		},
+		{
+			name:     "directory prefix",
+			includes: []string{"src/pkg/"},
+			matches: map[string]bool{
+				"src/pkg/main.go":     true,
+				"src/pkg/sub/util.go": true,
+				"src/main.go":         false,
+			},
+		},
+		{
+			name:  "file list",
+			files: []string{"./README.md", "docs"},
+			matches: map[string]bool{
+				"README.md":     true,
+				"docs/guide.md": true,
+				"src/README.md": false,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := NewPathFilter(tt.includes, tt.excludes, tt.files)
+			require.NoError(t, err)
+			for path, want := range tt.matches {
+				assert.Equal(t, want, filter.Match(path), "Match(%q)", path)
+			}
+		})
+	}
+}
+
+func TestPathFilter_MatchDir(t *testing.T) {
+	filter, err := NewPathFilter([]string{"configs/prod/**", "*.md"}, []string{"tmp"}, nil)
+	require.NoError(t, err)
+
+	assert.True(t, filter.MatchDir("configs"), "Parent of an include should be entered")
+	assert.True(t, filter.MatchDir("configs/prod/db"), "Directories below an include should be entered")
+	assert.True(t, filter.MatchDir("docs"), "Basename patterns can match at any depth")
+	assert.False(t, filter.MatchDir("tmp"), "Excluded directories should be skipped")
+
+	filter, err = NewPathFilter([]string{"configs/prod/**"}, nil, nil)
+	require.NoError(t, err)
+	assert.False(t, filter.MatchDir("data"), "Unrelated directories should be skipped")
+	assert.False(t, filter.MatchDir("configs/dev"))
+
+	var none *PathFilter
+	assert.True(t, none.Match("anything"), "A nil filter selects everything")
+	assert.True(t, none.MatchDir("anything"))
+}
+
+func TestNewPathFilter_InvalidPattern(t *testing.T) {
+	_, err := NewPathFilter([]string{"[abc"}, nil, nil)
+	assert.Error(t, err, "Malformed patterns should be rejected")
+}
+
+func TestReadFileList(t *testing.T) {
+	files, err := ReadFileList(strings.NewReader("# restore list\nREADME.md\n\n  docs/guide.md  \n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"README.md", "docs/guide.md"}, files)
+}
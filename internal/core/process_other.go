@@ -0,0 +1,16 @@
+//go:build !unix
+
+package core
+
+import "os"
+
+// processExists reports whether a process with the given ID is running on
+// this host
+func processExists(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package core
+
+import (
+	"errors"
+	"syscall"
+)
+
+// processExists reports whether a process with the given ID is running on
+// this host. A process owned by another user still exists.
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
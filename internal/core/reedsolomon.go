@@ -0,0 +1,181 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A systematic Reed-Solomon erasure code over GF(2^8). The parity shards are
+// computed with a Cauchy matrix, so any square submatrix is invertible and
+// any dataShards of the dataShards+parityShards shards rebuild the rest.
+
+// gfPolynomial is the reducing polynomial of the field, x^8+x^4+x^3+x^2+1
+const gfPolynomial = 0x11d
+
+var (
+	gfExp [510]byte // Doubled so the sum of two logarithms needs no reduction
+	gfLog [256]byte
+	gfMul [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= gfPolynomial
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+// gfInverse returns the multiplicative inverse of a, which must not be 0
+func gfInverse(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulAdd adds c times src to dst
+func gfMulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	row := &gfMul[c]
+	for i, b := range src {
+		dst[i] ^= row[b]
+	}
+}
+
+// errSingularMatrix is returned when a matrix can't be inverted, which a
+// Cauchy submatrix never is
+var errSingularMatrix = errors.New("matrix is singular")
+
+// gfInvertMatrix inverts the square matrix m with Gauss-Jordan elimination
+func gfInvertMatrix(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	work := make([][]byte, n)
+	for i := range m {
+		work[i] = make([]byte, 2*n)
+		copy(work[i], m[i])
+		work[i][n+i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errSingularMatrix
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		scale := gfInverse(work[col][col])
+		for j := range work[col] {
+			work[col][j] = gfMul[scale][work[col][j]]
+		}
+		for row := 0; row < n; row++ {
+			if row != col {
+				gfMulAdd(work[row], work[col], work[row][col])
+			}
+		}
+	}
+
+	inverse := make([][]byte, n)
+	for i := range work {
+		inverse[i] = work[i][n:]
+	}
+	return inverse, nil
+}
+
+// reedSolomon encodes and rebuilds shards of equal size
+type reedSolomon struct {
+	dataShards   int
+	parityShards int
+	// parity holds the coefficient of every data shard in every parity shard
+	parity [][]byte
+}
+
+// newReedSolomon returns a code of dataShards data and parityShards parity
+// shards, of at most 256 shards in total
+func newReedSolomon(dataShards, parityShards int) (*reedSolomon, error) {
+	if dataShards < 1 || parityShards < 1 || dataShards+parityShards > 256 {
+		return nil, fmt.Errorf("invalid Reed-Solomon code: %d data and %d parity shards", dataShards, parityShards)
+	}
+	rs := &reedSolomon{dataShards: dataShards, parityShards: parityShards, parity: make([][]byte, parityShards)}
+	for i := range rs.parity {
+		rs.parity[i] = make([]byte, dataShards)
+		for j := range rs.parity[i] {
+			// The two sets of points are disjoint, so the sum is never 0
+			rs.parity[i][j] = gfInverse(byte(dataShards+i) ^ byte(j))
+		}
+	}
+	return rs, nil
+}
+
+// encodeShard adds data shard index to the parity shards, which start zeroed
+func (rs *reedSolomon) encodeShard(index int, shard []byte, parity [][]byte) {
+	for i := range parity {
+		gfMulAdd(parity[i], shard, rs.parity[i][index])
+	}
+}
+
+// reconstruct rebuilds the data shards that are not present from the parity
+// shards that are. Absent parity shards are not rebuilt.
+func (rs *reedSolomon) reconstruct(data [][]byte, dataPresent []bool, parity [][]byte, parityPresent []bool) error {
+	var erased, rows []int
+	for j, present := range dataPresent {
+		if !present {
+			erased = append(erased, j)
+		}
+	}
+	if len(erased) == 0 {
+		return nil
+	}
+	for i, present := range parityPresent {
+		if present && len(rows) < len(erased) {
+			rows = append(rows, i)
+		}
+	}
+	if len(rows) < len(erased) {
+		return fmt.Errorf("%w: %d shards lost, %d parity shards left", ErrUnrepairable, len(erased), len(rows))
+	}
+
+	// Take the known data shards out of the parity shards, leaving a system
+	// of equations in the erased ones
+	size := len(parity[rows[0]])
+	remainders := make([][]byte, len(rows))
+	matrix := make([][]byte, len(rows))
+	for r, row := range rows {
+		remainders[r] = make([]byte, size)
+		copy(remainders[r], parity[row])
+		for j, present := range dataPresent {
+			if present {
+				gfMulAdd(remainders[r], data[j], rs.parity[row][j])
+			}
+		}
+		matrix[r] = make([]byte, len(erased))
+		for e, j := range erased {
+			matrix[r][e] = rs.parity[row][j]
+		}
+	}
+
+	inverse, err := gfInvertMatrix(matrix)
+	if err != nil {
+		return err
+	}
+	for e, j := range erased {
+		shard := data[j][:size]
+		clear(shard)
+		for r := range rows {
+			gfMulAdd(shard, remainders[r], inverse[e][r])
+		}
+	}
+	return nil
+}
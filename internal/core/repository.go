@@ -0,0 +1,1058 @@
+package core
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jimididit/nokvault/internal/crypto"
+)
+
+// Layout of a snapshot repository. The keys are kept in RepositoryFile, a
+// nokvault file unlocked like any other; chunks and snapshots are stored in
+// files named by their IDs.
+const (
+	// RepositoryFile names the file holding the keys of a repository
+	RepositoryFile = "repository.nokvault"
+
+	repositoryVersion      = 1
+	repositoryChunksDir    = "chunks"
+	repositorySnapshotsDir = "snapshots"
+	repositoryLockFile     = "lock"
+
+	// maxRepositoryConfigSize limits the configuration read from RepositoryFile
+	maxRepositoryConfigSize = 64 * 1024
+	// maxSnapshotSize limits the snapshot files read from a repository
+	maxSnapshotSize = 256 * 1024 * 1024
+
+	chunkIDSize    = sha256.Size
+	snapshotIDSize = 8
+)
+
+// Labels of the keys derived from the master key of a repository
+const (
+	repositoryIDKeyInfo   = "nokvault/repository/chunk-id"
+	repositoryDataKeyInfo = "nokvault/repository/data"
+	repositoryGearKeyInfo = "nokvault/repository/chunker"
+)
+
+// Kinds of blobs stored in a repository, bound to their IDs when sealed so
+// a blob can't be passed off as another
+const (
+	blobChunk    = "chunk"
+	blobSnapshot = "snapshot"
+)
+
+// Flags at the start of a sealed blob's plaintext
+const (
+	blobRaw  = 0
+	blobGzip = 1
+)
+
+var (
+	// ErrRepositoryExists is returned when creating a repository where one already exists
+	ErrRepositoryExists = errors.New("a repository already exists at this path")
+	// ErrNotRepository is returned when opening a path that holds no repository
+	ErrNotRepository = errors.New("not a nokvault repository")
+	// ErrRepositoryLocked is returned when another backup or prune holds the repository
+	ErrRepositoryLocked = errors.New("repository is locked by another operation")
+	// ErrSnapshotNotFound is returned when no snapshot has the requested ID
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+)
+
+// repositoryConfig is the payload of RepositoryFile
+type repositoryConfig struct {
+	Version   int           `json:"version"`
+	MasterKey []byte        `json:"master_key"`
+	Chunker   ChunkerParams `json:"chunker"`
+}
+
+// Repository is a deduplicating store of encrypted snapshots. Files are cut
+// into content-defined chunks, each stored once under an ID that is a keyed
+// hash of its contents, and every backup records a snapshot listing the
+// metadata and chunks of each entry of the tree. Unchanged data costs nothing
+// but its place in the snapshot.
+type Repository struct {
+	path               string
+	chunkerParams      ChunkerParams
+	idKey              []byte
+	gearKey            []byte
+	dataKey            []byte
+	aead               cipher.AEAD
+	compressionService *CompressionService
+	fileHandler        *FileHandler
+	compress           bool
+	verbose            bool
+	onWarning          func(message string)
+}
+
+// Snapshot records the state of a tree at the time of a backup
+type Snapshot struct {
+	ID      string          `json:"id"`
+	Time    time.Time       `json:"time"`
+	Source  string          `json:"source"`           // Absolute path of the backed up tree
+	Parent  string          `json:"parent,omitempty"` // Snapshot whose unchanged files were reused
+	Entries []SnapshotEntry `json:"entries"`
+}
+
+// SnapshotEntry is a file, directory or symbolic link of a snapshot, with the
+// IDs of the chunks holding a file's contents in order. RelativePath uses
+// forward slashes on every platform.
+type SnapshotEntry struct {
+	FileMetadata
+	Chunks []string `json:"chunks,omitempty"`
+}
+
+// FileCount returns the number of files and links in the snapshot
+func (s *Snapshot) FileCount() int {
+	count := 0
+	for _, entry := range s.Entries {
+		if !entry.IsDir {
+			count++
+		}
+	}
+	return count
+}
+
+// TotalSize returns the total size of the files in the snapshot
+func (s *Snapshot) TotalSize() int64 {
+	var size int64
+	for _, entry := range s.Entries {
+		if entry.IsRegular() {
+			size += entry.Size
+		}
+	}
+	return size
+}
+
+// BackupStats summarizes a backup
+type BackupStats struct {
+	Files     int   // Files backed up
+	Dirs      int   // Directories backed up
+	Unchanged int   // Files reused from the parent snapshot without being read
+	Bytes     int64 // Size of the files
+	NewChunks int   // Chunks added to the repository
+	NewBytes  int64 // Size of the chunks added, as stored
+}
+
+// KeepPolicy selects the snapshots of each source that prune keeps: the Last
+// most recent ones, and the most recent one of each of the last Hourly hours,
+// Daily days and Weekly weeks that have snapshots
+type KeepPolicy struct {
+	Last   int
+	Hourly int
+	Daily  int
+	Weekly int
+}
+
+// IsEmpty reports whether the policy keeps no snapshot at all
+func (p KeepPolicy) IsEmpty() bool {
+	return p.Last <= 0 && p.Hourly <= 0 && p.Daily <= 0 && p.Weekly <= 0
+}
+
+// PruneResult lists what prune kept and removed
+type PruneResult struct {
+	Kept    []*Snapshot
+	Removed []*Snapshot
+	Chunks  int   // Chunks no kept snapshot refers to
+	Bytes   int64 // Size of those chunks, as stored
+}
+
+// IsRepository reports whether path holds a snapshot repository
+func IsRepository(path string) bool {
+	_, err := os.Stat(filepath.Join(path, RepositoryFile))
+	return err == nil
+}
+
+// InitRepository creates a repository at path, which may exist but must not
+// hold a repository yet. Its keys are stored in RepositoryFile with a key slot
+// for each of the recipients, using this service's cipher.
+func (es *EncryptionService) InitRepository(path string, recipients *Recipients) (*Repository, error) {
+	return es.initRepository(path, recipients, DefaultChunkerParams())
+}
+
+// initRepository is InitRepository with the given chunk sizes
+func (es *EncryptionService) initRepository(path string, recipients *Recipients, chunkerParams ChunkerParams) (*Repository, error) {
+	if IsRepository(path) {
+		return nil, ErrRepositoryExists
+	}
+	for _, dir := range []string{path, filepath.Join(path, repositoryChunksDir), filepath.Join(path, repositorySnapshotsDir)} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create repository: %w", err)
+		}
+	}
+
+	masterKey, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	defer zeroizeKey(masterKey)
+
+	config := &repositoryConfig{Version: repositoryVersion, MasterKey: masterKey, Chunker: chunkerParams}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode repository configuration: %w", err)
+	}
+	defer zeroizeKey(data)
+
+	params := es.NewFormatParams()
+	params.Content = ContentRepository
+	params.Padding = PaddingNone
+	if err := es.writeFile(filepath.Join(path, RepositoryFile), bytes.NewReader(data), params, nil, recipients); err != nil {
+		return nil, fmt.Errorf("failed to write repository keys: %w", err)
+	}
+
+	return newRepository(path, params.Cipher, config)
+}
+
+// OpenRepository opens the repository at path, unlocking its keys with creds.
+// Slot keys are cached in cache when it is not nil.
+func (es *EncryptionService) OpenRepository(path string, creds *Credentials, cache *KeyCache) (*Repository, error) {
+	file, err := os.Open(filepath.Join(path, RepositoryFile))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w", path, ErrNotRepository)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open repository: %w", err)
+	}
+	defer file.Close()
+
+	header, err := NewFileHandler().ReadHeader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repository header: %w", err)
+	}
+	if header.Params == nil || header.Params.Content != ContentRepository {
+		return nil, fmt.Errorf("%s: %w", path, ErrNotRepository)
+	}
+
+	fileKey, _, err := es.keyManager.UnlockFileKey(header, creds, cache)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unlock repository: %w", err)
+	}
+	defer zeroizeKey(fileKey)
+
+	if _, err := file.Seek(int64(header.DataOffset), io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek to encrypted data: %w", err)
+	}
+	plaintext, err := es.NewPlaintextReader(file, header, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	defer plaintext.Close()
+
+	// Reading to the end authenticates the final chunk
+	data, err := io.ReadAll(io.LimitReader(plaintext, maxRepositoryConfigSize+1))
+	defer zeroizeKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt repository keys: %w", err)
+	}
+	if len(data) > maxRepositoryConfigSize {
+		return nil, fmt.Errorf("repository configuration too large")
+	}
+
+	var config repositoryConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to decode repository configuration: %w", err)
+	}
+	defer zeroizeKey(config.MasterKey)
+	if config.Version != repositoryVersion {
+		return nil, fmt.Errorf("unsupported repository version: %d", config.Version)
+	}
+	if err := config.Chunker.Validate(); err != nil {
+		return nil, err
+	}
+
+	return newRepository(path, header.Params.Cipher, &config)
+}
+
+// newRepository derives the keys of a repository from its configuration
+func newRepository(path, cipherID string, config *repositoryConfig) (*Repository, error) {
+	if len(config.MasterKey) != crypto.DefaultKeyLength {
+		return nil, fmt.Errorf("invalid repository master key")
+	}
+
+	r := &Repository{
+		path:               path,
+		chunkerParams:      config.Chunker,
+		compressionService: NewCompressionService(),
+		fileHandler:        NewFileHandler(),
+	}
+
+	var err error
+	if r.idKey, err = crypto.DeriveSubkey(config.MasterKey, repositoryIDKeyInfo); err != nil {
+		return nil, err
+	}
+	if r.gearKey, err = crypto.DeriveSubkey(config.MasterKey, repositoryGearKeyInfo); err != nil {
+		return nil, err
+	}
+	if r.dataKey, err = crypto.DeriveSubkey(config.MasterKey, repositoryDataKeyInfo); err != nil {
+		return nil, err
+	}
+
+	aead, err := crypto.NewAEAD(cipherID, r.dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	r.aead = aead.AEAD()
+	return r, nil
+}
+
+// SetCompression enables or disables compressing the chunks of later backups
+func (r *Repository) SetCompression(compress bool) {
+	r.compress = compress
+}
+
+// SetVerbose enables or disables warnings about skipped special files and
+// metadata that could not be restored
+func (r *Repository) SetVerbose(verbose bool) {
+	r.verbose = verbose
+}
+
+// SetOnWarning sets the function told about the warnings enabled by SetVerbose
+func (r *Repository) SetOnWarning(onWarning func(message string)) {
+	r.onWarning = onWarning
+}
+
+// Close zeroizes the keys of the repository
+func (r *Repository) Close() {
+	zeroizeKey(r.idKey)
+	zeroizeKey(r.gearKey)
+	zeroizeKey(r.dataKey)
+}
+
+// Backup records a snapshot of source, a directory or a single file, adding
+// the chunks of its files that the repository doesn't hold yet. Files whose
+// size and modification time match the latest snapshot of the same source
+// reuse its chunks without being read. Symbolic links are recorded, not
+// followed, and special files are skipped.
+func (r *Repository) Backup(source string, onProgress func(current, total int, currentFile string)) (*Snapshot, *BackupStats, error) {
+	source, err := filepath.Abs(source)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to resolve path: %w", err)
+	}
+	sourceInfo, err := os.Lstat(source)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s: %w", source, err)
+	}
+	repoPath, err := filepath.Abs(r.path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to resolve path: %w", err)
+	}
+
+	unlock, err := r.lock()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	snapshots, err := r.Snapshots()
+	if err != nil {
+		return nil, nil, err
+	}
+	id, err := newSnapshotID()
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshot := &Snapshot{ID: id, Time: time.Now().UTC(), Source: source}
+
+	previous := make(map[string]*SnapshotEntry)
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if parent := snapshots[i]; parent.Source == source {
+			snapshot.Parent = parent.ID
+			for j := range parent.Entries {
+				previous[parent.Entries[j].RelativePath] = &parent.Entries[j]
+			}
+			break
+		}
+	}
+
+	chunks, err := r.listChunks()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	total := 1
+	if sourceInfo.IsDir() {
+		if total, err = r.fileHandler.CountFiles(source); err != nil {
+			return nil, nil, fmt.Errorf("failed to count files: %w", err)
+		}
+	}
+
+	stats := &BackupStats{}
+	chunker := NewChunker(nil, r.gearKey, r.chunkerParams)
+	current := 0
+
+	err = r.fileHandler.WalkDirectory(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("error accessing %s: %w", path, err)
+		}
+		// A repository inside the tree is not backed up into itself
+		if info.IsDir() && path == repoPath {
+			return filepath.SkipDir
+		}
+
+		relPath := info.Name()
+		if sourceInfo.IsDir() {
+			rel, err := r.fileHandler.GetRelativePath(source, path)
+			if err != nil {
+				return fmt.Errorf("failed to get relative path: %w", err)
+			}
+			if rel == "." {
+				return nil
+			}
+			relPath = filepath.ToSlash(rel)
+		}
+
+		isSymlink := info.Mode()&os.ModeSymlink != 0
+		if !info.IsDir() && !isSymlink && !info.Mode().IsRegular() {
+			r.warn(fmt.Sprintf("Skipping special file %s", relPath))
+			return nil
+		}
+
+		metadata, err := readEntryMetadata(path, info, false, false)
+		if err != nil {
+			return fmt.Errorf("failed to read metadata of %s: %w", relPath, err)
+		}
+		metadata.RelativePath = relPath
+		entry := SnapshotEntry{FileMetadata: *metadata}
+
+		if info.IsDir() {
+			stats.Dirs++
+		} else {
+			current++
+			if onProgress != nil {
+				onProgress(current, total, relPath)
+			}
+		}
+
+		if entry.IsRegular() {
+			entry.Chunks, err = r.backupFile(path, &entry.FileMetadata, previous[relPath], chunks, chunker, stats)
+			if err != nil {
+				return fmt.Errorf("failed to back up %s: %w", relPath, err)
+			}
+			stats.Files++
+			stats.Bytes += entry.Size
+		}
+
+		snapshot.Entries = append(snapshot.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := r.saveSnapshot(snapshot); err != nil {
+		return nil, nil, err
+	}
+	return snapshot, stats, nil
+}
+
+// backupFile returns the IDs of the chunks of the file at path, adding those
+// missing from chunks to the repository. The size in metadata is updated to
+// the data actually read, in case the file changed since it was listed.
+func (r *Repository) backupFile(path string, metadata *FileMetadata, previous *SnapshotEntry, chunks map[string]int64, chunker *Chunker, stats *BackupStats) ([]string, error) {
+	if previous != nil && previous.IsRegular() && previous.Size == metadata.Size && previous.ModTime.Equal(metadata.ModTime) && hasChunks(chunks, previous.Chunks) {
+		stats.Unchanged++
+		return previous.Chunks, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	var ids []string
+	var size int64
+	chunker.Reset(file)
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+		size += int64(len(data))
+
+		id := r.chunkID(data)
+		if _, ok := chunks[id]; !ok {
+			stored, err := r.writeChunk(id, data)
+			if err != nil {
+				return nil, err
+			}
+			chunks[id] = stored
+			stats.NewChunks++
+			stats.NewBytes += stored
+		}
+		ids = append(ids, id)
+	}
+
+	metadata.Size = size
+	return ids, nil
+}
+
+// Snapshots returns every snapshot in the repository, oldest first
+func (r *Repository) Snapshots() ([]*Snapshot, error) {
+	ids, err := r.snapshotIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]*Snapshot, 0, len(ids))
+	for _, id := range ids {
+		snapshot, err := r.loadSnapshot(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read snapshot %s: %w", id, err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	sort.SliceStable(snapshots, func(i, j int) bool { return snapshots[i].Time.Before(snapshots[j].Time) })
+	return snapshots, nil
+}
+
+// LoadSnapshot returns the snapshot whose ID starts with id, or the most
+// recent snapshot if id is "latest"
+func (r *Repository) LoadSnapshot(id string) (*Snapshot, error) {
+	if id == "latest" {
+		snapshots, err := r.Snapshots()
+		if err != nil {
+			return nil, err
+		}
+		if len(snapshots) == 0 {
+			return nil, fmt.Errorf("%w: the repository holds no snapshots", ErrSnapshotNotFound)
+		}
+		return snapshots[len(snapshots)-1], nil
+	}
+
+	ids, err := r.snapshotIDs()
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, candidate := range ids {
+		if id != "" && strings.HasPrefix(candidate, strings.ToLower(id)) {
+			matches = append(matches, candidate)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, id)
+	case 1:
+		return r.loadSnapshot(matches[0])
+	default:
+		return nil, fmt.Errorf("snapshot ID %s is ambiguous", id)
+	}
+}
+
+// Restore writes the entries of snapshot selected by filter (all of them, if
+// nil) to outputDir. Symbolic links are created after every file is written,
+// and the modes and times of directories are restored last, deepest first.
+func (r *Repository) Restore(snapshot *Snapshot, outputDir string, filter *PathFilter, onProgress func(current, total int, currentFile string)) error {
+	var selected []*SnapshotEntry
+	total := 0
+	for i := range snapshot.Entries {
+		entry := &snapshot.Entries[i]
+		if filter.Match(entry.RelativePath) {
+			selected = append(selected, entry)
+			if !entry.IsDir {
+				total++
+			}
+		}
+	}
+
+	if err := r.fileHandler.EnsureDirectory(outputDir); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	var dirs, symlinks []*SnapshotEntry
+	current := 0
+	progress := func(entry *SnapshotEntry) {
+		current++
+		if onProgress != nil {
+			onProgress(current, total, entry.RelativePath)
+		}
+	}
+
+	for _, entry := range selected {
+		switch {
+		case entry.IsDir:
+			outputPath, err := prepareRestorePath(outputDir, entry.RelativePath)
+			if err == nil {
+				err = r.fileHandler.CreateEntry(outputPath, &entry.FileMetadata)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to restore %s: %w", entry.RelativePath, err)
+			}
+			dirs = append(dirs, entry)
+		case entry.Symlink != "":
+			symlinks = append(symlinks, entry)
+		default:
+			progress(entry)
+			if err := r.restoreFile(outputDir, entry); err != nil {
+				return fmt.Errorf("failed to restore %s: %w", entry.RelativePath, err)
+			}
+		}
+	}
+
+	for _, entry := range symlinks {
+		progress(entry)
+		outputPath, err := prepareRestorePath(outputDir, entry.RelativePath)
+		if err == nil {
+			err = r.fileHandler.CreateEntry(outputPath, &entry.FileMetadata)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %w", entry.RelativePath, err)
+		}
+		r.writeMetadata(outputPath, &entry.FileMetadata)
+	}
+
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].RelativePath > dirs[j].RelativePath })
+	for _, entry := range dirs {
+		r.writeMetadata(filepath.Join(outputDir, filepath.FromSlash(entry.RelativePath)), &entry.FileMetadata)
+	}
+	return nil
+}
+
+// restoreFile writes the contents of a file entry from its chunks
+func (r *Repository) restoreFile(outputDir string, entry *SnapshotEntry) error {
+	outputPath, err := prepareRestorePath(outputDir, entry.RelativePath)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	defer file.Close()
+
+	for _, id := range entry.Chunks {
+		data, err := r.readChunk(id)
+		if err == nil {
+			_, err = file.Write(data)
+		}
+		if err != nil {
+			file.Close()
+			os.Remove(outputPath)
+			return err
+		}
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	r.writeMetadata(outputPath, &entry.FileMetadata)
+	return nil
+}
+
+// Prune removes the snapshots policy doesn't keep, then the chunks no kept
+// snapshot refers to. With dryRun, nothing is removed.
+func (r *Repository) Prune(policy KeepPolicy, dryRun bool) (*PruneResult, error) {
+	if policy.IsEmpty() {
+		return nil, fmt.Errorf("the policy must keep at least one snapshot")
+	}
+
+	unlock, err := r.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	snapshots, err := r.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	kept := policy.keep(snapshots)
+	result := &PruneResult{}
+	referenced := make(map[string]bool)
+	for _, snapshot := range snapshots {
+		if !kept[snapshot.ID] {
+			result.Removed = append(result.Removed, snapshot)
+			continue
+		}
+		result.Kept = append(result.Kept, snapshot)
+		for _, entry := range snapshot.Entries {
+			for _, id := range entry.Chunks {
+				referenced[id] = true
+			}
+		}
+	}
+
+	chunks, err := r.listChunks()
+	if err != nil {
+		return nil, err
+	}
+	var unused []string
+	for id, size := range chunks {
+		if !referenced[id] {
+			unused = append(unused, id)
+			result.Bytes += size
+		}
+	}
+	result.Chunks = len(unused)
+	if dryRun {
+		return result, nil
+	}
+
+	// Snapshots go first, so an interrupted prune never leaves a snapshot
+	// without its chunks
+	for _, snapshot := range result.Removed {
+		if err := os.Remove(r.snapshotPath(snapshot.ID)); err != nil {
+			return nil, fmt.Errorf("failed to remove snapshot %s: %w", snapshot.ID, err)
+		}
+	}
+	for _, id := range unused {
+		if err := os.Remove(r.chunkPath(id)); err != nil {
+			return nil, fmt.Errorf("failed to remove chunk %s: %w", id, err)
+		}
+	}
+	return result, nil
+}
+
+// keep returns the IDs of the snapshots the policy keeps. The snapshots of
+// each source are considered separately.
+func (p KeepPolicy) keep(snapshots []*Snapshot) map[string]bool {
+	bySource := make(map[string][]*Snapshot)
+	for _, snapshot := range snapshots {
+		bySource[snapshot.Source] = append(bySource[snapshot.Source], snapshot)
+	}
+
+	kept := make(map[string]bool)
+	for _, group := range bySource {
+		sort.SliceStable(group, func(i, j int) bool { return group[i].Time.After(group[j].Time) })
+		for i := 0; i < p.Last && i < len(group); i++ {
+			kept[group[i].ID] = true
+		}
+		keepPeriods(group, p.Hourly, func(t time.Time) string { return t.Format("2006-01-02 15") }, kept)
+		keepPeriods(group, p.Daily, func(t time.Time) string { return t.Format("2006-01-02") }, kept)
+		keepPeriods(group, p.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}, kept)
+	}
+	return kept
+}
+
+// keepPeriods keeps the newest of snapshots, sorted newest first, in each of
+// the last n periods that have snapshots
+func keepPeriods(snapshots []*Snapshot, n int, period func(t time.Time) string, kept map[string]bool) {
+	last := ""
+	for _, snapshot := range snapshots {
+		if n <= 0 {
+			return
+		}
+		if key := period(snapshot.Time.Local()); key != last {
+			kept[snapshot.ID] = true
+			last = key
+			n--
+		}
+	}
+}
+
+// lock takes the repository lock, so backups and prunes don't run at the same
+// time, and returns the function releasing it. The lock records the process
+// and host holding it, so a lock left by a process on this host that is no
+// longer running is broken.
+func (r *Repository) lock() (func(), error) {
+	path := filepath.Join(r.path, repositoryLockFile)
+	unlock, holder, err := createLockFile(path)
+	if err == errLockHeld {
+		return nil, fmt.Errorf("%w: held by %s (remove %s if no other nokvault process is using the repository)", ErrRepositoryLocked, holder, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock repository: %w", err)
+	}
+	return unlock, nil
+}
+
+// chunkID returns the ID of a chunk: a hash of its contents keyed with a
+// secret, so IDs don't reveal which known data the repository holds
+func (r *Repository) chunkID(data []byte) string {
+	mac := hmac.New(sha256.New, r.idKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// chunkPath returns the path of a chunk, spread over directories by the
+// first byte of its ID
+func (r *Repository) chunkPath(id string) string {
+	return filepath.Join(r.path, repositoryChunksDir, id[:2], id)
+}
+
+// snapshotPath returns the path of a snapshot
+func (r *Repository) snapshotPath(id string) string {
+	return filepath.Join(r.path, repositorySnapshotsDir, id)
+}
+
+// writeChunk stores a chunk and returns its stored size
+func (r *Repository) writeChunk(id string, data []byte) (int64, error) {
+	blob, err := r.sealBlob(blobChunk, id, data, r.compress)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeFileAtomic(r.chunkPath(id), blob); err != nil {
+		return 0, fmt.Errorf("failed to write chunk: %w", err)
+	}
+	return int64(len(blob)), nil
+}
+
+// readChunk returns the contents of a chunk, checking them against its ID
+func (r *Repository) readChunk(id string) ([]byte, error) {
+	blob, err := os.ReadFile(r.chunkPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk: %w", err)
+	}
+	data, err := r.openBlob(blobChunk, id, blob)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %w", id, err)
+	}
+	if !hmac.Equal([]byte(r.chunkID(data)), []byte(id)) {
+		return nil, fmt.Errorf("chunk %s does not match its ID", id)
+	}
+	return data, nil
+}
+
+// listChunks returns the stored size of every chunk in the repository, by ID
+func (r *Repository) listChunks() (map[string]int64, error) {
+	chunksDir := filepath.Join(r.path, repositoryChunksDir)
+	dirs, err := os.ReadDir(chunksDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunks: %w", err)
+	}
+
+	chunks := make(map[string]int64)
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(chunksDir, dir.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list chunks: %w", err)
+		}
+		for _, entry := range entries {
+			// Temporary files of interrupted writes are not chunks
+			if !isHexID(entry.Name(), chunkIDSize) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return nil, fmt.Errorf("failed to list chunks: %w", err)
+			}
+			chunks[entry.Name()] = info.Size()
+		}
+	}
+	return chunks, nil
+}
+
+// snapshotIDs returns the IDs of the snapshots in the repository
+func (r *Repository) snapshotIDs() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(r.path, repositorySnapshotsDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		if isHexID(entry.Name(), snapshotIDSize) {
+			ids = append(ids, entry.Name())
+		}
+	}
+	return ids, nil
+}
+
+// saveSnapshot stores a snapshot, compressed
+func (r *Repository) saveSnapshot(snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+	blob, err := r.sealBlob(blobSnapshot, snapshot.ID, data, true)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(r.snapshotPath(snapshot.ID), blob); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
+
+// loadSnapshot reads the snapshot with the given ID
+func (r *Repository) loadSnapshot(id string) (*Snapshot, error) {
+	file, err := os.Open(r.snapshotPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer file.Close()
+
+	blob, err := io.ReadAll(io.LimitReader(file, maxSnapshotSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	if len(blob) > maxSnapshotSize {
+		return nil, fmt.Errorf("snapshot too large")
+	}
+	data, err := r.openBlob(blobSnapshot, id, blob)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	if snapshot.ID != id {
+		return nil, fmt.Errorf("snapshot %s is stored as %s", snapshot.ID, id)
+	}
+	for _, entry := range snapshot.Entries {
+		if err := checkArchivePath(entry.RelativePath); err != nil {
+			return nil, fmt.Errorf("snapshot entry: %w", err)
+		}
+		for _, chunk := range entry.Chunks {
+			if !isHexID(chunk, chunkIDSize) {
+				return nil, fmt.Errorf("snapshot entry %s: invalid chunk ID %q", entry.RelativePath, chunk)
+			}
+		}
+	}
+	return &snapshot, nil
+}
+
+// sealBlob encrypts data under a random nonce, prepending the nonce. With
+// compress, data is compressed first when that makes it smaller.
+func (r *Repository) sealBlob(kind, id string, data []byte, compress bool) ([]byte, error) {
+	flag := byte(blobRaw)
+	if compress && r.compressionService.ShouldCompress(data, compressionMinSize) {
+		compressed, err := r.compressionService.Compress(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(data) {
+			data, flag = compressed, blobGzip
+		}
+	}
+
+	plaintext := make([]byte, 0, 1+len(data))
+	plaintext = append(plaintext, flag)
+	plaintext = append(plaintext, data...)
+
+	nonceSize := r.aead.NonceSize()
+	nonce := make([]byte, nonceSize, nonceSize+len(plaintext)+r.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return r.aead.Seal(nonce, nonce, plaintext, blobAD(kind, id)), nil
+}
+
+// openBlob decrypts a blob written by sealBlob
+func (r *Repository) openBlob(kind, id string, blob []byte) ([]byte, error) {
+	nonceSize := r.aead.NonceSize()
+	if len(blob) < nonceSize+r.aead.Overhead()+1 {
+		return nil, fmt.Errorf("%s too short", kind)
+	}
+	plaintext, err := r.aead.Open(nil, blob[:nonceSize], blob[nonceSize:], blobAD(kind, id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w", kind, err)
+	}
+
+	switch plaintext[0] {
+	case blobRaw:
+		return plaintext[1:], nil
+	case blobGzip:
+		return r.compressionService.Decompress(plaintext[1:])
+	default:
+		return nil, fmt.Errorf("unsupported %s encoding: %d", kind, plaintext[0])
+	}
+}
+
+// writeMetadata restores metadata on path, warning about failures in verbose mode
+func (r *Repository) writeMetadata(path string, metadata *FileMetadata) {
+	if err := r.fileHandler.WriteMetadata(path, metadata); err != nil {
+		r.warn(fmt.Sprintf("Could not restore metadata for %s: %v", path, err))
+	}
+}
+
+// warn reports a warning to the warning function in verbose mode
+func (r *Repository) warn(message string) {
+	if r.verbose && r.onWarning != nil {
+		r.onWarning(message)
+	}
+}
+
+// blobAD returns the associated data binding a blob to its kind and ID
+func blobAD(kind, id string) []byte {
+	return []byte("nokvault-repository/" + kind + "/" + id)
+}
+
+// hasChunks reports whether every chunk in ids is stored
+func hasChunks(chunks map[string]int64, ids []string) bool {
+	for _, id := range ids {
+		if _, ok := chunks[id]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// newSnapshotID returns a random snapshot ID
+func newSnapshotID() (string, error) {
+	id := make([]byte, snapshotIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate snapshot ID: %w", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// isHexID reports whether s is the lowercase hex encoding of size bytes
+func isHexID(s string, size int) bool {
+	if len(s) != 2*size {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFileAtomic writes data to a new file at path through a temporary file,
+// so the file is never seen incomplete, creating its directory as needed
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
@@ -0,0 +1,251 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRepository creates a repository with small chunks and fast key
+// derivation, unlocked by password
+func newTestRepository(t *testing.T, password []byte) (*EncryptionService, *Repository, string) {
+	service := NewEncryptionService()
+	service.GetKeyManager().SetParams(8*1024, 1, 1, 32)
+	key, salt, err := service.GetKeyManager().DeriveKeyFromPassword(password)
+	require.NoError(t, err, "Failed to derive key")
+
+	repoPath := filepath.Join(t.TempDir(), "repo")
+	repo, err := service.initRepository(repoPath, &Recipients{Key: key, Salt: salt}, testChunkerParams)
+	require.NoError(t, err, "initRepository should succeed")
+	t.Cleanup(repo.Close)
+	return service, repo, repoPath
+}
+
+func TestRepository_BackupRestore(t *testing.T) {
+	password := []byte("repository-password")
+	service, repo, repoPath := newTestRepository(t, password)
+
+	large := make([]byte, 64*1024)
+	rand.New(rand.NewSource(3)).Read(large)
+
+	inputDir := filepath.Join(t.TempDir(), "docs")
+	require.NoError(t, os.MkdirAll(filepath.Join(inputDir, "sub", "empty"), 0750))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "large.bin"), large, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "sub", "copy.bin"), large, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "sub", "note.txt"), []byte("note"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "empty.txt"), nil, 0644))
+	if runtime.GOOS != "windows" {
+		require.NoError(t, os.Symlink("sub/note.txt", filepath.Join(inputDir, "link")))
+	}
+	modTime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(filepath.Join(inputDir, "sub"), modTime, modTime))
+
+	first, stats, err := repo.Backup(inputDir, nil)
+	require.NoError(t, err, "Backup should succeed")
+	assert.Equal(t, 4, stats.Files)
+	assert.Equal(t, 2, stats.Dirs)
+	assert.Equal(t, int64(2*len(large)+4), stats.Bytes)
+	assert.Empty(t, first.Parent)
+
+	// The copy of large.bin is stored once
+	chunks, err := repo.listChunks()
+	require.NoError(t, err)
+	assert.Equal(t, stats.NewChunks, len(chunks))
+	assert.Less(t, stats.NewBytes, int64(2*len(large)), "identical files should share their chunks")
+
+	// Changing one file only stores its new chunks, and unchanged files are not read
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "sub", "note.txt"), []byte("changed note"), 0644))
+	second, stats, err := repo.Backup(inputDir, nil)
+	require.NoError(t, err, "Backup should succeed")
+	assert.Equal(t, first.ID, second.Parent)
+	assert.Equal(t, 1, stats.NewChunks)
+	assert.Equal(t, 3, stats.Unchanged)
+
+	// Reopen the repository from its key file
+	reopened, err := service.OpenRepository(repoPath, &Credentials{Password: password}, nil)
+	require.NoError(t, err, "OpenRepository should succeed")
+	defer reopened.Close()
+
+	snapshots, err := reopened.Snapshots()
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	assert.Equal(t, first.ID, snapshots[0].ID)
+
+	outputDir := filepath.Join(t.TempDir(), "restored")
+	snapshot, err := reopened.LoadSnapshot(first.ID[:6])
+	require.NoError(t, err, "LoadSnapshot should accept an ID prefix")
+	require.NoError(t, reopened.Restore(snapshot, outputDir, nil, nil), "Restore should succeed")
+
+	data, err := os.ReadFile(filepath.Join(outputDir, "sub", "copy.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, large, data)
+	data, err = os.ReadFile(filepath.Join(outputDir, "sub", "note.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "note", string(data), "the first snapshot should hold the first version")
+	assert.DirExists(t, filepath.Join(outputDir, "sub", "empty"))
+	info, err := os.Stat(filepath.Join(outputDir, "sub"))
+	require.NoError(t, err)
+	assert.True(t, info.ModTime().Equal(modTime), "directory times should be restored")
+	if runtime.GOOS != "windows" {
+		target, err := os.Readlink(filepath.Join(outputDir, "link"))
+		require.NoError(t, err)
+		assert.Equal(t, "sub/note.txt", target)
+		info, err := os.Stat(filepath.Join(outputDir, "sub", "copy.bin"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	// Restore a selection of the latest snapshot
+	filter, err := NewPathFilter([]string{"sub/*.txt"}, nil, nil)
+	require.NoError(t, err)
+	latest, err := reopened.LoadSnapshot("latest")
+	require.NoError(t, err)
+	assert.Equal(t, second.ID, latest.ID)
+	selectedDir := filepath.Join(t.TempDir(), "selected")
+	require.NoError(t, reopened.Restore(latest, selectedDir, filter, nil))
+	data, err = os.ReadFile(filepath.Join(selectedDir, "sub", "note.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "changed note", string(data))
+	assert.NoFileExists(t, filepath.Join(selectedDir, "large.bin"))
+}
+
+func TestRepository_Open(t *testing.T) {
+	service, _, repoPath := newTestRepository(t, []byte("right"))
+
+	_, err := service.OpenRepository(repoPath, &Credentials{Password: []byte("wrong")}, nil)
+	assert.Error(t, err, "OpenRepository should fail with the wrong password")
+
+	_, err = service.OpenRepository(t.TempDir(), &Credentials{Password: []byte("right")}, nil)
+	assert.ErrorIs(t, err, ErrNotRepository)
+
+	_, err = service.InitRepository(repoPath, &Recipients{})
+	assert.ErrorIs(t, err, ErrRepositoryExists)
+	assert.True(t, IsRepository(repoPath))
+}
+
+func TestRepository_TamperedChunk(t *testing.T) {
+	_, repo, _ := newTestRepository(t, []byte("password"))
+
+	inputDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "file.txt"), []byte("some contents"), 0644))
+	snapshot, _, err := repo.Backup(inputDir, nil)
+	require.NoError(t, err)
+
+	// Swap the chunk for another blob of the repository
+	other, err := repo.sealBlob(blobChunk, "other", []byte("other contents"), false)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(repo.chunkPath(snapshot.Entries[0].Chunks[0]), other, 0600))
+
+	err = repo.Restore(snapshot, t.TempDir(), nil, nil)
+	assert.Error(t, err, "Restore should reject a chunk sealed for another ID")
+}
+
+func TestRepository_Lock(t *testing.T) {
+	_, repo, repoPath := newTestRepository(t, []byte("password"))
+	require.NoError(t, os.WriteFile(filepath.Join(repoPath, repositoryLockFile), nil, 0600))
+
+	_, _, err := repo.Backup(t.TempDir(), nil)
+	assert.ErrorIs(t, err, ErrRepositoryLocked)
+	_, err = repo.Prune(KeepPolicy{Last: 1}, false)
+	assert.ErrorIs(t, err, ErrRepositoryLocked)
+
+	require.NoError(t, os.Remove(filepath.Join(repoPath, repositoryLockFile)))
+	_, _, err = repo.Backup(t.TempDir(), nil)
+	assert.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(repoPath, repositoryLockFile), "Backup should release the lock")
+
+	// A lock held by a running process names it
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	lock := fmt.Sprintf("pid %d host %s since 2026-01-02T03:04:05Z\n", os.Getpid(), hostname)
+	require.NoError(t, os.WriteFile(filepath.Join(repoPath, repositoryLockFile), []byte(lock), 0600))
+	_, _, err = repo.Backup(t.TempDir(), nil)
+	require.ErrorIs(t, err, ErrRepositoryLocked)
+	assert.Contains(t, err.Error(), fmt.Sprintf("pid %d on %s", os.Getpid(), hostname))
+
+	// A lock left by a process of this host that is gone is broken
+	lock = fmt.Sprintf("pid %d host %s since 2026-01-02T03:04:05Z\n", math.MaxInt32, hostname)
+	require.NoError(t, os.WriteFile(filepath.Join(repoPath, repositoryLockFile), []byte(lock), 0600))
+	_, _, err = repo.Backup(t.TempDir(), nil)
+	assert.NoError(t, err, "A stale lock should be broken")
+
+	// One from another host can't be checked
+	lock = fmt.Sprintf("pid %d host other-%s since 2026-01-02T03:04:05Z\n", math.MaxInt32, hostname)
+	require.NoError(t, os.WriteFile(filepath.Join(repoPath, repositoryLockFile), []byte(lock), 0600))
+	_, _, err = repo.Backup(t.TempDir(), nil)
+	assert.ErrorIs(t, err, ErrRepositoryLocked)
+}
+
+func TestRepository_Prune(t *testing.T) {
+	_, repo, _ := newTestRepository(t, []byte("password"))
+
+	inputDir := t.TempDir()
+	for _, contents := range []string{"first version", "second version", "third version"} {
+		require.NoError(t, os.WriteFile(filepath.Join(inputDir, "file.txt"), []byte(contents), 0644))
+		_, _, err := repo.Backup(inputDir, nil)
+		require.NoError(t, err)
+	}
+
+	_, err := repo.Prune(KeepPolicy{}, false)
+	assert.Error(t, err, "Prune should refuse to remove every snapshot")
+
+	result, err := repo.Prune(KeepPolicy{Last: 1}, true)
+	require.NoError(t, err)
+	assert.Len(t, result.Kept, 1)
+	assert.Len(t, result.Removed, 2)
+	assert.Equal(t, 2, result.Chunks)
+	snapshots, err := repo.Snapshots()
+	require.NoError(t, err)
+	assert.Len(t, snapshots, 3, "a dry run should remove nothing")
+
+	_, err = repo.Prune(KeepPolicy{Last: 1}, false)
+	require.NoError(t, err)
+	snapshots, err = repo.Snapshots()
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+	chunks, err := repo.listChunks()
+	require.NoError(t, err)
+	assert.Len(t, chunks, 1, "only the chunk of the kept snapshot should remain")
+
+	outputDir := t.TempDir()
+	require.NoError(t, repo.Restore(snapshots[0], outputDir, nil, nil))
+	data, err := os.ReadFile(filepath.Join(outputDir, "file.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "third version", string(data))
+}
+
+func TestKeepPolicy_Keep(t *testing.T) {
+	start := time.Date(2025, 6, 2, 0, 30, 0, 0, time.Local) // A Monday
+	var snapshots []*Snapshot
+	// Every 6 hours for 15 days
+	for i := 0; i < 60; i++ {
+		snapshots = append(snapshots, &Snapshot{ID: string(rune('A' + i)), Time: start.Add(time.Duration(i) * 6 * time.Hour), Source: "/data"})
+	}
+	other := &Snapshot{ID: "other", Time: start, Source: "/other"}
+	snapshots = append(snapshots, other)
+
+	kept := KeepPolicy{Last: 2}.keep(snapshots)
+	assert.Len(t, kept, 3, "the latest snapshots of each source should be kept")
+	assert.True(t, kept[other.ID])
+
+	kept = KeepPolicy{Daily: 3}.keep(snapshots)
+	assert.Len(t, kept, 4)
+	assert.True(t, kept[snapshots[59].ID])
+	assert.True(t, kept[snapshots[55].ID], "the newest snapshot of each day should be kept")
+	assert.True(t, kept[snapshots[51].ID])
+
+	kept = KeepPolicy{Weekly: 5}.keep(snapshots)
+	assert.Len(t, kept, 4, "15 days starting on a Monday span 3 weeks")
+
+	kept = KeepPolicy{Last: 1, Hourly: 2}.keep(snapshots)
+	assert.Len(t, kept, 3)
+	assert.True(t, kept[snapshots[58].ID])
+}
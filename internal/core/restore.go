@@ -0,0 +1,220 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// TreeRestorer restores the entries of an encrypted directory one at a time.
+// Regular files and directories are written by Restore; symbolic links, hard
+// links and the modes and times of directories are only restored by Finish,
+// so that nothing is written through a link restored from the tree and the
+// times of directories survive the files written into them.
+type TreeRestorer struct {
+	encryptionService *EncryptionService
+	fileHandler       *FileHandler
+	outputDir         string
+	unlock            func(header *NokvaultHeader) ([]byte, error)
+	onWarning         func(message string)
+
+	sources   map[string]string // .nokvault file of every regular file, by relative path
+	restored  map[string]bool   // Regular files written by Restore
+	dirs      []restoredEntry
+	symlinks  []restoredEntry
+	hardlinks []restoredEntry
+}
+
+// restoredEntry is an entry whose restoration was left to Finish
+type restoredEntry struct {
+	relPath  string
+	metadata *FileMetadata
+}
+
+// NewTreeRestorer creates a restorer writing to outputDir the entries of the
+// encrypted directory whose files are listed in files, as returned by
+// ResolveEncryptedFiles without a filter. The files are unlocked with creds,
+// and slot keys are cached in cache when it is not nil.
+func NewTreeRestorer(encryptionService *EncryptionService, files []EncryptedFile, outputDir string, creds *Credentials, cache *KeyCache) *TreeRestorer {
+	return newTreeRestorer(encryptionService, files, outputDir, func(header *NokvaultHeader) ([]byte, error) {
+		fileKey, _, err := encryptionService.keyManager.UnlockFileKey(header, creds, cache)
+		return fileKey, err
+	}, nil)
+}
+
+// newTreeRestorer is NewTreeRestorer with the files unlocked by unlock
+func newTreeRestorer(encryptionService *EncryptionService, files []EncryptedFile, outputDir string, unlock func(header *NokvaultHeader) ([]byte, error), onWarning func(message string)) *TreeRestorer {
+	sources := make(map[string]string, len(files))
+	for _, file := range files {
+		if !file.IsDir {
+			sources[file.RelativePath] = file.Path
+		}
+	}
+
+	return &TreeRestorer{
+		encryptionService: encryptionService,
+		fileHandler:       NewFileHandler(),
+		outputDir:         outputDir,
+		unlock:            unlock,
+		onWarning:         onWarning,
+		sources:           sources,
+		restored:          make(map[string]bool),
+	}
+}
+
+// SetOnWarning sets the function told about metadata that could not be
+// restored. Without one, such failures are ignored.
+func (r *TreeRestorer) SetOnWarning(onWarning func(message string)) {
+	r.onWarning = onWarning
+}
+
+// Restore decrypts file into the output directory, creating its parent
+// directories as needed
+func (r *TreeRestorer) Restore(file EncryptedFile) error {
+	outputPath, err := r.prepare(file.RelativePath)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := r.encryptionService.decryptFile(file.Path, outputPath, r.unlock)
+	if err != nil {
+		return err
+	}
+
+	entry := restoredEntry{relPath: file.RelativePath, metadata: metadata}
+	switch {
+	case metadata == nil || metadata.IsRegular():
+		r.restored[file.RelativePath] = true
+		r.writeMetadata(outputPath, metadata)
+	case metadata.IsDir:
+		if err := r.fileHandler.CreateEntry(outputPath, metadata); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+		r.dirs = append(r.dirs, entry)
+	case metadata.Symlink != "":
+		r.symlinks = append(r.symlinks, entry)
+	default:
+		if err := checkArchivePath(metadata.Hardlink); err != nil {
+			return fmt.Errorf("invalid hard link: %w", err)
+		}
+		r.hardlinks = append(r.hardlinks, entry)
+	}
+	return nil
+}
+
+// Finish creates the links restored so far and restores the modes and times
+// of the directories, deepest first. Every entry is attempted; the errors of
+// those that failed are returned together.
+func (r *TreeRestorer) Finish() error {
+	var errs []error
+
+	// Hard links to files that were not restored get a copy of their contents
+	for _, entry := range r.hardlinks {
+		if err := r.restoreHardlink(entry); err != nil {
+			errs = append(errs, fmt.Errorf("failed to restore %s: %w", entry.relPath, err))
+		}
+	}
+
+	sort.Slice(r.symlinks, func(i, j int) bool { return r.symlinks[i].relPath < r.symlinks[j].relPath })
+	for _, entry := range r.symlinks {
+		outputPath, err := r.prepare(entry.relPath)
+		if err == nil {
+			err = r.fileHandler.CreateEntry(outputPath, entry.metadata)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to restore %s: %w", entry.relPath, err))
+			continue
+		}
+		r.writeMetadata(outputPath, entry.metadata)
+	}
+
+	sort.Slice(r.dirs, func(i, j int) bool { return r.dirs[i].relPath > r.dirs[j].relPath })
+	for _, entry := range r.dirs {
+		r.writeMetadata(filepath.Join(r.outputDir, filepath.FromSlash(entry.relPath)), entry.metadata)
+	}
+
+	return errors.Join(errs...)
+}
+
+// restoreHardlink links entry to the file it shares its contents with, or
+// decrypts that file's contents into it if the file was not restored
+func (r *TreeRestorer) restoreHardlink(entry restoredEntry) error {
+	outputPath, err := r.prepare(entry.relPath)
+	if err != nil {
+		return err
+	}
+
+	target := entry.metadata.Hardlink
+	if r.restored[target] {
+		if err := os.Remove(outputPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to replace %s: %w", outputPath, err)
+		}
+		return os.Link(filepath.Join(r.outputDir, filepath.FromSlash(target)), outputPath)
+	}
+
+	source, ok := r.sources[target]
+	if !ok {
+		return fmt.Errorf("linked file %s is missing", target)
+	}
+	metadata, err := r.encryptionService.decryptFile(source, outputPath, r.unlock)
+	if err != nil {
+		return err
+	}
+	if metadata != nil && !metadata.IsRegular() {
+		return fmt.Errorf("linked file %s is not a regular file", target)
+	}
+	r.writeMetadata(outputPath, metadata)
+	return nil
+}
+
+// prepare returns the output path of relPath after creating its parent directories
+func (r *TreeRestorer) prepare(relPath string) (string, error) {
+	return prepareRestorePath(r.outputDir, relPath)
+}
+
+// prepareRestorePath returns the path of relPath below outputDir after
+// creating its parent directories. It refuses to write below a symbolic link,
+// and removes a link already at the path so nothing is written through it.
+func prepareRestorePath(outputDir, relPath string) (string, error) {
+	if err := checkArchivePath(relPath); err != nil {
+		return "", err
+	}
+
+	dir := outputDir
+	segments := strings.Split(relPath, "/")
+	for i, segment := range segments[:len(segments)-1] {
+		dir = filepath.Join(dir, segment)
+		info, err := os.Lstat(dir)
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Mkdir(dir, 0755); err != nil {
+				return "", fmt.Errorf("failed to create output directory: %w", err)
+			}
+		case err != nil:
+			return "", fmt.Errorf("failed to create output directory: %w", err)
+		case info.Mode()&os.ModeSymlink != 0:
+			return "", fmt.Errorf("refusing to write %s through the symbolic link %s", relPath, path.Join(segments[:i+1]...))
+		case !info.IsDir():
+			return "", fmt.Errorf("failed to create output directory: %s is not a directory", dir)
+		}
+	}
+
+	outputPath := filepath.Join(dir, segments[len(segments)-1])
+	if info, err := os.Lstat(outputPath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(outputPath); err != nil {
+			return "", fmt.Errorf("failed to replace %s: %w", outputPath, err)
+		}
+	}
+	return outputPath, nil
+}
+
+// writeMetadata restores metadata on path, reporting failures as warnings
+func (r *TreeRestorer) writeMetadata(path string, metadata *FileMetadata) {
+	if err := r.fileHandler.WriteMetadata(path, metadata); err != nil && r.onWarning != nil {
+		r.onWarning(fmt.Sprintf("Could not restore metadata for %s: %v", path, err))
+	}
+}
@@ -0,0 +1,248 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/jimididit/nokvault/internal/crypto"
+)
+
+// A nokvault file can be signed with an Ed25519 signing key, which proves who
+// wrote it where the shared password only proves that someone who knows it
+// did. The signature is kept beside the file in <path>.sig, or beside the
+// path a volume set was split from. It covers the authenticated part of the
+// header (format parameters and sealed metadata) and the encrypted payload,
+// but not the key slots, so they can still be changed without re-signing.
+
+const (
+	// SignatureSuffix is appended to the path of a file to name its signature
+	SignatureSuffix = ".sig"
+
+	// signatureVersion is the version of the signature file format
+	signatureVersion = 1
+	// signatureContext separates nokvault file signatures from other uses of a key
+	signatureContext = "nokvault/signature/v1"
+)
+
+// Outcomes of checking the signature of a file
+const (
+	// SignatureValid means the file is signed by a trusted signer
+	SignatureValid = "valid"
+	// SignatureMissing means the file has no signature
+	SignatureMissing = "missing"
+	// SignatureUnknownSigner means the file is signed, but not by a trusted signer
+	SignatureUnknownSigner = "unknown-signer"
+	// SignatureInvalid means the signature does not match the file: the file
+	// or its signature was changed after it was signed
+	SignatureInvalid = "invalid"
+)
+
+// Signature is the contents of a signature file
+type Signature struct {
+	Version   int    `json:"version"`
+	Signer    string `json:"signer"`    // Verifying key of the signer
+	Signature string `json:"signature"` // Base64 Ed25519 signature
+}
+
+// SignatureCheck is the outcome of checking the signature of one file
+type SignatureCheck struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Signer string `json:"signer,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// OK reports whether the file is signed by a trusted signer
+func (c *SignatureCheck) OK() bool {
+	return c.Status == SignatureValid
+}
+
+// SignaturePath returns the path of the signature of the nokvault file or
+// volume set at path
+func SignaturePath(path string) string {
+	if basePath, ok := VolumeSetBase(path); ok {
+		path = basePath
+	}
+	return path + SignatureSuffix
+}
+
+// SetSigningKey signs every new file with key, or none when key is nil
+func (es *EncryptionService) SetSigningKey(key *crypto.SigningKey) {
+	es.signingKey = key
+}
+
+// SigningKey returns the key new files are signed with, nil if they aren't
+func (es *EncryptionService) SigningKey() *crypto.SigningKey {
+	return es.signingKey
+}
+
+// signOutput signs the new file at outputPath with the signing key. Without
+// one, the stale signature of a file it replaced is removed, so it isn't
+// taken for a signature of the new file.
+func (es *EncryptionService) signOutput(outputPath string) error {
+	if es.signingKey == nil {
+		if err := os.Remove(SignaturePath(outputPath)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove stale signature: %w", err)
+		}
+		return nil
+	}
+	return SignFile(outputPath, es.signingKey)
+}
+
+// SignFile signs the nokvault file or volume set at path with key, replacing
+// any signature it has
+func SignFile(path string, key *crypto.SigningKey) error {
+	digest, err := signatureDigest(path)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(&Signature{
+		Version:   signatureVersion,
+		Signer:    key.Public().String(),
+		Signature: base64.StdEncoding.EncodeToString(key.Sign(digest)),
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode signature: %w", err)
+	}
+
+	// The temporary file lives in the same directory so the rename is atomic
+	signaturePath := SignaturePath(path)
+	output, err := os.CreateTemp(filepath.Dir(signaturePath), "."+filepath.Base(signaturePath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create signature: %w", err)
+	}
+	tempPath := output.Name()
+	defer os.Remove(tempPath)
+
+	_, err = output.Write(append(data, '\n'))
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write signature: %w", err)
+	}
+	if err := os.Rename(tempPath, signaturePath); err != nil {
+		return fmt.Errorf("failed to replace signature: %w", err)
+	}
+	return nil
+}
+
+// CheckSignature checks the signature of the nokvault file or volume set at
+// path against the trusted signers. An error reading the file or its
+// signature is reported as an invalid signature.
+func CheckSignature(path string, trusted []*crypto.VerifyingKey) *SignatureCheck {
+	check := &SignatureCheck{Path: path}
+	data, err := os.ReadFile(SignaturePath(path))
+	if os.IsNotExist(err) {
+		check.Status = SignatureMissing
+		return check
+	}
+
+	check.Status = SignatureInvalid
+	if err != nil {
+		check.Error = fmt.Sprintf("failed to read signature: %v", err)
+		return check
+	}
+	var signature Signature
+	if err := json.Unmarshal(data, &signature); err != nil {
+		check.Error = fmt.Sprintf("malformed signature: %v", err)
+		return check
+	}
+	if signature.Version != signatureVersion {
+		check.Error = fmt.Sprintf("unsupported signature version: %d", signature.Version)
+		return check
+	}
+	check.Signer = signature.Signer
+	signer, err := crypto.ParseVerifyingKey(signature.Signer)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature.Signature)
+	if err != nil {
+		check.Error = fmt.Sprintf("malformed signature: %v", err)
+		return check
+	}
+
+	digest, err := signatureDigest(path)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	if !signer.Verify(digest, sig) {
+		check.Error = "the signature does not match the file"
+		return check
+	}
+
+	for _, key := range trusted {
+		if key.Equal(signer) {
+			check.Status = SignatureValid
+			return check
+		}
+	}
+	check.Status = SignatureUnknownSigner
+	check.Error = "signed by a key that is not a trusted signer"
+	return check
+}
+
+// CheckSignatures checks the signature of the nokvault file or volume set at
+// path, or of every nokvault file under it if it is a directory, including
+// its manifest
+func CheckSignatures(path string, trusted []*crypto.VerifyingKey) ([]*SignatureCheck, error) {
+	paths := []string{path}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		paths, err = FindNokvaultFiles(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find files: %w", err)
+		}
+		if HasManifest(path) {
+			paths = append(paths, filepath.Join(path, ManifestFile))
+		}
+	}
+
+	checks := make([]*SignatureCheck, len(paths))
+	for i, path := range paths {
+		checks[i] = CheckSignature(path, trusted)
+	}
+	return checks, nil
+}
+
+// signatureDigest returns the digest of the nokvault file or volume set at
+// path that is signed: the authenticated part of its header and its payload
+func signatureDigest(path string) ([]byte, error) {
+	file, err := openEncryptedFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	header, _, err := NewFileHandler().ReadHeaderWithMetadata(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	if header.Version == LegacyVersion {
+		return nil, fmt.Errorf("version %d files can't be signed", LegacyVersion)
+	}
+	ad, err := header.AssociatedData()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(int64(header.DataOffset), io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek to encrypted data: %w", err)
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(signatureContext))
+	binary.Write(hash, binary.BigEndian, uint64(len(ad)))
+	hash.Write(ad)
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, fmt.Errorf("failed to read encrypted data: %w", err)
+	}
+	return hash.Sum(nil), nil
+}
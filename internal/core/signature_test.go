@@ -0,0 +1,101 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jimididit/nokvault/internal/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignature_Check(t *testing.T) {
+	password := []byte("signature-password")
+	archiver, recipients := newTestArchiver(t, password)
+	service := archiver.encryptionService
+	signingKey, err := crypto.GenerateSigningKey()
+	require.NoError(t, err)
+	other, err := crypto.GenerateSigningKey()
+	require.NoError(t, err)
+	trusted := []*crypto.VerifyingKey{signingKey.Public()}
+
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, "data.txt")
+	require.NoError(t, os.WriteFile(inputPath, []byte("signed contents"), 0644))
+	path := filepath.Join(tmpDir, "data.nokvault")
+
+	require.NoError(t, service.EncryptFileForRecipients(inputPath, path, recipients, false))
+	assert.Equal(t, SignatureMissing, CheckSignature(path, trusted).Status)
+
+	service.SetSigningKey(signingKey)
+	require.NoError(t, service.EncryptFileForRecipients(inputPath, path, recipients, false))
+	require.FileExists(t, SignaturePath(path))
+	check := CheckSignature(path, trusted)
+	assert.True(t, check.OK(), check.Error)
+	assert.Equal(t, signingKey.Public().String(), check.Signer)
+	assert.Equal(t, SignatureUnknownSigner, CheckSignature(path, []*crypto.VerifyingKey{other.Public()}).Status)
+
+	// Key slots can change without breaking the signature
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	header, _, err := NewFileHandler().ReadHeaderWithMetadata(file)
+	file.Close()
+	require.NoError(t, err)
+	slots, err := service.GetKeyManager().AddPasswordSlot(header, &Credentials{Password: password}, []byte("second-password"), nil)
+	require.NoError(t, err)
+	require.NoError(t, NewFileHandler().UpdateKeySlots(path, header, slots))
+	assert.True(t, CheckSignature(path, trusted).OK(), "adding a key slot should keep the signature valid")
+
+	// Changing the payload breaks it
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	contents[len(contents)-1] ^= 1
+	require.NoError(t, os.WriteFile(path, contents, 0644))
+	check = CheckSignature(path, trusted)
+	assert.Equal(t, SignatureInvalid, check.Status)
+	assert.Contains(t, check.Error, "does not match")
+
+	// Another file's signature doesn't match
+	otherPath := filepath.Join(tmpDir, "other.nokvault")
+	require.NoError(t, service.EncryptFileForRecipients(inputPath, otherPath, recipients, false))
+	require.NoError(t, os.Rename(SignaturePath(otherPath), SignaturePath(path)))
+	contents[len(contents)-1] ^= 1
+	require.NoError(t, os.WriteFile(path, contents, 0644))
+	assert.Equal(t, SignatureInvalid, CheckSignature(path, trusted).Status)
+
+	// Without a signing key, the stale signature of a replaced file is removed
+	service.SetSigningKey(nil)
+	require.NoError(t, service.EncryptFileForRecipients(inputPath, path, recipients, false))
+	assert.NoFileExists(t, SignaturePath(path))
+}
+
+func TestSignature_DirectoryAndVolumes(t *testing.T) {
+	archiver, recipients := newTestArchiver(t, []byte("signature-password"))
+	service := archiver.encryptionService
+	signingKey, err := crypto.GenerateSigningKey()
+	require.NoError(t, err)
+	service.SetSigningKey(signingKey)
+	trusted := []*crypto.VerifyingKey{signingKey.Public()}
+
+	inputDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(inputDir, "docs"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "a.txt"), []byte("a"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "docs", "b.txt"), make([]byte, 2*MinVolumeSize), 0644))
+
+	encryptedDir := t.TempDir()
+	require.NoError(t, NewDirectoryEncryptor(service, false).EncryptDirectoryForRecipients(inputDir, encryptedDir, recipients, nil))
+	checks, err := CheckSignatures(encryptedDir, trusted)
+	require.NoError(t, err)
+	require.Len(t, checks, 4, "the files, the directory entry and the manifest are signed")
+	for _, check := range checks {
+		assert.True(t, check.OK(), "%s: %s", check.Path, check.Error)
+	}
+
+	// A volume set has one signature beside the path it was split from
+	require.NoError(t, service.SetVolumeSize(MinVolumeSize))
+	path := filepath.Join(t.TempDir(), "b.nokvault")
+	require.NoError(t, service.EncryptFileForRecipients(filepath.Join(inputDir, "docs", "b.txt"), path, recipients, false))
+	assert.Equal(t, path+SignatureSuffix, SignaturePath(VolumePath(path, 2)))
+	assert.True(t, CheckSignature(VolumePath(path, 1), trusted).OK())
+}
@@ -0,0 +1,195 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/jimididit/nokvault/internal/crypto"
+)
+
+// UpgradeFile rewrites the nokvault file at path in the current format
+// version, unlocking it with creds. Files that already have key slots keep
+// them, along with their file key and cipher. Version 1 files have a single
+// password key instead: the secret that unlocked the file gets a password
+// slot with a fresh salt, so the same password or keyfile keeps working. It
+// returns false, leaving the file alone, if it is already current.
+func (es *EncryptionService) UpgradeFile(path string, creds *Credentials, cache *KeyCache) (bool, error) {
+	header, err := NewFileHandler().ReadHeaderFromFile(path)
+	if err != nil {
+		return false, err
+	}
+	if !header.NeedsUpgrade() {
+		return false, nil
+	}
+
+	oldKey, _, err := es.keyManager.UnlockFileKey(header, creds, cache)
+	if err != nil {
+		return false, err
+	}
+	defer zeroizeKey(oldKey)
+
+	if header.Version != LegacyVersion {
+		// The slots are wrapped with the file's cipher, so it is kept
+		rewriter := *es
+		rewriter.cipher = header.Params.Cipher
+		if err := rewriter.RewriteFile(path, oldKey, oldKey, header.KeySlots); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	// Older versions only have a single password key
+	slot := legacySlot(header)
+	secrets := creds.secretsFor(&slot)
+	if len(secrets) == 0 {
+		return false, fmt.Errorf("version %d files can only be upgraded with a password or keyfile", header.Version)
+	}
+	slotKey, salt, err := es.keyManager.DeriveKeyFromPassword(secrets[0].password)
+	if err != nil {
+		return false, err
+	}
+	defer zeroizeKey(slotKey)
+
+	fileKey, err := crypto.GenerateKey()
+	if err != nil {
+		return false, err
+	}
+	defer zeroizeKey(fileKey)
+
+	newSlot, err := es.keyManager.NewPasswordSlot(slotKey, salt, fileKey, es.cipher)
+	if err != nil {
+		return false, fmt.Errorf("failed to create key slot: %w", err)
+	}
+
+	if err := es.RewriteFile(path, oldKey, fileKey, []KeySlot{newSlot}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RewriteFile re-encrypts the nokvault file at path into the current format
+// version with this service's cipher. The contents are decrypted with oldKey
+// (the file key, or the password key of version 1 files) and encrypted under
+// fileKey, which slots must wrap. The metadata and compression are kept.
+//
+// The new file is written next to path and decrypted again to check that it
+// holds the same contents before it atomically replaces path, so path is left
+// untouched if anything fails. A parity file is rewritten to match, and the
+// file is signed again with the signing key, or its signature is removed.
+func (es *EncryptionService) RewriteFile(path string, oldKey, fileKey []byte, slots []KeySlot) error {
+	inputFile, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open input file: %w", err)
+	}
+	defer inputFile.Close()
+
+	info, err := inputFile.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat input file: %w", err)
+	}
+
+	fileHandler := NewFileHandler()
+	header, _, err := fileHandler.ReadHeaderWithMetadata(inputFile)
+	if err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+	metadata, err := header.OpenMetadata(oldKey)
+	if err != nil {
+		return err
+	}
+	if _, err := inputFile.Seek(int64(header.DataOffset), io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek to encrypted data: %w", err)
+	}
+
+	plaintext, compression, err := es.newPlaintextReader(inputFile, header, oldKey)
+	if err != nil {
+		return err
+	}
+	defer plaintext.Close()
+
+	params := es.NewFormatParams()
+	params.Compression = compression
+	if header.Params != nil {
+		params.Content = header.Params.Content
+		// Rewriting a padded file doesn't reveal its size
+		if header.Params.Padding != PaddingNone {
+			params.Padding = header.Params.Padding
+		}
+	}
+	newHeader, err := fileHandler.NewHeader(params, metadata, fileKey, slots)
+	if err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+
+	// The temporary file lives in the same directory so the rename is atomic
+	outputFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tempPath := outputFile.Name()
+	defer os.Remove(tempPath)
+	defer outputFile.Close()
+
+	if err := outputFile.Chmod(info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to set file mode: %w", err)
+	}
+	if err := fileHandler.WriteRawHeader(outputFile, newHeader); err != nil {
+		return err
+	}
+
+	// Hash the contents on the way through to verify the new file against them
+	original := sha256.New()
+	if err := es.EncryptPayload(outputFile, io.TeeReader(plaintext, original), fileKey, newHeader); err != nil {
+		return fmt.Errorf("failed to re-encrypt file: %w", err)
+	}
+	if err := outputFile.Sync(); err != nil {
+		return fmt.Errorf("failed to write encrypted data: %w", err)
+	}
+	if err := outputFile.Close(); err != nil {
+		return fmt.Errorf("failed to write encrypted data: %w", err)
+	}
+
+	if err := es.verifyFile(tempPath, fileKey, original.Sum(nil)); err != nil {
+		return fmt.Errorf("rewritten file failed verification: %w", err)
+	}
+
+	inputFile.Close()
+	if err := os.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+	if err := es.signOutput(path); err != nil {
+		return err
+	}
+	return RefreshParity(path)
+}
+
+// verifyFile decrypts the nokvault file at path with fileKey and checks that
+// the SHA-256 of its contents is sum
+func (es *EncryptionService) verifyFile(path string, fileKey, sum []byte) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	header, _, err := NewFileHandler().ReadHeaderWithMetadata(file)
+	if err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+	if _, err := file.Seek(int64(header.DataOffset), io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek to encrypted data: %w", err)
+	}
+
+	hash := sha256.New()
+	if err := es.DecryptPayload(hash, file, header, fileKey); err != nil {
+		return err
+	}
+	if !bytes.Equal(hash.Sum(nil), sum) {
+		return fmt.Errorf("contents do not match the original")
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jimididit/nokvault/internal/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeLegacyFile writes a version 1 file of plaintext encrypted with the key
+// derived from password, as nokvault 0.1 did
+func writeLegacyFile(t *testing.T, path string, password, plaintext []byte, metadata *FileMetadata) {
+	salt, err := crypto.GenerateSalt()
+	require.NoError(t, err)
+	key, err := crypto.DeriveKey(password, salt, crypto.DefaultArgon2Params())
+	require.NoError(t, err)
+
+	ciphertext, err := NewEncryptionService().EncryptData(plaintext, key)
+	require.NoError(t, err)
+	metadataJSON, err := json.Marshal(metadata)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	prelude := headerPrelude{Version: LegacyVersion}
+	copy(prelude.Magic[:], NokvaultMagic)
+	fields := headerFieldsV1{MetadataSize: uint32(len(metadataJSON))}
+	copy(fields.Salt[:], salt)
+	fields.DataOffset = uint64(binary.Size(prelude)+binary.Size(fields)) + uint64(len(metadataJSON))
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, &prelude))
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, &fields))
+	buf.Write(metadataJSON)
+	buf.Write(ciphertext)
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0640))
+}
+
+func TestUpgradeFile(t *testing.T) {
+	service := NewEncryptionService()
+	service.GetKeyManager().SetParams(8*1024, 1, 1, 32)
+	tmpDir := t.TempDir()
+
+	password := []byte("legacy-password")
+	plaintext := []byte("written by nokvault 0.1")
+	metadata := &FileMetadata{Name: "notes.txt", Size: int64(len(plaintext)), Mode: 0600, ModTime: time.Unix(1700000000, 0).UTC()}
+	encryptedPath := filepath.Join(tmpDir, "notes.txt.nokvault")
+	writeLegacyFile(t, encryptedPath, password, plaintext, metadata)
+
+	upgraded, err := service.UpgradeFile(encryptedPath, &Credentials{Password: password}, nil)
+	require.NoError(t, err, "Upgrade should succeed")
+	assert.True(t, upgraded, "Version 1 file should be upgraded")
+
+	header, err := NewFileHandler().ReadHeaderFromFile(encryptedPath)
+	require.NoError(t, err, "Failed to read header")
+	assert.Equal(t, uint16(CurrentVersion), header.Version)
+	assert.False(t, header.NeedsUpgrade())
+	require.Len(t, header.KeySlots, 1, "Upgraded file should have one key slot")
+
+	info, err := os.Stat(encryptedPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm(), "File mode should be kept")
+
+	outputPath := filepath.Join(tmpDir, "notes.txt")
+	restored, err := service.DecryptFileWithCredentials(encryptedPath, outputPath, &Credentials{Password: password}, nil)
+	require.NoError(t, err, "The same password should decrypt the upgraded file")
+	assert.Equal(t, "notes.txt", restored.Name, "Metadata should be kept")
+	assert.True(t, metadata.ModTime.Equal(restored.ModTime), "Metadata should be kept")
+	decrypted, err := os.ReadFile(outputPath)
+	require.NoError(t, err, "Failed to read decrypted file")
+	assert.Equal(t, plaintext, decrypted)
+
+	upgraded, err = service.UpgradeFile(encryptedPath, &Credentials{Password: password}, nil)
+	require.NoError(t, err)
+	assert.False(t, upgraded, "Current files should be left alone")
+}
+
+func TestUpgradeFile_WrongPasswordKeepsOriginal(t *testing.T) {
+	service := NewEncryptionService()
+	tmpDir := t.TempDir()
+
+	encryptedPath := filepath.Join(tmpDir, "legacy.nokvault")
+	writeLegacyFile(t, encryptedPath, []byte("legacy-password"), []byte("keep me"), &FileMetadata{Name: "legacy"})
+	original, err := os.ReadFile(encryptedPath)
+	require.NoError(t, err)
+
+	_, err = service.UpgradeFile(encryptedPath, &Credentials{Password: []byte("wrong-password")}, nil)
+	assert.Error(t, err, "Upgrade with a wrong password should fail")
+
+	after, err := os.ReadFile(encryptedPath)
+	require.NoError(t, err)
+	assert.Equal(t, original, after, "Original file should be unchanged")
+
+	entries, err := os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "No temporary files should be left behind")
+}
+
+// writeV2File writes a version 2 file of plaintext, whose metadata is stored
+// in plaintext, with a key slot for password
+func writeV2File(t *testing.T, service *EncryptionService, path string, password, plaintext []byte, metadata *FileMetadata) {
+	fileKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	slotKey, salt, err := service.GetKeyManager().DeriveKeyFromPassword(password)
+	require.NoError(t, err)
+	slots, err := service.GetKeyManager().NewKeySlots(&Recipients{Key: slotKey, Salt: salt}, fileKey, service.Cipher())
+	require.NoError(t, err)
+
+	header, err := NewFileHandler().NewHeader(service.NewFormatParams(), nil, fileKey, slots)
+	require.NoError(t, err)
+	header.Version = StreamVersion
+	header.metadataData, err = json.Marshal(metadata)
+	require.NoError(t, err)
+	header.MetadataSize = uint32(len(header.metadataData))
+	require.NoError(t, header.SetKeySlots(slots))
+
+	var buf bytes.Buffer
+	require.NoError(t, NewFileHandler().WriteRawHeader(&buf, header))
+	require.NoError(t, service.EncryptPayload(&buf, bytes.NewReader(plaintext), fileKey, header))
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0600))
+}
+
+func TestUpgradeFile_SealsMetadata(t *testing.T) {
+	service := NewEncryptionService()
+	service.GetKeyManager().SetParams(8*1024, 1, 1, 32)
+	tmpDir := t.TempDir()
+
+	password := []byte("v2-password")
+	plaintext := []byte("written by nokvault 0.2")
+	encryptedPath := filepath.Join(tmpDir, "plans.txt.nokvault")
+	writeV2File(t, service, encryptedPath, password, plaintext, &FileMetadata{Name: "plans.txt", Size: int64(len(plaintext))})
+
+	header, metadata, err := NewFileHandler().ReadMetadataFromFile(encryptedPath)
+	require.NoError(t, err)
+	assert.False(t, header.MetadataSealed())
+	assert.True(t, header.NeedsUpgrade(), "Version 2 files should be upgraded")
+	require.NotNil(t, metadata, "Version 2 metadata should be readable without a key")
+	originalSlots := header.KeySlots
+
+	upgraded, err := service.UpgradeFile(encryptedPath, &Credentials{Password: password}, nil)
+	require.NoError(t, err, "Upgrade should succeed")
+	assert.True(t, upgraded)
+
+	header, metadata, err = NewFileHandler().ReadMetadataFromFile(encryptedPath)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(CurrentVersion), header.Version)
+	assert.True(t, header.MetadataSealed(), "Upgraded metadata should be sealed")
+	assert.Nil(t, metadata, "Sealed metadata should not be readable without a key")
+	assert.Equal(t, originalSlots, header.KeySlots, "Key slots should be kept")
+
+	metadata, err = service.UnlockMetadata(header, &Credentials{Password: password}, nil)
+	require.NoError(t, err, "The same password should unlock the metadata")
+	assert.Equal(t, "plans.txt", metadata.Name)
+
+	outputPath := filepath.Join(tmpDir, "plans.txt")
+	_, err = service.DecryptFileWithCredentials(encryptedPath, outputPath, &Credentials{Password: password}, nil)
+	require.NoError(t, err, "The same password should decrypt the upgraded file")
+	decrypted, err := os.ReadFile(outputPath)
+	require.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+}
@@ -0,0 +1,147 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Outcomes of verifying a nokvault file
+const (
+	// VerifyOK means the header, metadata and payload authenticate
+	VerifyOK = "ok"
+	// VerifyCorrupt means the file was unlocked but its metadata or payload
+	// failed authentication or could not be decoded
+	VerifyCorrupt = "corrupt"
+	// VerifyWrongKey means none of the key slots could be unlocked
+	VerifyWrongKey = "wrong-key"
+	// VerifyBadFormat means the file could not be read as a nokvault file
+	VerifyBadFormat = "bad-format"
+)
+
+// VerifyResult is the outcome of verifying one nokvault file or volume set
+type VerifyResult struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Repairable is set when a damaged file has parity: whether its parity
+	// can rebuild the damage (see RepairFile)
+	Repairable *bool `json:"repairable,omitempty"`
+}
+
+// OK reports whether the file verified
+func (r *VerifyResult) OK() bool {
+	return r.Status == VerifyOK
+}
+
+// VerifyFile checks the nokvault file or volume set at path: it unlocks the
+// file key with creds and authenticates the sealed metadata and every chunk
+// of the payload, decoding it as decryption would, without writing any
+// plaintext. Slot keys are cached in cache when it is not nil. A damaged
+// file with parity is also checked against it.
+func (es *EncryptionService) VerifyFile(path string, creds *Credentials, cache *KeyCache) *VerifyResult {
+	result := &VerifyResult{Path: path, Status: VerifyOK}
+	if status, err := es.checkFile(path, creds, cache); err != nil {
+		result.Status = status
+		result.Error = err.Error()
+	}
+	// A wrong key is not damage
+	if !result.OK() && result.Status != VerifyWrongKey {
+		result.Repairable = parityRepairable(path)
+	}
+	return result
+}
+
+// parityRepairable reports whether the parity of the file or volume set at
+// path can rebuild its damage, or returns nil if it has no parity. Damage
+// the parity doesn't see happened before it was written, so it can't be
+// repaired.
+func parityRepairable(path string) *bool {
+	paths := FilesWithParity(path)
+	if len(paths) == 0 {
+		return nil
+	}
+	repairable := false
+	for _, path := range paths {
+		report, err := CheckParity(path)
+		if err != nil {
+			repairable = false
+			break
+		}
+		repairable = repairable || report.DamagedBlocks > 0 || report.ExtraBytes > 0
+	}
+	return &repairable
+}
+
+// checkFile verifies the file at path and returns the status describing
+// the first problem found
+func (es *EncryptionService) checkFile(path string, creds *Credentials, cache *KeyCache) (string, error) {
+	file, err := openEncryptedFile(path)
+	if err != nil {
+		return VerifyBadFormat, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	header, _, err := NewFileHandler().ReadHeaderWithMetadata(file)
+	if err != nil {
+		return VerifyBadFormat, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	fileKey, _, err := es.keyManager.UnlockFileKey(header, creds, cache)
+	if err != nil {
+		return VerifyWrongKey, err
+	}
+	defer zeroizeKey(fileKey)
+
+	if _, err := header.OpenMetadata(fileKey); err != nil {
+		return VerifyCorrupt, err
+	}
+
+	if _, err := file.Seek(int64(header.DataOffset), io.SeekStart); err != nil {
+		return VerifyCorrupt, fmt.Errorf("failed to seek to encrypted data: %w", err)
+	}
+	if err := es.DecryptPayload(io.Discard, file, header, fileKey); err != nil {
+		// Version 1 files have no key slots, so a wrong key only shows here
+		if header.Version == LegacyVersion {
+			return VerifyCorrupt, fmt.Errorf("%w (version 1 files can't tell a wrong key from corruption)", err)
+		}
+		return VerifyCorrupt, err
+	}
+	return VerifyOK, nil
+}
+
+// FindNokvaultFiles returns the paths of the nokvault files under root, in
+// order: .nokvault files, including directory entries, name maps and volume
+// sets, which are returned once by the path they were split from
+func FindNokvaultFiles(root string) ([]string, error) {
+	var paths []string
+	sets := make(map[string]bool)
+	fileHandler := NewFileHandler()
+	err := fileHandler.WalkDirectory(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		switch {
+		case filepath.Ext(path) == ".nokvault", info.Name() == NameMapFile:
+			paths = append(paths, path)
+		default:
+			if basePath, ok := VolumeSetBase(path); ok && !sets[basePath] {
+				sets[basePath] = true
+				paths = append(paths, basePath)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
@@ -0,0 +1,89 @@
+package core
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptionServiceVerifyFile(t *testing.T) {
+	password := []byte("verify-password")
+	archiver, recipients := newTestArchiver(t, password)
+	service := archiver.encryptionService
+	creds := &Credentials{Password: password}
+
+	data := make([]byte, 200*1024)
+	rand.New(rand.NewSource(7)).Read(data)
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, "data.bin")
+	require.NoError(t, os.WriteFile(inputPath, data, 0644))
+
+	encrypt := func(name string) string {
+		path := filepath.Join(tmpDir, name)
+		require.NoError(t, service.EncryptFileForRecipients(inputPath, path, recipients, false))
+		return path
+	}
+
+	path := encrypt("ok.nokvault")
+	result := service.VerifyFile(path, creds, nil)
+	assert.True(t, result.OK(), "an intact file should verify: %s", result.Error)
+	assert.Equal(t, path, result.Path)
+
+	result = service.VerifyFile(path, &Credentials{Password: []byte("wrong")}, nil)
+	assert.Equal(t, VerifyWrongKey, result.Status)
+	assert.NotEmpty(t, result.Error)
+
+	// A flipped bit in the payload is found without writing anything
+	path = encrypt("flipped.nokvault")
+	header, err := NewFileHandler().ReadHeaderFromFile(path)
+	require.NoError(t, err)
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	contents[int(header.DataOffset)+150*1024] ^= 1
+	require.NoError(t, os.WriteFile(path, contents, 0644))
+	assert.Equal(t, VerifyCorrupt, service.VerifyFile(path, creds, nil).Status)
+
+	// So is a file cut at a chunk boundary
+	path = encrypt("truncated.nokvault")
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-int64(len(data))/2))
+	assert.Equal(t, VerifyCorrupt, service.VerifyFile(path, creds, nil).Status)
+
+	path = filepath.Join(tmpDir, "notes.nokvault")
+	require.NoError(t, os.WriteFile(path, []byte("not encrypted at all"), 0644))
+	assert.Equal(t, VerifyBadFormat, service.VerifyFile(path, creds, nil).Status)
+
+	// Volume sets are verified as a whole
+	require.NoError(t, service.SetVolumeSize(MinVolumeSize))
+	path = encrypt("split.nokvault")
+	assert.True(t, service.VerifyFile(path, creds, nil).OK())
+	require.NoError(t, os.Remove(VolumePath(path, 2)))
+	assert.Equal(t, VerifyBadFormat, service.VerifyFile(path, creds, nil).Status)
+}
+
+func TestFindNokvaultFiles(t *testing.T) {
+	archiver, recipients := newTestArchiver(t, []byte("verify-password"))
+	service := archiver.encryptionService
+
+	data := make([]byte, 100*1024)
+	rand.New(rand.NewSource(8)).Read(data)
+	root := t.TempDir()
+	inputPath := filepath.Join(t.TempDir(), "data.bin")
+	require.NoError(t, os.WriteFile(inputPath, data, 0644))
+
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "sub"), 0755))
+	require.NoError(t, service.EncryptFileForRecipients(inputPath, filepath.Join(root, "sub", "a.nokvault"), recipients, false))
+	require.NoError(t, service.SetVolumeSize(MinVolumeSize))
+	require.NoError(t, service.EncryptFileForRecipients(inputPath, filepath.Join(root, "b.nokvault"), recipients, false))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "readme.txt"), []byte("plain"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "notes.001"), []byte("plain"), 0644))
+
+	paths, err := FindNokvaultFiles(root)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(root, "b.nokvault"), filepath.Join(root, "sub", "a.nokvault")}, paths)
+}
@@ -0,0 +1,394 @@
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A nokvault file can be split into a set of volumes of a fixed size, written
+// as <path>.001, <path>.002 and so on. Every volume starts with a header
+// recording the random ID of its set and its index in the set, and the last
+// volume is flagged, so a missing, foreign or renamed volume is detected
+// before anything is decrypted.
+
+const (
+	// volumeMagic identifies a volume of a nokvault file
+	volumeMagic = "NOKVOLUM"
+	// volumeVersion is the version of the volume header
+	volumeVersion = 1
+	// volumeSetIDSize is the size of the random ID shared by a set
+	volumeSetIDSize = 16
+	// volumeHeaderSize is the size of the header at the start of every volume:
+	// magic, version, flags, set ID and index
+	volumeHeaderSize = len(volumeMagic) + 2 + volumeSetIDSize + 4
+	// volumeFlagsOffset is the offset of the flags in the volume header
+	volumeFlagsOffset = len(volumeMagic) + 1
+	// volumeFlagLast marks the last volume of a set
+	volumeFlagLast = 1
+
+	// MinVolumeSize is the smallest volume size, header included
+	MinVolumeSize = 64 * 1024
+)
+
+var (
+	// ErrNotVolume is returned when a file is not a volume of a nokvault file
+	ErrNotVolume = errors.New("not a nokvault volume")
+	// ErrVolumeMissing is returned when a volume of a set cannot be found
+	ErrVolumeMissing = errors.New("volume missing")
+	// ErrVolumeOutOfOrder is returned when a volume is not at its index in the set
+	ErrVolumeOutOfOrder = errors.New("volume out of order")
+	// ErrVolumeSetMismatch is returned when a volume belongs to another set
+	ErrVolumeSetMismatch = errors.New("volume belongs to another set")
+)
+
+// VolumePath returns the path of volume index (starting at 1) of the set
+// split from basePath
+func VolumePath(basePath string, index int) string {
+	return fmt.Sprintf("%s.%03d", basePath, index)
+}
+
+// volumeHeader is the header at the start of a volume
+type volumeHeader struct {
+	SetID [volumeSetIDSize]byte
+	Index uint32 // Starting at 0
+	Last  bool
+}
+
+// encode returns the binary form of the header
+func (h *volumeHeader) encode() []byte {
+	buf := make([]byte, 0, volumeHeaderSize)
+	buf = append(buf, volumeMagic...)
+	buf = append(buf, volumeVersion, 0)
+	if h.Last {
+		buf[volumeFlagsOffset] = volumeFlagLast
+	}
+	buf = append(buf, h.SetID[:]...)
+	return binary.BigEndian.AppendUint32(buf, h.Index)
+}
+
+// readVolumeHeader reads the header of the volume at path
+func readVolumeHeader(path string) (*volumeHeader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	buf := make([]byte, volumeHeaderSize)
+	if _, err := io.ReadFull(file, buf); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNotVolume
+		}
+		return nil, fmt.Errorf("failed to read volume header: %w", err)
+	}
+	if string(buf[:len(volumeMagic)]) != volumeMagic {
+		return nil, ErrNotVolume
+	}
+	if version := buf[len(volumeMagic)]; version != volumeVersion {
+		return nil, fmt.Errorf("unsupported volume version: %d", version)
+	}
+
+	header := &volumeHeader{
+		Index: binary.BigEndian.Uint32(buf[volumeHeaderSize-4:]),
+		Last:  buf[volumeFlagsOffset]&volumeFlagLast != 0,
+	}
+	copy(header.SetID[:], buf[volumeFlagsOffset+1:])
+	return header, nil
+}
+
+// isVolume reports whether the file at path starts with a volume header
+func isVolume(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(volumeMagic))
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, []byte(volumeMagic))
+}
+
+// VolumeSetBase returns the path a volume set was split from if path names
+// one: either one of its volumes, or the base path itself when no file exists
+// there but its first volume does
+func VolumeSetBase(path string) (string, bool) {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return path, isVolume(VolumePath(path, 1))
+	}
+
+	ext := filepath.Ext(path)
+	if len(ext) < 4 || strings.Trim(ext[1:], "0123456789") != "" || !isVolume(path) {
+		return "", false
+	}
+	return strings.TrimSuffix(path, ext), true
+}
+
+// isVolumeOf reports whether path is a volume of the set split from basePath
+func isVolumeOf(path, basePath string) bool {
+	if !strings.HasPrefix(path, basePath+".") {
+		return false
+	}
+	base, ok := VolumeSetBase(path)
+	return ok && base == basePath
+}
+
+// ListVolumes returns the paths of the volumes of the set split from
+// basePath, in order, after checking that they all belong to the same set,
+// are at their index and that the set is complete
+func ListVolumes(basePath string) ([]string, error) {
+	var paths []string
+	var setID [volumeSetIDSize]byte
+	for index := 0; ; index++ {
+		path := VolumePath(basePath, index+1)
+		header, err := readVolumeHeader(path)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s not found", ErrVolumeMissing, path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		if index == 0 {
+			setID = header.SetID
+		} else if header.SetID != setID {
+			return nil, fmt.Errorf("%w: %s", ErrVolumeSetMismatch, path)
+		}
+		if header.Index != uint32(index) {
+			return nil, fmt.Errorf("%w: %s is volume %d of its set", ErrVolumeOutOfOrder, path, header.Index+1)
+		}
+
+		paths = append(paths, path)
+		if header.Last {
+			return paths, nil
+		}
+	}
+}
+
+// VolumeWriter splits everything written to it into the volumes of a new set
+type VolumeWriter struct {
+	basePath   string
+	volumeSize int64
+	setID      [volumeSetIDSize]byte
+	file       *os.File
+	count      int
+	written    int64 // Bytes written to the current volume, header included
+}
+
+// NewVolumeWriter creates the first volume of a set split from basePath.
+// volumeSize is the size of every volume but the last, header included.
+func NewVolumeWriter(basePath string, volumeSize int64) (*VolumeWriter, error) {
+	if volumeSize < MinVolumeSize {
+		return nil, fmt.Errorf("volume size must be at least %d bytes", MinVolumeSize)
+	}
+
+	w := &VolumeWriter{basePath: basePath, volumeSize: volumeSize}
+	if _, err := rand.Read(w.setID[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate volume set ID: %w", err)
+	}
+	if err := w.nextVolume(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// nextVolume closes the current volume and starts the next one
+func (w *VolumeWriter) nextVolume() error {
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			return fmt.Errorf("failed to write volume: %w", err)
+		}
+		w.file = nil
+	}
+
+	file, err := os.Create(VolumePath(w.basePath, w.count+1))
+	if err != nil {
+		return fmt.Errorf("failed to create volume: %w", err)
+	}
+	w.file = file
+	w.count++
+
+	header := &volumeHeader{SetID: w.setID, Index: uint32(w.count - 1)}
+	n, err := file.Write(header.encode())
+	w.written = int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write volume header: %w", err)
+	}
+	return nil
+}
+
+// Write writes p across as many volumes as needed
+func (w *VolumeWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		if w.written >= w.volumeSize {
+			if err := w.nextVolume(); err != nil {
+				return total, err
+			}
+		}
+		n := int(min(int64(len(p)), w.volumeSize-w.written))
+		n, err := w.file.Write(p[:n])
+		total += n
+		w.written += int64(n)
+		p = p[n:]
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Close flags the current volume as the last one of the set and closes it.
+// Volumes left over from an earlier, longer set under the same name are removed.
+func (w *VolumeWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	_, err := w.file.WriteAt([]byte{volumeFlagLast}, int64(volumeFlagsOffset))
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.file = nil
+	if err != nil {
+		return fmt.Errorf("failed to write volume: %w", err)
+	}
+
+	for index := w.count + 1; isVolume(VolumePath(w.basePath, index)); index++ {
+		if err := os.Remove(VolumePath(w.basePath, index)); err != nil {
+			return fmt.Errorf("failed to remove stale volume: %w", err)
+		}
+	}
+	return nil
+}
+
+// Remove closes the writer and removes the volumes written so far
+func (w *VolumeWriter) Remove() {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	for index := 1; index <= w.count; index++ {
+		os.Remove(VolumePath(w.basePath, index))
+	}
+}
+
+// Count returns the number of volumes written so far
+func (w *VolumeWriter) Count() int {
+	return w.count
+}
+
+// volumeReader reads the contents of a volume set as a single stream
+type volumeReader struct {
+	paths   []string
+	sizes   []int64 // Size of the contents of every volume, without its header
+	size    int64
+	offset  int64
+	current int
+	file    *os.File
+}
+
+// OpenVolumes opens the volume set split from basePath for reading, after
+// checking that the set is complete and in order
+func OpenVolumes(basePath string) (io.ReadSeekCloser, error) {
+	paths, err := ListVolumes(basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &volumeReader{paths: paths, current: -1}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat volume: %w", err)
+		}
+		size := info.Size() - int64(volumeHeaderSize)
+		r.sizes = append(r.sizes, size)
+		r.size += size
+	}
+	return r, nil
+}
+
+// Read reads from the volume holding the current offset
+func (r *volumeReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	start := int64(0)
+	for index, size := range r.sizes {
+		if r.offset >= start+size {
+			start += size
+			continue
+		}
+
+		if index != r.current {
+			if r.file != nil {
+				r.file.Close()
+				r.file = nil
+			}
+			file, err := os.Open(r.paths[index])
+			if err != nil {
+				return 0, fmt.Errorf("failed to open volume: %w", err)
+			}
+			r.file, r.current = file, index
+		}
+
+		p = p[:min(int64(len(p)), start+size-r.offset)]
+		n, err := r.file.ReadAt(p, int64(volumeHeaderSize)+r.offset-start)
+		r.offset += int64(n)
+		if err == io.EOF {
+			if n < len(p) {
+				return n, fmt.Errorf("volume %s shrank while being read", r.paths[index])
+			}
+			err = nil
+		}
+		return n, err
+	}
+	return 0, io.EOF
+}
+
+// Seek sets the offset of the next read in the contents of the set
+func (r *volumeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position: %d", offset)
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// Close closes the volume being read
+func (r *volumeReader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// openEncryptedFile opens the nokvault file at path for reading, or the
+// volume set path names
+func openEncryptedFile(path string) (io.ReadSeekCloser, error) {
+	if basePath, ok := VolumeSetBase(path); ok {
+		return OpenVolumes(basePath)
+	}
+	return os.Open(path)
+}
@@ -0,0 +1,148 @@
+package core
+
+import (
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestVolumes encrypts data into a volume set split from basePath and
+// returns the paths of its volumes
+func writeTestVolumes(t *testing.T, archiver *Archiver, recipients *Recipients, data []byte, basePath string) []string {
+	inputPath := filepath.Join(t.TempDir(), "input.bin")
+	require.NoError(t, os.WriteFile(inputPath, data, 0644))
+	require.NoError(t, archiver.encryptionService.EncryptFileForRecipients(inputPath, basePath, recipients, false))
+
+	paths, err := ListVolumes(basePath)
+	require.NoError(t, err, "ListVolumes should succeed")
+	return paths
+}
+
+func TestVolumes_RoundTrip(t *testing.T) {
+	password := []byte("volume-password")
+	archiver, recipients := newTestArchiver(t, password)
+	require.Error(t, archiver.encryptionService.SetVolumeSize(1024), "tiny volumes should be rejected")
+	require.NoError(t, archiver.encryptionService.SetVolumeSize(MinVolumeSize))
+
+	data := make([]byte, 3*MinVolumeSize+1000)
+	rand.New(rand.NewSource(4)).Read(data)
+	basePath := filepath.Join(t.TempDir(), "data.nokvault")
+	paths := writeTestVolumes(t, archiver, recipients, data, basePath)
+	require.Len(t, paths, 4)
+	assert.NoFileExists(t, basePath)
+	for _, path := range paths[:3] {
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, int64(MinVolumeSize), info.Size(), "every volume but the last should be full")
+	}
+
+	// The set is named by its base path or any of its volumes
+	for _, path := range []string{basePath, paths[0], paths[2]} {
+		base, ok := VolumeSetBase(path)
+		assert.True(t, ok, "%s should name the volume set", path)
+		assert.Equal(t, basePath, base)
+
+		outputPath := filepath.Join(t.TempDir(), "data.bin")
+		_, err := archiver.encryptionService.DecryptFileWithCredentials(path, outputPath, &Credentials{Password: password}, nil)
+		require.NoError(t, err, "Decrypting the volume set should succeed")
+		decrypted, err := os.ReadFile(outputPath)
+		require.NoError(t, err)
+		assert.Equal(t, data, decrypted)
+	}
+
+	// Reading part of the set seeks across volumes
+	reader, err := OpenVolumes(basePath)
+	require.NoError(t, err)
+	defer reader.Close()
+	_, err = reader.Seek(int64(MinVolumeSize-100), io.SeekStart)
+	require.NoError(t, err)
+	_, err = io.ReadFull(reader, make([]byte, 200))
+	assert.NoError(t, err, "a read should span two volumes")
+
+	// A shorter set under the same name removes the volumes left over
+	paths = writeTestVolumes(t, archiver, recipients, data[:1000], basePath)
+	assert.Len(t, paths, 1)
+	assert.NoFileExists(t, VolumePath(basePath, 2))
+
+	_, ok := VolumeSetBase(filepath.Join(t.TempDir(), "missing.nokvault"))
+	assert.False(t, ok)
+}
+
+func TestVolumes_Archive(t *testing.T) {
+	password := []byte("volume-password")
+	archiver, recipients := newTestArchiver(t, password)
+	require.NoError(t, archiver.encryptionService.SetVolumeSize(MinVolumeSize))
+
+	data := make([]byte, 2*MinVolumeSize)
+	rand.New(rand.NewSource(5)).Read(data)
+	inputDir := filepath.Join(t.TempDir(), "project")
+	require.NoError(t, os.MkdirAll(filepath.Join(inputDir, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "sub", "data.bin"), data, 0644))
+
+	archivePath := filepath.Join(t.TempDir(), "project.nokvault")
+	require.NoError(t, archiver.EncryptArchive(inputDir, archivePath, recipients, nil))
+	assert.FileExists(t, VolumePath(archivePath, 3))
+
+	header, err := NewFileHandler().ReadHeaderFromFile(VolumePath(archivePath, 1))
+	require.NoError(t, err, "the header should be read from the first volume")
+	assert.True(t, IsArchive(header))
+
+	outputDir := filepath.Join(t.TempDir(), "restored")
+	_, _, err = archiver.DecryptArchive(archivePath, outputDir, &Credentials{Password: password}, nil)
+	require.NoError(t, err, "DecryptArchive should read across the volumes")
+	restored, err := os.ReadFile(filepath.Join(outputDir, "sub", "data.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, data, restored)
+}
+
+func TestVolumes_BrokenSet(t *testing.T) {
+	archiver, recipients := newTestArchiver(t, []byte("volume-password"))
+	require.NoError(t, archiver.encryptionService.SetVolumeSize(MinVolumeSize))
+	data := make([]byte, 3*MinVolumeSize)
+	rand.New(rand.NewSource(6)).Read(data)
+
+	t.Run("missing", func(t *testing.T) {
+		basePath := filepath.Join(t.TempDir(), "data.nokvault")
+		paths := writeTestVolumes(t, archiver, recipients, data, basePath)
+		require.NoError(t, os.Remove(paths[1]))
+		_, err := ListVolumes(basePath)
+		assert.ErrorIs(t, err, ErrVolumeMissing)
+
+		require.NoError(t, os.Rename(paths[len(paths)-1], paths[1]))
+		_, err = ListVolumes(basePath)
+		assert.ErrorIs(t, err, ErrVolumeOutOfOrder, "the last volume should not pass for the second")
+	})
+
+	t.Run("out of order", func(t *testing.T) {
+		basePath := filepath.Join(t.TempDir(), "data.nokvault")
+		paths := writeTestVolumes(t, archiver, recipients, data, basePath)
+		require.NoError(t, os.Rename(paths[1], basePath+".tmp"))
+		require.NoError(t, os.Rename(paths[2], paths[1]))
+		require.NoError(t, os.Rename(basePath+".tmp", paths[2]))
+		_, err := OpenVolumes(basePath)
+		assert.ErrorIs(t, err, ErrVolumeOutOfOrder)
+		_, err = archiver.encryptionService.DecryptFileWithCredentials(basePath, filepath.Join(t.TempDir(), "out"), &Credentials{Password: []byte("volume-password")}, nil)
+		assert.ErrorIs(t, err, ErrVolumeOutOfOrder)
+	})
+
+	t.Run("other set", func(t *testing.T) {
+		dir := t.TempDir()
+		first := writeTestVolumes(t, archiver, recipients, data, filepath.Join(dir, "first.nokvault"))
+		second := writeTestVolumes(t, archiver, recipients, data, filepath.Join(dir, "second.nokvault"))
+		require.NoError(t, os.Rename(second[1], first[1]))
+		_, err := ListVolumes(filepath.Join(dir, "first.nokvault"))
+		assert.ErrorIs(t, err, ErrVolumeSetMismatch)
+	})
+
+	t.Run("not a volume", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "notes.001")
+		require.NoError(t, os.WriteFile(path, []byte("plain text notes"), 0644))
+		_, ok := VolumeSetBase(path)
+		assert.False(t, ok)
+	})
+}
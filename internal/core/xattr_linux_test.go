@@ -0,0 +1,37 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestDirectoryEncryptor_SetPreserveXattrs(t *testing.T) {
+	inputDir := t.TempDir()
+	encryptedDir := t.TempDir()
+	outputDir := t.TempDir()
+
+	filePath := filepath.Join(inputDir, "notes.txt")
+	require.NoError(t, os.WriteFile(filePath, []byte("notes"), 0644))
+	if err := unix.Setxattr(filePath, "user.nokvault.test", []byte("value"), 0); err != nil {
+		t.Skipf("extended attributes are not supported here: %v", err)
+	}
+
+	encryptionService := NewEncryptionService()
+	encryptionService.GetKeyManager().SetParams(8*1024, 1, 1, 32)
+	key, salt, err := encryptionService.GetKeyManager().DeriveKeyFromPassword([]byte("test-password-123"))
+	require.NoError(t, err)
+
+	encryptor := NewDirectoryEncryptor(encryptionService, false)
+	encryptor.SetPreserveXattrs(true)
+	require.NoError(t, encryptor.EncryptDirectory(inputDir, encryptedDir, key, salt, nil))
+	require.NoError(t, NewDirectoryDecryptor(NewEncryptionService(), false).DecryptDirectory(encryptedDir, outputDir, key, nil))
+
+	xattrs, err := readXattrs(filepath.Join(outputDir, "notes.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), xattrs["user.nokvault.test"])
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package core
+
+import "fmt"
+
+// readXattrs returns no extended attributes: they are only recorded on Linux
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// restoreXattrs fails if there are extended attributes to restore, since
+// they are only restored on Linux
+func restoreXattrs(path string, xattrs map[string][]byte) error {
+	if len(xattrs) > 0 {
+		return fmt.Errorf("extended attributes are not supported on this platform")
+	}
+	return nil
+}
@@ -3,9 +3,7 @@ package crypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
 	"fmt"
-	"io"
 )
 
 const (
@@ -41,33 +39,20 @@ func NewAESGCM(key []byte) (*AESGCM, error) {
 
 // Encrypt encrypts plaintext using AES-GCM
 func (a *AESGCM) Encrypt(plaintext []byte) ([]byte, error) {
-	nonce := make([]byte, NonceSize)
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, fmt.Errorf("failed to generate nonce: %w", err)
-	}
-
-	ciphertext := a.aead.Seal(nonce, nonce, plaintext, nil)
-	return ciphertext, nil
+	return sealMessage(a.aead, plaintext)
 }
 
 // Decrypt decrypts ciphertext using AES-GCM
 func (a *AESGCM) Decrypt(ciphertext []byte) ([]byte, error) {
-	if len(ciphertext) < NonceSize+GCMTagSize {
-		return nil, fmt.Errorf("ciphertext too short")
-	}
-
-	nonce := ciphertext[:NonceSize]
-	ciphertext = ciphertext[NonceSize:]
-
-	plaintext, err := a.aead.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return nil, fmt.Errorf("decryption failed: %w", err)
-	}
-
-	return plaintext, nil
+	return openMessage(a.aead, ciphertext)
 }
 
 // NonceSize returns the nonce size
 func (a *AESGCM) NonceSize() int {
 	return NonceSize
 }
+
+// AEAD returns the underlying AEAD for callers that manage their own nonces
+func (a *AESGCM) AEAD() cipher.AEAD {
+	return a.aead
+}
@@ -0,0 +1,64 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ChaCha20Poly1305 handles ChaCha20-Poly1305 and XChaCha20-Poly1305
+// encryption/decryption. Unlike AES-GCM it is fast without AES hardware
+// support, and the XChaCha20 variant's 24-byte nonce makes random nonces
+// safe for very large numbers of messages.
+type ChaCha20Poly1305 struct {
+	aead cipher.AEAD
+}
+
+// NewChaCha20Poly1305 creates a new ChaCha20-Poly1305 cipher (12-byte nonce)
+func NewChaCha20Poly1305(key []byte) (*ChaCha20Poly1305, error) {
+	if len(key) != chacha20poly1305.KeySize {
+		return nil, fmt.Errorf("invalid key length: expected 32 bytes (256 bits), got %d", len(key))
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ChaCha20-Poly1305: %w", err)
+	}
+
+	return &ChaCha20Poly1305{aead: aead}, nil
+}
+
+// NewXChaCha20Poly1305 creates a new XChaCha20-Poly1305 cipher (24-byte nonce)
+func NewXChaCha20Poly1305(key []byte) (*ChaCha20Poly1305, error) {
+	if len(key) != chacha20poly1305.KeySize {
+		return nil, fmt.Errorf("invalid key length: expected 32 bytes (256 bits), got %d", len(key))
+	}
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create XChaCha20-Poly1305: %w", err)
+	}
+
+	return &ChaCha20Poly1305{aead: aead}, nil
+}
+
+// Encrypt encrypts plaintext with a random nonce
+func (c *ChaCha20Poly1305) Encrypt(plaintext []byte) ([]byte, error) {
+	return sealMessage(c.aead, plaintext)
+}
+
+// Decrypt decrypts ciphertext produced by Encrypt
+func (c *ChaCha20Poly1305) Decrypt(ciphertext []byte) ([]byte, error) {
+	return openMessage(c.aead, ciphertext)
+}
+
+// NonceSize returns the nonce size
+func (c *ChaCha20Poly1305) NonceSize() int {
+	return c.aead.NonceSize()
+}
+
+// AEAD returns the underlying AEAD for callers that manage their own nonces
+func (c *ChaCha20Poly1305) AEAD() cipher.AEAD {
+	return c.aead
+}
@@ -0,0 +1,97 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Cipher IDs recorded in file headers
+const (
+	CipherAES256GCM         = "aes256gcm"
+	CipherChaCha20Poly1305  = "chacha20poly1305"
+	CipherXChaCha20Poly1305 = "xchacha20poly1305"
+
+	// DefaultCipher is the cipher used when none is configured
+	DefaultCipher = CipherAES256GCM
+)
+
+// AEAD is an authenticated cipher that seals single messages with a random
+// nonce and exposes the underlying cipher.AEAD for chunked streams
+type AEAD interface {
+	// Encrypt seals plaintext and returns nonce || ciphertext || tag
+	Encrypt(plaintext []byte) ([]byte, error)
+	// Decrypt opens a message produced by Encrypt
+	Decrypt(ciphertext []byte) ([]byte, error)
+	// NonceSize returns the nonce size
+	NonceSize() int
+	// AEAD returns the underlying AEAD for callers that manage their own nonces
+	AEAD() cipher.AEAD
+}
+
+// NewAEAD creates the cipher identified by a cipher ID
+func NewAEAD(id string, key []byte) (AEAD, error) {
+	switch id {
+	case CipherAES256GCM:
+		return NewAESGCM(key)
+	case CipherChaCha20Poly1305:
+		return NewChaCha20Poly1305(key)
+	case CipherXChaCha20Poly1305:
+		return NewXChaCha20Poly1305(key)
+	default:
+		return nil, fmt.Errorf("unsupported cipher: %q", id)
+	}
+}
+
+// IsSupportedCipher reports whether id is a known cipher ID
+func IsSupportedCipher(id string) bool {
+	switch id {
+	case CipherAES256GCM, CipherChaCha20Poly1305, CipherXChaCha20Poly1305:
+		return true
+	}
+	return false
+}
+
+// ParseCipher converts a user-supplied algorithm name, such as "aes256gcm",
+// "chacha20" or "xchacha20", into a cipher ID
+func ParseCipher(name string) (string, error) {
+	switch strings.ToLower(strings.ReplaceAll(name, "-", "")) {
+	case "aes", "aes256", "aes256gcm":
+		return CipherAES256GCM, nil
+	case "chacha20", "chacha20poly1305":
+		return CipherChaCha20Poly1305, nil
+	case "xchacha20", "xchacha20poly1305":
+		return CipherXChaCha20Poly1305, nil
+	default:
+		return "", fmt.Errorf("unsupported algorithm: %q (supported: aes256gcm, chacha20, xchacha20)", name)
+	}
+}
+
+// sealMessage encrypts plaintext under a random nonce, prepending the nonce
+func sealMessage(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// openMessage decrypts a message produced by sealMessage
+func openMessage(aead cipher.AEAD, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	nonce := ciphertext[:aead.NonceSize()]
+	ciphertext = ciphertext[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %w", err)
+	}
+
+	return plaintext, nil
+}
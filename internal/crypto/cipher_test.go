@@ -0,0 +1,90 @@
+package crypto
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAEAD_EncryptDecrypt(t *testing.T) {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	plaintext := []byte("Hello, World! This is a test message.")
+
+	for _, id := range []string{CipherAES256GCM, CipherChaCha20Poly1305, CipherXChaCha20Poly1305} {
+		t.Run(id, func(t *testing.T) {
+			aead, err := NewAEAD(id, key)
+			require.NoError(t, err, "Failed to create cipher")
+
+			ciphertext, err := aead.Encrypt(plaintext)
+			require.NoError(t, err, "Encryption should succeed")
+			assert.Len(t, ciphertext, aead.NonceSize()+len(plaintext)+aead.AEAD().Overhead())
+
+			decrypted, err := aead.Decrypt(ciphertext)
+			require.NoError(t, err, "Decryption should succeed")
+			assert.Equal(t, plaintext, decrypted)
+
+			// Tampering must be detected
+			ciphertext[len(ciphertext)-1] ^= 0x01
+			_, err = aead.Decrypt(ciphertext)
+			assert.Error(t, err, "Tampered ciphertext should fail")
+
+			_, err = aead.Decrypt(ciphertext[:aead.NonceSize()])
+			assert.Error(t, err, "Short ciphertext should fail")
+		})
+	}
+}
+
+func TestNewAEAD_XChaCha20Stream(t *testing.T) {
+	key := make([]byte, 32)
+	aead, err := NewAEAD(CipherXChaCha20Poly1305, key)
+	require.NoError(t, err, "Failed to create cipher")
+	assert.Equal(t, 24, aead.NonceSize(), "XChaCha20 should use a 24-byte nonce")
+
+	plaintext := bytes.Repeat([]byte("z"), 50)
+	var buf bytes.Buffer
+	writer, err := NewStreamWriter(&buf, aead.AEAD(), 16, []byte("ad"))
+	require.NoError(t, err, "Failed to create stream writer")
+	_, err = writer.Write(plaintext)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	reader, err := NewStreamReader(&buf, aead.AEAD(), 16, []byte("ad"))
+	require.NoError(t, err, "Failed to create stream reader")
+	decrypted, err := io.ReadAll(reader)
+	require.NoError(t, err, "Stream decryption should succeed")
+	assert.Equal(t, plaintext, decrypted)
+}
+
+func TestNewAEAD_Invalid(t *testing.T) {
+	_, err := NewAEAD("rot13", make([]byte, 32))
+	assert.Error(t, err, "Unknown cipher should be rejected")
+
+	_, err = NewAEAD(CipherXChaCha20Poly1305, make([]byte, 16))
+	assert.Error(t, err, "Short key should be rejected")
+}
+
+func TestParseCipher(t *testing.T) {
+	tests := map[string]string{
+		"aes256gcm":         CipherAES256GCM,
+		"AES-256-GCM":       CipherAES256GCM,
+		"chacha20":          CipherChaCha20Poly1305,
+		"chacha20-poly1305": CipherChaCha20Poly1305,
+		"xchacha20":         CipherXChaCha20Poly1305,
+		"xchacha20poly1305": CipherXChaCha20Poly1305,
+	}
+	for name, expected := range tests {
+		id, err := ParseCipher(name)
+		require.NoError(t, err, "ParseCipher(%q) should succeed", name)
+		assert.Equal(t, expected, id, "ParseCipher(%q)", name)
+		assert.True(t, IsSupportedCipher(id))
+	}
+
+	_, err := ParseCipher("des")
+	assert.Error(t, err, "Unknown algorithm should be rejected")
+}
@@ -0,0 +1,136 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// VerifyingKeyPrefix starts the text form of an Ed25519 public key
+	VerifyingKeyPrefix = "nokvaultsig1"
+	// SigningKeyPrefix starts the text form of an Ed25519 private key
+	SigningKeyPrefix = "NOKVAULT-SIGNING-KEY-1"
+)
+
+// SigningKey is an Ed25519 private key that signs encrypted files
+type SigningKey struct {
+	key ed25519.PrivateKey
+}
+
+// VerifyingKey is an Ed25519 public key that checks the signatures of a SigningKey
+type VerifyingKey struct {
+	key ed25519.PublicKey
+}
+
+// GenerateSigningKey generates a new random signing key
+func GenerateSigningKey() (*SigningKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate Ed25519 key: %w", err)
+	}
+	return &SigningKey{key: key}, nil
+}
+
+// ParseSigningKey parses a signing key in the NOKVAULT-SIGNING-KEY-1... form
+func ParseSigningKey(s string) (*SigningKey, error) {
+	seed, err := decodeKey(s, SigningKeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key: %w", err)
+	}
+	return &SigningKey{key: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// ParseVerifyingKey parses a verifying key in the nokvaultsig1... form
+func ParseVerifyingKey(s string) (*VerifyingKey, error) {
+	raw, err := decodeKey(s, VerifyingKeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid verifying key: %w", err)
+	}
+	return &VerifyingKey{key: ed25519.PublicKey(raw)}, nil
+}
+
+// ParseSigningKeyFile parses a signing key file, as written by 'nokvault
+// keygen --signing': a single signing key, with blank lines and lines
+// starting with # ignored
+func ParseSigningKeyFile(r io.Reader) (*SigningKey, error) {
+	var keys []*SigningKey
+	err := scanKeyLines(r, func(line string) error {
+		key, err := ParseSigningKey(line)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) != 1 {
+		return nil, fmt.Errorf("expected one signing key, found %d", len(keys))
+	}
+	return keys[0], nil
+}
+
+// ParseVerifyingKeys parses a trusted signers file: one verifying key per
+// line, with blank lines and lines starting with # ignored. Signing keys are
+// accepted too and stand for their verifying key.
+func ParseVerifyingKeys(r io.Reader) ([]*VerifyingKey, error) {
+	var keys []*VerifyingKey
+	err := scanKeyLines(r, func(line string) error {
+		if strings.HasPrefix(line, SigningKeyPrefix) {
+			key, err := ParseSigningKey(line)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key.Public())
+			return nil
+		}
+
+		key, err := ParseVerifyingKey(line)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no verifying keys found")
+	}
+	return keys, nil
+}
+
+// Public returns the verifying key of the signing key
+func (k *SigningKey) Public() *VerifyingKey {
+	return &VerifyingKey{key: k.key.Public().(ed25519.PublicKey)}
+}
+
+// Sign signs message
+func (k *SigningKey) Sign(message []byte) []byte {
+	return ed25519.Sign(k.key, message)
+}
+
+// String returns the text form of the signing key
+func (k *SigningKey) String() string {
+	return SigningKeyPrefix + keyEncoding.EncodeToString(k.key.Seed())
+}
+
+// Verify reports whether signature is a valid signature of message by this key
+func (k *VerifyingKey) Verify(message, signature []byte) bool {
+	return len(signature) == ed25519.SignatureSize && ed25519.Verify(k.key, message, signature)
+}
+
+// Equal reports whether k and other are the same key
+func (k *VerifyingKey) Equal(other *VerifyingKey) bool {
+	return k.key.Equal(other.key)
+}
+
+// String returns the text form of the verifying key
+func (k *VerifyingKey) String() string {
+	return VerifyingKeyPrefix + strings.ToLower(keyEncoding.EncodeToString(k.key))
+}
@@ -0,0 +1,60 @@
+package crypto
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEd25519SignVerify(t *testing.T) {
+	key, err := GenerateSigningKey()
+	require.NoError(t, err, "GenerateSigningKey should succeed")
+
+	message := []byte("header and ciphertext digest")
+	signature := key.Sign(message)
+	assert.True(t, key.Public().Verify(message, signature), "The signature should verify")
+
+	other, err := GenerateSigningKey()
+	require.NoError(t, err)
+	assert.False(t, other.Public().Verify(message, signature), "Another key should not verify the signature")
+	assert.False(t, key.Public().Verify([]byte("another message"), signature), "A different message should not verify")
+	assert.False(t, key.Public().Verify(message, signature[:10]), "A truncated signature should not verify")
+}
+
+func TestEd25519Encoding(t *testing.T) {
+	key, err := GenerateSigningKey()
+	require.NoError(t, err)
+
+	public := key.Public().String()
+	assert.True(t, strings.HasPrefix(public, VerifyingKeyPrefix), "Verifying key should have its prefix")
+	assert.Equal(t, strings.ToLower(public), public, "Verifying key should be lower case")
+
+	parsedPublic, err := ParseVerifyingKey(public)
+	require.NoError(t, err, "ParseVerifyingKey should succeed")
+	assert.True(t, parsedPublic.Equal(key.Public()))
+
+	keyFile := "# created: now\n# verifying key: " + public + "\n" + key.String() + "\n"
+	parsed, err := ParseSigningKeyFile(strings.NewReader(keyFile))
+	require.NoError(t, err, "ParseSigningKeyFile should succeed")
+	assert.Equal(t, key.String(), parsed.String())
+
+	// Trusted signers files may list verifying keys and signing keys
+	other, err := GenerateSigningKey()
+	require.NoError(t, err)
+	trusted, err := ParseVerifyingKeys(strings.NewReader(other.Public().String() + "\n\n" + keyFile))
+	require.NoError(t, err, "ParseVerifyingKeys should succeed")
+	require.Len(t, trusted, 2)
+	assert.True(t, trusted[0].Equal(other.Public()))
+	assert.True(t, trusted[1].Equal(key.Public()))
+
+	_, err = ParseVerifyingKey(key.String())
+	assert.Error(t, err, "A signing key is not a verifying key")
+	_, err = ParseSigningKeyFile(strings.NewReader(keyFile + other.String() + "\n"))
+	assert.Error(t, err, "A signing key file holds a single key")
+	_, err = ParseVerifyingKeys(strings.NewReader("# only comments\n"))
+	assert.Error(t, err, "A file without keys should be rejected")
+	_, err = ParseX25519Recipient(public)
+	assert.Error(t, err, "A verifying key is not a recipient")
+}
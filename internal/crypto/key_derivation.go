@@ -2,11 +2,14 @@ package crypto
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
+	"io"
 
 	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
 )
 
 const (
@@ -16,6 +19,17 @@ const (
 	DefaultParallelism = 4
 	DefaultKeyLength   = 32 // 32 bytes = 256 bits
 	SaltLength         = 16 // 16 bytes for salt
+
+	// KDFArgon2id identifies Argon2id key derivation in file headers
+	KDFArgon2id = "argon2id"
+
+	// Upper bounds accepted for parameters read from untrusted headers
+	MaxMemory      = 4 * 1024 * 1024 // 4 GB
+	MaxTime        = 64
+	MaxParallelism = 64
+
+	// keyfileInfo separates keys combined with a keyfile from other HKDF uses
+	keyfileInfo = "nokvault/password+keyfile"
 )
 
 // Argon2Params holds Argon2 key derivation parameters
@@ -36,6 +50,23 @@ func DefaultArgon2Params() *Argon2Params {
 	}
 }
 
+// Validate checks that the parameters are usable and within safe bounds
+func (p *Argon2Params) Validate() error {
+	if p.Memory == 0 || p.Memory > MaxMemory {
+		return fmt.Errorf("invalid Argon2 memory cost: %d KB", p.Memory)
+	}
+	if p.Time == 0 || p.Time > MaxTime {
+		return fmt.Errorf("invalid Argon2 time cost: %d", p.Time)
+	}
+	if p.Parallelism == 0 || p.Parallelism > MaxParallelism {
+		return fmt.Errorf("invalid Argon2 parallelism: %d", p.Parallelism)
+	}
+	if p.KeyLength != DefaultKeyLength {
+		return fmt.Errorf("invalid key length: expected %d, got %d", DefaultKeyLength, p.KeyLength)
+	}
+	return nil
+}
+
 // DeriveKey derives a key from a password using Argon2id
 func DeriveKey(password []byte, salt []byte, params *Argon2Params) ([]byte, error) {
 	if len(salt) != SaltLength {
@@ -55,6 +86,40 @@ func GenerateSalt() ([]byte, error) {
 	return salt, nil
 }
 
+// CombineKeyfile mixes a keyfile into a password-derived key with HKDF-SHA256,
+// so both the password and the keyfile are needed to reproduce the result
+func CombineKeyfile(passwordKey, keyfile []byte) ([]byte, error) {
+	if len(keyfile) == 0 {
+		return nil, fmt.Errorf("keyfile is empty")
+	}
+
+	digest := sha256.Sum256(keyfile)
+	key := make([]byte, len(passwordKey))
+	if _, err := io.ReadFull(hkdf.New(sha256.New, passwordKey, digest[:], []byte(keyfileInfo)), key); err != nil {
+		return nil, fmt.Errorf("failed to combine keyfile: %w", err)
+	}
+	return key, nil
+}
+
+// DeriveSubkey derives a key for a separate purpose, named by info, from a
+// random key with HKDF-SHA256
+func DeriveSubkey(key []byte, info string) ([]byte, error) {
+	subkey := make([]byte, len(key))
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(info)), subkey); err != nil {
+		return nil, fmt.Errorf("failed to derive subkey: %w", err)
+	}
+	return subkey, nil
+}
+
+// GenerateKey generates a random 256-bit key
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, DefaultKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return key, nil
+}
+
 // ConstantTimeCompare compares two byte slices in constant time
 func ConstantTimeCompare(a, b []byte) bool {
 	return subtle.ConstantTimeCompare(a, b) == 1
@@ -104,3 +104,68 @@ func TestEncodeDecodeSalt(t *testing.T) {
 
 	assert.True(t, ConstantTimeCompare(originalSalt, decoded), "Decoded salt should match original")
 }
+
+func TestArgon2ParamsValidate(t *testing.T) {
+	assert.NoError(t, DefaultArgon2Params().Validate(), "Default parameters should be valid")
+
+	tests := []struct {
+		name   string
+		modify func(p *Argon2Params)
+	}{
+		{"zero memory", func(p *Argon2Params) { p.Memory = 0 }},
+		{"excessive memory", func(p *Argon2Params) { p.Memory = MaxMemory + 1 }},
+		{"zero time", func(p *Argon2Params) { p.Time = 0 }},
+		{"excessive time", func(p *Argon2Params) { p.Time = MaxTime + 1 }},
+		{"zero parallelism", func(p *Argon2Params) { p.Parallelism = 0 }},
+		{"wrong key length", func(p *Argon2Params) { p.KeyLength = 16 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := DefaultArgon2Params()
+			tt.modify(params)
+			assert.Error(t, params.Validate())
+		})
+	}
+}
+
+func TestCombineKeyfile(t *testing.T) {
+	passwordKey := make([]byte, DefaultKeyLength)
+	for i := range passwordKey {
+		passwordKey[i] = byte(i)
+	}
+
+	key, err := CombineKeyfile(passwordKey, []byte("keyfile contents"))
+	require.NoError(t, err, "CombineKeyfile should succeed")
+	assert.Len(t, key, DefaultKeyLength)
+	assert.NotEqual(t, passwordKey, key, "Combined key should differ from the password key")
+
+	again, err := CombineKeyfile(passwordKey, []byte("keyfile contents"))
+	require.NoError(t, err)
+	assert.Equal(t, key, again, "Combining should be deterministic")
+
+	other, err := CombineKeyfile(passwordKey, []byte("other keyfile"))
+	require.NoError(t, err)
+	assert.NotEqual(t, key, other, "A different keyfile should give a different key")
+
+	_, err = CombineKeyfile(passwordKey, nil)
+	assert.Error(t, err, "An empty keyfile should be rejected")
+}
+
+func TestDeriveSubkey(t *testing.T) {
+	key, err := GenerateKey()
+	require.NoError(t, err)
+
+	subkey, err := DeriveSubkey(key, "purpose")
+	require.NoError(t, err, "DeriveSubkey should succeed")
+	assert.Len(t, subkey, len(key))
+	assert.NotEqual(t, key, subkey, "Subkey should differ from the key")
+
+	again, err := DeriveSubkey(key, "purpose")
+	require.NoError(t, err)
+	assert.Equal(t, subkey, again, "Deriving should be deterministic")
+
+	other, err := DeriveSubkey(key, "other purpose")
+	require.NoError(t, err)
+	assert.NotEqual(t, subkey, other, "A different purpose should give a different key")
+}
@@ -0,0 +1,227 @@
+package crypto
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	// DefaultChunkSize is the plaintext size of each sealed chunk in a stream (64 KB)
+	DefaultChunkSize = 64 * 1024
+	// MaxChunkSize is the largest chunk size accepted when reading a stream (16 MB)
+	MaxChunkSize = 16 * 1024 * 1024
+
+	// streamCounterSize and streamFlagSize make up the nonce suffix of each chunk
+	streamCounterSize = 4
+	streamFlagSize    = 1
+	streamLastChunk   = 0x01
+)
+
+// StreamNoncePrefixSize returns the size of the random nonce prefix written at
+// the start of a stream for the given AEAD
+func StreamNoncePrefixSize(aead cipher.AEAD) int {
+	return aead.NonceSize() - streamCounterSize - streamFlagSize
+}
+
+// StreamWriter encrypts everything written to it as a sequence of authenticated
+// chunks (STREAM construction). Each chunk nonce is a random per-stream prefix
+// followed by a big-endian chunk counter and a final-chunk flag, so chunks cannot
+// be reordered, dropped or truncated without failing authentication.
+type StreamWriter struct {
+	writer    io.Writer
+	aead      cipher.AEAD
+	ad        []byte
+	nonce     []byte
+	buf       []byte
+	sealed    []byte
+	chunkSize int
+	counter   uint32
+	closed    bool
+}
+
+// NewStreamWriter creates a stream writer and writes the nonce prefix to w.
+// The associated data ad, which may be nil, is authenticated with every chunk.
+func NewStreamWriter(w io.Writer, aead cipher.AEAD, chunkSize int, ad []byte) (*StreamWriter, error) {
+	if chunkSize <= 0 || chunkSize > MaxChunkSize {
+		return nil, fmt.Errorf("invalid chunk size: %d", chunkSize)
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	prefixSize := StreamNoncePrefixSize(aead)
+	if _, err := io.ReadFull(rand.Reader, nonce[:prefixSize]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce prefix: %w", err)
+	}
+
+	if _, err := w.Write(nonce[:prefixSize]); err != nil {
+		return nil, fmt.Errorf("failed to write nonce prefix: %w", err)
+	}
+
+	return &StreamWriter{
+		writer:    w,
+		aead:      aead,
+		ad:        ad,
+		nonce:     nonce,
+		buf:       make([]byte, 0, chunkSize),
+		sealed:    make([]byte, 0, chunkSize+aead.Overhead()),
+		chunkSize: chunkSize,
+	}, nil
+}
+
+// Write buffers plaintext and seals every full chunk
+func (sw *StreamWriter) Write(p []byte) (int, error) {
+	if sw.closed {
+		return 0, fmt.Errorf("write to closed stream")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// Only seal a full chunk once more data arrives, so the final chunk
+		// is never empty unless the whole stream is
+		if len(sw.buf) == sw.chunkSize {
+			if err := sw.flushChunk(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := sw.chunkSize - len(sw.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		sw.buf = append(sw.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close seals the final chunk. It does not close the underlying writer.
+func (sw *StreamWriter) Close() error {
+	if sw.closed {
+		return nil
+	}
+	sw.closed = true
+	return sw.flushChunk(true)
+}
+
+// flushChunk seals the buffered plaintext as the next chunk
+func (sw *StreamWriter) flushChunk(last bool) error {
+	if sw.counter == math.MaxUint32 {
+		return fmt.Errorf("stream too large: chunk counter overflow")
+	}
+
+	setStreamNonce(sw.nonce, StreamNoncePrefixSize(sw.aead), sw.counter, last)
+	sw.sealed = sw.aead.Seal(sw.sealed[:0], sw.nonce, sw.buf, sw.ad)
+
+	if _, err := sw.writer.Write(sw.sealed); err != nil {
+		return fmt.Errorf("failed to write encrypted chunk: %w", err)
+	}
+
+	sw.counter++
+	sw.buf = sw.buf[:0]
+	return nil
+}
+
+// StreamReader decrypts and authenticates a stream produced by StreamWriter
+type StreamReader struct {
+	reader    *bufio.Reader
+	aead      cipher.AEAD
+	ad        []byte
+	nonce     []byte
+	buf       []byte
+	plain     []byte
+	chunkSize int
+	counter   uint32
+	done      bool
+}
+
+// NewStreamReader creates a stream reader, reading the nonce prefix from r.
+// The associated data ad must match the data given to NewStreamWriter.
+func NewStreamReader(r io.Reader, aead cipher.AEAD, chunkSize int, ad []byte) (*StreamReader, error) {
+	if chunkSize <= 0 || chunkSize > MaxChunkSize {
+		return nil, fmt.Errorf("invalid chunk size: %d", chunkSize)
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(r, nonce[:StreamNoncePrefixSize(aead)]); err != nil {
+		return nil, fmt.Errorf("failed to read nonce prefix: %w", err)
+	}
+
+	return &StreamReader{
+		reader:    bufio.NewReaderSize(r, chunkSize+aead.Overhead()),
+		aead:      aead,
+		ad:        ad,
+		nonce:     nonce,
+		buf:       make([]byte, chunkSize+aead.Overhead()),
+		chunkSize: chunkSize,
+	}, nil
+}
+
+// Read returns authenticated plaintext. Data is only returned once the chunk
+// containing it has been verified.
+func (sr *StreamReader) Read(p []byte) (int, error) {
+	for len(sr.plain) == 0 {
+		if sr.done {
+			return 0, io.EOF
+		}
+		if err := sr.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, sr.plain)
+	sr.plain = sr.plain[n:]
+	return n, nil
+}
+
+// readChunk reads, authenticates and decrypts the next chunk
+func (sr *StreamReader) readChunk() error {
+	n, err := io.ReadFull(sr.reader, sr.buf)
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return fmt.Errorf("failed to read encrypted chunk: %w", err)
+	default:
+		// A full chunk is the last one only if nothing follows it
+		if _, peekErr := sr.reader.Peek(1); peekErr == io.EOF {
+			last = true
+		} else if peekErr != nil {
+			return fmt.Errorf("failed to read encrypted chunk: %w", peekErr)
+		}
+	}
+
+	if n < sr.aead.Overhead() {
+		return fmt.Errorf("decryption failed: stream truncated")
+	}
+
+	setStreamNonce(sr.nonce, StreamNoncePrefixSize(sr.aead), sr.counter, last)
+	plain, err := sr.aead.Open(sr.buf[:0], sr.nonce, sr.buf[:n], sr.ad)
+	if err != nil {
+		return fmt.Errorf("decryption failed: chunk %d: %w", sr.counter, err)
+	}
+
+	if sr.counter == math.MaxUint32 && !last {
+		return fmt.Errorf("stream too large: chunk counter overflow")
+	}
+
+	sr.counter++
+	sr.plain = plain
+	sr.done = last
+	return nil
+}
+
+// setStreamNonce fills in the counter and final-chunk flag after the nonce prefix
+func setStreamNonce(nonce []byte, prefixSize int, counter uint32, last bool) {
+	binary.BigEndian.PutUint32(nonce[prefixSize:], counter)
+	nonce[len(nonce)-1] = 0
+	if last {
+		nonce[len(nonce)-1] = streamLastChunk
+	}
+}
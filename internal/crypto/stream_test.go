@@ -0,0 +1,132 @@
+package crypto
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStreamCipher(t *testing.T) *AESGCM {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+
+	aesGCM, err := NewAESGCM(key)
+	require.NoError(t, err, "Failed to create AES-GCM")
+	return aesGCM
+}
+
+func encryptTestStream(t *testing.T, aesGCM *AESGCM, plaintext []byte, chunkSize int) []byte {
+	var buf bytes.Buffer
+	writer, err := NewStreamWriter(&buf, aesGCM.AEAD(), chunkSize, nil)
+	require.NoError(t, err, "Failed to create stream writer")
+
+	_, err = writer.Write(plaintext)
+	require.NoError(t, err, "Stream write should succeed")
+	require.NoError(t, writer.Close(), "Stream close should succeed")
+
+	return buf.Bytes()
+}
+
+func TestStreamEncryptDecrypt(t *testing.T) {
+	aesGCM := newTestStreamCipher(t)
+	chunkSize := 16
+
+	// Cover empty input, partial chunks and exact chunk boundaries
+	for _, size := range []int{0, 1, 15, 16, 17, 32, 100} {
+		plaintext := bytes.Repeat([]byte{0xAB}, size)
+		ciphertext := encryptTestStream(t, aesGCM, plaintext, chunkSize)
+
+		reader, err := NewStreamReader(bytes.NewReader(ciphertext), aesGCM.AEAD(), chunkSize, nil)
+		require.NoError(t, err, "Failed to create stream reader")
+
+		decrypted, err := io.ReadAll(reader)
+		require.NoError(t, err, "Stream decryption should succeed for size %d", size)
+		assert.Equal(t, plaintext, decrypted, "Decrypted stream should match original for size %d", size)
+	}
+}
+
+func TestStreamTamperedChunk(t *testing.T) {
+	aesGCM := newTestStreamCipher(t)
+	ciphertext := encryptTestStream(t, aesGCM, bytes.Repeat([]byte("x"), 40), 16)
+
+	// Flip a bit in the second chunk
+	prefixSize := StreamNoncePrefixSize(aesGCM.AEAD())
+	ciphertext[prefixSize+16+GCMTagSize+1] ^= 0x01
+
+	reader, err := NewStreamReader(bytes.NewReader(ciphertext), aesGCM.AEAD(), 16, nil)
+	require.NoError(t, err, "Failed to create stream reader")
+
+	_, err = io.ReadAll(reader)
+	assert.Error(t, err, "Expected error when decrypting tampered stream")
+}
+
+func TestStreamTruncatedAtChunkBoundary(t *testing.T) {
+	aesGCM := newTestStreamCipher(t)
+	ciphertext := encryptTestStream(t, aesGCM, bytes.Repeat([]byte("x"), 40), 16)
+
+	// Drop the final chunk so the stream ends on a non-final chunk
+	prefixSize := StreamNoncePrefixSize(aesGCM.AEAD())
+	truncated := ciphertext[:prefixSize+2*(16+GCMTagSize)]
+
+	reader, err := NewStreamReader(bytes.NewReader(truncated), aesGCM.AEAD(), 16, nil)
+	require.NoError(t, err, "Failed to create stream reader")
+
+	_, err = io.ReadAll(reader)
+	assert.Error(t, err, "Expected error when decrypting truncated stream")
+}
+
+func TestStreamReorderedChunks(t *testing.T) {
+	aesGCM := newTestStreamCipher(t)
+	ciphertext := encryptTestStream(t, aesGCM, bytes.Repeat([]byte("x"), 40), 16)
+
+	// Swap the first two chunks
+	prefixSize := StreamNoncePrefixSize(aesGCM.AEAD())
+	sealedSize := 16 + GCMTagSize
+	first := append([]byte(nil), ciphertext[prefixSize:prefixSize+sealedSize]...)
+	copy(ciphertext[prefixSize:], ciphertext[prefixSize+sealedSize:prefixSize+2*sealedSize])
+	copy(ciphertext[prefixSize+sealedSize:], first)
+
+	reader, err := NewStreamReader(bytes.NewReader(ciphertext), aesGCM.AEAD(), 16, nil)
+	require.NoError(t, err, "Failed to create stream reader")
+
+	_, err = io.ReadAll(reader)
+	assert.Error(t, err, "Expected error when decrypting reordered stream")
+}
+
+func TestStreamInvalidChunkSize(t *testing.T) {
+	aesGCM := newTestStreamCipher(t)
+
+	_, err := NewStreamWriter(io.Discard, aesGCM.AEAD(), 0, nil)
+	assert.Error(t, err, "Expected error for zero chunk size")
+
+	_, err = NewStreamWriter(io.Discard, aesGCM.AEAD(), MaxChunkSize+1, nil)
+	assert.Error(t, err, "Expected error for oversized chunk size")
+}
+
+func TestStreamAssociatedData(t *testing.T) {
+	aesGCM := newTestStreamCipher(t)
+	plaintext := bytes.Repeat([]byte("y"), 40)
+
+	var buf bytes.Buffer
+	writer, err := NewStreamWriter(&buf, aesGCM.AEAD(), 16, []byte("header"))
+	require.NoError(t, err, "Failed to create stream writer")
+	_, err = writer.Write(plaintext)
+	require.NoError(t, err, "Stream write should succeed")
+	require.NoError(t, writer.Close(), "Stream close should succeed")
+
+	reader, err := NewStreamReader(bytes.NewReader(buf.Bytes()), aesGCM.AEAD(), 16, []byte("header"))
+	require.NoError(t, err, "Failed to create stream reader")
+	decrypted, err := io.ReadAll(reader)
+	require.NoError(t, err, "Decryption with matching associated data should succeed")
+	assert.Equal(t, plaintext, decrypted)
+
+	reader, err = NewStreamReader(bytes.NewReader(buf.Bytes()), aesGCM.AEAD(), 16, []byte("HEADER"))
+	require.NoError(t, err, "Failed to create stream reader")
+	_, err = io.ReadAll(reader)
+	assert.Error(t, err, "Decryption with different associated data should fail")
+}
@@ -0,0 +1,248 @@
+package crypto
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// X25519RecipientPrefix starts the text form of an X25519 public key
+	X25519RecipientPrefix = "nokvault1"
+	// X25519IdentityPrefix starts the text form of an X25519 private key
+	X25519IdentityPrefix = "NOKVAULT-SECRET-KEY-1"
+
+	// x25519WrapInfo separates keys derived for wrapping from other uses
+	x25519WrapInfo = "nokvault/x25519"
+)
+
+// keyEncoding encodes X25519 keys as unpadded base32
+var keyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// X25519Recipient is a public key that file keys can be wrapped to
+type X25519Recipient struct {
+	key *ecdh.PublicKey
+}
+
+// X25519Identity is a private key that unwraps file keys wrapped to its recipient
+type X25519Identity struct {
+	key *ecdh.PrivateKey
+}
+
+// GenerateX25519Identity generates a new random identity
+func GenerateX25519Identity() (*X25519Identity, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate X25519 key: %w", err)
+	}
+	return &X25519Identity{key: key}, nil
+}
+
+// ParseX25519Identity parses an identity in the NOKVAULT-SECRET-KEY-1... form
+func ParseX25519Identity(s string) (*X25519Identity, error) {
+	raw, err := decodeKey(s, X25519IdentityPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity: %w", err)
+	}
+
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity: %w", err)
+	}
+	return &X25519Identity{key: key}, nil
+}
+
+// ParseX25519Recipient parses a recipient in the nokvault1... form
+func ParseX25519Recipient(s string) (*X25519Recipient, error) {
+	raw, err := decodeKey(s, X25519RecipientPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient: %w", err)
+	}
+
+	key, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient: %w", err)
+	}
+	return &X25519Recipient{key: key}, nil
+}
+
+// ParseX25519Identities parses an identity file: one identity per line, with
+// blank lines and lines starting with # ignored
+func ParseX25519Identities(r io.Reader) ([]*X25519Identity, error) {
+	var identities []*X25519Identity
+	err := scanKeyLines(r, func(line string) error {
+		identity, err := ParseX25519Identity(line)
+		if err != nil {
+			return err
+		}
+		identities = append(identities, identity)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("no identities found")
+	}
+	return identities, nil
+}
+
+// ParseX25519Recipients parses a recipients file: one recipient per line, with
+// blank lines and lines starting with # ignored. Identities are accepted too
+// and stand for their recipient, so an identity file can be passed directly.
+func ParseX25519Recipients(r io.Reader) ([]*X25519Recipient, error) {
+	var recipients []*X25519Recipient
+	err := scanKeyLines(r, func(line string) error {
+		if strings.HasPrefix(line, X25519IdentityPrefix) {
+			identity, err := ParseX25519Identity(line)
+			if err != nil {
+				return err
+			}
+			recipients = append(recipients, identity.Recipient())
+			return nil
+		}
+
+		recipient, err := ParseX25519Recipient(line)
+		if err != nil {
+			return err
+		}
+		recipients = append(recipients, recipient)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no recipients found")
+	}
+	return recipients, nil
+}
+
+// Recipient returns the public key of the identity
+func (i *X25519Identity) Recipient() *X25519Recipient {
+	return &X25519Recipient{key: i.key.PublicKey()}
+}
+
+// String returns the text form of the identity
+func (i *X25519Identity) String() string {
+	return X25519IdentityPrefix + keyEncoding.EncodeToString(i.key.Bytes())
+}
+
+// String returns the text form of the recipient
+func (r *X25519Recipient) String() string {
+	return X25519RecipientPrefix + strings.ToLower(keyEncoding.EncodeToString(r.key.Bytes()))
+}
+
+// Wrap seals fileKey to the recipient. It returns the public key of a fresh
+// ephemeral key pair and the wrapped key, which are both needed to unwrap it.
+func (r *X25519Recipient) Wrap(fileKey []byte) (ephemeral, wrapped []byte, err error) {
+	ephemeralKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+
+	shared, err := ephemeralKey.ECDH(r.key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+
+	ephemeral = ephemeralKey.PublicKey().Bytes()
+	aead, err := x25519WrapAEAD(shared, ephemeral, r.key.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrapped, err = aead.Encrypt(fileKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to wrap file key: %w", err)
+	}
+	return ephemeral, wrapped, nil
+}
+
+// Unwrap opens a file key wrapped to this identity's recipient
+func (i *X25519Identity) Unwrap(ephemeral, wrapped []byte) ([]byte, error) {
+	ephemeralKey, err := ecdh.X25519().NewPublicKey(ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ephemeral key: %w", err)
+	}
+
+	shared, err := i.key.ECDH(ephemeralKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+
+	aead, err := x25519WrapAEAD(shared, ephemeral, i.key.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	fileKey, err := aead.Decrypt(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap file key: %w", err)
+	}
+	return fileKey, nil
+}
+
+// x25519WrapAEAD derives the wrapping cipher from a shared secret, binding it
+// to both public keys
+func x25519WrapAEAD(shared, ephemeral, recipient []byte) (AEAD, error) {
+	salt := make([]byte, 0, len(ephemeral)+len(recipient))
+	salt = append(append(salt, ephemeral...), recipient...)
+
+	key := make([]byte, DefaultKeyLength)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(x25519WrapInfo)), key); err != nil {
+		return nil, fmt.Errorf("failed to derive wrapping key: %w", err)
+	}
+	defer func() {
+		for i := range key {
+			key[i] = 0
+		}
+	}()
+
+	return NewChaCha20Poly1305(key)
+}
+
+// decodeKey decodes the base32 body of a key with the given prefix
+func decodeKey(s, prefix string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, prefix) {
+		return nil, fmt.Errorf("missing %q prefix", prefix)
+	}
+
+	// Recipients are written in lower case to tell them apart from identities
+	raw, err := keyEncoding.DecodeString(strings.ToUpper(s[len(prefix):]))
+	if err != nil {
+		return nil, fmt.Errorf("malformed key: %w", err)
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("invalid key length: %d", len(raw))
+	}
+	return raw, nil
+}
+
+// scanKeyLines calls fn for every line of r that is not blank or a comment
+func scanKeyLines(r io.Reader, fn func(line string) error) error {
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return fmt.Errorf("line %d: %w", lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read keys: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package crypto
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestX25519WrapUnwrap(t *testing.T) {
+	identity, err := GenerateX25519Identity()
+	require.NoError(t, err, "GenerateX25519Identity should succeed")
+
+	fileKey, err := GenerateKey()
+	require.NoError(t, err, "GenerateKey should succeed")
+
+	ephemeral, wrapped, err := identity.Recipient().Wrap(fileKey)
+	require.NoError(t, err, "Wrap should succeed")
+	assert.Len(t, ephemeral, 32, "Ephemeral key should be 32 bytes")
+
+	unwrapped, err := identity.Unwrap(ephemeral, wrapped)
+	require.NoError(t, err, "Unwrap should succeed")
+	assert.Equal(t, fileKey, unwrapped, "Unwrapped key should match")
+
+	other, err := GenerateX25519Identity()
+	require.NoError(t, err)
+	_, err = other.Unwrap(ephemeral, wrapped)
+	assert.Error(t, err, "Another identity should not unwrap the key")
+
+	wrapped[len(wrapped)-1] ^= 0x01
+	_, err = identity.Unwrap(ephemeral, wrapped)
+	assert.Error(t, err, "A modified wrapped key should fail")
+}
+
+func TestX25519Encoding(t *testing.T) {
+	identity, err := GenerateX25519Identity()
+	require.NoError(t, err)
+
+	recipient := identity.Recipient().String()
+	assert.True(t, strings.HasPrefix(recipient, X25519RecipientPrefix), "Recipient should have its prefix")
+	assert.Equal(t, strings.ToLower(recipient), recipient, "Recipient should be lower case")
+
+	parsedRecipient, err := ParseX25519Recipient(recipient)
+	require.NoError(t, err, "ParseX25519Recipient should succeed")
+	assert.Equal(t, recipient, parsedRecipient.String())
+
+	parsedIdentity, err := ParseX25519Identity(identity.String())
+	require.NoError(t, err, "ParseX25519Identity should succeed")
+	assert.Equal(t, recipient, parsedIdentity.Recipient().String(), "Parsed identity should have the same recipient")
+
+	_, err = ParseX25519Recipient(identity.String())
+	assert.Error(t, err, "An identity is not a recipient")
+	_, err = ParseX25519Recipient(recipient[:len(recipient)-2])
+	assert.Error(t, err, "A truncated recipient should be rejected")
+}
+
+func TestParseX25519Files(t *testing.T) {
+	identity, err := GenerateX25519Identity()
+	require.NoError(t, err)
+	other, err := GenerateX25519Identity()
+	require.NoError(t, err)
+
+	identityFile := "# created: now\n# public key: " + identity.Recipient().String() + "\n" + identity.String() + "\n"
+	identities, err := ParseX25519Identities(strings.NewReader(identityFile))
+	require.NoError(t, err, "ParseX25519Identities should succeed")
+	require.Len(t, identities, 1)
+
+	// Recipients files may list public keys and identities
+	recipientsFile := other.Recipient().String() + "\n\n" + identityFile
+	recipients, err := ParseX25519Recipients(strings.NewReader(recipientsFile))
+	require.NoError(t, err, "ParseX25519Recipients should succeed")
+	require.Len(t, recipients, 2)
+	assert.Equal(t, other.Recipient().String(), recipients[0].String())
+	assert.Equal(t, identity.Recipient().String(), recipients[1].String())
+
+	_, err = ParseX25519Identities(strings.NewReader("# only comments\n"))
+	assert.Error(t, err, "A file without identities should be rejected")
+	_, err = ParseX25519Recipients(strings.NewReader("not a key\n"))
+	assert.Error(t, err, "Malformed lines should be rejected")
+}
@@ -46,6 +46,12 @@ func getDefaultHint(code string) string {
 		return "This may indicate insufficient system resources. Try again or reduce key derivation parameters."
 	case "INVALID_FORMAT":
 		return "The file may not be a valid nokvault encrypted file. Ensure it was encrypted with nokvault."
+	case "INVALID_ARGUMENT":
+		return "Run the command with --help to see the accepted values."
+	case "INVALID_CONFIG":
+		return "Check your configuration with 'nokvault config --show', or reset it with 'nokvault config --init'."
+	case "VERIFICATION_FAILED":
+		return "Restore the failed files from another copy. Files reported as wrong-key may only need another password, keyfile or identity."
 	default:
 		return "Check the documentation or use --verbose for more details."
 	}
@@ -60,6 +66,9 @@ var (
 	ErrFileNotFound     = &NokvaultError{Code: "FILE_NOT_FOUND", Message: "File not found"}
 	ErrKeyDerivation    = &NokvaultError{Code: "KEY_DERIVATION_FAILED", Message: "Key derivation failed"}
 	ErrInvalidFormat    = &NokvaultError{Code: "INVALID_FORMAT", Message: "Invalid file format"}
+	ErrInvalidConfig    = &NokvaultError{Code: "INVALID_CONFIG", Message: "Invalid configuration"}
+	ErrInvalidArgument  = &NokvaultError{Code: "INVALID_ARGUMENT", Message: "Invalid command argument"}
+	ErrVerification     = &NokvaultError{Code: "VERIFICATION_FAILED", Message: "Verification failed"}
 )
 
 // NewError creates a new error with context
@@ -13,15 +13,7 @@ import (
 func GetPassword(passwordFlag, keyfileFlag string, noPrompt, confirm bool) ([]byte, error) {
 	// Try keyfile first
 	if keyfileFlag != "" {
-		keyfileData, err := os.ReadFile(keyfileFlag)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read keyfile: %w", err)
-		}
-		// Remove trailing newline if present
-		if len(keyfileData) > 0 && keyfileData[len(keyfileData)-1] == '\n' {
-			keyfileData = keyfileData[:len(keyfileData)-1]
-		}
-		return keyfileData, nil
+		return ReadKeyfile(keyfileFlag)
 	}
 
 	// Try password flag
@@ -60,6 +52,19 @@ func GetPassword(passwordFlag, keyfileFlag string, noPrompt, confirm bool) ([]by
 	return password, nil
 }
 
+// ReadKeyfile reads the contents of a keyfile
+func ReadKeyfile(path string) ([]byte, error) {
+	keyfileData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyfile: %w", err)
+	}
+	// Remove trailing newline if present
+	if len(keyfileData) > 0 && keyfileData[len(keyfileData)-1] == '\n' {
+		keyfileData = keyfileData[:len(keyfileData)-1]
+	}
+	return keyfileData, nil
+}
+
 // PromptPassword prompts for a password
 func PromptPassword(label string, mask bool) ([]byte, error) {
 	if mask {
@@ -59,11 +59,11 @@ func (pb *ProgressBar) Wait() {
 		return
 	}
 
-	// Get current progress and mark as complete
-	current := pb.bar.Current()
 	// Set total to current to mark as 100% complete
-	// The second parameter 'true' marks it as complete
-	pb.bar.SetTotal(current, true)
+	pb.bar.SetTotal(-1, true)
+	// A bar created with a total only completes by reaching it and ignores
+	// the new total, so one left short by skipped files is stopped where it is
+	pb.bar.Abort(false)
 
 	// Wait for the progress container to finish rendering
 	// This ensures the final state is displayed before cleanup
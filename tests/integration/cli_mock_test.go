@@ -1,11 +1,18 @@
 package integration
 
 import (
+	"bytes"
+	"encoding/json"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/jimididit/nokvault/internal/cli"
+	"github.com/jimididit/nokvault/internal/core"
+	"github.com/jimididit/nokvault/internal/crypto"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -41,6 +48,20 @@ func TestCLI_CommandsExist(t *testing.T) {
 		"config",
 		"rotate-key",
 		"schedule",
+		"key",
+		"keygen",
+		"upgrade",
+		"unprotect",
+		"ls",
+		"list",
+		"backup",
+		"snapshots",
+		"restore",
+		"prune",
+		"verify",
+		"inspect",
+		"repair",
+		"audit",
 	}
 
 	for _, cmdName := range expectedCommands {
@@ -134,6 +155,47 @@ func createTempTestFile(t *testing.T, content string) string {
 	return tmpFile.Name()
 }
 
+// Helper function to run CLI commands with every flag reset to its default
+// before each run and after the test, so flags don't leak between runs
+func newCLIRunner(t *testing.T) func(args ...string) error {
+	rootCmd := cli.GetRootCmd()
+	t.Cleanup(func() { resetFlags(rootCmd) })
+	return func(args ...string) error {
+		resetFlags(rootCmd)
+		rootCmd.SetArgs(args)
+		return rootCmd.Execute()
+	}
+}
+
+// resetFlags restores the flags of cmd and its subcommands to their defaults
+func resetFlags(cmd *cobra.Command) {
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if slice, ok := f.Value.(pflag.SliceValue); ok {
+			slice.Replace(nil)
+		} else {
+			f.Value.Set(f.DefValue)
+		}
+		f.Changed = false
+	})
+	for _, sub := range cmd.Commands() {
+		resetFlags(sub)
+	}
+}
+
+// TestMain runs the tests with a temporary home directory, so the commands
+// they run don't read the user's config or append to their audit log
+func TestMain(m *testing.M) {
+	home, err := os.MkdirTemp("", "nokvault-home-*")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("HOME", home)
+	os.Setenv("USERPROFILE", home)
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
 // Helper function to create a temporary test directory
 func createTempTestDir(t *testing.T) string {
 	tmpDir, err := os.MkdirTemp("", "nokvault-test-dir-*")
@@ -210,6 +272,833 @@ func TestCLI_Decrypt_File_WithPassword(t *testing.T) {
 	assert.Equal(t, "test content for decryption", string(decryptedContent), "Decrypted content should match original")
 }
 
+// TestCLI_EncryptDecrypt_Algorithm tests encrypting with a non-default cipher
+func TestCLI_EncryptDecrypt_Algorithm(t *testing.T) {
+	testFile := createTempTestFile(t, "test content for xchacha20")
+	defer os.Remove(testFile)
+
+	encryptedFile := testFile + ".nokvault"
+	defer os.Remove(encryptedFile)
+
+	rootCmd := cli.GetRootCmd()
+	rootCmd.SetArgs([]string{
+		"encrypt",
+		testFile,
+		"--output", encryptedFile,
+		"--password", "test-password-123",
+		"--algorithm", "xchacha20",
+		"--no-prompt",
+	})
+	err := rootCmd.Execute()
+	require.NoError(t, err, "Encrypt with xchacha20 should succeed")
+
+	header, err := core.NewFileHandler().ReadHeaderFromFile(encryptedFile)
+	require.NoError(t, err, "Failed to read header")
+	assert.Equal(t, crypto.CipherXChaCha20Poly1305, header.Params.Cipher, "Header should record the cipher")
+
+	decryptedFile := testFile + ".decrypted"
+	defer os.Remove(decryptedFile)
+
+	rootCmd.SetArgs([]string{
+		"decrypt",
+		encryptedFile,
+		"--output", decryptedFile,
+		"--password", "test-password-123",
+		"--no-prompt",
+	})
+	err = rootCmd.Execute()
+	require.NoError(t, err, "Decrypt should succeed")
+
+	decryptedContent, err := os.ReadFile(decryptedFile)
+	require.NoError(t, err, "Failed to read decrypted file")
+	assert.Equal(t, "test content for xchacha20", string(decryptedContent))
+}
+
+// TestCLI_KeySlots tests adding, listing and removing key slots
+func TestCLI_KeySlots(t *testing.T) {
+	testFile := createTempTestFile(t, "test content shared between passwords")
+	defer os.Remove(testFile)
+
+	encryptedFile := testFile + ".nokvault"
+	defer os.Remove(encryptedFile)
+
+	decryptedFile := testFile + ".decrypted"
+	defer os.Remove(decryptedFile)
+
+	run := newCLIRunner(t)
+
+	require.NoError(t, run("encrypt", testFile, "--output", encryptedFile, "--password", "first-password", "--no-prompt"), "Encrypt should succeed")
+
+	require.NoError(t, run("key", "add", encryptedFile, "--password", "first-password", "--new-password", "second-password", "--no-prompt"), "Key add should succeed")
+	assert.Error(t, run("key", "add", encryptedFile, "--password", "wrong-password", "--new-password", "third-password", "--no-prompt"), "Key add with a wrong password should fail")
+
+	header, err := core.NewFileHandler().ReadHeaderFromFile(encryptedFile)
+	require.NoError(t, err, "Failed to read header")
+	assert.Len(t, header.KeySlots, 2, "File should have two key slots")
+	require.NoError(t, run("key", "list", encryptedFile), "Key list should succeed")
+
+	// Both passwords unlock the file
+	for _, password := range []string{"first-password", "second-password"} {
+		require.NoError(t, run("decrypt", encryptedFile, "--output", decryptedFile, "--password", password, "--no-prompt"), "Decrypt with %s should succeed", password)
+		decryptedContent, err := os.ReadFile(decryptedFile)
+		require.NoError(t, err, "Failed to read decrypted file")
+		assert.Equal(t, "test content shared between passwords", string(decryptedContent))
+	}
+
+	// Remove the first password's slot using the second password
+	require.NoError(t, run("key", "remove", encryptedFile, "--password", "second-password", "--slot", "0", "--no-prompt"), "Key remove should succeed")
+	assert.Error(t, run("decrypt", encryptedFile, "--output", decryptedFile, "--password", "first-password", "--no-prompt"), "Removed password should no longer decrypt")
+	assert.Error(t, run("key", "remove", encryptedFile, "--password", "second-password", "--slot", "-1", "--no-prompt"), "The last slot should not be removable")
+	require.NoError(t, run("decrypt", encryptedFile, "--output", decryptedFile, "--password", "second-password", "--no-prompt"), "Remaining password should decrypt")
+}
+
+// TestCLI_Recipients tests encrypting to a public key and decrypting with the identity
+func TestCLI_Recipients(t *testing.T) {
+	tmpDir := t.TempDir()
+	testFile := filepath.Join(tmpDir, "secret.txt")
+	require.NoError(t, os.WriteFile(testFile, []byte("test content for a recipient"), 0644))
+
+	identityFile := filepath.Join(tmpDir, "identity.key")
+	encryptedFile := testFile + ".nokvault"
+	decryptedFile := testFile + ".decrypted"
+
+	run := newCLIRunner(t)
+
+	require.NoError(t, run("keygen", "--output", identityFile), "Keygen should succeed")
+	assert.Error(t, run("keygen", "--output", identityFile), "Keygen should not overwrite an identity")
+
+	info, err := os.Stat(identityFile)
+	require.NoError(t, err, "Identity file should exist")
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "Identity file should be private")
+
+	data, err := os.ReadFile(identityFile)
+	require.NoError(t, err)
+	identities, err := crypto.ParseX25519Identities(strings.NewReader(string(data)))
+	require.NoError(t, err, "Identity file should parse")
+	publicKey := identities[0].Recipient().String()
+
+	// No password is needed to encrypt to a recipient
+	require.NoError(t, run("encrypt", testFile, "--output", encryptedFile, "--recipient", publicKey, "--no-prompt"), "Encrypt to a recipient should succeed")
+
+	require.NoError(t, run("decrypt", encryptedFile, "--output", decryptedFile, "--identity", identityFile, "--no-prompt"), "Decrypt with the identity should succeed")
+	decryptedContent, err := os.ReadFile(decryptedFile)
+	require.NoError(t, err, "Failed to read decrypted file")
+	assert.Equal(t, "test content for a recipient", string(decryptedContent))
+}
+
+// TestCLI_TwoFactor tests files that need both a password and a keyfile
+func TestCLI_TwoFactor(t *testing.T) {
+	tmpDir := t.TempDir()
+	testFile := filepath.Join(tmpDir, "secret.txt")
+	require.NoError(t, os.WriteFile(testFile, []byte("test content behind two factors"), 0644))
+
+	keyfile := filepath.Join(tmpDir, "second.key")
+	require.NoError(t, os.WriteFile(keyfile, []byte("keyfile contents"), 0600))
+
+	encryptedFile := testFile + ".nokvault"
+	decryptedFile := testFile + ".decrypted"
+
+	run := newCLIRunner(t)
+
+	require.NoError(t, run("encrypt", testFile, "--output", encryptedFile, "--password", "two-factor-password", "--keyfile", keyfile, "--two-factor", "--no-prompt"), "Two-factor encrypt should succeed")
+
+	header, err := core.NewFileHandler().ReadHeaderFromFile(encryptedFile)
+	require.NoError(t, err, "Failed to read header")
+	assert.True(t, core.RequiresKeyfile(header), "File should require a keyfile")
+
+	require.NoError(t, run("decrypt", encryptedFile, "--output", decryptedFile, "--password", "two-factor-password", "--keyfile", keyfile, "--no-prompt"), "Decrypt with both factors should succeed")
+	decryptedContent, err := os.ReadFile(decryptedFile)
+	require.NoError(t, err, "Failed to read decrypted file")
+	assert.Equal(t, "test content behind two factors", string(decryptedContent))
+
+	assert.Error(t, run("decrypt", encryptedFile, "--output", decryptedFile, "--password", "two-factor-password", "--no-prompt"), "Decrypt without the keyfile should fail")
+	assert.Error(t, run("decrypt", encryptedFile, "--output", decryptedFile, "--keyfile", keyfile, "--no-prompt"), "Decrypt without the password should fail")
+}
+
+// TestCLI_Upgrade tests that upgrade leaves current files alone
+func TestCLI_Upgrade(t *testing.T) {
+	tmpDir := t.TempDir()
+	testFile := filepath.Join(tmpDir, "current.txt")
+	require.NoError(t, os.WriteFile(testFile, []byte("already current"), 0644))
+	encryptedFile := testFile + ".nokvault"
+
+	run := newCLIRunner(t)
+	require.NoError(t, run("encrypt", testFile, "--output", encryptedFile, "--password", "upgrade-password", "--no-prompt"), "Encrypt should succeed")
+	original, err := os.ReadFile(encryptedFile)
+	require.NoError(t, err)
+
+	require.NoError(t, run("upgrade", tmpDir, "--dry-run"), "Upgrade dry run should succeed")
+
+	// No password is needed when there is nothing to upgrade
+	require.NoError(t, run("upgrade", tmpDir, "--no-prompt"), "Upgrade should succeed")
+	after, err := os.ReadFile(encryptedFile)
+	require.NoError(t, err)
+	assert.Equal(t, original, after, "Current files should not be rewritten")
+}
+
+// TestCLI_ProtectUnprotect tests archiving a directory into a single file and restoring it
+func TestCLI_ProtectUnprotect(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputDir := filepath.Join(tmpDir, "project")
+	require.NoError(t, os.MkdirAll(filepath.Join(inputDir, "docs", "empty"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "docs", "plan.txt"), []byte("the plan"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "notes.txt"), []byte("some notes"), 0600))
+
+	archivePath := filepath.Join(tmpDir, "project.nokvault")
+
+	run := newCLIRunner(t)
+	require.NoError(t, run("protect", inputDir, "--output", archivePath, "--password", "archive-password", "--no-prompt"), "Protect should succeed")
+
+	header, err := core.NewFileHandler().ReadHeaderFromFile(archivePath)
+	require.NoError(t, err, "Failed to read header")
+	assert.True(t, core.IsArchive(header), "Output should be an archive")
+
+	restoredDir := filepath.Join(tmpDir, "restored")
+	require.NoError(t, run("unprotect", archivePath, "--output", restoredDir, "--password", "archive-password", "--no-prompt"), "Unprotect should succeed")
+	content, err := os.ReadFile(filepath.Join(restoredDir, "docs", "plan.txt"))
+	require.NoError(t, err, "Failed to read restored file")
+	assert.Equal(t, "the plan", string(content))
+	info, err := os.Stat(filepath.Join(restoredDir, "docs", "empty"))
+	require.NoError(t, err, "Empty directory should be restored")
+	assert.True(t, info.IsDir())
+
+	// decrypt recognizes archives too
+	decryptedDir := filepath.Join(tmpDir, "decrypted")
+	require.NoError(t, run("decrypt", archivePath, "--output", decryptedDir, "--password", "archive-password", "--no-prompt"), "Decrypt of an archive should succeed")
+	content, err = os.ReadFile(filepath.Join(decryptedDir, "notes.txt"))
+	require.NoError(t, err, "Failed to read restored file")
+	assert.Equal(t, "some notes", string(content))
+
+	assert.Error(t, run("unprotect", archivePath, "--output", filepath.Join(tmpDir, "wrong"), "--password", "wrong-password", "--no-prompt"), "Unprotect with a wrong password should fail")
+}
+
+func TestCLI_SelectiveDecrypt(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputDir := filepath.Join(tmpDir, "tree")
+	for _, relPath := range []string{"configs/app.yaml", "configs/debug.log", "data/big.bin", "README.md"} {
+		filePath := filepath.Join(inputDir, relPath)
+		require.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+		require.NoError(t, os.WriteFile(filePath, []byte(relPath), 0644))
+	}
+
+	run := newCLIRunner(t)
+	for _, encrypt := range [][]string{
+		{"encrypt", inputDir, "--output", filepath.Join(tmpDir, "vault")},
+		{"protect", inputDir, "--output", filepath.Join(tmpDir, "tree.nokvault")},
+	} {
+		require.NoError(t, run(append(encrypt, "--password", "test-password-123", "--no-prompt")...), "%s should succeed", encrypt[0])
+	}
+
+	listPath := filepath.Join(tmpDir, "restore-list.txt")
+	require.NoError(t, os.WriteFile(listPath, []byte("# wanted\nREADME.md\n"), 0644))
+
+	for _, source := range []string{"vault", "tree.nokvault"} {
+		outputDir := filepath.Join(tmpDir, source+"-configs")
+		err := run("decrypt", filepath.Join(tmpDir, source), "--output", outputDir, "--password", "test-password-123", "--no-prompt",
+			"--include", "configs/**", "--exclude", "*.log")
+		require.NoError(t, err, "Selective decrypt of %s should succeed", source)
+		content, err := os.ReadFile(filepath.Join(outputDir, "configs", "app.yaml"))
+		require.NoError(t, err, "Selected file should be decrypted from %s", source)
+		assert.Equal(t, "configs/app.yaml", string(content))
+		assert.NoFileExists(t, filepath.Join(outputDir, "configs", "debug.log"))
+		assert.NoFileExists(t, filepath.Join(outputDir, "README.md"))
+		assert.NoDirExists(t, filepath.Join(outputDir, "data"))
+
+		outputDir = filepath.Join(tmpDir, source+"-list")
+		err = run("decrypt", filepath.Join(tmpDir, source), "--output", outputDir, "--password", "test-password-123", "--no-prompt",
+			"--files-from", listPath)
+		require.NoError(t, err, "Decrypt with --files-from of %s should succeed", source)
+		assert.FileExists(t, filepath.Join(outputDir, "README.md"))
+		assert.NoDirExists(t, filepath.Join(outputDir, "configs"))
+	}
+
+	// Selection flags don't apply to single files
+	err := run("decrypt", filepath.Join(tmpDir, "vault", "README.md.nokvault"), "--password", "test-password-123", "--no-prompt", "--include", "*.md")
+	assert.Error(t, err, "Selection flags should be rejected for single files")
+}
+
+func TestCLI_Ls(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputDir := filepath.Join(tmpDir, "tree")
+	require.NoError(t, os.MkdirAll(filepath.Join(inputDir, "configs"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "configs", "app.yaml"), []byte("name: app"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "README.md"), []byte("# tree"), 0644))
+
+	run := newCLIRunner(t)
+	vaultDir := filepath.Join(tmpDir, "vault")
+	archivePath := filepath.Join(tmpDir, "tree.nokvault")
+	require.NoError(t, run("encrypt", inputDir, "--output", vaultDir, "--password", "test-password-123", "--no-prompt"))
+	require.NoError(t, run("protect", inputDir, "--output", archivePath, "--password", "test-password-123", "--no-prompt"))
+
+	rootCmd := cli.GetRootCmd()
+	var out bytes.Buffer
+	rootCmd.SetOut(&out)
+	t.Cleanup(func() { rootCmd.SetOut(nil) })
+	ls := func(args ...string) string {
+		out.Reset()
+		require.NoError(t, run(append([]string{"ls"}, args...)...), "ls %v should succeed", args)
+		return out.String()
+	}
+
+	// The metadata in the headers is sealed, so listing needs the password
+	assert.Error(t, run("ls", vaultDir, "--no-prompt"), "Listing sealed metadata without a password should fail")
+	assert.Equal(t, "README.md\nconfigs/\nconfigs/app.yaml\n", ls(vaultDir, "--password", "test-password-123", "--no-prompt"))
+
+	var entries []core.FileMetadata
+	require.NoError(t, json.Unmarshal([]byte(ls(vaultDir, "--json", "--password", "test-password-123", "--no-prompt")), &entries))
+	require.Len(t, entries, 3)
+	assert.True(t, entries[1].IsDir)
+	assert.Equal(t, "configs/app.yaml", entries[2].RelativePath)
+	assert.Equal(t, int64(9), entries[2].Size)
+
+	long := ls(filepath.Join(vaultDir, "configs", "app.yaml.nokvault"), "--long", "--password", "test-password-123", "--no-prompt")
+	assert.Contains(t, long, "-rw-------")
+	assert.Contains(t, long, "app.yaml")
+	assert.Error(t, run("ls", vaultDir, "--password", "wrong-password", "--no-prompt"), "A wrong password should fail")
+
+	// Archives need the password to decrypt their index
+	assert.Error(t, run("ls", archivePath, "--no-prompt"), "Listing an archive without a password should fail")
+	assert.Equal(t, "tree/\n├── README.md\n└── configs/\n    └── app.yaml\n", ls(archivePath, "--tree", "--password", "test-password-123", "--no-prompt"))
+
+	assert.Error(t, run("list", vaultDir, "--json", "--tree"), "Output formats should be exclusive")
+}
+
+func TestCLI_EncryptPad(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, "salary.txt")
+	require.NoError(t, os.WriteFile(inputPath, []byte("123456"), 0600))
+
+	run := newCLIRunner(t)
+	encryptedPath := filepath.Join(tmpDir, "salary.txt.nokvault")
+	require.NoError(t, run("encrypt", inputPath, "--pad", "--password", "test-password-123", "--no-prompt"))
+
+	header, err := core.NewFileHandler().ReadHeaderFromFile(encryptedPath)
+	require.NoError(t, err)
+	assert.Equal(t, core.PaddingPadme, header.Params.Padding, "--pad should use Padmé by default")
+
+	outputPath := filepath.Join(tmpDir, "restored.txt")
+	require.NoError(t, run("decrypt", encryptedPath, "--output", outputPath, "--password", "test-password-123", "--no-prompt"))
+	content, err := os.ReadFile(outputPath)
+	require.NoError(t, err)
+	assert.Equal(t, "123456", string(content), "Padding should be stripped")
+
+	unpaddedPath := filepath.Join(tmpDir, "unpadded.nokvault")
+	require.NoError(t, run("encrypt", inputPath, "--output", unpaddedPath, "--pad", "--no-pad", "--password", "test-password-123", "--no-prompt"))
+	header, err = core.NewFileHandler().ReadHeaderFromFile(unpaddedPath)
+	require.NoError(t, err)
+	assert.Equal(t, core.PaddingNone, header.Params.Padding, "--no-pad should take precedence")
+}
+
+func TestCLI_EncryptNames(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputDir := filepath.Join(tmpDir, "tree")
+	require.NoError(t, os.MkdirAll(filepath.Join(inputDir, "hr"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "hr", "2025-layoffs-draft.docx"), []byte("draft"), 0644))
+
+	run := newCLIRunner(t)
+	vaultDir := filepath.Join(tmpDir, "vault")
+	require.NoError(t, run("encrypt", inputDir, "--output", vaultDir, "--encrypt-names", "--password", "test-password-123", "--no-prompt"))
+
+	// The name map of the earlier files can't be extended, so encrypting into
+	// the same output again is refused
+	err := run("encrypt", inputDir, "--output", vaultDir, "--encrypt-names", "--password", "test-password-123", "--no-prompt")
+	assert.ErrorIs(t, err, core.ErrNameMapExists)
+
+	entries, err := os.ReadDir(vaultDir)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		assert.NotContains(t, entry.Name(), "layoffs", "Names should be hidden")
+		assert.NotEqual(t, "hr", entry.Name(), "Directory names should be hidden")
+	}
+
+	rootCmd := cli.GetRootCmd()
+	var out bytes.Buffer
+	rootCmd.SetOut(&out)
+	t.Cleanup(func() { rootCmd.SetOut(nil) })
+	assert.Error(t, run("ls", vaultDir, "--no-prompt"), "Listing hidden names without a password should fail")
+	out.Reset()
+	require.NoError(t, run("ls", vaultDir, "--password", "test-password-123", "--no-prompt"))
+	assert.Equal(t, "hr/\nhr/2025-layoffs-draft.docx\n", out.String())
+
+	outputDir := filepath.Join(tmpDir, "restored")
+	require.NoError(t, run("decrypt", vaultDir, "--output", outputDir, "--password", "test-password-123", "--no-prompt"))
+	content, err := os.ReadFile(filepath.Join(outputDir, "hr", "2025-layoffs-draft.docx"))
+	require.NoError(t, err, "Original names should be restored")
+	assert.Equal(t, "draft", string(content))
+
+	assert.Error(t, run("decrypt", vaultDir, "--output", filepath.Join(tmpDir, "wrong"), "--password", "wrong-password", "--no-prompt"), "A wrong password should fail")
+}
+
+func TestCLI_EncryptDecrypt_Tree(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputDir := filepath.Join(tmpDir, "project")
+	require.NoError(t, os.MkdirAll(filepath.Join(inputDir, "build"), 0700))
+	require.NoError(t, os.MkdirAll(filepath.Join(inputDir, "bin"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "bin", "tool"), []byte("#!/bin/sh"), 0755))
+	require.NoError(t, os.Symlink("bin/tool", filepath.Join(inputDir, "tool")))
+
+	run := newCLIRunner(t)
+	for _, flag := range []string{"--hardlinks", "--encrypt-names"} {
+		vaultDir := filepath.Join(tmpDir, "vault"+flag)
+		outputDir := filepath.Join(tmpDir, "restored"+flag)
+		args := []string{"encrypt", inputDir, "--output", vaultDir, flag, "--password", "test-password-123", "--no-prompt"}
+		require.NoError(t, run(args...))
+		require.NoError(t, run("decrypt", vaultDir, "--output", outputDir, "--password", "test-password-123", "--no-prompt"))
+
+		info, err := os.Stat(filepath.Join(outputDir, "build"))
+		require.NoError(t, err, "Empty directories should be restored")
+		assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+		target, err := os.Readlink(filepath.Join(outputDir, "tool"))
+		require.NoError(t, err, "Symbolic links should be restored as links")
+		assert.Equal(t, "bin/tool", target)
+
+		content, err := os.ReadFile(filepath.Join(outputDir, "tool"))
+		require.NoError(t, err)
+		assert.Equal(t, "#!/bin/sh", string(content))
+	}
+}
+
+func TestCLI_EncryptDecrypt_Volumes(t *testing.T) {
+	tmpDir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 10*1024)
+	inputPath := filepath.Join(tmpDir, "data.bin")
+	require.NoError(t, os.WriteFile(inputPath, data, 0644))
+
+	run := newCLIRunner(t)
+	assert.Error(t, run("encrypt", inputPath, "--volume-size", "1K", "--password", "test-password-123", "--no-prompt"), "Volumes smaller than 64K should be rejected")
+	assert.Error(t, run("encrypt", tmpDir, "--volume-size", "64K", "--password", "test-password-123", "--no-prompt"), "Directories should be split with protect")
+
+	require.NoError(t, run("encrypt", inputPath, "--volume-size", "64K", "--password", "test-password-123", "--no-prompt"))
+	assert.NoFileExists(t, inputPath+".nokvault")
+	assert.FileExists(t, inputPath+".nokvault.003")
+
+	// The key slots of a set can be listed but not changed
+	for _, setPath := range []string{inputPath + ".nokvault", inputPath + ".nokvault.001"} {
+		require.NoError(t, run("key", "list", setPath), "Key list should read the slots of a set")
+		err := run("key", "add", setPath, "--password", "test-password-123", "--new-password", "second-password", "--no-prompt")
+		assert.ErrorContains(t, err, "volume set")
+		err = run("rotate-key", setPath, "--old-password", "test-password-123", "--new-password", "second-password", "--no-prompt")
+		assert.ErrorContains(t, err, "volume set")
+	}
+
+	require.NoError(t, os.Remove(inputPath))
+	require.NoError(t, run("decrypt", inputPath+".nokvault.001", "--password", "test-password-123", "--no-prompt"))
+	content, err := os.ReadFile(inputPath)
+	require.NoError(t, err, "The output should be named after the set")
+	assert.Equal(t, data, content)
+
+	require.NoError(t, os.Rename(inputPath+".nokvault.002", inputPath+".nokvault.tmp"))
+	require.NoError(t, os.Rename(inputPath+".nokvault.003", inputPath+".nokvault.002"))
+	err = run("decrypt", inputPath+".nokvault", "--output", filepath.Join(tmpDir, "swapped"), "--password", "test-password-123", "--no-prompt")
+	assert.ErrorIs(t, err, core.ErrVolumeOutOfOrder)
+	assert.NoFileExists(t, filepath.Join(tmpDir, "swapped"))
+
+	// Archives of directories are split by protect
+	inputDir := filepath.Join(tmpDir, "project")
+	require.NoError(t, os.MkdirAll(inputDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "data.bin"), data, 0644))
+	archivePath := filepath.Join(tmpDir, "archive.nokvault")
+	require.NoError(t, run("protect", inputDir, "--output", archivePath, "--volume-size", "64K", "--password", "test-password-123", "--no-prompt"))
+	outputDir := filepath.Join(tmpDir, "restored")
+	require.NoError(t, run("unprotect", archivePath, "--output", outputDir, "--password", "test-password-123", "--no-prompt"))
+	content, err = os.ReadFile(filepath.Join(outputDir, "data.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, data, content)
+}
+
+func TestCLI_Verify(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputDir := filepath.Join(tmpDir, "documents")
+	require.NoError(t, os.MkdirAll(inputDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "a.txt"), []byte("first file"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "b.txt"), []byte("second file"), 0644))
+
+	run := newCLIRunner(t)
+	vaultDir := filepath.Join(tmpDir, "vault")
+	require.NoError(t, run("encrypt", inputDir, "--output", vaultDir, "--password", "test-password-123", "--no-prompt"))
+
+	var out bytes.Buffer
+	rootCmd := cli.GetRootCmd()
+	rootCmd.SetOut(&out)
+	defer rootCmd.SetOut(nil)
+
+	type verifyOutput struct {
+		Files []struct {
+			Path   string `json:"path"`
+			Status string `json:"status"`
+		} `json:"files"`
+		Summary struct {
+			Total    int `json:"total"`
+			OK       int `json:"ok"`
+			Corrupt  int `json:"corrupt"`
+			WrongKey int `json:"wrong_key"`
+		} `json:"summary"`
+	}
+	verify := func(password string) (*verifyOutput, error) {
+		out.Reset()
+		err := run("verify", vaultDir, "--json", "--password", password, "--no-prompt")
+		result := &verifyOutput{}
+		require.NoError(t, json.Unmarshal(out.Bytes(), result))
+		return result, err
+	}
+
+	result, err := verify("test-password-123")
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Summary.Total)
+	assert.Equal(t, 2, result.Summary.OK)
+
+	result, err = verify("wrong-password")
+	assert.Error(t, err, "verify should fail when no file unlocks")
+	assert.Equal(t, 2, result.Summary.WrongKey)
+
+	// Flip the last byte of one file
+	target := filepath.Join(vaultDir, "b.txt.nokvault")
+	contents, err := os.ReadFile(target)
+	require.NoError(t, err)
+	contents[len(contents)-1] ^= 1
+	require.NoError(t, os.WriteFile(target, contents, 0644))
+
+	result, err = verify("test-password-123")
+	assert.Error(t, err, "verify should fail on a corrupt file")
+	assert.Equal(t, 1, result.Summary.Corrupt)
+	for _, file := range result.Files {
+		if file.Path == target {
+			assert.Equal(t, core.VerifyCorrupt, file.Status)
+		} else {
+			assert.Equal(t, core.VerifyOK, file.Status)
+		}
+	}
+	assert.NoFileExists(t, filepath.Join(vaultDir, "b.txt"), "verify should not write plaintext")
+}
+
+func TestCLI_Inspect(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputFile := filepath.Join(tmpDir, "report.txt")
+	require.NoError(t, os.WriteFile(inputFile, bytes.Repeat([]byte("quarterly numbers\n"), 1000), 0644))
+
+	run := newCLIRunner(t)
+	encryptedFile := filepath.Join(tmpDir, "report.txt.nokvault")
+	require.NoError(t, run("encrypt", inputFile, "--password", "test-password-123", "--no-prompt"))
+
+	var out bytes.Buffer
+	rootCmd := cli.GetRootCmd()
+	rootCmd.SetOut(&out)
+	defer rootCmd.SetOut(nil)
+
+	inspect := func(args ...string) (*core.Inspection, error) {
+		out.Reset()
+		err := run(append([]string{"inspect", "--json"}, args...)...)
+		inspection := &core.Inspection{}
+		require.NoError(t, json.Unmarshal(out.Bytes(), inspection))
+		return inspection, err
+	}
+
+	inspection, err := inspect(encryptedFile)
+	require.NoError(t, err, "inspect should not need a password")
+	assert.Equal(t, core.NokvaultMagic, inspection.Magic)
+	assert.Equal(t, uint16(core.CurrentVersion), inspection.Version)
+	require.Len(t, inspection.KeySlots, 1)
+	assert.NotEmpty(t, inspection.KeySlots[0].Salt)
+	assert.Empty(t, inspection.Problems)
+
+	// Cut the file inside its header
+	require.NoError(t, os.Truncate(encryptedFile, int64(inspection.DataOffset)-10))
+	inspection, err = inspect(encryptedFile)
+	assert.Error(t, err, "inspect should fail on a truncated file")
+	assert.NotEmpty(t, inspection.Problems)
+
+	assert.Error(t, run("inspect", filepath.Join(tmpDir, "missing.nokvault")), "inspect should fail on a missing file")
+}
+
+func TestCLI_Manifest(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputDir := filepath.Join(tmpDir, "documents")
+	require.NoError(t, os.MkdirAll(inputDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "a.txt"), []byte("first file"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "b.txt"), []byte("second file"), 0644))
+
+	run := newCLIRunner(t)
+	vaultDir := filepath.Join(tmpDir, "vault")
+	require.NoError(t, run("encrypt", inputDir, "--output", vaultDir, "--password", "test-password-123", "--no-prompt"))
+	assert.FileExists(t, filepath.Join(vaultDir, core.ManifestFile))
+
+	// Swap the two files
+	aPath := filepath.Join(vaultDir, "a.txt.nokvault")
+	bPath := filepath.Join(vaultDir, "b.txt.nokvault")
+	require.NoError(t, os.Rename(aPath, aPath+".tmp"))
+	require.NoError(t, os.Rename(bPath, aPath))
+	require.NoError(t, os.Rename(aPath+".tmp", bPath))
+
+	var out bytes.Buffer
+	rootCmd := cli.GetRootCmd()
+	rootCmd.SetOut(&out)
+	defer rootCmd.SetOut(nil)
+
+	err := run("verify", vaultDir, "--json", "--password", "test-password-123", "--no-prompt")
+	assert.Error(t, err, "verify should fail when files are swapped")
+	var result struct {
+		Manifest struct {
+			Generation uint64                 `json:"generation"`
+			Problems   []core.ManifestProblem `json:"problems"`
+		} `json:"manifest"`
+		Summary struct {
+			OK int `json:"ok"`
+		} `json:"summary"`
+	}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &result))
+	assert.Equal(t, 2, result.Summary.OK, "each file is intact on its own")
+	assert.Equal(t, uint64(1), result.Manifest.Generation)
+	require.Len(t, result.Manifest.Problems, 2)
+	for _, problem := range result.Manifest.Problems {
+		assert.Equal(t, core.ManifestSwapped, problem.Kind)
+	}
+
+	outputDir := filepath.Join(tmpDir, "restored")
+	err = run("decrypt", vaultDir, "--output", outputDir, "--password", "test-password-123", "--no-prompt")
+	assert.ErrorIs(t, err, core.ErrManifestMismatch)
+	assert.NoFileExists(t, filepath.Join(outputDir, "a.txt"), "nothing should be written")
+
+	require.NoError(t, run("decrypt", vaultDir, "--output", outputDir, "--password", "test-password-123", "--no-prompt", "--ignore-manifest"))
+	content, err := os.ReadFile(filepath.Join(outputDir, "a.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "second file", string(content), "the swapped contents are restored with --ignore-manifest")
+
+	// An output without a manifest, such as one written by an older release,
+	// is refused before anything is encrypted
+	require.NoError(t, os.Remove(filepath.Join(vaultDir, core.ManifestFile)))
+	err = run("encrypt", inputDir, "--output", vaultDir, "--password", "test-password-123", "--no-prompt")
+	assert.ErrorIs(t, err, core.ErrOutputNotManaged)
+}
+
+func TestCLI_Repair(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, "report.bin")
+	contents := bytes.Repeat([]byte("long-term archive "), 20000)
+	require.NoError(t, os.WriteFile(inputPath, contents, 0644))
+
+	run := newCLIRunner(t)
+	outputPath := inputPath + ".nokvault"
+	require.NoError(t, run("encrypt", inputPath, "--parity", "10", "--password", "test-password-123", "--no-prompt"))
+	assert.FileExists(t, core.ParityPath(outputPath))
+	assert.Error(t, run("encrypt", inputPath, "--output", filepath.Join(tmpDir, "bad.nokvault"), "--parity", "150", "--password", "test-password-123", "--no-prompt"))
+
+	// Flip a bit in the payload
+	encrypted, err := os.ReadFile(outputPath)
+	require.NoError(t, err)
+	encrypted[len(encrypted)-100] ^= 1
+	require.NoError(t, os.WriteFile(outputPath, encrypted, 0644))
+
+	var out bytes.Buffer
+	rootCmd := cli.GetRootCmd()
+	rootCmd.SetOut(&out)
+	defer rootCmd.SetOut(nil)
+
+	err = run("verify", outputPath, "--json", "--password", "test-password-123", "--no-prompt")
+	assert.Error(t, err, "verify should fail on a damaged file")
+	var result struct {
+		Files   []core.VerifyResult `json:"files"`
+		Summary struct {
+			Repairable int `json:"repairable"`
+		} `json:"summary"`
+	}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &result))
+	require.Len(t, result.Files, 1)
+	require.NotNil(t, result.Files[0].Repairable)
+	assert.True(t, *result.Files[0].Repairable)
+	assert.Equal(t, 1, result.Summary.Repairable)
+
+	require.NoError(t, run("repair", tmpDir, "--dry-run"))
+	require.NoError(t, run("repair", outputPath))
+	require.NoError(t, run("verify", outputPath, "--password", "test-password-123", "--no-prompt"))
+
+	decryptedPath := filepath.Join(tmpDir, "restored.bin")
+	require.NoError(t, run("decrypt", outputPath, "--output", decryptedPath, "--password", "test-password-123", "--no-prompt"))
+	decrypted, err := os.ReadFile(decryptedPath)
+	require.NoError(t, err)
+	assert.Equal(t, contents, decrypted)
+
+	assert.Error(t, run("repair", inputPath), "repair should fail on a file without parity")
+}
+
+func TestCLI_Signing(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, "release.txt")
+	require.NoError(t, os.WriteFile(inputPath, []byte("signed release notes"), 0644))
+
+	run := newCLIRunner(t)
+	signingKey := filepath.Join(tmpDir, "signing.key")
+	otherKey := filepath.Join(tmpDir, "other.key")
+	require.NoError(t, run("keygen", "--signing", "--output", signingKey), "Keygen should write a signing key")
+	require.NoError(t, run("keygen", "--signing", "--output", otherKey))
+	assert.Error(t, run("keygen", "--signing", "--output", signingKey), "Keygen should not overwrite a signing key")
+
+	// A trusted signers file lists verifying keys; a signing key stands for its own
+	trustedSigners := filepath.Join(tmpDir, "trusted.txt")
+	keyFile, err := os.ReadFile(signingKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(trustedSigners, keyFile, 0600))
+
+	outputPath := inputPath + ".nokvault"
+	require.NoError(t, run("encrypt", inputPath, "--sign-key", signingKey, "--password", "test-password-123", "--no-prompt"))
+	assert.FileExists(t, outputPath+core.SignatureSuffix)
+	require.NoError(t, run("verify", outputPath, "--trusted-signers", trustedSigners, "--password", "test-password-123", "--no-prompt"))
+
+	decryptedPath := filepath.Join(tmpDir, "restored.txt")
+	require.NoError(t, run("decrypt", outputPath, "--output", decryptedPath, "--trusted-signers", trustedSigners, "--password", "test-password-123", "--no-prompt"))
+	decrypted, err := os.ReadFile(decryptedPath)
+	require.NoError(t, err)
+	assert.Equal(t, "signed release notes", string(decrypted))
+
+	// Files from an unknown signer are refused, unless only warned about
+	otherPath := filepath.Join(tmpDir, "other.nokvault")
+	require.NoError(t, run("encrypt", inputPath, "--output", otherPath, "--sign-key", otherKey, "--password", "test-password-123", "--no-prompt"))
+	assert.Error(t, run("verify", otherPath, "--trusted-signers", trustedSigners, "--password", "test-password-123", "--no-prompt"))
+	assert.Error(t, run("decrypt", otherPath, "--output", filepath.Join(tmpDir, "other.txt"), "--trusted-signers", trustedSigners, "--password", "test-password-123", "--no-prompt"))
+	assert.NoFileExists(t, filepath.Join(tmpDir, "other.txt"))
+	require.NoError(t, run("decrypt", otherPath, "--output", filepath.Join(tmpDir, "other.txt"), "--trusted-signers", trustedSigners, "--warn-untrusted", "--password", "test-password-123", "--no-prompt"))
+
+	// So are unsigned files
+	require.NoError(t, os.Remove(outputPath+core.SignatureSuffix))
+	assert.Error(t, run("decrypt", outputPath, "--output", filepath.Join(tmpDir, "unsigned.txt"), "--trusted-signers", trustedSigners, "--password", "test-password-123", "--no-prompt"))
+
+	// A signature that doesn't match its file is refused even with --warn-untrusted
+	require.NoError(t, run("encrypt", inputPath, "--output", outputPath, "--sign-key", signingKey, "--password", "test-password-123", "--no-prompt"))
+	encrypted, err := os.ReadFile(outputPath)
+	require.NoError(t, err)
+	encrypted[len(encrypted)-1] ^= 1
+	require.NoError(t, os.WriteFile(outputPath, encrypted, 0644))
+	assert.Error(t, run("decrypt", outputPath, "--output", filepath.Join(tmpDir, "tampered.txt"), "--trusted-signers", trustedSigners, "--warn-untrusted", "--password", "test-password-123", "--no-prompt"))
+	assert.NoFileExists(t, filepath.Join(tmpDir, "tampered.txt"))
+}
+
+func TestCLI_Audit(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("USERPROFILE", os.Getenv("HOME"))
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, "ledger.txt")
+	require.NoError(t, os.WriteFile(inputPath, []byte("quarterly figures"), 0644))
+
+	run := newCLIRunner(t)
+	outputPath := inputPath + ".nokvault"
+	require.NoError(t, run("encrypt", inputPath, "--password", "test-password-123", "--no-prompt"))
+	require.NoError(t, run("decrypt", outputPath, "--output", filepath.Join(tmpDir, "restored.txt"), "--dry-run", "--password", "test-password-123", "--no-prompt"))
+	assert.Error(t, run("decrypt", outputPath, "--output", filepath.Join(tmpDir, "restored.txt"), "--password", "wrong-password-123", "--no-prompt"))
+	require.NoError(t, run("secure-delete", inputPath))
+	require.NoError(t, run("key", "add", outputPath, "--password", "test-password-123", "--new-password", "second-password", "--no-prompt"))
+	repoDir := filepath.Join(tmpDir, "repo")
+	require.NoError(t, run("backup", tmpDir, "--repo", repoDir, "--password", "test-password-123", "--no-prompt"))
+	require.NoError(t, run("prune", "--repo", repoDir, "--keep-last", "1", "--dry-run", "--password", "test-password-123", "--no-prompt"))
+	require.NoError(t, run("prune", "--repo", repoDir, "--keep-last", "1", "--password", "test-password-123", "--no-prompt"))
+
+	var out bytes.Buffer
+	rootCmd := cli.GetRootCmd()
+	rootCmd.SetOut(&out)
+	defer rootCmd.SetOut(nil)
+
+	require.NoError(t, run("audit", "show", "--json"))
+	var records []core.AuditRecord
+	require.NoError(t, json.Unmarshal(out.Bytes(), &records))
+	require.Len(t, records, 6, "dry runs should not be recorded")
+	assert.Equal(t, core.AuditEncrypt, records[0].Operation)
+	assert.Equal(t, core.AuditPathHash(inputPath), records[0].PathHash)
+	assert.Equal(t, core.AuditSuccess, records[0].Result)
+	assert.Equal(t, core.AuditDecrypt, records[1].Operation)
+	assert.Equal(t, core.AuditFailure, records[1].Result)
+	assert.Equal(t, "DECRYPTION_FAILED", records[1].ErrorCode)
+	assert.Equal(t, core.AuditSecureDelete, records[2].Operation)
+	assert.Equal(t, core.AuditAddKey, records[3].Operation)
+	assert.Equal(t, core.AuditBackup, records[4].Operation)
+	assert.Equal(t, core.AuditPathHash(tmpDir), records[4].PathHash)
+	assert.Equal(t, core.AuditPrune, records[5].Operation)
+	assert.Equal(t, core.AuditPathHash(repoDir), records[5].PathHash, "commands without arguments should record their repository")
+
+	out.Reset()
+	require.NoError(t, run("audit", "show", "--json", "--path", outputPath, "--result", "failure", "--since", "2000-01-01"))
+	records = nil
+	require.NoError(t, json.Unmarshal(out.Bytes(), &records))
+	require.Len(t, records, 1)
+	assert.Equal(t, core.AuditDecrypt, records[0].Operation)
+	assert.Error(t, run("audit", "show", "--operation", "delete"), "unknown operations should be rejected")
+	assert.Error(t, run("audit", "show", "--since", "yesterday"), "invalid times should be rejected")
+
+	require.NoError(t, run("audit", "verify"))
+
+	// Removing the last record is detected
+	logPath := filepath.Join(os.Getenv("HOME"), ".config", "nokvault", "audit.log")
+	data, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	require.NoError(t, os.WriteFile(logPath, bytes.Join(lines[:2], nil), 0600))
+	assert.Error(t, run("audit", "verify"), "a truncated log should fail verification")
+}
+
+func TestCLI_BackupRestore(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputDir := filepath.Join(tmpDir, "documents")
+	require.NoError(t, os.MkdirAll(filepath.Join(inputDir, "notes"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "notes", "todo.txt"), []byte("first"), 0644))
+
+	run := newCLIRunner(t)
+	repoDir := filepath.Join(tmpDir, "repo")
+	require.NoError(t, run("backup", inputDir, "--repo", repoDir, "--password", "test-password-123", "--no-prompt"), "The first backup should create the repository")
+	assert.FileExists(t, filepath.Join(repoDir, core.RepositoryFile))
+
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "notes", "todo.txt"), []byte("second"), 0644))
+	require.NoError(t, run("backup", inputDir, "--repo", repoDir, "--password", "test-password-123", "--no-prompt"))
+	assert.Error(t, run("backup", inputDir, "--repo", repoDir, "--password", "wrong-password", "--no-prompt"), "A wrong password should fail")
+
+	assert.Error(t, run("snapshots", repoDir, "--password", "test-password-123", "--no-prompt"), "the repository should only be given with --repo")
+	err := run("snapshots", "--repo", filepath.Join(tmpDir, "missing"), "--password", "test-password-123", "--no-prompt")
+	assert.ErrorIs(t, err, core.ErrNotRepository, "a directory without a repository should be named as such")
+
+	var out bytes.Buffer
+	rootCmd := cli.GetRootCmd()
+	rootCmd.SetOut(&out)
+	defer rootCmd.SetOut(nil)
+	require.NoError(t, run("snapshots", "--repo", repoDir, "--json", "--password", "test-password-123", "--no-prompt"))
+	var snapshots []struct {
+		ID    string `json:"id"`
+		Files int    `json:"files"`
+	}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &snapshots))
+	require.Len(t, snapshots, 2)
+	assert.Equal(t, 1, snapshots[0].Files)
+
+	outputDir := filepath.Join(tmpDir, "restored")
+	require.NoError(t, run("restore", "--repo", repoDir, "--snapshot", snapshots[0].ID[:8], "--output", outputDir, "--password", "test-password-123", "--no-prompt"))
+	content, err := os.ReadFile(filepath.Join(outputDir, "notes", "todo.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(content))
+
+	assert.Error(t, run("prune", "--repo", repoDir, "--password", "test-password-123", "--no-prompt"), "prune should require a --keep option")
+	require.NoError(t, run("prune", "--repo", repoDir, "--keep-last", "1", "--password", "test-password-123", "--no-prompt"))
+
+	latestDir := filepath.Join(tmpDir, "latest")
+	require.NoError(t, run("restore", "--repo", repoDir, "--output", latestDir, "--password", "test-password-123", "--no-prompt"))
+	content, err = os.ReadFile(filepath.Join(latestDir, "notes", "todo.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(content))
+	assert.Error(t, run("restore", "--repo", repoDir, "--snapshot", snapshots[0].ID, "--output", filepath.Join(tmpDir, "pruned"), "--password", "test-password-123", "--no-prompt"), "pruned snapshots should be gone")
+}
+
+// TestCLI_BackupRepositoryInSource tests backing up a tree holding its own
+// repository, whose files are counted but skipped
+func TestCLI_BackupRepositoryInSource(t *testing.T) {
+	inputDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(inputDir, "todo.txt"), []byte("first"), 0644))
+
+	run := newCLIRunner(t)
+	repoDir := filepath.Join(inputDir, "repo")
+	require.NoError(t, run("backup", inputDir, "--repo", repoDir, "--password", "test-password-123", "--no-prompt"))
+	require.NoError(t, run("backup", inputDir, "--repo", repoDir, "--password", "test-password-123", "--no-prompt"), "Backup should finish when the repository is skipped")
+
+	outputDir := filepath.Join(t.TempDir(), "restored")
+	require.NoError(t, run("restore", "--repo", repoDir, "--output", outputDir, "--password", "test-password-123", "--no-prompt"))
+	assert.FileExists(t, filepath.Join(outputDir, "todo.txt"))
+	assert.NoDirExists(t, filepath.Join(outputDir, "repo"), "The repository should not be backed up into itself")
+}
+
 // TestCLI_Encrypt_Directory tests encrypting a directory
 func TestCLI_Encrypt_Directory(t *testing.T) {
 	// Create a temporary test directory with files
@@ -301,15 +1190,70 @@ func TestCLI_Commands_Flags(t *testing.T) {
 		{"encrypt", "password", true},
 		{"encrypt", "keyfile", true},
 		{"encrypt", "no-prompt", true},
+		{"encrypt", "algorithm", true},
+		{"encrypt", "recipient", true},
+		{"encrypt", "encrypt-names", true},
+		{"encrypt", "preserve-owner", true},
+		{"encrypt", "xattrs", true},
+		{"encrypt", "hardlinks", true},
+		{"encrypt", "pad", true},
+		{"encrypt", "no-pad", true},
+		{"encrypt", "volume-size", true},
+		{"protect", "volume-size", true},
+		{"schedule encrypt", "pad", true},
+		{"schedule encrypt", "repo", true},
+		{"backup", "repo", true},
+		{"snapshots", "repo", true},
+		{"restore", "repo", true},
+		{"prune", "repo", true},
+		{"restore", "snapshot", true},
+		{"restore", "include", true},
+		{"snapshots", "json", true},
+		{"prune", "keep-daily", true},
+		{"prune", "dry-run", true},
+		{"verify", "json", true},
+		{"verify", "identity", true},
+		{"inspect", "json", true},
+		{"decrypt", "identity", true},
+		{"decrypt", "include", true},
+		{"decrypt", "exclude", true},
+		{"decrypt", "files-from", true},
+		{"decrypt", "ignore-manifest", true},
+		{"encrypt", "parity", true},
+		{"encrypt", "no-parity", true},
+		{"protect", "parity", true},
+		{"repair", "dry-run", true},
+		{"repair", "json", true},
+		{"keygen", "signing", true},
+		{"audit verify", "json", true},
+		{"audit show", "operation", true},
+		{"audit show", "result", true},
+		{"audit show", "path", true},
+		{"audit show", "since", true},
+		{"audit show", "until", true},
+		{"audit show", "json", true},
+		{"encrypt", "sign-key", true},
+		{"protect", "sign-key", true},
+		{"decrypt", "trusted-signers", true},
+		{"decrypt", "warn-untrusted", true},
+		{"verify", "trusted-signers", true},
+		{"ls", "long", true},
+		{"ls", "json", true},
+		{"ls", "tree", true},
 		{"decrypt", "output", true},
 		{"decrypt", "password", true},
 		{"decrypt", "keyfile", true},
+		{"key add", "new-password", true},
+		{"key remove", "slot", true},
+		{"upgrade", "dry-run", true},
+		{"protect", "recipient", true},
+		{"unprotect", "identity", true},
 		{"secure-delete", "passes", true},
 		{"secure-delete", "verbose", true},
 	}
 
 	for _, tt := range tests {
-		cmd, _, err := rootCmd.Find([]string{tt.command})
+		cmd, _, err := rootCmd.Find(strings.Fields(tt.command))
 		require.NoError(t, err, "Command %s should exist", tt.command)
 
 		if tt.shouldHave {
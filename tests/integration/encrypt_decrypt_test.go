@@ -54,7 +54,7 @@ func TestEncryptDecryptFile(t *testing.T) {
 	defer encryptedFile.Close()
 
 	// Write header
-	if err := fileHandler.WriteHeader(encryptedFile, salt, metadata); err != nil {
+	if err := fileHandler.WriteHeader(encryptedFile, salt, key, metadata); err != nil {
 		t.Fatalf("Failed to write header: %v", err)
 	}
 
@@ -77,10 +77,14 @@ func TestEncryptDecryptFile(t *testing.T) {
 	defer encryptedFile.Close()
 
 	// Read header
-	header, readMetadata, err := fileHandler.ReadHeaderWithMetadata(encryptedFile)
+	header, _, err := fileHandler.ReadHeaderWithMetadata(encryptedFile)
 	if err != nil {
 		t.Fatalf("Failed to read header: %v", err)
 	}
+	readMetadata, err := header.OpenMetadata(key)
+	if err != nil {
+		t.Fatalf("Failed to open metadata: %v", err)
+	}
 
 	if string(header.Magic[:]) != core.NokvaultMagic {
 		t.Errorf("Invalid magic number")